@@ -0,0 +1,24 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os"
+
+// chown is a no-op, as there are no numeric owners here.
+func chown(*os.File, os.FileInfo) error { return nil }
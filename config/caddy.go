@@ -19,12 +19,16 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode/utf8"
 
 	"github.com/mholt/caddy/caddyfile"
 	toml "github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
 )
 
 type caddyEncDec struct{}
@@ -44,105 +48,723 @@ func (ed caddyEncDec) Decode(r io.Reader) (Config, error) {
 		cb := convertCaddyBlock(block)
 		// key: {directive:}
 		for _, k := range block.Keys {
-			k = caddyQuoteKey(k)
-			path := []string{k, "", "", ""}[:1]
-			for _, dirs := range cb {
-				for _, dir := range dirs {
-					path := append(path, dir.Main.Name)
-					var written bool
-					if len(dir.Main.Args) != 0 {
-						tt.SetPath(append(path, "args"), toIntfSlice(dir.Main.Args))
-						written = true
-					}
-					if len(dir.Params) == 0 {
-						if !written {
-							tt.SetPath(path, "")
-						}
-						continue
-					}
-					for _, vv := range dir.Params {
-						written = true
-						path := append(path, vv.Name)
-						if len(vv.Args) == 0 {
-							tt.SetPath(path, "")
-						} else {
-							tt.SetPath(path, toIntfSlice(vv.Args))
-						}
-					}
-					if !written {
-						tt.SetPath(path, "")
+			m1 := make(map[string]interface{}, len(cb))
+			for name, dirs := range cb {
+				if len(dirs) == 1 {
+					m1[name] = dirs[0].node()
+					continue
+				}
+				// repeated directives are kept as a list, in order
+				is := make([]interface{}, len(dirs))
+				for i, dir := range dirs {
+					if is[i] = dir.node(); is[i] == "" {
+						is[i] = map[string]interface{}{}
 					}
 				}
+				m1[name] = is
+			}
+			t1, err := treeFromMap(m1)
+			if err != nil {
+				return Config{Tree: tt}, err
 			}
+			tt.SetPath([]string{caddyQuoteKey(k)}, t1)
 		}
 	}
 
-	return Config{Tree: tt}, nil
+	src := buf.String()
+	return Config{Tree: tt, src: &caddyFile{
+		Lines:  splitLines(src),
+		Blocks: scanCaddyfile(src),
+		orig:   tt.ToMap(),
+	}}, nil
 }
 
+// Encode the Config as a Caddyfile.
+//
+// If the Config has been decoded from a Caddyfile, then the original text is
+// written back, with only the changed directives (and subdirectives) rewritten.
+// New server blocks are appended in key order.
 func (ed caddyEncDec) Encode(w io.Writer, cfg Config) error {
 	m0 := cfg.Tree.ToMap()
-	seen := make(map[string][]string, len(m0))
+	ew := newErrWriter(w)
+	written := make(map[string]bool, len(m0))
+	if f, ok := cfg.src.(*caddyFile); ok {
+		f.writeTo(ew, m0)
+		for k := range f.orig {
+			written[k] = true
+		}
+	}
+
+	rKeys := make([]string, 0, len(m0))
+	for k := range m0 {
+		if !written[k] {
+			rKeys = append(rKeys, k)
+		}
+	}
+	sort.Strings(rKeys)
+	// group the keys with the same content
+	var texts []string
+	seen := make(map[string][]string, len(rKeys))
 	var buf bytes.Buffer
-	for rK, rV := range m0 {
-		m1, ok := rV.(map[string]interface{})
+	for _, rK := range rKeys {
+		m1, ok := m0[rK].(map[string]interface{})
 		if !ok {
 			continue
 		}
 		buf.Reset()
-		for k, v := range m1 {
-			m2, ok := v.(map[string]interface{})
-			if !ok {
-				continue
-			}
-			fmt.Fprintf(&buf, "\t%s ", k)
-			args := asStringSlice(m2["args"])
-			var minus int
-			if len(args) != 0 {
-				minus = 1
-				quoteSlice(args, " ")
-				fmt.Fprintf(&buf, "%s", strings.Join(args, " "))
-			}
-			if len(m2) == minus {
-				fmt.Fprintf(&buf, "\n\n")
-				continue
-			}
-			fmt.Fprintf(&buf, " {\n")
-			for kk, vv := range m2 {
-				if kk == "args" {
-					continue
-				}
-				fmt.Fprintf(&buf, "\t\t%s", kk)
-				args = asStringSlice(vv)
-				if len(args) == 0 {
-					continue
-				}
-				quoteSlice(args, " ")
-				for i, s := range args {
-					sep := " "
-					if i == 0 {
-						sep = "\t"
-					}
-					fmt.Fprintf(&buf, "%s%s", sep, s)
-				}
-				fmt.Fprintf(&buf, "\n")
-			}
-			fmt.Fprintf(&buf, "\t}\n\n")
+		for _, k := range sortedMapKeys(m1) {
+			caddyWriteDirective(&buf, "\t", k, m1[k])
 		}
 		k := buf.String()
+		if _, ok := seen[k]; !ok {
+			texts = append(texts, k)
+		}
 		seen[k] = append(seen[k], caddyUnquoteKey(rK))
 	}
 
-	ew := newErrWriter(w)
-	for text, keys := range seen {
+	for _, text := range texts {
+		keys := seen[text]
 		quoteSlice(keys, " ")
 		fmt.Fprintf(ew, "%s {\n%s}\n\n", strings.Join(keys, " "), text)
 	}
 	return ew.Err()
 }
 
+// caddyWriteDirective writes the (possibly repeated) directive with its subdirectives, as a new text.
+func caddyWriteDirective(w io.Writer, indent, name string, v interface{}) {
+	for _, v := range caddyInstances(v) {
+		caddyWriteInstance(w, indent, name, v)
+	}
+}
+
+func caddyWriteInstance(w io.Writer, indent, name string, v interface{}) {
+	args, params := caddySplitNode(v)
+	fmt.Fprintf(w, "%s%s", indent, name)
+	for _, a := range args {
+		fmt.Fprintf(w, " %s", caddyQuoteArg(a))
+	}
+	if len(params) == 0 {
+		io.WriteString(w, "\n")
+		return
+	}
+	io.WriteString(w, " {\n")
+	for _, k := range sortedMapKeys(params) {
+		caddyWriteParam(w, indent+"\t", k, params[k])
+	}
+	fmt.Fprintf(w, "%s}\n", indent)
+}
+
+func caddyWriteParam(w io.Writer, indent, name string, v interface{}) {
+	for _, args := range caddyParamValues(v) {
+		fmt.Fprintf(w, "%s%s", indent, name)
+		for _, a := range args {
+			fmt.Fprintf(w, " %s", caddyQuoteArg(a))
+		}
+		io.WriteString(w, "\n")
+	}
+}
+
+// caddySplitNode splits the directive's node to the main arguments and the subdirectives.
+func caddySplitNode(v interface{}) ([]string, map[string]interface{}) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return asStringSlice(v), nil
+	}
+	params := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if k != "args" {
+			params[k] = v
+		}
+	}
+	return asStringSlice(m["args"]), params
+}
+
+// caddyFile is the concrete syntax tree of a Caddyfile:
+// the source lines, with the line ranges of the server blocks and directives.
+type caddyFile struct {
+	Lines  []string
+	Blocks []caddySrcBlock
+	// orig is the tree as decoded, to find the changed nodes.
+	orig map[string]interface{}
+}
+
+// resolveKey resolves the site address as it is stored (see caddyQuoteKey),
+// and the directives (see directiveKey).
+func (f *caddyFile) resolveKey(tt *toml.Tree, key []string, set bool) ([]string, error) {
+	if len(key) != 0 && !tt.HasPath(key[:1]) {
+		key = append([]string{caddyQuoteKey(key[0])}, key[1:]...)
+	}
+	return directiveKey(tt, key, set)
+}
+
+// directiveKey resolves the key in a tree of directives (Caddyfile, nginx), where a single
+// directive is a list of one: its index 0 is the directive itself. For set, index 1
+// appends to it, making it a list.
+func directiveKey(tt *toml.Tree, key []string, set bool) ([]string, error) {
+	path := make([]string, 0, len(key))
+	var node interface{} = tt
+	for i := 0; i < len(key); i++ {
+		parent, k := node, key[i]
+		path = append(path, k)
+		node = getPath(parent, []string{k})
+		t, ok := node.(*toml.Tree)
+		if !ok || i+1 == len(key) {
+			continue
+		}
+		pt, ok := parent.(*toml.Tree)
+		n, err := strconv.Atoi(key[i+1])
+		if !ok || err != nil {
+			continue
+		}
+		switch {
+		case n == 0:
+			i++ // the directive itself
+		case !set:
+		case n == 1:
+			node = []*toml.Tree{t}
+			pt.SetPath([]string{k}, node)
+		default:
+			return path, errors.Errorf("index %d out of range (single %s)", n, k)
+		}
+	}
+	return path, nil
+}
+
+// caddySrcBlock is a server block in the source.
+//
+// All line numbers are 0-based indexes into caddyFile.Lines;
+// Open and Close are -1 for a block without braces.
+type caddySrcBlock struct {
+	// Keys as written, without the separating commas.
+	Keys                []string
+	Header, Open, Close int
+	Directives          []caddySrcDirective
+}
+
+// caddySrcDirective is a directive in the source, with its arguments as written.
+type caddySrcDirective struct {
+	caddyLine
+	Params      []caddyLine
+	End         int
+	Open, Close int
+}
+
+// scanCaddyfile scans the raw tokens of the source, for the line ranges of the blocks and directives.
+func scanCaddyfile(src string) []caddySrcBlock {
+	d := caddyfile.NewDispenser("Caddyfile", strings.NewReader(src))
+	var tokens []caddyfile.Token
+	for d.Next() {
+		tokens = append(tokens, caddyfile.Token{Line: d.Line() - 1, Text: d.Val()})
+	}
+
+	var blocks []caddySrcBlock
+	for i := 0; i < len(tokens); {
+		b := caddySrcBlock{Header: tokens[i].Line, Open: -1, Close: -1}
+		line := tokens[i].Line
+		for i < len(tokens) && tokens[i].Text != "{" &&
+			(tokens[i].Line == line || len(b.Keys) != 0 && strings.HasSuffix(b.Keys[len(b.Keys)-1], ",")) {
+			line = tokens[i].Line
+			b.Keys = append(b.Keys, tokens[i].Text)
+			i++
+		}
+		for j, k := range b.Keys {
+			b.Keys[j] = strings.TrimSuffix(k, ",")
+		}
+		if i < len(tokens) && tokens[i].Text == "{" {
+			b.Open = tokens[i].Line
+			i++
+		}
+		for i < len(tokens) {
+			if tokens[i].Text == "}" && b.Open >= 0 {
+				b.Close = tokens[i].Line
+				i++
+				break
+			}
+			var dir caddySrcDirective
+			dir, i = scanCaddyDirective(tokens, i)
+			b.Directives = append(b.Directives, dir)
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+func scanCaddyDirective(tokens []caddyfile.Token, i int) (caddySrcDirective, int) {
+	line := tokens[i].Line
+	dir := caddySrcDirective{
+		caddyLine: caddyLine{Name: tokens[i].Text, Line: line},
+		End:       line, Open: -1, Close: -1,
+	}
+	for i++; i < len(tokens) && tokens[i].Line == line; i++ {
+		if tokens[i].Text == "{" && (i+1 == len(tokens) || tokens[i+1].Line != line) {
+			dir.Open = line
+			continue
+		}
+		dir.Args = append(dir.Args, tokens[i].Text)
+	}
+	if dir.Open < 0 {
+		return dir, i
+	}
+	var nesting int
+	for ; i < len(tokens); i++ {
+		token := tokens[i]
+		dir.End = token.Line
+		switch token.Text {
+		case "{":
+			nesting++
+		case "}":
+			if nesting == 0 {
+				dir.Close = token.Line
+				return dir, i + 1
+			}
+			nesting--
+		}
+		if n := len(dir.Params); n == 0 || dir.Params[n-1].Line != token.Line {
+			dir.Params = append(dir.Params, caddyLine{Name: token.Text, Line: token.Line})
+		} else {
+			dir.Params[n-1].Args = append(dir.Params[n-1].Args, token.Text)
+		}
+	}
+	return dir, i
+}
+
+func (f *caddyFile) writeTo(w io.Writer, m0 map[string]interface{}) {
+	var next int
+	for _, b := range f.Blocks {
+		end := b.Close
+		if end < 0 {
+			end = len(f.Lines) - 1
+			if n := len(b.Directives); n != 0 && b.Directives[n-1].End > end {
+				end = b.Directives[n-1].End
+			}
+		}
+		for _, line := range f.Lines[next:b.Header] {
+			io.WriteString(w, line)
+		}
+		next = end + 1
+		f.writeBlock(w, b, end, m0)
+	}
+	for _, line := range f.Lines[next:] {
+		io.WriteString(w, line)
+	}
+}
+
+func (f *caddyFile) writeBlock(w io.Writer, b caddySrcBlock, end int, m0 map[string]interface{}) {
+	treeKeys := make([]string, len(b.Keys))
+	for i, k := range b.Keys {
+		treeKeys[i] = caddyQuoteKey(caddyExpand(k))
+		if _, ok := f.orig[treeKeys[i]]; !ok {
+			// not a server block (snippet, import)
+			f.writeLines(w, b.Header, end)
+			return
+		}
+	}
+	var texts []string
+	groups := make(map[string][]string, len(b.Keys))
+	for i, k := range treeKeys {
+		m1, ok := m0[k].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		text := f.blockBody(b, k, m1)
+		if _, ok := groups[text]; !ok {
+			texts = append(texts, text)
+		}
+		groups[text] = append(groups[text], b.Keys[i])
+	}
+	bodyStart := b.Open + 1
+	if b.Open < 0 {
+		bodyStart = b.Header + 1
+	}
+	if len(texts) == 1 && len(groups[texts[0]]) == len(b.Keys) {
+		for _, line := range f.Lines[b.Header:bodyStart] {
+			io.WriteString(w, line)
+		}
+		io.WriteString(w, texts[0])
+		if b.Close >= 0 {
+			io.WriteString(w, f.Lines[b.Close])
+		}
+		return
+	}
+	for i, text := range texts {
+		if i != 0 {
+			io.WriteString(w, "\n")
+		}
+		fmt.Fprintf(w, "%s {\n%s}\n", strings.Join(groups[text], ", "), text)
+	}
+}
+
+// blockBody returns the text of the block's body (without the braces), for the given key.
+func (f *caddyFile) blockBody(b caddySrcBlock, key string, m1 map[string]interface{}) string {
+	orig, _ := f.orig[key].(map[string]interface{})
+	count := make(map[string]int, len(b.Directives))
+	for _, dir := range b.Directives {
+		count[dir.Name]++
+	}
+	start, end := b.Open+1, b.Close
+	if b.Open < 0 {
+		start, end = b.Header+1, len(f.Lines)
+	}
+	var buf bytes.Buffer
+	indent := "\t"
+	if len(b.Directives) != 0 {
+		indent = leadingSpace(f.Lines[b.Directives[0].Line])
+	}
+	dirs := b.Directives
+	seen := make(map[string]int, len(count))
+	emits, pairs := make(map[string][][]int, len(count)), make(map[string][]int, len(count))
+	for i := start; i < end; i++ {
+		if len(dirs) == 0 || dirs[0].Line != i {
+			buf.WriteString(f.Lines[i])
+			continue
+		}
+		dir := dirs[0]
+		dirs = dirs[1:]
+		i = dir.End
+		if _, known := orig[dir.Name]; !known {
+			f.writeLines(&buf, dir.Line, dir.End)
+			continue
+		}
+		// the n-th instance in the source is the n-th in the tree
+		n := seen[dir.Name]
+		seen[dir.Name]++
+		cur, origs := caddyInstances(m1[dir.Name]), caddyInstances(orig[dir.Name])
+		if _, ok := emits[dir.Name]; !ok {
+			emits[dir.Name], pairs[dir.Name] = alignLists(len(origs), len(cur), func(i, j int) bool {
+				return reflect.DeepEqual(origs[i], cur[j])
+			})
+		}
+		if n >= len(origs) {
+			continue
+		}
+		for _, j := range emits[dir.Name][n] {
+			if j == pairs[dir.Name][n] {
+				f.writeDirective(&buf, dir, cur[j], origs[n])
+			} else {
+				caddyWriteInstance(&buf, leadingSpace(f.Lines[dir.Line]), dir.Name, cur[j])
+			}
+		}
+	}
+	for _, k := range sortedMapKeys(m1) {
+		if _, ok := count[k]; !ok {
+			caddyWriteDirective(&buf, indent, k, m1[k])
+		}
+	}
+	return buf.String()
+}
+
+// writeDirective writes the directive - as is, if it hasn't changed,
+// or rewriting only the changed lines.
+func (f *caddyFile) writeDirective(w *bytes.Buffer, dir caddySrcDirective, cur, orig interface{}) {
+	if cur == nil {
+		return
+	}
+	if reflect.DeepEqual(cur, orig) {
+		f.writeLines(w, dir.Line, dir.End)
+		return
+	}
+	indent := leadingSpace(f.Lines[dir.Line])
+	curArgs, curParams := caddySplitNode(cur)
+	origArgs, origParams := caddySplitNode(orig)
+	simple := dir.Open < 0 || strings.TrimSpace(f.Lines[dir.Close]) == "}"
+	for _, p := range dir.Params {
+		simple = simple && p.Line != dir.Open && p.Line != dir.Close
+	}
+	if !simple {
+		caddyWriteInstance(w, indent, dir.Name, cur)
+		return
+	}
+
+	if stringsEqual(curArgs, origArgs) && (dir.Open >= 0) == (len(curParams) != 0) {
+		w.WriteString(f.Lines[dir.Line])
+	} else {
+		w.WriteString(indent + dir.Name)
+		caddyWriteArgs(w, dir.Args, origArgs, curArgs)
+		if len(curParams) != 0 {
+			w.WriteString(" {")
+		}
+		w.WriteString("\n")
+	}
+	if len(curParams) == 0 {
+		return
+	}
+	if dir.Open < 0 {
+		for _, k := range sortedMapKeys(curParams) {
+			caddyWriteParam(w, indent+"\t", k, curParams[k])
+		}
+		w.WriteString(indent + "}\n")
+		return
+	}
+
+	count := make(map[string]int, len(dir.Params))
+	for _, p := range dir.Params {
+		count[p.Name]++
+	}
+	pIndent := indent + "\t"
+	params := dir.Params
+	seen := make(map[string]int, len(count))
+	emits, pairs := make(map[string][][]int, len(count)), make(map[string][]int, len(count))
+	for i := dir.Open + 1; i < dir.Close; i++ {
+		if len(params) == 0 || params[0].Line != i {
+			w.WriteString(f.Lines[i])
+			continue
+		}
+		p := params[0]
+		params = params[1:]
+		pIndent = leadingSpace(f.Lines[i])
+		n := seen[p.Name]
+		seen[p.Name]++
+		cur, origs := caddyParamValues(curParams[p.Name]), caddyParamValues(origParams[p.Name])
+		if _, ok := emits[p.Name]; !ok {
+			emits[p.Name], pairs[p.Name] = alignLists(len(origs), len(cur), func(i, j int) bool {
+				return stringsEqual(origs[i], cur[j])
+			})
+		}
+		if n >= len(origs) {
+			continue
+		}
+		for _, j := range emits[p.Name][n] {
+			if j == pairs[p.Name][n] && stringsEqual(cur[j], origs[n]) {
+				w.WriteString(f.Lines[i])
+				continue
+			}
+			w.WriteString(pIndent + p.Name)
+			if j == pairs[p.Name][n] {
+				caddyWriteArgs(w, p.Args, origs[n], cur[j])
+			} else {
+				caddyWriteArgs(w, nil, nil, cur[j])
+			}
+			w.WriteString("\n")
+		}
+	}
+	for _, k := range sortedMapKeys(curParams) {
+		if _, ok := count[k]; !ok {
+			caddyWriteParam(w, pIndent, k, curParams[k])
+		}
+	}
+	w.WriteString(f.Lines[dir.Close])
+}
+
+// caddyWriteArgs writes the args, using the raw (as written) form
+// of the unchanged ones, to keep the environment variable placeholders.
+func caddyWriteArgs(w io.Writer, raw, orig, args []string) {
+	for i, a := range args {
+		if len(raw) == len(orig) && i < len(orig) && orig[i] == a {
+			a = raw[i]
+		}
+		fmt.Fprintf(w, " %s", caddyQuoteArg(a))
+	}
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// alignLists aligns the n original elements with the m current ones:
+// the equal ones (by the longest common subsequence) are paired,
+// the rest are paired in order between them (as changed).
+//
+// Returns the current elements to be written in place of each original
+// (empty for a deleted original, more for inserted ones),
+// and the current pair of each original (-1 if has none).
+func alignLists(n, m int, eq func(i, j int) bool) (emit [][]int, pair []int) {
+	// lcs[i][j] is the length of the LCS of orig[i:] and cur[j:]
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if eq(i, j) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	emit, pair = make([][]int, n), make([]int, n)
+	for i := range pair {
+		pair[i] = -1
+	}
+	if n == 0 {
+		return emit, pair
+	}
+	// the gap before each match (and the end) is paired in order
+	var gapI, gapJ []int
+	closeGap := func(next int) {
+		k := 0
+		for ; k < len(gapI) && k < len(gapJ); k++ {
+			pair[gapI[k]] = gapJ[k]
+			emit[gapI[k]] = append(emit[gapI[k]], gapJ[k])
+		}
+		if k < len(gapJ) {
+			// the remaining new elements go after the last original in the gap,
+			// or before the next one
+			at := next
+			if len(gapI) != 0 {
+				at = gapI[len(gapI)-1]
+			} else if next < 0 || next >= n {
+				at = n - 1
+			}
+			if at == next {
+				emit[at] = append(append([]int(nil), gapJ[k:]...), emit[at]...)
+			} else {
+				emit[at] = append(emit[at], gapJ[k:]...)
+			}
+		}
+		gapI, gapJ = gapI[:0], gapJ[:0]
+	}
+	i, j := 0, 0
+	for i < n && j < m {
+		if eq(i, j) && lcs[i][j] == lcs[i+1][j+1]+1 {
+			closeGap(i)
+			pair[i] = j
+			emit[i] = append(emit[i], j)
+			i, j = i+1, j+1
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			gapI = append(gapI, i)
+			i++
+		} else {
+			gapJ = append(gapJ, j)
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		gapI = append(gapI, i)
+	}
+	for ; j < m; j++ {
+		gapJ = append(gapJ, j)
+	}
+	closeGap(n)
+	return emit, pair
+}
+
+func (f *caddyFile) writeLines(w io.Writer, from, to int) {
+	for _, line := range f.Lines[from : to+1] {
+		io.WriteString(w, line)
+	}
+}
+
+// caddyExpand replaces the environment variable placeholders,
+// as caddyfile.Parse does.
+func caddyExpand(s string) string {
+	for _, delim := range [][2]string{{"{%", "%}"}, {"{$", "}"}} {
+		refStart, refEnd := delim[0], delim[1]
+		for {
+			i := strings.Index(s, refStart)
+			if i < 0 {
+				break
+			}
+			j := strings.Index(s[i:], refEnd)
+			if j <= len(refStart) {
+				break
+			}
+			ref := s[i : i+j+len(refEnd)]
+			s = strings.Replace(s, ref, os.Getenv(ref[len(refStart):len(ref)-len(refEnd)]), -1)
+		}
+	}
+	return s
+}
+
+// caddyQuoteArg quotes the argument, if the Caddyfile lexer would split or drop it.
+func caddyQuoteArg(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\r\n\"#") {
+		return s
+	}
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+func leadingSpace(s string) string {
+	return s[:len(s)-len(strings.TrimLeft(s, " \t"))]
+}
+
+func sortedMapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 type caddyBlock map[string][]caddyDirective
 
+// node returns the tree node of the directive: "" for a bare directive,
+// a map of the main args (as "args") and the subdirectives otherwise.
+// A repeated subdirective's value is the list of its args.
+func (dir caddyDirective) node() interface{} {
+	if len(dir.Main.Args) == 0 && len(dir.Params) == 0 {
+		return ""
+	}
+	m := make(map[string]interface{}, 1+len(dir.Params))
+	if len(dir.Main.Args) != 0 {
+		m["args"] = toIntfSlice(dir.Main.Args)
+	}
+	var names []string
+	params := make(map[string][]interface{}, len(dir.Params))
+	for _, p := range dir.Params {
+		if _, ok := params[p.Name]; !ok {
+			names = append(names, p.Name)
+		}
+		params[p.Name] = append(params[p.Name], toIntfSlice(p.Args))
+	}
+	for _, name := range names {
+		vs := params[name]
+		if len(vs) > 1 {
+			m[name] = vs
+		} else if args := vs[0].([]interface{}); len(args) == 0 {
+			m[name] = ""
+		} else {
+			m[name] = args
+		}
+	}
+	return m
+}
+
+// caddyInstances returns the instances of a (possibly repeated) directive's node.
+func caddyInstances(v interface{}) []interface{} {
+	if v == nil {
+		return nil
+	}
+	if is, ok := v.([]interface{}); ok && len(is) != 0 {
+		for _, v := range is {
+			if _, ok := v.(map[string]interface{}); !ok {
+				return []interface{}{v}
+			}
+		}
+		return is
+	}
+	return []interface{}{v}
+}
+
+// caddyParamValues returns the args of each instance of a (possibly repeated) subdirective.
+func caddyParamValues(v interface{}) [][]string {
+	if v == nil {
+		return nil
+	}
+	if is, ok := v.([]interface{}); ok && len(is) != 0 {
+		ss := make([][]string, len(is))
+		for i, v := range is {
+			if _, ok := v.([]interface{}); !ok {
+				return [][]string{asStringSlice(is)}
+			}
+			ss[i] = asStringSlice(v)
+		}
+		return ss
+	}
+	return [][]string{asStringSlice(v)}
+}
+
 type caddyDirective struct {
 	Main   caddyLine
 	Params []caddyLine
@@ -150,6 +772,8 @@ type caddyDirective struct {
 type caddyLine struct {
 	Name string
 	Args []string
+	// Line is the 0-based line index in the source.
+	Line int `json:"-"`
 }
 
 func convertCaddyBlock(block caddyfile.ServerBlock) caddyBlock {
@@ -270,18 +894,24 @@ func asStringSlice(i interface{}) []string {
 	if ss, ok := i.([]string); ok {
 		return ss
 	}
+	if s, ok := i.(string); ok {
+		if s == "" {
+			return nil
+		}
+		return []string{s}
+	}
 	if is, ok := i.([]interface{}); ok {
 		ss := make([]string, len(is))
 		for i, v := range is {
 			if s, ok := v.(string); ok {
 				ss[i] = s
 			} else {
-				ss[i] = fmt.Sprintf("%v", v)
+				ss[i] = FormatValue(v)
 			}
 		}
 		return ss
 	}
-	return nil
+	return []string{FormatValue(i)}
 }
 
 func quoteSlice(ss []string, sep string) {
@@ -151,39 +151,81 @@ const caddyTest1TOML = `
   ["http://0.0.0.0:4444".log]
     args = ["{BRUNO_HOME}/data/mai/log/grafana-proxy.log"]
 
-  ["http://0.0.0.0:4444".proxy]
-    args = ["/","http://192.168.3.110:3000"]
-    header_upstream = ["-Proxy",""]
+  [["http://0.0.0.0:4444".proxy]]
+    args = ["/metrics/oracle", "http://localhost:/metrics"]
+    header_upstream = ["-Proxy", ""]
+    without = ["/metrics/oracle"]
+
+  [["http://0.0.0.0:4444".proxy]]
+    args = ["/metrics/ws-1", "http://localhost:/metrics"]
+    header_upstream = ["-Proxy", ""]
+    without = ["/metrics/ws-1"]
+
+  [["http://0.0.0.0:4444".proxy]]
+    args = ["/metrics/ws-2", "http://localhost:/metrics"]
+    header_upstream = ["-Proxy", ""]
+    without = ["/metrics/ws-2"]
+
+  [["http://0.0.0.0:4444".proxy]]
+    args = ["/metrics/ktny", "http://localhost:/metrics"]
+    header_upstream = ["-Proxy", ""]
+    without = ["/metrics/ktny"]
+
+  [["http://0.0.0.0:4444".proxy]]
+    args = ["/metrics/mabisz", "http://localhost:/metrics"]
+    header_upstream = ["-Proxy", ""]
     without = ["/metrics/mabisz"]
 
+  [["http://0.0.0.0:4444".proxy]]
+    args = ["/", "http://192.168.3.110:3000"]
+    header_upstream = ["-Proxy", ""]
+
 ["http://0.0.0.0:{portof_aodb_http}"]
 
   ["http://0.0.0.0:{portof_aodb_http}".log]
     args = ["{BRUNO_HOME}/data/mai/log/aodb-proxy.log"]
 
-  ["http://0.0.0.0:{portof_aodb_http}".proxy]
-    args = ["/","unix:{BRUNO_HOME}/data/ws/aodb.socket"]
+  [["http://0.0.0.0:{portof_aodb_http}".proxy]]
+    args = ["/_koord", "http://localhost:{portof_mevv}"]
+    header_upstream = ["-Proxy", ""]
+    without = ["/_koord"]
+
+  [["http://0.0.0.0:{portof_aodb_http}".proxy]]
+    args = ["/_macroexpert", "http://localhost:{portof_mevv}"]
+    header_upstream = ["-Proxy", ""]
+    without = ["/_macroexpert"]
+
+  [["http://0.0.0.0:{portof_aodb_http}".proxy]]
+    args = ["/", "unix:{BRUNO_HOME}/data/ws/aodb.socket"]
     fail_timeout = ["1s"]
-    header_upstream = ["-Proxy",""]
+    header_upstream = ["-Proxy", ""]
     max_fails = ["3"]
     policy = ["least_conn"]
     transparent = ""
     try_duration = ["3s"]
-    without = ["/_macroexpert"]
 
 ["https://0.0.0.0:{portof_aodb_https}"]
 
   ["https://0.0.0.0:{portof_aodb_https}".log]
     args = ["{BRUNO_HOME}/data/mai/log/aodb-proxy-https.log"]
 
-  ["https://0.0.0.0:{portof_aodb_https}".proxy]
-    args = ["/","http://localhost:"]
-    header_upstream = ["-Proxy",""]
+  [["https://0.0.0.0:{portof_aodb_https}".proxy]]
+    args = ["/_koord", "http://localhost:{portof_mevv}"]
+    header_upstream = ["-Proxy", ""]
+    without = ["/_koord"]
+
+  [["https://0.0.0.0:{portof_aodb_https}".proxy]]
+    args = ["/_macroexpert", "http://localhost:{portof_mevv}"]
+    header_upstream = ["-Proxy", ""]
     without = ["/_macroexpert"]
 
+  [["https://0.0.0.0:{portof_aodb_https}".proxy]]
+    args = ["/", "http://localhost:"]
+    header_upstream = ["-Proxy", ""]
+
   ["https://0.0.0.0:{portof_aodb_https}".tls]
-    args = ["{BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.crt.pem","{BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.key.pem"]
-    protocols = ["tls1.0","tls1.2"]
+    args = ["{BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.crt.pem", "{BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.key.pem"]
+    protocols = ["tls1.0", "tls1.2"]
 
 ["https://0.0.0.0:{portof_splprn_admin_https}"]
 
@@ -191,35 +233,59 @@ const caddyTest1TOML = `
     args = ["{BRUNO_HOME}/data/mai/log/splprn_admin-proxy.log"]
 
   ["https://0.0.0.0:{portof_splprn_admin_https}".proxy]
-    args = ["/","http://localhost:{portof_splprn_admin}"]
-    header_upstream = ["-Proxy",""]
+    args = ["/", "http://localhost:{portof_splprn_admin}"]
+    header_upstream = ["-Proxy", ""]
 
   ["https://0.0.0.0:{portof_splprn_admin_https}".tls]
-    args = ["{BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.crt.pem","{BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.key.pem"]
-    protocols = ["tls1.0","tls1.2"]
+    args = ["{BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.crt.pem", "{BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.key.pem"]
+    protocols = ["tls1.0", "tls1.2"]
 
 ["https://0.0.0.0:{portof_ws}"]
 
   ["https://0.0.0.0:{portof_ws}".log]
     args = ["{BRUNO_HOME}/data/mai/log/ws-proxy.log"]
 
-  ["https://0.0.0.0:{portof_ws}".proxy]
-    args = ["/","unix:{BRUNO_HOME}/data/ws/ws-1.socket","unix:{BRUNO_HOME}/data/ws/ws-1.socket"]
+  [["https://0.0.0.0:{portof_ws}".proxy]]
+    args = ["/dealer/allomany", "http://localhost:{portof_dealer_szerzodesek}"]
+    header_upstream = ["X-Forward-For", "{remote}"]
+    without = ["/dealer/allomany"]
+
+  [["https://0.0.0.0:{portof_ws}".proxy]]
+    args = ["/inphone", "unix:{BRUNO_HOME}/data/ws/callcenter.socket"]
+    without = ["/inphone"]
+
+  [["https://0.0.0.0:{portof_ws}".proxy]]
+    args = ["/call_center", "unix:{BRUNO_HOME}/data/ws/callcenter.socket"]
+    without = ["/call_center"]
+
+  [["https://0.0.0.0:{portof_ws}".proxy]]
+    args = ["/test", "http://localhost:"]
+    header_upstream = ["-Proxy", ""]
+
+  [["https://0.0.0.0:{portof_ws}".proxy]]
+    args = ["/letme", "http://127.0.0.1:8081"]
+    without = ["/letme"]
+
+  [["https://0.0.0.0:{portof_ws}".proxy]]
+    args = ["/", "unix:{BRUNO_HOME}/data/ws/ws-1.socket", "unix:{BRUNO_HOME}/data/ws/ws-1.socket"]
     fail_timeout = ["9s"]
-    header_upstream = ["X-Forwarded-For","{remote}"]
+    header_upstream = [["-Proxy", ""], ["X-Forwarded-For", "{remote}"]]
     max_fails = ["1"]
     policy = ["least_conn"]
     transparent = ""
     try_duration = ["10s"]
-    without = ["/letme"]
 
-  ["https://0.0.0.0:{portof_ws}".rewrite]
+  [["https://0.0.0.0:{portof_ws}".rewrite]]
+    r = ["/Dealer/(.*)"]
+    to = ["/letme/Dealer/{1}"]
+
+  [["https://0.0.0.0:{portof_ws}".rewrite]]
     r = ["^(/letme)?/Dealer/Dealer/(.*)"]
     to = ["/letme/Dealer/{1}"]
 
   ["https://0.0.0.0:{portof_ws}".tls]
-    args = ["{BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.crt.pem","{BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.key.pem"]
-    protocols = ["tls1.0","tls1.2"]
+    args = ["{BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.crt.pem", "{BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.key.pem"]
+    protocols = ["tls1.0", "tls1.2"]
 `
 
 const caddyTest1 = `## WS-HTTP
@@ -364,3 +430,180 @@ https://0.0.0.0:{$portof_splprn_admin_https} {
 	}
 }
 `
+
+func TestCaddyRoundTrip(t *testing.T) {
+	var ed caddyEncDec
+	cfg, err := ed.Decode(strings.NewReader(caddyTest1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = ed.Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d := diff.Diff(caddyTest1, buf.String()); d != "" {
+		t.Errorf("unchanged round trip:\n%s", d)
+	}
+
+	site := caddyQuoteKey("https://0.0.0.0:{portof_aodb_https}")
+	cfg.Set([]string{site, "log", "args"}, []interface{}{"/var/log/aodb.log"})
+	cfg.Set([]string{site, "tls", "protocols"}, []interface{}{"tls1.2", "tls1.3"})
+	cfg.Set([]string{site, "gzip"}, "")
+	buf.Reset()
+	if err = ed.Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(caddyTest1, `# AODB-HTTPS
+https://0.0.0.0:{$portof_aodb_https} {
+	log {$BRUNO_HOME}/data/mai/log/aodb-proxy-https.log
+	tls {$BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.crt.pem {$BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.key.pem {
+		protocols tls1.0 tls1.2
+	}
+`, `# AODB-HTTPS
+https://0.0.0.0:{$portof_aodb_https} {
+	log /var/log/aodb.log
+	tls {$BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.crt.pem {$BRUNO_HOME}/../admin/ssl/lnx-dev-kbe.unosoft.local.key.pem {
+		protocols tls1.2 tls1.3
+	}
+`, 1)
+	want = strings.Replace(want, `	proxy / http://localhost:{$portof_aodb_local} {
+		header_upstream -Proxy ""
+	}
+}
+`, `	proxy / http://localhost:{$portof_aodb_local} {
+		header_upstream -Proxy ""
+	}
+	gzip
+}
+`, 1)
+	if d := diff.Diff(want, buf.String()); d != "" {
+		t.Errorf("changed:\n%s", d)
+	}
+}
+
+func TestCaddyRepeated(t *testing.T) {
+	const src = `example.com {
+	proxy /a http://a {
+		header_upstream A 1
+		header_upstream B 2
+	}
+	# the second
+	proxy /b http://b
+}
+`
+	var ed caddyEncDec
+	cfg, err := ed.Decode(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := caddyQuoteKey("example.com")
+	if got := asStringSlice(cfg.Get([]string{site, "proxy", "1", "args"})); !stringsEqual(got, []string{"/b", "http://b"}) {
+		t.Errorf("got %q", got)
+	}
+	if got := caddyParamValues(cfg.Get([]string{site, "proxy", "0", "header_upstream"})); len(got) != 2 {
+		t.Errorf("got %q, wanted 2 header_upstream", got)
+	}
+
+	if err = cfg.Set([]string{site, "proxy", "0", "header_upstream", "1"}, []interface{}{"B", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Set([]string{site, "proxy", "2"}, map[string]interface{}{"args": []interface{}{"/c", "http://c"}}); err != nil {
+		t.Fatal(err)
+	}
+	// appending by index, below the new directive
+	if err = cfg.Set([]string{site, "proxy", "3", "args"}, []interface{}{"/d", "http://d"}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = ed.Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := `example.com {
+	proxy /a http://a {
+		header_upstream A 1
+		header_upstream B 3
+	}
+	# the second
+	proxy /b http://b
+	proxy /c http://c
+	proxy /d http://d
+}
+`
+	if d := diff.Diff(want, buf.String()); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestCaddySingle(t *testing.T) {
+	var ed caddyEncDec
+	cfg, err := ed.Decode(strings.NewReader("example.com {\n\tproxy /a http://a\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := caddyQuoteKey("example.com")
+	if got := asStringSlice(cfg.Get([]string{site, "proxy", "0", "args"})); !stringsEqual(got, []string{"/a", "http://a"}) {
+		t.Errorf("proxy/0: got %q", got)
+	}
+	if got := cfg.Get([]string{site, "proxy", "1", "args"}); got != nil {
+		t.Errorf("proxy/1: got %#v", got)
+	}
+	if err = cfg.Set([]string{site, "proxy", "2", "args"}, []interface{}{"/c", "http://c"}); err == nil {
+		t.Error("proxy/2 of a single proxy: no error")
+	}
+	if err = cfg.Set([]string{site, "proxy", "0", "args"}, []interface{}{"/b", "http://b"}); err != nil {
+		t.Fatal(err)
+	}
+	// appending to the single one
+	if err = cfg.Set([]string{site, "proxy", "1", "args"}, []interface{}{"/c", "http://c"}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = ed.Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d := diff.Diff(buf.String(), "example.com {\n\tproxy /b http://b\n\tproxy /c http://c\n}\n"); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestCaddyDelete(t *testing.T) {
+	const src = `example.com {
+	gzip
+	proxy /a http://a
+	proxy /b http://b {
+		header_upstream A 1
+		header_upstream B 2
+	}
+	proxy /c http://c
+}
+`
+	var ed caddyEncDec
+	cfg, err := ed.Decode(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := caddyQuoteKey("example.com")
+	for _, k := range [][]string{
+		{site, "proxy", "0"},
+		{site, "proxy", "0", "header_upstream", "0"},
+		{site, "gzip"},
+	} {
+		if err = cfg.Del(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err = ed.Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := `example.com {
+	proxy /b http://b {
+		header_upstream B 2
+	}
+	proxy /c http://c
+}
+`
+	if d := diff.Diff(want, buf.String()); d != "" {
+		t.Error(d)
+	}
+}
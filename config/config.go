@@ -18,19 +18,14 @@ package config
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
 	"io"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
-	"github.com/hashicorp/hcl"
-	"github.com/hashicorp/hcl/hcl/printer"
-
 	"github.com/magiconair/properties"
 	"github.com/pelletier/go-toml"
-	"github.com/pelletier/go-toml/query"
-	yaml "gopkg.in/yaml.v2"
 
 	"github.com/pkg/errors"
 )
@@ -38,6 +33,7 @@ import (
 var (
 	ErrUnknownType    = errors.New("unknown type")
 	ErrNotImplemented = errors.New("not implemented")
+	ErrNotFound       = errors.New("not found")
 )
 
 // Encoder is an interface for encoding a Config.
@@ -61,16 +57,81 @@ type EncoderDecoder interface {
 // Config is the read, modifyable configuration, based on *toml.Tree.
 type Config struct {
 	*toml.Tree
-	// tbd is the list of keys to be deleted (at Encode).
-	tbd []string
+	// src is the concrete syntax tree of the decoded file, if the Decoder keeps it,
+	// for the Encoder of the same type to write back the unchanged parts as is.
+	src interface{}
 }
 
 // New returns a new Config from the given map.
 func New(m map[string]interface{}) (Config, error) {
-	tt, err := toml.TreeFromMap(m)
+	tt, err := treeFromMap(m)
 	return Config{Tree: tt}, err
 }
 
+// Clone returns a copy of the Config, which can be changed independently,
+// and still be written back losslessly as the original.
+func (cfg Config) Clone() (Config, error) {
+	tt, err := treeFromMap(cfg.Tree.ToMap())
+	return Config{Tree: tt, src: cfg.src}, err
+}
+
+// treeFromMap is like toml.TreeFromMap, but accepts lists of lists, too.
+func treeFromMap(m map[string]interface{}) (*toml.Tree, error) {
+	tt, err := toml.TreeFromMap(make(map[string]interface{}, len(m)))
+	if err != nil {
+		return tt, err
+	}
+	for k, v := range m {
+		if v, err = tomlNode(v); err != nil {
+			return tt, errors.Wrap(err, k)
+		}
+		tt.SetPath([]string{k}, v)
+	}
+	return tt, nil
+}
+
+// tomlNode converts the maps to *toml.Tree, the lists of maps to []*toml.Tree,
+// and the numbers to int64, uint64 or float64.
+func tomlNode(v interface{}) (_ interface{}, err error) {
+	switch x := normalizeValue(v).(type) {
+	case map[string]interface{}:
+		return treeFromMap(x)
+	case []map[string]interface{}:
+		ts := make([]*toml.Tree, len(x))
+		for i, m := range x {
+			if ts[i], err = treeFromMap(m); err != nil {
+				return nil, err
+			}
+		}
+		return ts, nil
+	case []interface{}:
+		if len(x) == 0 {
+			return x, nil
+		}
+		for _, v := range x {
+			if _, ok := v.(map[string]interface{}); !ok {
+				is := make([]interface{}, len(x))
+				for i, v := range x {
+					if _, ok := v.(map[string]interface{}); ok {
+						is[i] = v
+					} else if is[i], err = tomlNode(v); err != nil {
+						return nil, err
+					}
+				}
+				return is, nil
+			}
+		}
+		ts := make([]*toml.Tree, len(x))
+		for i, v := range x {
+			if ts[i], err = treeFromMap(v.(map[string]interface{})); err != nil {
+				return nil, err
+			}
+		}
+		return ts, nil
+	}
+	return normalizeValue(v), nil
+}
+
 func (cfg Config) String() string {
 	var buf bytes.Buffer
 	if _, err := cfg.Tree.WriteTo(&buf); err != nil {
@@ -85,48 +146,51 @@ type Type string
 var encdecMu sync.RWMutex
 var encdec = map[Type]EncoderDecoder{
 	caddyEnc:      caddyEncDec{},
-	hclEnc:        defaultEncDec{Type: hclEnc},
+	dotenvEnc:     dotenvEncDec{sep: DotenvSeparator},
+	gitconfigEnc:  gitconfigEncDec{},
+	hclEnc:        hclEncDec{},
+	hcl2Enc:       hcl2EncDec{},
 	iniEnc:        iniEncDec{},
 	jsonEnc:       defaultEncDec{Type: jsonEnc},
+	nginxEnc:      nginxEncDec{},
 	propertiesEnc: defaultEncDec{Type: propertiesEnc},
-	tomlEnc:       defaultEncDec{Type: tomlEnc},
-	yamlEnc:       defaultEncDec{Type: yamlEnc},
+	systemdEnc:    systemdEncDec{},
+	tomlEnc:       tomlEncDec{},
+	xmlEnc:        xmlEncDec{},
+	yamlEnc:       yamlEncDec{},
 }
 
 // Register a new EncoderDecoder. Will panic if typ already registered.
+//
+// See RegisterFormat for registering with a descriptor.
 func Register(typ Type, ed EncoderDecoder) {
-	encdecMu.Lock()
-	defer encdecMu.Unlock()
-	if _, ok := encdec[typ]; ok {
-		panic(typ + " already registered!")
-	}
-	encdec[typ] = ed
+	RegisterFormat(Format{Type: typ}, ed)
 }
 
-// Parser returns a Decoder for the given type.
+// Parser returns a Decoder for the given type (or alias), nil for an unknown one.
 func Parser(typ Type) Decoder {
 	encdecMu.RLock()
 	defer encdecMu.RUnlock()
-	return encdec[typ]
+	return encdec[resolve(typ)]
 }
 
-// Dumper returns an Encoder for the given type.
+// Dumper returns an Encoder for the given type (or alias), nil for an unknown one.
 func Dumper(typ Type) Encoder {
 	encdecMu.RLock()
 	defer encdecMu.RUnlock()
-	return encdec[typ]
+	return encdec[resolve(typ)]
 }
 
 type defaultEncDec struct{ Type string }
 
-const caddyEnc, hclEnc, iniEnc, jsonEnc, propertiesEnc, tomlEnc, yamlEnc = "caddy", "hcl", "ini", "json", "properties", "toml", "yaml"
+const caddyEnc, dotenvEnc, gitconfigEnc, hclEnc, hcl2Enc, iniEnc, jsonEnc, nginxEnc, propertiesEnc, systemdEnc, tomlEnc, xmlEnc, yamlEnc = "caddy", "dotenv", "gitconfig", "hcl", "hcl2", "ini", "json", "nginx", "properties", "systemd", "toml", "xml", "yaml"
 
 func (ved defaultEncDec) Decode(r io.Reader) (Config, error) {
 	m := make(map[string]interface{})
 	var b []byte
 	var cfg Config
 	switch ved.Type {
-	case yamlEnc, hclEnc, propertiesEnc:
+	case propertiesEnc:
 		var err error
 		if b, err = io.ReadAll(r); err != nil {
 			return cfg, err
@@ -134,22 +198,10 @@ func (ved defaultEncDec) Decode(r io.Reader) (Config, error) {
 	}
 
 	switch ved.Type {
-	case tomlEnc:
-		tt, err := toml.LoadReader(r)
-		return Config{Tree: tt}, err
-
-	case yamlEnc:
-		if err := yaml.Unmarshal(b, m); err != nil {
-			return cfg, err
-		}
 	case jsonEnc:
 		if err := json.NewDecoder(r).Decode(&m); err != nil {
 			return cfg, err
 		}
-	case hclEnc:
-		if err := hcl.Unmarshal(b, m); err != nil {
-			return cfg, err
-		}
 	case propertiesEnc:
 		props, err := properties.Load(b, properties.UTF8)
 		if err != nil {
@@ -161,31 +213,16 @@ func (ved defaultEncDec) Decode(r io.Reader) (Config, error) {
 	default:
 		return cfg, errors.Wrap(ErrUnknownType, ved.Type)
 	}
-	tt, err := toml.TreeFromMap(m)
+	tt, err := treeFromMap(m)
 	return Config{Tree: tt}, err
 }
 func (ved defaultEncDec) Encode(w io.Writer, cfg Config) error {
 	m := cfg.AllSettings()
 	switch ved.Type {
-	case yamlEnc:
-		b, err := yaml.Marshal(m)
-		if err != nil {
-			return err
-		}
-		_, err = w.Write(b)
-		return err
 	case jsonEnc:
 		enc := json.NewEncoder(w)
 		enc.SetIndent("", "  ")
 		return enc.Encode(m)
-	case hclEnc:
-		return printer.Fprint(w, mapToNode(m, keyDelim))
-	case tomlEnc:
-		tt, err := toml.TreeFromMap(m)
-		if _, wErr := io.WriteString(w, tt.String()); wErr != nil && err == nil {
-			return wErr
-		}
-		return err
 	case propertiesEnc:
 		p := properties.NewProperties()
 		keys := make([]string, 0, len(m))
@@ -194,7 +231,7 @@ func (ved defaultEncDec) Encode(w io.Writer, cfg Config) error {
 		}
 		sort.Strings(keys)
 		for _, k := range keys {
-			p.Set(k, fmt.Sprintf("%v", cfg.Get([]string{k})))
+			p.Set(k, FormatValue(cfg.Get([]string{k})))
 		}
 		_, err := p.Write(w, properties.UTF8)
 		return err
@@ -203,56 +240,434 @@ func (ved defaultEncDec) Encode(w io.Writer, cfg Config) error {
 	}
 }
 
-func (cfg *Config) Del(key ...string) {
-	cfg.tbd = append(cfg.tbd, key...)
+// withoutNulls returns the map without the nil values, recursively.
+func withoutNulls(m map[string]interface{}) map[string]interface{} {
+	for k, v := range m {
+		switch x := v.(type) {
+		case nil:
+			delete(m, k)
+		case map[string]interface{}:
+			withoutNulls(x)
+		case []interface{}:
+			is := x[:0]
+			for _, v := range x {
+				if v == nil {
+					continue
+				}
+				if m, ok := v.(map[string]interface{}); ok {
+					v = withoutNulls(m)
+				}
+				is = append(is, v)
+			}
+			m[k] = is
+		}
+	}
+	return m
 }
 
-// AllSettings returns all settings, excluding the deleted keys.
-func (cfg Config) AllSettings() map[string]interface{} {
-	m := cfg.Tree.ToMap()
-	if len(cfg.tbd) == 0 {
-		return m
+// Del deletes the key from the tree - a table, a value or an array element.
+//
+// If the key starts with "$", then it is a JSONPath expression (see CompileQuery),
+// and all the selected nodes are deleted.
+func (cfg Config) Del(key []string) error {
+	if !isQuery(key) {
+		path, err := cfg.resolve(key, false)
+		if err == nil {
+			_, err = deletePath(cfg.Tree, path)
+		}
+		return errors.Wrap(err, strings.Join(key, keyDelim))
 	}
-	for _, key := range cfg.tbd {
-		delete(m, key)
-		key += keyDelim
-		for k := range m {
-			if strings.HasPrefix(k, key) {
-				delete(m, key)
-			}
+	matches, err := cfg.Query(key[0])
+	if err != nil {
+		return err
+	}
+	paths := make([][]string, 0, len(matches))
+	for _, m := range matches {
+		if len(m.Path) == 0 {
+			return errors.Errorf("%s: cannot delete the root", key[0])
+		}
+		paths = append(paths, m.Path)
+	}
+	// backwards, to keep the array indexes valid, and children before their parents
+	sort.Slice(paths, func(i, j int) bool { return comparePaths(paths[i], paths[j]) > 0 })
+	for i, path := range paths {
+		if i != 0 && comparePaths(paths[i-1], path) == 0 {
+			continue
+		}
+		if _, err := deletePath(cfg.Tree, path); err != nil {
+			return errors.Wrap(err, strings.Join(path, keyDelim))
+		}
+	}
+	return nil
+}
+
+// Query returns the nodes selected by the JSONPath expression,
+// with the tables converted to maps.
+func (cfg Config) Query(expr string) ([]Match, error) {
+	q, err := CompileQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+	matches := q.Match(cfg.Tree)
+	for i, m := range matches {
+		matches[i].Value = plainValue(m.Value)
+	}
+	return matches, nil
+}
+
+// keyResolver is implemented by the sources whose trees are addressed by their own
+// rules, besides the generic ones (see directiveKey).
+type keyResolver interface {
+	// resolveKey returns the key as the tree holds it. For set, it may reshape the tree
+	// to make room for the new value.
+	resolveKey(tt *toml.Tree, key []string, set bool) ([]string, error)
+}
+
+// resolve returns the key as the tree of the source holds it.
+func (cfg Config) resolve(key []string, set bool) ([]string, error) {
+	if r, ok := cfg.src.(keyResolver); ok {
+		return r.resolveKey(cfg.Tree, key, set)
+	}
+	return key, nil
+}
+
+func isQuery(key []string) bool { return len(key) == 1 && strings.HasPrefix(key[0], "$") }
+
+// walk calls visit for each node under node (including node itself), in key order,
+// with its path. The children of the node are visited only if visit returns true.
+func walk(node interface{}, path []string, visit func(path []string, v interface{}) bool) {
+	if !visit(path, node) {
+		return
+	}
+	switch x := node.(type) {
+	case *toml.Tree:
+		keys := x.Keys()
+		sort.Strings(keys)
+		for _, k := range keys {
+			walk(x.GetPath([]string{k}), append(path, k), visit)
+		}
+	case []*toml.Tree:
+		for i, t := range x {
+			walk(t, append(path, strconv.Itoa(i)), visit)
+		}
+	case []interface{}:
+		for i, v := range x {
+			walk(v, append(path, strconv.Itoa(i)), visit)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			walk(x[k], append(path, k), visit)
 		}
 	}
-	return m
+}
+
+// AllSettings returns all settings, as a map.
+func (cfg Config) AllSettings() map[string]interface{} {
+	return cfg.Tree.ToMap()
 }
 
 // Get returns the value for the key.
+// The numeric elements of the key index into the arrays.
 //
-// If the key starts with "$", then a JSONPath-like TOML Query is compiled and executed.
+// If the key starts with "$", then it is a JSONPath expression (see CompileQuery),
+// and the values of the selected nodes are returned in a []interface{}.
 func (cfg Config) Get(key []string) interface{} {
-	if !strings.HasPrefix(key[0], "$") {
-		return cfg.Tree.GetPath(key)
+	if !isQuery(key) {
+		path, err := cfg.resolve(key, false)
+		if err != nil {
+			return nil
+		}
+		return getPath(cfg.Tree, path)
 	}
-	//tt := toml.TreeFromMap(cfg.AllSettings())
-	//qr, err := tt.Query(key)
-	qry, err := query.Compile(key[0])
-	if qry == nil {
+	matches, err := cfg.Query(key[0])
+	if err != nil {
 		return err
 	}
-	qr := qry.Execute(cfg.Tree)
-	result := make([]map[string]interface{}, len(qr.Values()))
-	for i, v := range qr.Values() {
-		switch x := v.(type) {
+	result := make([]interface{}, len(matches))
+	for i, m := range matches {
+		result[i] = m.Value
+	}
+	return result
+}
+
+// Has reports whether there is a value at key - for a JSONPath expression, whether it selects any.
+// An invalid expression selects nothing: check it with CompileQuery first.
+func (cfg Config) Has(key []string) bool {
+	if !isQuery(key) {
+		return cfg.Get(key) != nil
+	}
+	matches, err := cfg.Query(key[0])
+	return err == nil && len(matches) != 0
+}
+
+// Equal reports whether the two values are equal: as JSON values (numbers by value),
+// or by their text form, for the formats where everything is a string (ini, dotenv).
+func Equal(a, b interface{}) bool {
+	a, b = plainValue(a), plainValue(b)
+	return jsonEqual(a, b) || FormatValue(a) == FormatValue(b)
+}
+
+// Set the value at key, creating the missing tables.
+// The numeric elements of the key index into the arrays - an index equal to the
+// length of the array appends to it.
+//
+// If the key starts with "$", then it is a JSONPath expression (see CompileQuery),
+// and the value is set at all the selected nodes. If the last step of the expression
+// is a plain name, then it is created in all the tables selected by the steps before it.
+func (cfg Config) Set(key []string, value interface{}) error {
+	if !isQuery(key) {
+		v, err := tomlNode(value)
+		if err != nil {
+			return err
+		}
+		path, err := cfg.resolve(key, true)
+		if err == nil {
+			_, err = setPath(cfg.Tree, path, v)
+		}
+		return errors.Wrap(err, strings.Join(key, keyDelim))
+	}
+	q, err := CompileQuery(key[0])
+	if err != nil {
+		return err
+	}
+	var paths [][]string
+	if parent, name := q.parent(); parent != nil {
+		for _, m := range parent.Match(cfg.Tree) {
+			if _, ok := m.Value.(*toml.Tree); ok {
+				paths = append(paths, append(append([]string(nil), m.Path...), name))
+			}
+		}
+	} else {
+		for _, m := range q.Match(cfg.Tree) {
+			if len(m.Path) == 0 {
+				return errors.Errorf("%s: cannot set the root", key[0])
+			}
+			paths = append(paths, m.Path)
+		}
+	}
+	for _, path := range paths {
+		// a new node for each path, not to share the tables
+		v, err := tomlNode(value)
+		if err != nil {
+			return err
+		}
+		if _, err = setPath(cfg.Tree, path, v); err != nil {
+			return errors.Wrap(err, strings.Join(path, keyDelim))
+		}
+	}
+	return nil
+}
+
+func getPath(node interface{}, key []string) interface{} {
+	for _, k := range key {
+		switch x := node.(type) {
 		case *toml.Tree:
-			result[i] = x.ToMap()
+			node = x.GetPath([]string{k})
+		case []*toml.Tree:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil
+			}
+			node = x[i]
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil
+			}
+			node = x[i]
 		case map[string]interface{}:
-			result[i] = x
+			// a table in a list of values
+			node = x[k]
 		default:
-			result[i] = map[string]interface{}{"error": errors.Errorf("cannot convert %T to map[string]interface{}: %v", v, v)}
+			return nil
 		}
 	}
-	return result
+	return node
 }
 
-func (cfg Config) Set(key []string, value interface{}) {
-	cfg.Tree.SetPath(key, value)
+// setPath sets the value at the key under node,
+// and returns the node (which may be a new one, for arrays).
+func setPath(node interface{}, key []string, value interface{}) (interface{}, error) {
+	if node == nil {
+		var err error
+		if node, err = toml.TreeFromMap(make(map[string]interface{})); err != nil {
+			return node, err
+		}
+	}
+	k := key[0]
+	switch x := node.(type) {
+	case *toml.Tree:
+		if len(key) == 1 {
+			x.SetPath([]string{k}, value)
+			return x, nil
+		}
+		child := x.GetPath([]string{k})
+		child, err := setPath(child, key[1:], value)
+		if err != nil {
+			return x, err
+		}
+		x.SetPath([]string{k}, child)
+		return x, nil
+
+	case []*toml.Tree:
+		i, err := arrayIndex(k, len(x))
+		if err != nil {
+			return x, err
+		}
+		// copy on write, as the slice may be shared
+		x = append(make([]*toml.Tree, 0, len(x)+1), x...)
+		if i == len(x) {
+			x = append(x, nil)
+		}
+		if len(key) == 1 {
+			t, ok := value.(*toml.Tree)
+			if !ok {
+				return x, errors.Errorf("cannot put %T into an array of tables", value)
+			}
+			x[i] = t
+			return x, nil
+		}
+		var child interface{}
+		if x[i] != nil { // not a typed nil, to have a new table made
+			child = x[i]
+		}
+		if child, err = setPath(child, key[1:], value); err != nil {
+			return x, err
+		}
+		x[i] = child.(*toml.Tree)
+		return x, nil
+
+	case []interface{}:
+		i, err := arrayIndex(k, len(x))
+		if err != nil {
+			return x, err
+		}
+		x = append(make([]interface{}, 0, len(x)+1), x...)
+		if i == len(x) {
+			x = append(x, nil)
+		}
+		if len(key) == 1 {
+			// the lists of values hold plain maps (as tomlNode makes them)
+			x[i] = plainValue(value)
+			return x, nil
+		}
+		if x[i], err = setPath(x[i], key[1:], value); err != nil {
+			return x, err
+		}
+		return x, nil
+
+	case map[string]interface{}:
+		// a table in a list of values: plain values, copy on write
+		m := copyMap(x)
+		if len(key) == 1 {
+			m[k] = plainValue(value)
+			return m, nil
+		}
+		child, err := setPath(m[k], key[1:], value)
+		if err != nil {
+			return m, err
+		}
+		m[k] = plainValue(child)
+		return m, nil
+	}
+	return node, errors.Errorf("cannot set %q in %T", k, node)
+}
+
+// deletePath deletes the element at key under node,
+// and returns the node (which may be a new one, for arrays).
+func deletePath(node interface{}, key []string) (interface{}, error) {
+	k := key[0]
+	switch x := node.(type) {
+	case *toml.Tree:
+		child := x.GetPath([]string{k})
+		if child == nil {
+			return x, errors.Wrap(ErrNotFound, k)
+		}
+		if len(key) == 1 {
+			treeDelete(x, k)
+			return x, nil
+		}
+		child, err := deletePath(child, key[1:])
+		if err != nil {
+			return x, err
+		}
+		x.SetPath([]string{k}, child)
+		return x, nil
+
+	case []*toml.Tree:
+		i, err := arrayIndex(k, len(x)-1)
+		if err != nil {
+			return x, errors.Wrap(ErrNotFound, err.Error())
+		}
+		if len(key) == 1 {
+			return append(append(make([]*toml.Tree, 0, len(x)-1), x[:i]...), x[i+1:]...), nil
+		}
+		_, err = deletePath(x[i], key[1:])
+		return x, err
+
+	case []interface{}:
+		i, err := arrayIndex(k, len(x)-1)
+		if err != nil {
+			return x, errors.Wrap(ErrNotFound, err.Error())
+		}
+		if len(key) == 1 {
+			return append(append(make([]interface{}, 0, len(x)-1), x[:i]...), x[i+1:]...), nil
+		}
+		x = append(make([]interface{}, 0, len(x)), x...)
+		x[i], err = deletePath(x[i], key[1:])
+		return x, err
+
+	case map[string]interface{}:
+		child, ok := x[k]
+		if !ok {
+			return x, errors.Wrap(ErrNotFound, k)
+		}
+		m := copyMap(x)
+		if len(key) == 1 {
+			delete(m, k)
+			return m, nil
+		}
+		var err error
+		m[k], err = deletePath(child, key[1:])
+		return m, err
+	}
+	return node, errors.Wrapf(ErrNotFound, "%q in %T", k, node)
+}
+
+// copyMap returns a shallow copy of the map.
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m)+1)
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// treeDelete deletes the key from the tree, in place.
+//
+// As *toml.Tree has no Delete method, this rebuilds the tree without the key.
+func treeDelete(tt *toml.Tree, key string) {
+	nt, _ := toml.TreeFromMap(make(map[string]interface{}))
+	for _, k := range tt.Keys() {
+		if k != key {
+			nt.SetPath([]string{k}, tt.GetPath([]string{k}))
+		}
+	}
+	*tt = *nt
+}
+
+func arrayIndex(k string, length int) (int, error) {
+	i, err := strconv.Atoi(k)
+	if err != nil {
+		return 0, errors.Wrapf(err, "array index %q", k)
+	}
+	if i < 0 || i > length {
+		return i, errors.Errorf("array index %d out of range [0,%d]", i, length)
+	}
+	return i, nil
 }
@@ -0,0 +1,166 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDel(t *testing.T) {
+	for i, tc := range []struct {
+		Doc, Key, Want string
+	}{
+		{Doc: `{"a":{"b":{"c":1,"d":2}}}`, Key: "a/b/c", Want: `{"a":{"b":{"d":2}}}`},
+		{Doc: `{"a":[1,2,3]}`, Key: "a/1", Want: `{"a":[1,3]}`},
+		{Doc: `{"a":[{"b":1},{"b":2}]}`, Key: "a/0/b", Want: `{"a":[{},{"b":2}]}`},
+		{Doc: `{"a":{"x":{"n":1}},"b":{"x":{"n":2}},"c":{"y":3}}`, Key: "$..x", Want: `{"a":{},"b":{},"c":{"y":3}}`},
+		{Doc: `{"a":[1,2,3,4]}`, Key: "$.a[?(@ > 1 && @ < 4)]", Want: `{"a":[1,4]}`},
+		{Doc: `{"s":[{"p":1,"q":2},{"p":3}]}`, Key: "$.s[*].p", Want: `{"s":[{"q":2},{}]}`},
+		{Doc: `{"e":[1,{"f":2,"g":3}]}`, Key: "e/1/f", Want: `{"e":[1,{"g":3}]}`},
+		{Doc: `{"e":[1,{"f":2,"g":3}]}`, Key: "$.e[1].g", Want: `{"e":[1,{"f":2}]}`},
+	} {
+		cfg, err := Parser(jsonEnc).Decode(strings.NewReader(tc.Doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := []string{tc.Key}
+		if !strings.HasPrefix(tc.Key, "$") {
+			key = strings.Split(tc.Key, "/")
+		}
+		if err = cfg.Del(key); err != nil {
+			t.Errorf("%d. %v", i, err)
+		}
+		if got := compactJSON(t, cfg); got != tc.Want {
+			t.Errorf("%d. got %s, wanted %s", i, got, tc.Want)
+		}
+	}
+}
+
+func TestHasEqual(t *testing.T) {
+	cfg, err := New(map[string]interface{}{
+		"server": map[string]interface{}{"port": "8080", "hosts": []interface{}{"a", "b"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]bool{
+		"server/port":    true,
+		"server/hosts/1": true,
+		"server/nope":    false,
+		"nope/port":      false,
+		"$..port":        true,
+		"$..nope":        false,
+	} {
+		key := strings.Split(k, "/")
+		if got := cfg.Has(key); got != want {
+			t.Errorf("Has(%s): got %t, wanted %t", k, got, want)
+		}
+	}
+
+	for i, tc := range []struct {
+		A, B interface{}
+		Want bool
+	}{
+		{A: cfg.Get([]string{"server", "port"}), B: int64(8080), Want: true},
+		{A: int64(1), B: 1.0, Want: true},
+		{A: cfg.Get([]string{"server", "hosts"}), B: []interface{}{"a", "b"}, Want: true},
+		{A: cfg.Get([]string{"server"}), B: map[string]interface{}{"port": 8080, "hosts": []interface{}{"a", "b"}}, Want: false},
+		{A: "true", B: true, Want: true},
+		{A: "x", B: "y", Want: false},
+	} {
+		if got := Equal(tc.A, tc.B); got != tc.Want {
+			t.Errorf("%d. Equal(%#v, %#v): got %t", i, tc.A, tc.B, got)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	cfg, err := Parser(gitconfigEnc).Decode(strings.NewReader(gitconfigTest1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone, err := cfg.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = clone.Set([]string{"core", "bare"}, "true"); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Get([]string{"core", "bare"}); got != "false" {
+		t.Errorf("original changed: got %#v", got)
+	}
+	if clone, err = cfg.Clone(); err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err = Dumper(gitconfigEnc).Encode(&buf, clone); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != gitconfigTest1 {
+		t.Errorf("got\n%s\nwanted\n%s", got, gitconfigTest1)
+	}
+}
+
+func TestMixedList(t *testing.T) {
+	cfg, err := Parser(jsonEnc).Decode(strings.NewReader(`{"e":[1,{"f":2}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []string{"e", "1", "f"}
+	if got := cfg.Get(key); !Equal(got, 2) {
+		t.Errorf("Get: got %#v", got)
+	}
+	if !cfg.Has([]string{"$.e[1].f"}) || !cfg.Has([]string{"$..f"}) {
+		t.Error("the query did not match")
+	}
+	clone, err := cfg.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = clone.Set(key, int64(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err = clone.Set([]string{"e", "1", "h", "i"}, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := compactJSON(t, clone), `{"e":[1,{"f":5,"h":{"i":"x"}}]}`; got != want {
+		t.Errorf("got %s, wanted %s", got, want)
+	}
+	if got := cfg.Get(key); !Equal(got, 2) {
+		t.Errorf("original changed: got %#v", got)
+	}
+}
+
+func TestNumericKey(t *testing.T) {
+	for _, typ := range []Type{jsonEnc, yamlEnc, tomlEnc} {
+		src := map[Type]string{jsonEnc: `{"server":{"a":1}}`, yamlEnc: "server:\n  a: 1\n", tomlEnc: "[server]\na = 1\n"}[typ]
+		cfg, err := Parser(typ).Decode(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a table is not a list of one
+		if got := cfg.Get([]string{"server", "0"}); got != nil {
+			t.Errorf("%s: server/0: got %#v", typ, got)
+		}
+		if err = cfg.Set([]string{"server", "8080"}, "web"); err != nil {
+			t.Errorf("%s: %+v", typ, err)
+		}
+		if got := cfg.Get([]string{"server", "8080"}); got != "web" {
+			t.Errorf("%s: server/8080: got %#v", typ, got)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Detect returns the Type of the named config file: by its well-known name
+// (Caddyfile, nginx.conf, .env, .gitconfig) or extension, and if that is not conclusive,
+// by sniffing its first bytes (head, which may be nil).
+//
+// Returns ErrUnknownType if neither tells the type.
+func Detect(name string, head []byte) (Type, error) {
+	if typ := detectName(name); typ != "" {
+		return typ, nil
+	}
+	if typ := sniff(head); typ != "" {
+		return typ, nil
+	}
+	return "", errors.Wrap(ErrUnknownType, name)
+}
+
+var (
+	rSniffSection    = regexp.MustCompile(`^\[\[?[^\[\]"=,]+\]\]?$`)
+	rSniffGitSection = regexp.MustCompile(`^\[[A-Za-z0-9.-]+\s+"(?:[^"\\]|\\.)*"\]$`)
+	rSniffTOMLTable  = regexp.MustCompile(`^\[\[?\s*(?:[A-Za-z0-9_-]+|"(?:[^"\\]|\\.)*"|'[^']*')(?:\s*\.\s*(?:[A-Za-z0-9_-]+|"(?:[^"\\]|\\.)*"|'[^']*'))*\s*\]\]?$`)
+	rSniffDotenv     = regexp.MustCompile(`^(?:export\s+)?[A-Z_][A-Z0-9_]*\s*=`)
+	rSniffYAML       = regexp.MustCompile(`^(?:-(?:\s|$)|[A-Za-z0-9_.-]+:(?:\s|$)|"[^"]*":(?:\s|$))`)
+	rSniffBlock      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*(?:\s+"[^"]*")*\s*\{`)
+	rSniffTOMLValue  = regexp.MustCompile(`^(?:"(?:[^"\\]|\\.)*"|'[^']*'|[+-]?[0-9][0-9_.eE+:TZ-]*|true|false|[+-]?inf|[+-]?nan|\[.*|\{.*)\s*(?:#.*)?$`)
+
+	systemdSectionNames = map[string]bool{
+		"Unit": true, "Install": true, "Service": true, "Socket": true, "Timer": true,
+		"Mount": true, "Automount": true, "Path": true, "Slice": true, "Scope": true, "Swap": true,
+		"Match": true, "Link": true, "Network": true, "NetDev": true,
+	}
+)
+
+// sniff guesses the type from the head of the file, or returns "".
+func sniff(head []byte) Type {
+	s := strings.TrimPrefix(string(head), "\ufeff")
+	if t := strings.TrimSpace(s); t == "" {
+		return ""
+	} else if t[0] == '<' {
+		return xmlEnc
+	} else if t[0] == '{' {
+		return jsonEnc
+	} else if strings.HasPrefix(t, "---") || strings.HasPrefix(t, "%YAML") {
+		return yamlEnc
+	}
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' || strings.HasPrefix(line, "//") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) > 1 && !strings.HasSuffix(s, "\n") {
+		// the head may end in the middle of a line
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		// only comments
+		return ""
+	}
+	all := func(f func(line string) bool) bool {
+		for _, line := range lines {
+			if !f(line) {
+				return false
+			}
+		}
+		return true
+	}
+	some := func(f func(line string) bool) bool {
+		for _, line := range lines {
+			if f(line) {
+				return true
+			}
+		}
+		return false
+	}
+	isSection := func(line string) bool {
+		return rSniffSection.MatchString(line) || rSniffGitSection.MatchString(line)
+	}
+
+	first := lines[0]
+	switch {
+	case first[0] == '[':
+		if isSection(first) {
+			return sniffSections(lines)
+		}
+		if rSniffTOMLTable.MatchString(first) && sniffTOMLValues(lines) {
+			return tomlEnc
+		}
+		return jsonEnc
+	case rSniffDotenv.MatchString(first) && all(func(line string) bool {
+		return !strings.Contains(line, "=") || rSniffDotenv.MatchString(line)
+	}):
+		return dotenvEnc
+	case rSniffYAML.MatchString(first) && !strings.Contains(first, "="):
+		return yamlEnc
+	case some(func(line string) bool { return strings.HasSuffix(line, ";") }):
+		return nginxEnc
+	case some(rSniffBlock.MatchString) && some(func(line string) bool { return strings.Contains(line, "=") }):
+		return hclEnc
+	case strings.Contains(first, "="):
+		if some(isSection) {
+			return sniffSections(lines)
+		}
+		if sniffTOMLValues(lines) {
+			return tomlEnc
+		}
+		return iniEnc
+	case some(func(line string) bool { return strings.HasSuffix(line, "{") }):
+		return caddyEnc
+	}
+	return ""
+}
+
+// sniffSections tells the type of a file with [section] headers.
+func sniffSections(lines []string) Type {
+	for _, line := range lines {
+		switch {
+		case rSniffGitSection.MatchString(line):
+			return gitconfigEnc
+		case strings.HasPrefix(line, "[[") && rSniffSection.MatchString(line):
+			return tomlEnc
+		case rSniffSection.MatchString(line):
+			name := strings.TrimSpace(strings.Trim(line, "[]"))
+			if systemdSectionNames[name] {
+				return systemdEnc
+			}
+			if name == "core" {
+				return gitconfigEnc
+			}
+		}
+	}
+	if sniffTOMLValues(lines) {
+		return tomlEnc
+	}
+	return iniEnc
+}
+
+// sniffTOMLValues reports whether all the values of the key = value lines are valid TOML values.
+func sniffTOMLValues(lines []string) bool {
+	var n int
+	for _, line := range lines {
+		i := strings.IndexByte(line, '=')
+		if i < 0 || line[0] == '[' {
+			continue
+		}
+		n++
+		if !rSniffTOMLValue.MatchString(strings.TrimSpace(line[i+1:])) {
+			return false
+		}
+	}
+	return n != 0
+}
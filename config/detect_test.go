@@ -0,0 +1,69 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDetect(t *testing.T) {
+	for _, tc := range []struct {
+		Name, Head string
+		Want       Type
+	}{
+		{Name: "/etc/caddy/Caddyfile", Want: caddyEnc},
+		{Name: "/etc/nginx/nginx.conf", Want: nginxEnc},
+		{Name: ".env.local", Want: dotenvEnc},
+		{Name: "app.service", Want: systemdEnc},
+		{Name: "repo/.git/config", Want: gitconfigEnc},
+		{Name: "config.YML", Want: yamlEnc},
+		{Name: "main.tf", Want: hcl2Enc},
+		{Name: "pom.xml", Want: xmlEnc},
+		{Name: "a.toml", Head: "{}", Want: tomlEnc},
+
+		{Name: "a.conf", Head: caddyTest1, Want: caddyEnc},
+		{Name: "a.conf", Head: nginxTest1, Want: nginxEnc},
+		{Name: "a.conf", Head: iniTest1, Want: iniEnc},
+		{Name: "a.conf", Head: systemdTest1, Want: systemdEnc},
+		{Name: "a.conf", Head: gitconfigTest1, Want: gitconfigEnc},
+		{Name: "a.conf", Head: tomlTest1, Want: tomlEnc},
+		{Name: "a.conf", Head: caddyTest1TOML, Want: tomlEnc},
+		{Name: "a.conf", Head: yamlTest1, Want: yamlEnc},
+		{Name: "a.conf", Head: xmlTest1, Want: xmlEnc},
+		{Name: "a.conf", Head: hclTest1, Want: hclEnc},
+		{Name: "a.conf", Head: dotenvTest1, Want: dotenvEnc},
+		{Name: "a.conf", Head: "\ufeff{\"a\": 1}", Want: jsonEnc},
+		{Name: "a.conf", Head: "[1, 2]", Want: jsonEnc},
+		{Name: "a.conf", Head: "a: 1\nb:\n  - c\n", Want: yamlEnc},
+		// truncated in the middle of the last line
+		{Name: "a", Head: "[server]\nport = 80\nhost = \"loc", Want: tomlEnc},
+	} {
+		got, err := Detect(tc.Name, []byte(tc.Head))
+		if err != nil {
+			t.Errorf("%s %.20q: %+v", tc.Name, tc.Head, err)
+		} else if got != tc.Want {
+			t.Errorf("%s %.20q: got %q, wanted %q", tc.Name, tc.Head, got, tc.Want)
+		}
+	}
+
+	for _, head := range []string{"just some text\n", "# only a comment\n", "\n\n; comment\n  \n"} {
+		if _, err := Detect("a.conf", []byte(head)); errors.Cause(err) != ErrUnknownType {
+			t.Errorf("%q: got %v, wanted ErrUnknownType", head, err)
+		}
+	}
+}
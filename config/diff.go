@@ -0,0 +1,209 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Change is a difference between two configs.
+type Change struct {
+	// Op is "add", "remove" or "replace", as in JSON Patch.
+	Op string
+	// Path of the changed value. The array indexes are valid when the changes
+	// are applied in order, as in JSON Patch.
+	Path     []string
+	Old, New interface{}
+}
+
+// MarshalJSON writes the Path as a JSON Pointer, and only the relevant values.
+func (c Change) MarshalJSON() ([]byte, error) {
+	type change struct {
+		Op   string       `json:"op"`
+		Path string       `json:"path"`
+		Old  *interface{} `json:"old,omitempty"`
+		New  *interface{} `json:"new,omitempty"`
+	}
+	x := change{Op: c.Op, Path: JoinPointer(c.Path)}
+	if c.Op != "add" {
+		x.Old = &c.Old
+	}
+	if c.Op != "remove" {
+		x.New = &c.New
+	}
+	return json.Marshal(x)
+}
+
+// Changes is the list of differences returned by Diff.
+type Changes []Change
+
+// String returns the changes one per line: "+ path: new", "- path: old" or "~ path: old -> new",
+// with the values in JSON.
+func (cs Changes) String() string {
+	var buf strings.Builder
+	for _, c := range cs {
+		switch c.Op {
+		case "add":
+			buf.WriteString("+ " + JoinPointer(c.Path) + ": " + jsonText(c.New))
+		case "remove":
+			buf.WriteString("- " + JoinPointer(c.Path) + ": " + jsonText(c.Old))
+		default:
+			buf.WriteString("~ " + JoinPointer(c.Path) + ": " + jsonText(c.Old) + " -> " + jsonText(c.New))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// Patch returns the RFC 6902 JSON Patch which transforms the old config to the new.
+func (cs Changes) Patch() Patch {
+	patch := make(Patch, len(cs))
+	for i, c := range cs {
+		patch[i] = PatchOperation{Op: c.Op, Path: JoinPointer(c.Path), Value: c.New}
+	}
+	return patch
+}
+
+// Diff returns the changes from a to b.
+//
+// The comparison is semantic: formatting, comments and key order do not matter,
+// numbers are compared by value, and as the untyped formats (INI, properties...)
+// hold only strings, a string equals the number, bool or datetime with the same text form.
+// Arrays are aligned by their longest common subsequence,
+// the unpaired tables at the same place are compared key by key.
+func Diff(a, b Config) (Changes, error) {
+	x, err := plainDoc(a)
+	if err != nil {
+		return nil, err
+	}
+	y, err := plainDoc(b)
+	if err != nil {
+		return nil, err
+	}
+	return diffValues(nil, nil, x, y), nil
+}
+
+// plainDoc returns the tree as plain JSON values: maps, []interface{}, int64, float64,
+// strings (times in RFC 3339), bools and nils.
+func plainDoc(cfg Config) (interface{}, error) {
+	b, err := json.Marshal(cfg.Tree.ToMap())
+	if err != nil {
+		return nil, err
+	}
+	return parseJSON(string(b))
+}
+
+func diffValues(cs Changes, path []string, a, b interface{}) Changes {
+	child := func(k string) []string {
+		return append(append(make([]string, 0, len(path)+1), path...), k)
+	}
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(x)+len(y))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		for k := range y {
+			if _, ok := x[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v, inA := x[k]
+			w, inB := y[k]
+			switch {
+			case !inB:
+				cs = append(cs, Change{Op: "remove", Path: child(k), Old: v})
+			case !inA:
+				cs = append(cs, Change{Op: "add", Path: child(k), New: w})
+			default:
+				cs = diffValues(cs, child(k), v, w)
+			}
+		}
+		return cs
+
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		_, pair := alignLists(len(x), len(y), func(i, j int) bool { return len(diffValues(nil, nil, x[i], y[j])) == 0 })
+		// pos is the index in the array as patched so far
+		var pos, i, j int
+		// gap emits the unpaired elements up to x[xEnd] and y[yEnd]:
+		// the tables at the same place are compared as modified, the rest are removed or added.
+		gap := func(xEnd, yEnd int) {
+			for ; i < xEnd && j < yEnd && isTable(x[i]) && isTable(y[j]); i, j, pos = i+1, j+1, pos+1 {
+				cs = diffValues(cs, child(strconv.Itoa(pos)), x[i], y[j])
+			}
+			for ; i < xEnd; i++ {
+				cs = append(cs, Change{Op: "remove", Path: child(strconv.Itoa(pos)), Old: x[i]})
+			}
+			for ; j < yEnd; j, pos = j+1, pos+1 {
+				cs = append(cs, Change{Op: "add", Path: child(strconv.Itoa(pos)), New: y[j]})
+			}
+		}
+		for k, p := range pair {
+			if p < 0 {
+				continue
+			}
+			gap(k, p)
+			cs = diffValues(cs, child(strconv.Itoa(pos)), x[k], y[p])
+			i, j, pos = k+1, p+1, pos+1
+		}
+		gap(len(x), len(y))
+		return cs
+
+	default:
+		if jsonEqual(a, b) {
+			return cs
+		}
+		if _, ok := b.(map[string]interface{}); ok {
+			break
+		}
+		if _, ok := b.([]interface{}); ok {
+			break
+		}
+		if _, ok := a.(string); ok && b != nil && FormatValue(a) == FormatValue(b) {
+			return cs
+		}
+		if _, ok := b.(string); ok && a != nil && FormatValue(a) == FormatValue(b) {
+			return cs
+		}
+	}
+	return append(cs, Change{Op: "replace", Path: path, Old: a, New: b})
+}
+
+func isTable(v interface{}) bool {
+	_, ok := v.(map[string]interface{})
+	return ok
+}
+
+func jsonText(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return FormatValue(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+)
+
+func TestDiff(t *testing.T) {
+	for i, tc := range []struct {
+		TypeA, TypeB Type
+		A, B, Want   string
+	}{
+		{TypeA: iniEnc, TypeB: tomlEnc,
+			A: "; comment\n[server]\nport = 8080\ndebug = true\nhost=a\nratio = 0.5\n",
+			B: "[server]\nport = 8081\ndebug = true\nmode = \"prod\"\nratio = 0.5\n",
+			Want: `- /server/host: "a"
++ /server/mode: "prod"
+~ /server/port: "8080" -> 8081
+`},
+		{TypeA: jsonEnc, TypeB: jsonEnc,
+			A: `{"a":[1,2,3,4],"b":{"c":[{"x":1},{"x":2}]},"d":"s"}`,
+			B: `{"a":[0,1,3,4,5],"b":{"c":[{"x":1},{"x":3}]},"d":{"s":1}}`,
+			Want: `+ /a/0: 0
+- /a/2: 2
++ /a/4: 5
+~ /b/c/1/x: 2 -> 3
+~ /d: "s" -> {"s":1}
+`},
+	} {
+		a, err := Parser(tc.TypeA).Decode(strings.NewReader(tc.A))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := Parser(tc.TypeB).Decode(strings.NewReader(tc.B))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs, err := Diff(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := diff.Diff(cs.String(), tc.Want); d != "" {
+			t.Errorf("%d. %s", i, d)
+		}
+		if tc.TypeA != jsonEnc {
+			continue
+		}
+		// the patch transforms a to b
+		if err = a.ApplyPatch(cs.Patch()); err != nil {
+			t.Fatalf("%d. %v", i, err)
+		}
+		if got, want := compactJSON(t, a), compactJSON(t, b); got != want {
+			t.Errorf("%d. patched: got %s, wanted %s", i, got, want)
+		}
+		if cs, _ = Diff(a, b); len(cs) != 0 {
+			t.Errorf("%d. patched: %s", i, cs)
+		}
+	}
+}
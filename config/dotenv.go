@@ -0,0 +1,388 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DotenvSeparator is the default separator of the nested keys in the dotenv variable names.
+const DotenvSeparator = "__"
+
+// NewDotenv returns an EncoderDecoder for dotenv files, which splits the variable names
+// on sep into paths: with "__", DB__HOST=x is {"DB": {"HOST": "x"}}.
+// The tables with keys 0, 1, ... n-1 are lists. An empty sep keeps the names flat.
+func NewDotenv(sep string) EncoderDecoder { return dotenvEncDec{sep: sep} }
+
+type dotenvEncDec struct{ sep string }
+
+func (ed dotenvEncDec) Decode(r io.Reader) (Config, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Config{}, err
+	}
+	f, err := parseDotenv(b)
+	if err != nil {
+		return Config{}, err
+	}
+	m := make(map[string]interface{})
+	for _, line := range f.Lines {
+		if line.Name == "" {
+			continue
+		}
+		if err = dotenvPut(m, ed.split(line.Name), line.Value); err != nil {
+			return Config{}, errors.Wrapf(err, "%d", line.lineNo)
+		}
+	}
+	tt, err := treeFromMap(dotenvLists(m).(map[string]interface{}))
+	return Config{Tree: tt, src: f}, err
+}
+
+// Encode the Config as a dotenv file.
+//
+// If the Config has been decoded from a dotenv file, then the comments and the
+// unchanged lines are written back as is, the changed values keep their quoting,
+// and the new variables are appended.
+func (ed dotenvEncDec) Encode(w io.Writer, cfg Config) error {
+	f, _ := cfg.src.(*dotenvFile)
+	if f == nil {
+		f = &dotenvFile{}
+	}
+	values := make(map[string]string)
+	if err := ed.flatten(values, "", cfg.Tree.ToMap()); err != nil {
+		return err
+	}
+	ew := newErrWriter(w)
+	f.writeTo(ew, values)
+	return errors.Wrap(ew.Err(), "write dotenv")
+}
+
+// split the variable name into a path - unless it would have empty elements.
+func (ed dotenvEncDec) split(name string) []string {
+	if ed.sep == "" {
+		return []string{name}
+	}
+	path := strings.Split(name, ed.sep)
+	for _, k := range path {
+		if k == "" {
+			return []string{name}
+		}
+	}
+	return path
+}
+
+// flatten the value into values, with the joined names.
+func (ed dotenvEncDec) flatten(values map[string]string, name string, v interface{}) error {
+	join := func(k string) string {
+		if name == "" {
+			return k
+		}
+		return name + ed.sep + k
+	}
+	if ed.sep != "" || name == "" {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			for k, v := range x {
+				if err := ed.flatten(values, join(k), v); err != nil {
+					return err
+				}
+			}
+			return nil
+		case []interface{}:
+			if name != "" {
+				for i, v := range x {
+					if err := ed.flatten(values, join(strconv.Itoa(i)), v); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}
+	}
+	if !rDotenvName.MatchString(name) {
+		return errors.Errorf("%q is not a valid variable name", name)
+	}
+	values[name] = FormatValue(v)
+	return nil
+}
+
+// dotenvPut puts the value at the path into m, creating the missing tables.
+func dotenvPut(m map[string]interface{}, path []string, value string) error {
+	for i, k := range path[:len(path)-1] {
+		switch x := m[k].(type) {
+		case nil:
+			sub := make(map[string]interface{})
+			m[k], m = sub, sub
+		case map[string]interface{}:
+			m = x
+		default:
+			return errors.Errorf("%s is a value, not a table", strings.Join(path[:i+1], keyDelim))
+		}
+	}
+	k := path[len(path)-1]
+	if _, ok := m[k].(map[string]interface{}); ok {
+		return errors.Errorf("%s is a table, not a value", strings.Join(path, keyDelim))
+	}
+	m[k] = value
+	return nil
+}
+
+// dotenvLists converts the tables with keys 0, 1, ... n-1 to lists, recursively.
+func dotenvLists(v interface{}) interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+	for k, v := range m {
+		m[k] = dotenvLists(v)
+	}
+	if len(m) == 0 {
+		return m
+	}
+	is := make([]interface{}, len(m))
+	for i := range is {
+		v, ok := m[strconv.Itoa(i)]
+		if !ok {
+			return m
+		}
+		is[i] = v
+	}
+	return is
+}
+
+var rDotenvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// dotenvFile is the concrete syntax tree of a dotenv file.
+type dotenvFile struct {
+	Lines []dotenvLine
+}
+
+// dotenvLine is one logical line of a dotenv file, with all its physical lines in Raw.
+type dotenvLine struct {
+	// Raw is the original text, including the line ending.
+	Raw string
+	// Name is empty for comments and blank lines.
+	Name string
+	// Value is the decoded (unquoted, unescaped) value.
+	Value string
+	// lead is Raw up to the name ("export "),
+	// prefix is Raw up to the value, without the opening quote ("export KEY="),
+	// suffix is Raw after the value, without the closing quote (inline comment, line ending).
+	lead, prefix, suffix string
+	// quote is the quote character of the value, 0 if unquoted.
+	quote     byte
+	multiline bool
+	lineNo    int
+}
+
+func parseDotenv(b []byte) (*dotenvFile, error) {
+	var f dotenvFile
+	lines := splitLines(string(b))
+	for i := 0; i < len(lines); i++ {
+		content, nl := chompLine(lines[i])
+		if trimmed := strings.TrimSpace(content); trimmed == "" || trimmed[0] == '#' {
+			f.Lines = append(f.Lines, dotenvLine{Raw: lines[i]})
+			continue
+		}
+		line, n, err := parseDotenvLine(lines[i:], content, nl)
+		if err != nil {
+			return &f, errors.Wrapf(err, "%d", i+1)
+		}
+		line.lineNo = i + 1
+		i += n - 1
+		f.Lines = append(f.Lines, line)
+	}
+	return &f, nil
+}
+
+// parseDotenvLine parses the variable assignment, which may continue in the following lines
+// in a quoted value. Returns the number of physical lines consumed.
+func parseDotenvLine(lines []string, content, nl string) (dotenvLine, int, error) {
+	line := dotenvLine{Raw: lines[0]}
+	off := len(content) - len(strings.TrimLeft(content, " \t"))
+	if rest := content[off:]; strings.HasPrefix(rest, "export") && len(rest) > 6 && (rest[6] == ' ' || rest[6] == '\t') {
+		off += 6
+		off += len(content[off:]) - len(strings.TrimLeft(content[off:], " \t"))
+	}
+	line.lead = content[:off]
+	d := strings.IndexByte(content[off:], '=')
+	if d < 0 {
+		return line, 1, errors.Errorf("no '=' in %q", content)
+	}
+	line.Name = strings.TrimRight(content[off:off+d], " \t")
+	if !rDotenvName.MatchString(line.Name) {
+		return line, 1, errors.Errorf("%q is not a valid variable name", line.Name)
+	}
+	off += d + 1
+	off += len(content[off:]) - len(strings.TrimLeft(content[off:], " \t"))
+	line.prefix = content[:off]
+	v := content[off:]
+
+	if v != "" && (v[0] == '"' || v[0] == '\'' || v[0] == '`') {
+		line.quote = v[0]
+		body := v[1:]
+		for n := 1; ; n++ {
+			if j := dotenvClosingQuote(body, line.quote); j >= 0 {
+				line.Value, line.suffix = body[:j], body[j+1:]+nl
+				if line.quote == '"' {
+					line.Value = dotenvUnescape(line.Value)
+				}
+				line.Raw = strings.Join(lines[:n], "")
+				line.multiline = n > 1
+				return line, n, nil
+			}
+			if n == len(lines) {
+				return line, n, errors.Errorf("unclosed quoted value of %q", line.Name)
+			}
+			var next string
+			next, nl = chompLine(lines[n])
+			body += "\n" + next
+		}
+	}
+
+	// an inline comment starts with a whitespace and #
+	if j := strings.Index(v, "#"); j == 0 {
+		v = ""
+	} else if j := strings.Index(v, " #"); j >= 0 {
+		v = v[:j]
+	} else if j := strings.Index(v, "\t#"); j >= 0 {
+		v = v[:j]
+	}
+	line.Value = strings.TrimRight(v, " \t")
+	line.suffix = content[off+len(line.Value):] + nl
+	return line, 1, nil
+}
+
+// dotenvClosingQuote returns the index of the closing quote in s, -1 if there is none.
+// Backslash escapes the next character in double quoted values.
+func dotenvClosingQuote(s string, q byte) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case q:
+			return i
+		case '\\':
+			if q == '"' {
+				i++
+			}
+		}
+	}
+	return -1
+}
+
+func dotenvUnescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			buf.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case '"', '\\', '$', '`':
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// dotenvQuote returns the value quoted with q if possible, or in the simplest way it survives a round trip.
+// Double quoted values with new lines are written on multiple lines if multiline.
+func dotenvQuote(s string, q byte, multiline bool) string {
+	switch q {
+	case 0:
+		if rDotenvBare.MatchString(s) {
+			return s
+		}
+	case '\'', '`':
+		if !strings.ContainsRune(s, rune(q)) {
+			return string(q) + s + string(q)
+		}
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", `\r`, "\n", `\n`)
+	if multiline {
+		r = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\r", `\r`)
+	}
+	return `"` + r.Replace(s) + `"`
+}
+
+// rDotenvBare matches the values which need no quoting, not even for the shell.
+var rDotenvBare = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]*$`)
+
+func (f *dotenvFile) writeTo(w io.Writer, values map[string]string) {
+	// The last line of the variable holds its value.
+	last := make(map[string]int)
+	var lead, nl string
+	for i, line := range f.Lines {
+		if line.Name != "" {
+			last[line.Name] = i
+			lead = line.lead
+		}
+		if nl == "" && strings.HasSuffix(line.Raw, "\n") {
+			_, nl = chompLine(line.Raw)
+		}
+	}
+	if nl == "" {
+		nl = "\n"
+	}
+
+	var buf bytes.Buffer
+	for i, line := range f.Lines {
+		if line.Name == "" {
+			buf.WriteString(line.Raw)
+			continue
+		}
+		v, ok := values[line.Name]
+		if !ok {
+			continue
+		}
+		if v == line.Value || last[line.Name] != i {
+			buf.WriteString(line.Raw)
+			continue
+		}
+		buf.WriteString(line.prefix)
+		buf.WriteString(dotenvQuote(v, line.quote, line.multiline))
+		buf.WriteString(line.suffix)
+	}
+
+	// new variables
+	for _, name := range sortedKeys(values) {
+		if _, ok := last[name]; !ok {
+			if b := buf.Bytes(); len(b) != 0 && b[len(b)-1] != '\n' {
+				buf.WriteString(nl)
+			}
+			buf.WriteString(lead + name + "=" + dotenvQuote(values[name], 0, false) + nl)
+		}
+	}
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+)
+
+const dotenvTest1 = `# database
+export DB__HOST=localhost   # inline comment
+DB__PORT = 5432
+DB__PASSWORD='s3cr#t'
+GREETING="Hello\n\"World\""
+KEY=` + "`a'b\"c`" + `
+CERT="-----BEGIN-----
+abc
+-----END-----"
+
+HOSTS__0=a.example.com
+HOSTS__1=b.example.com
+EMPTY=
+`
+
+func TestDotenvRoundTrip(t *testing.T) {
+	ed := Parser(dotenvEnc).(EncoderDecoder)
+	cfg, err := ed.Decode(strings.NewReader(dotenvTest1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]interface{}{
+		"DB/HOST":     "localhost",
+		"DB/PORT":     "5432",
+		"DB/PASSWORD": "s3cr#t",
+		"GREETING":    "Hello\n\"World\"",
+		"KEY":         "a'b\"c",
+		"CERT":        "-----BEGIN-----\nabc\n-----END-----",
+		"HOSTS/1":     "b.example.com",
+		"EMPTY":       "",
+	} {
+		if got := cfg.Get(strings.Split(path, "/")); got != want {
+			t.Errorf("%s: got %q, wanted %q", path, got, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := ed.Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d := diff.Diff(dotenvTest1, buf.String()); d != "" {
+		t.Errorf("unchanged round trip:\n%s", d)
+	}
+
+	for k, v := range map[string]interface{}{
+		"DB/HOST":     "db.internal",
+		"DB/PASSWORD": "it's",
+		"GREETING":    "Hi",
+		"CERT":        "-----BEGIN-----\nxyz\n-----END-----",
+		"HOSTS/2":     "c.example.com",
+		"DB/NAME":     "app db",
+		"DEBUG":       true,
+	} {
+		if err = cfg.Set(strings.Split(k, "/"), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = cfg.Del([]string{"DB", "PORT"}); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := ed.Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := `# database
+export DB__HOST=db.internal   # inline comment
+DB__PASSWORD="it's"
+GREETING="Hi"
+KEY=` + "`a'b\"c`" + `
+CERT="-----BEGIN-----
+xyz
+-----END-----"
+
+HOSTS__0=a.example.com
+HOSTS__1=b.example.com
+EMPTY=
+DB__NAME="app db"
+DEBUG=true
+HOSTS__2=c.example.com
+`
+	if d := diff.Diff(want, buf.String()); d != "" {
+		t.Errorf("changed:\n%s", d)
+	}
+}
+
+func TestDotenvSeparator(t *testing.T) {
+	cfg, err := New(map[string]interface{}{
+		"app": map[string]interface{}{"name": "x", "ports": []interface{}{80, 443}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sep, want := range map[string]string{
+		"_": "app_name=x\napp_ports_0=80\napp_ports_1=443\n",
+		"":  `app="{\"name\":\"x\",\"ports\":[80,443]}"` + "\n",
+	} {
+		var buf bytes.Buffer
+		if err = NewDotenv(sep).Encode(&buf, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if d := diff.Diff(want, buf.String()); d != "" {
+			t.Errorf("%q: %s", sep, d)
+		}
+	}
+
+	if _, err = Parser(dotenvEnc).Decode(strings.NewReader("A=1\nA__B=2\n")); err == nil {
+		t.Error("wanted error for A being a value and a table")
+	}
+}
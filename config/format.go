@@ -0,0 +1,168 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Format describes a registered Type.
+type Format struct {
+	Type Type `json:"type"`
+	// Aliases are the other names of the Type (yml), accepted by Parser and Dumper, too.
+	Aliases []Type `json:"aliases,omitempty"`
+	// Extensions are the file name extensions, without the dot.
+	Extensions []string `json:"extensions,omitempty"`
+	// Names are the well-known file names, as path.Match patterns, matched case insensitively
+	// to the end of the path (.env.*, .git/config).
+	Names []string `json:"names,omitempty"`
+	// MediaTypes are the MIME types of the format.
+	MediaTypes []string `json:"mediaTypes,omitempty"`
+
+	// Lossless is true if the unchanged parts are written back as they have been read.
+	Lossless bool `json:"lossless"`
+	// Comments is true if the comments are kept.
+	Comments bool `json:"comments"`
+	// Streaming is true if a file may hold a stream of documents (YAML's ---).
+	Streaming bool `json:"streaming"`
+}
+
+var formats = map[Type]Format{
+	caddyEnc: {Type: caddyEnc, Names: []string{"Caddyfile"}, MediaTypes: []string{"text/caddyfile"},
+		Lossless: true, Comments: true},
+	dotenvEnc: {Type: dotenvEnc, Aliases: []Type{"env"}, Extensions: []string{"env"}, Names: []string{".env", ".env.*"},
+		Lossless: true, Comments: true},
+	gitconfigEnc: {Type: gitconfigEnc, Names: []string{".gitconfig", ".gitmodules", ".git/config"},
+		Lossless: true, Comments: true},
+	hclEnc: {Type: hclEnc, Extensions: []string{"hcl", "nomad"},
+		Lossless: true, Comments: true},
+	hcl2Enc: {Type: hcl2Enc, Aliases: []Type{"tf", "terraform"}, Extensions: []string{"tf", "tfvars"},
+		Lossless: true, Comments: true},
+	iniEnc: {Type: iniEnc, Extensions: []string{"ini"},
+		Lossless: true, Comments: true},
+	jsonEnc: {Type: jsonEnc, Extensions: []string{"json"}, MediaTypes: []string{"application/json"}},
+	nginxEnc: {Type: nginxEnc, Names: []string{"nginx.conf"},
+		Lossless: true, Comments: true},
+	propertiesEnc: {Type: propertiesEnc, Extensions: []string{"properties"}, MediaTypes: []string{"text/x-java-properties"}},
+	systemdEnc: {Type: systemdEnc, Aliases: []Type{"unit"},
+		Extensions: []string{"service", "socket", "timer", "mount", "automount", "path", "target", "slice", "scope", "swap"},
+		Lossless:   true, Comments: true},
+	tomlEnc: {Type: tomlEnc, Extensions: []string{"toml"}, MediaTypes: []string{"application/toml"},
+		Lossless: true, Comments: true},
+	xmlEnc: {Type: xmlEnc, Extensions: []string{"xml", "config", "csproj", "pom"}, MediaTypes: []string{"application/xml", "text/xml"},
+		Lossless: true, Comments: true},
+	yamlEnc: {Type: yamlEnc, Aliases: []Type{"yml"}, Extensions: []string{"yaml", "yml"},
+		MediaTypes: []string{"application/yaml", "application/x-yaml", "text/yaml"},
+		Lossless:   true, Comments: true, Streaming: true},
+}
+
+// RegisterFormat registers a new EncoderDecoder, with its descriptor.
+// Will panic if its Type or an alias is already registered.
+func RegisterFormat(f Format, ed EncoderDecoder) {
+	encdecMu.Lock()
+	defer encdecMu.Unlock()
+	for _, typ := range append([]Type{f.Type}, f.Aliases...) {
+		if resolve(typ) != "" {
+			panic(typ + " already registered!")
+		}
+	}
+	encdec[f.Type] = ed
+	formats[f.Type] = f
+}
+
+// Formats returns the descriptors of the registered types, ordered by Type.
+func Formats() []Format {
+	encdecMu.RLock()
+	defer encdecMu.RUnlock()
+	fs := make([]Format, 0, len(formats))
+	for _, typ := range sortedTypes() {
+		fs = append(fs, formats[typ])
+	}
+	return fs
+}
+
+// Lookup returns the descriptor of the Type, given by its name or an alias.
+func Lookup(name string) (Format, bool) {
+	encdecMu.RLock()
+	defer encdecMu.RUnlock()
+	f, ok := formats[resolve(Type(name))]
+	return f, ok
+}
+
+// resolve returns the registered Type of the name or alias, or "".
+// Must be called with encdecMu held.
+func resolve(typ Type) Type {
+	if _, ok := encdec[typ]; ok {
+		return typ
+	}
+	lower := Type(strings.ToLower(string(typ)))
+	for _, t := range sortedTypes() {
+		if t == lower {
+			return t
+		}
+		for _, a := range formats[t].Aliases {
+			if a == lower {
+				return t
+			}
+		}
+	}
+	return ""
+}
+
+// detectName returns the Type of the file by its well-known name or its extension, or "".
+func detectName(name string) Type {
+	encdecMu.RLock()
+	defer encdecMu.RUnlock()
+	types := sortedTypes()
+	elems := strings.Split(strings.ToLower(filepath.ToSlash(name)), "/")
+	for _, typ := range types {
+		for _, pattern := range formats[typ].Names {
+			n := strings.Count(pattern, "/") + 1
+			if n > len(elems) {
+				continue
+			}
+			if ok, _ := path.Match(strings.ToLower(pattern), strings.Join(elems[len(elems)-n:], "/")); ok {
+				return typ
+			}
+		}
+	}
+	ext := strings.TrimPrefix(path.Ext(elems[len(elems)-1]), ".")
+	if ext == "" {
+		return ""
+	}
+	for _, typ := range types {
+		for _, e := range formats[typ].Extensions {
+			if e == ext {
+				return typ
+			}
+		}
+	}
+	return resolve(Type(ext))
+}
+
+// sortedTypes returns the registered types in order.
+// Must be called with encdecMu held.
+func sortedTypes() []Type {
+	types := make([]Type, 0, len(encdec))
+	for typ := range encdec {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"testing"
+)
+
+func TestFormats(t *testing.T) {
+	fs := Formats()
+	if len(fs) < 13 {
+		t.Fatalf("got %d formats", len(fs))
+	}
+	for i, f := range fs {
+		if i > 0 && fs[i-1].Type >= f.Type {
+			t.Errorf("%d. %q is not after %q", i, f.Type, fs[i-1].Type)
+		}
+		if Parser(f.Type) == nil || Dumper(f.Type) == nil {
+			t.Errorf("%q: no encoder/decoder", f.Type)
+		}
+		for _, a := range f.Aliases {
+			if Parser(a) != Parser(f.Type) {
+				t.Errorf("%q: alias %q is not resolved", f.Type, a)
+			}
+		}
+	}
+
+	if f, ok := Lookup("YML"); !ok || f.Type != yamlEnc || !f.Lossless || !f.Streaming {
+		t.Errorf("Lookup(YML): got %#v, %t", f, ok)
+	}
+	if f, ok := Lookup("json"); !ok || f.Lossless || f.Comments || f.MediaTypes[0] != "application/json" {
+		t.Errorf("Lookup(json): got %#v, %t", f, ok)
+	}
+	if _, ok := Lookup("nope"); ok {
+		t.Error("Lookup(nope) found")
+	}
+
+	if _, ok := Lookup("testfmt"); !ok {
+		RegisterFormat(Format{Type: "testfmt", Aliases: []Type{"tf2"}, Extensions: []string{"tfmt"}}, iniEncDec{})
+	}
+	if typ, err := Detect("a/b.tfmt", nil); err != nil || typ != "testfmt" {
+		t.Errorf("Detect(b.tfmt): got %q, %v", typ, err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("registering the yml alias again did not panic")
+			}
+		}()
+		RegisterFormat(Format{Type: "other", Aliases: []Type{"yml"}}, iniEncDec{})
+	}()
+}
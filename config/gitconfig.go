@@ -0,0 +1,510 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	toml "github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+)
+
+// gitconfigEncDec is for git-config files (.gitconfig, .git/config, .gitmodules).
+//
+// [section] is the "section" table, [section "sub"] is its "sub" table,
+// so remote.origin.fetch is at remote/origin/fetch.
+// The section and key names are case insensitive (lowercased), the subsection names are not.
+// A repeated key is a list, a key without value (boolean true) is true.
+// include and includeIf are ordinary sections: they are not followed.
+type gitconfigEncDec struct{}
+
+func (ed gitconfigEncDec) Decode(r io.Reader) (Config, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Config{}, err
+	}
+	f, err := parseGitconfig(string(b))
+	if err != nil {
+		return Config{}, err
+	}
+	m := make(map[string]interface{})
+	for _, section := range f.Sections[1:] {
+		values, ok := m[section.Name].(map[string]interface{})
+		if !ok {
+			values = make(map[string]interface{})
+			m[section.Name] = values
+		}
+		if section.HasSub {
+			sub, ok := values[section.Sub].(map[string]interface{})
+			if !ok {
+				if _, isValue := values[section.Sub]; isValue {
+					return Config{}, errors.Errorf("%s.%s is both a key and a subsection", section.Name, section.Sub)
+				}
+				sub = make(map[string]interface{})
+				values[section.Sub] = sub
+			}
+			values = sub
+		}
+		for _, line := range section.Lines {
+			if line.Key == "" {
+				continue
+			}
+			var v interface{} = line.Value
+			if line.Bare {
+				v = true
+			}
+			switch x := values[line.Key].(type) {
+			case nil:
+				values[line.Key] = v
+			case map[string]interface{}:
+				return Config{}, errors.Errorf("%s.%s is both a key and a subsection", section.Name, line.Key)
+			case []interface{}:
+				values[line.Key] = append(x, line.Value)
+			default:
+				values[line.Key] = []interface{}{FormatValue(x), line.Value}
+			}
+		}
+	}
+	tt, err := treeFromMap(m)
+	return Config{Tree: tt, src: f}, err
+}
+
+// Encode the Config as a git-config file.
+//
+// If the Config has been decoded from a git-config file, then the unchanged lines
+// are written back as is, only the changed key lines are rewritten,
+// and the new keys are appended to their sections.
+func (ed gitconfigEncDec) Encode(w io.Writer, cfg Config) error {
+	f, _ := cfg.src.(*gitconfigFile)
+	if f == nil {
+		f = &gitconfigFile{Sections: []*gitconfigSection{{}}}
+	}
+	sections, err := gitconfigSections(cfg.Tree)
+	if err != nil {
+		return err
+	}
+	ew := newErrWriter(w)
+	f.writeTo(ew, sections)
+	return errors.Wrap(ew.Err(), "write gitconfig")
+}
+
+// gitconfigFile is the concrete syntax tree of a git-config file.
+//
+// The first section is the comments before the first section header.
+type gitconfigFile struct {
+	Sections []*gitconfigSection
+}
+
+// gitconfigSection is a section: its header line and all the following lines
+// up to the next section header.
+type gitconfigSection struct {
+	// Name is lowercased, Sub is kept as is.
+	Name, Sub string
+	HasSub    bool
+	Lines     []gitconfigLine
+}
+
+func (s gitconfigSection) key() gitconfigSectionKey {
+	return gitconfigSectionKey{Name: s.Name, Sub: s.Sub, HasSub: s.HasSub}
+}
+
+// gitconfigSectionKey identifies a section.
+type gitconfigSectionKey struct {
+	Name, Sub string
+	HasSub    bool
+}
+
+func (k gitconfigSectionKey) String() string {
+	if !k.HasSub {
+		return "[" + k.Name + "]"
+	}
+	return "[" + k.Name + ` "` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(k.Sub) + `"]`
+}
+
+// gitconfigLine is one logical line, with all its physical lines in Raw.
+type gitconfigLine struct {
+	// Raw is the original text, including the line ending.
+	Raw string
+	// Key is lowercased, and empty for comments, blank lines and section headers.
+	Key string
+	// Value is the decoded value, "true" for a key without value.
+	Value string
+	Bare  bool
+	// prefix is Raw up to the value ("\tkey = "),
+	// suffix is Raw after the value (spaces, comment, line ending);
+	// for a key without value, they are split at the end of the key.
+	prefix, suffix string
+}
+
+func parseGitconfig(text string) (*gitconfigFile, error) {
+	f := &gitconfigFile{Sections: []*gitconfigSection{{}}}
+	section := f.Sections[0]
+	lines := splitLines(text)
+	for i := 0; i < len(lines); i++ {
+		content, _ := chompLine(lines[i])
+		trimmed := strings.TrimLeft(content, " \t")
+		if trimmed == "" || trimmed[0] == '#' || trimmed[0] == ';' {
+			section.Lines = append(section.Lines, gitconfigLine{Raw: lines[i]})
+			continue
+		}
+		if trimmed[0] == '[' {
+			s, err := parseGitconfigHeader(trimmed)
+			if err != nil {
+				return f, errors.Wrapf(err, "%d", i+1)
+			}
+			s.Lines = append(s.Lines, gitconfigLine{Raw: lines[i]})
+			section = s
+			f.Sections = append(f.Sections, section)
+			continue
+		}
+		if len(f.Sections) == 1 {
+			return f, errors.Errorf("%d: key %q is not in a section", i+1, trimmed)
+		}
+		line, n, err := parseGitconfigKeyLine(lines[i:])
+		if err != nil {
+			return f, errors.Wrapf(err, "%d", i+1)
+		}
+		i += n - 1
+		section.Lines = append(section.Lines, line)
+	}
+	return f, nil
+}
+
+// parseGitconfigHeader parses [section], [section "sub"] and the deprecated [section.sub].
+func parseGitconfigHeader(s string) (*gitconfigSection, error) {
+	i := 1
+	for i < len(s) && (isAlnum(s[i]) || s[i] == '-' || s[i] == '.') {
+		i++
+	}
+	section := &gitconfigSection{Name: strings.ToLower(s[1:i])}
+	if section.Name == "" {
+		return nil, errors.Errorf("bad section header %q", s)
+	}
+	if i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		if i == len(s) || s[i] != '"' {
+			return nil, errors.Errorf("bad subsection in %q", s)
+		}
+		var buf strings.Builder
+		for i++; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+			}
+			buf.WriteByte(s[i])
+		}
+		if i == len(s) {
+			return nil, errors.Errorf("unclosed subsection in %q", s)
+		}
+		i++
+		section.Sub, section.HasSub = buf.String(), true
+	} else if j := strings.IndexByte(section.Name, '.'); j >= 0 {
+		section.Name, section.Sub, section.HasSub = section.Name[:j], section.Name[j+1:], true
+	}
+	if i == len(s) || s[i] != ']' {
+		return nil, errors.Errorf("unclosed section header %q", s)
+	}
+	if rest := strings.TrimLeft(s[i+1:], " \t"); rest != "" && rest[0] != '#' && rest[0] != ';' {
+		return nil, errors.Errorf("text after the section header %q", s)
+	}
+	return section, nil
+}
+
+// parseGitconfigKeyLine parses the key line, which may continue in the following lines.
+// Returns the number of physical lines consumed.
+func parseGitconfigKeyLine(lines []string) (gitconfigLine, int, error) {
+	line := gitconfigLine{Raw: lines[0]}
+	content, nl := chompLine(lines[0])
+	i := len(content) - len(strings.TrimLeft(content, " \t"))
+	start := i
+	for i < len(content) && (isAlnum(content[i]) || content[i] == '-') {
+		i++
+	}
+	if i == start || !isAlpha(content[start]) {
+		return line, 1, errors.Errorf("bad key name in %q", content)
+	}
+	line.Key = strings.ToLower(content[start:i])
+	keyEnd := i
+	for i < len(content) && (content[i] == ' ' || content[i] == '\t') {
+		i++
+	}
+	if i == len(content) || content[i] == '#' || content[i] == ';' {
+		line.Value, line.Bare = "true", true
+		line.prefix, line.suffix = content[:keyEnd], content[keyEnd:]+nl
+		return line, 1, nil
+	}
+	if content[i] != '=' {
+		return line, 1, errors.Errorf("delimiter(=) not found in %q", content)
+	}
+	for i++; i < len(content) && (content[i] == ' ' || content[i] == '\t'); i++ {
+	}
+	line.prefix = content[:i]
+
+	// the value ends at the last character that is not a space or a comment;
+	// the spaces between the words are kept (as one space each), those in quotes as is
+	var buf strings.Builder
+	n, end, spaces, quote := 1, i, 0, false
+	for {
+		if i == len(content) {
+			if quote {
+				return line, n, errors.Errorf("unclosed quote in the value of %q", line.Key)
+			}
+			break
+		}
+		c := content[i]
+		if !quote && (c == ' ' || c == '\t') {
+			if buf.Len() != 0 {
+				spaces++
+			}
+			i++
+			continue
+		}
+		if !quote && (c == '#' || c == ';') {
+			break
+		}
+		if c == '\\' && i+1 == len(content) {
+			// continuation
+			if n == len(lines) {
+				break
+			}
+			content, nl = chompLine(lines[n])
+			line.Raw += lines[n]
+			n, i, end = n+1, 0, 0
+			continue
+		}
+		for ; spaces > 0; spaces-- {
+			buf.WriteByte(' ')
+		}
+		switch c {
+		case '\\':
+			i++
+			switch content[i] {
+			case 'n':
+				buf.WriteByte('\n')
+			case 't':
+				buf.WriteByte('\t')
+			case 'b':
+				buf.WriteByte('\b')
+			case '\\', '"':
+				buf.WriteByte(content[i])
+			default:
+				return line, n, errors.Errorf("bad escape %q in the value of %q", content[i-1:i+1], line.Key)
+			}
+		case '"':
+			quote = !quote
+		default:
+			buf.WriteByte(c)
+		}
+		i++
+		end = i
+	}
+	line.Value, line.suffix = buf.String(), content[end:]+nl
+	return line, n, nil
+}
+
+// gitconfigQuote escapes the value, and quotes it if its spaces or comment characters
+// would not survive a round trip.
+func gitconfigQuote(s string) string {
+	q := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`, "\b", `\b`).Replace(s)
+	if s != strings.TrimSpace(s) || strings.Contains(s, "  ") || strings.ContainsAny(s, "#;") {
+		return `"` + q + `"`
+	}
+	return q
+}
+
+// gitconfigSections returns the keys of each section of the tree, with their string values.
+func gitconfigSections(tt *toml.Tree) (map[gitconfigSectionKey]map[string][]string, error) {
+	sections := make(map[gitconfigSectionKey]map[string][]string)
+	add := func(key gitconfigSectionKey, tt *toml.Tree, subs bool) error {
+		values := sections[key]
+		if values == nil && len(tt.Keys()) == 0 {
+			sections[key] = make(map[string][]string)
+		}
+		for _, k := range tt.Keys() {
+			var vals []string
+			switch x := tt.GetPath([]string{k}).(type) {
+			case *toml.Tree:
+				if !subs {
+					return errors.Errorf("%s: %q is too deep", key, k)
+				}
+				continue
+			case []*toml.Tree:
+				return errors.Errorf("%s: %q is a list of tables", key, k)
+			case []interface{}:
+				for _, v := range x {
+					vals = append(vals, FormatValue(v))
+				}
+			default:
+				vals = []string{FormatValue(x)}
+			}
+			if values == nil {
+				values = make(map[string][]string)
+				sections[key] = values
+			}
+			values[strings.ToLower(k)] = vals
+		}
+		return nil
+	}
+	for _, name := range tt.Keys() {
+		section, ok := tt.GetPath([]string{name}).(*toml.Tree)
+		if !ok {
+			return nil, errors.Errorf("%q is not a section", name)
+		}
+		lower := strings.ToLower(name)
+		if err := add(gitconfigSectionKey{Name: lower}, section, true); err != nil {
+			return nil, err
+		}
+		for _, k := range section.Keys() {
+			if sub, ok := section.GetPath([]string{k}).(*toml.Tree); ok {
+				if err := add(gitconfigSectionKey{Name: lower, Sub: k, HasSub: true}, sub, false); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return sections, nil
+}
+
+// gitconfigRef is the place of a key line: the indexes of its section and line.
+type gitconfigRef struct{ section, line int }
+
+func (f *gitconfigFile) writeTo(w io.Writer, cur map[gitconfigSectionKey]map[string][]string) {
+	type keyRef struct {
+		section gitconfigSectionKey
+		key     string
+	}
+	keys := make(map[keyRef][]gitconfigRef)
+	lastSection := make(map[gitconfigSectionKey]int)
+	for i, section := range f.Sections[1:] {
+		lastSection[section.key()] = i + 1
+		for j, line := range section.Lines {
+			if line.Key != "" {
+				k := keyRef{section.key(), line.Key}
+				keys[k] = append(keys[k], gitconfigRef{i + 1, j})
+			}
+		}
+	}
+	// the plan for each key line: the current values to be written in its place
+	type plan struct {
+		refs []gitconfigRef
+		emit [][]int
+		pair []int
+		vals []string
+	}
+	plans := make(map[gitconfigRef]*plan)
+	for k, refs := range keys {
+		vals, ok := cur[k.section][k.key]
+		if !ok {
+			continue
+		}
+		p := &plan{refs: refs, vals: vals}
+		p.emit, p.pair = alignLists(len(refs), len(vals), func(i, j int) bool {
+			return f.Sections[refs[i].section].Lines[refs[i].line].Value == vals[j]
+		})
+		for _, ref := range refs {
+			plans[ref] = p
+		}
+	}
+	writeNew := func(buf *bytes.Buffer, indent string, key gitconfigSectionKey) {
+		values := cur[key]
+		names := make([]string, 0, len(values))
+		for k := range values {
+			if _, ok := keys[keyRef{key, k}]; !ok {
+				names = append(names, k)
+			}
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			for _, v := range values[k] {
+				fmt.Fprintf(buf, "%s%s = %s\n", indent, k, gitconfigQuote(v))
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	for i, section := range f.Sections {
+		if _, ok := cur[section.key()]; !ok && i != 0 {
+			// deleted section
+			continue
+		}
+		insertAt, indent := len(section.Lines), "\t"
+		for j, line := range section.Lines {
+			if line.Key != "" {
+				insertAt = j + 1
+				content, _ := chompLine(line.Raw)
+				indent = content[:len(content)-len(strings.TrimLeft(content, " \t"))]
+			}
+		}
+		for j, line := range section.Lines {
+			if line.Key == "" {
+				buf.WriteString(line.Raw)
+			} else if p := plans[gitconfigRef{i, j}]; p != nil {
+				n := 0
+				for n < len(p.refs) && p.refs[n] != (gitconfigRef{i, j}) {
+					n++
+				}
+				for _, k := range p.emit[n] {
+					if k != p.pair[n] {
+						ensureNewline(&buf)
+						fmt.Fprintf(&buf, "%s%s = %s\n", indent, line.Key, gitconfigQuote(p.vals[k]))
+					} else if p.vals[k] == line.Value {
+						buf.WriteString(line.Raw)
+					} else if line.Bare {
+						buf.WriteString(line.prefix + " = " + gitconfigQuote(p.vals[k]) + line.suffix)
+					} else {
+						buf.WriteString(line.prefix + gitconfigQuote(p.vals[k]) + line.suffix)
+					}
+				}
+			}
+			if j == insertAt-1 && i != 0 && lastSection[section.key()] == i {
+				ensureNewline(&buf)
+				writeNew(&buf, indent, section.key())
+			}
+		}
+	}
+
+	// new sections
+	// (an empty one is just the parent of deleted subsections)
+	var names []gitconfigSectionKey
+	for key, values := range cur {
+		if _, ok := lastSection[key]; !ok && len(values) != 0 {
+			names = append(names, key)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].Name != names[j].Name {
+			return names[i].Name < names[j].Name
+		}
+		if names[i].HasSub != names[j].HasSub {
+			return !names[i].HasSub
+		}
+		return names[i].Sub < names[j].Sub
+	})
+	for _, key := range names {
+		ensureNewline(&buf)
+		buf.WriteString(key.String() + "\n")
+		writeNew(&buf, "\t", key)
+	}
+	w.Write(buf.Bytes())
+}
+
+func isAlpha(c byte) bool { return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' }
+func isAlnum(c byte) bool { return isAlpha(c) || '0' <= c && c <= '9' }
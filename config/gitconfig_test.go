@@ -0,0 +1,142 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+)
+
+const gitconfigTest1 = `# repository config
+[core]
+	repositoryformatversion = 0
+	bare = false
+	logAllRefUpdates
+	editor = "vim -u NONE"   ; no plugins
+[remote "origin"]
+	url = git@github.com:tgulacsi/confed.git
+	fetch = +refs/heads/*:refs/remotes/origin/*
+	fetch = +refs/tags/*:refs/tags/*
+[branch "Main"]
+	remote = origin
+[alias]
+	lg = log --graph \
+		--oneline
+	say = "!echo \"hi\tthere\""
+[includeIf "gitdir:~/work/"]
+	path = ~/.gitconfig-work
+`
+
+func TestGitconfigRoundTrip(t *testing.T) {
+	cfg, err := Parser(gitconfigEnc).Decode(strings.NewReader(gitconfigTest1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]interface{}{
+		"core/bare":             "false",
+		"core/logallrefupdates": true,
+		"core/editor":           "vim -u NONE",
+		"remote/origin/fetch":   []interface{}{"+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"},
+		"branch/Main/remote":    "origin",
+		"alias/lg":              "log --graph   --oneline",
+		"alias/say":             "!echo \"hi\tthere\"",
+	} {
+		if got := cfg.Get(strings.Split(path, "/")); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, wanted %#v", path, got, want)
+		}
+	}
+	if got := cfg.Get([]string{"includeif", "gitdir:~/work/", "path"}); got != "~/.gitconfig-work" {
+		t.Errorf("includeIf: got %#v", got)
+	}
+	var buf strings.Builder
+	if err = Dumper(gitconfigEnc).Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d := diff.Diff(buf.String(), gitconfigTest1); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestGitconfigEdit(t *testing.T) {
+	cfg, err := Parser(gitconfigEnc).Decode(strings.NewReader(gitconfigTest1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]interface{}{
+		"core/logallrefupdates": "always",
+		"core/editor":           "emacs # not vim",
+		"remote/origin/fetch":   []interface{}{"+refs/heads/*:refs/remotes/origin/*", "+refs/notes/*:refs/notes/*", "+refs/tags/*:refs/tags/*"},
+		"remote/origin/prune":   true,
+		"remote/upstream/url":   `C:\repo`,
+		"user/name":             "Tamás Gulácsi",
+	} {
+		if err = cfg.Set(strings.Split(k, "/"), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []string{"branch/Main", "alias/lg"} {
+		if err = cfg.Del(strings.Split(k, "/")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf strings.Builder
+	if err = Dumper(gitconfigEnc).Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := `# repository config
+[core]
+	repositoryformatversion = 0
+	bare = false
+	logAllRefUpdates = always
+	editor = "emacs # not vim"   ; no plugins
+[remote "origin"]
+	url = git@github.com:tgulacsi/confed.git
+	fetch = +refs/heads/*:refs/remotes/origin/*
+	fetch = +refs/notes/*:refs/notes/*
+	fetch = +refs/tags/*:refs/tags/*
+	prune = true
+[alias]
+	say = "!echo \"hi\tthere\""
+[includeIf "gitdir:~/work/"]
+	path = ~/.gitconfig-work
+[remote "upstream"]
+	url = C:\\repo
+[user]
+	name = Tamás Gulácsi
+`
+	if d := diff.Diff(buf.String(), want); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestGitconfigErrors(t *testing.T) {
+	for _, src := range []string{
+		"key = value\n",
+		"[core\n",
+		"[remote \"origin]\n",
+		"[core]\n\t1key = x\n",
+		"[core]\n\tkey = \"x\n",
+		"[core]\n\tkey = a\\qb\n",
+		"[remote]\n\torigin = x\n[remote \"origin\"]\n\turl = y\n",
+	} {
+		if _, err := Parser(gitconfigEnc).Decode(strings.NewReader(src)); err == nil {
+			t.Errorf("%q: no error", src)
+		}
+	}
+}
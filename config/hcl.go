@@ -16,115 +16,556 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/parser"
+	"github.com/hashicorp/hcl/hcl/printer"
 	"github.com/hashicorp/hcl/hcl/token"
+	"github.com/pkg/errors"
 )
 
 const keyDelim = "/"
 
-func mapToNode(m map[string]interface{}, keyDelim string) ast.Node {
-	lis := &ast.ObjectList{Items: make([]*ast.ObjectItem, 0, len(m))}
-	keys := make(map[string]*ast.ObjectList, len(m))
-	for k, v := range m {
-		path := strings.Split(k, keyDelim)
-		parent := lis
-		for i := range path {
-			subPath := strings.Join(path[:i+1], keyDelim)
-			if i != 0 {
-				parent = keys[subPath]
-			}
-			if i == len(path)-1 { // the last
-				o := astObjectItem(path[i], v)
-				if i == 0 {
-					lis.Add(o)
-				} else if parent != nil {
-					parent.Add(o)
+// The HCL documents are mapped to the tree as
+//
+//	name = value                -> name: value
+//	type "label1" "label2" {..} -> type/label1/label2: table
+//
+// and the repeated blocks (with the same type and labels) are lists of tables.
+//
+// The encoders update the syntax tree of the source: the unchanged
+// attributes and blocks are kept with their comments, the new ones are appended.
+
+type hclEncDec struct{}
+
+// hclSource is the source of a decoded HCL document.
+type hclSource struct {
+	text []byte
+	v2   bool
+	// orig is the tree as decoded, to find the changes.
+	orig map[string]interface{}
+}
+
+func (hclEncDec) Decode(r io.Reader) (Config, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Config{}, err
+	}
+	f, err := parser.Parse(b)
+	if err != nil {
+		return Config{}, err
+	}
+	m, err := hclDecode(hcl1Body{list: f.Node.(*ast.ObjectList)})
+	if err != nil {
+		return Config{}, err
+	}
+	tt, err := treeFromMap(m)
+	if err != nil {
+		return Config{}, err
+	}
+	return Config{Tree: tt, src: &hclSource{text: b, orig: tt.ToMap()}}, nil
+}
+
+func (hclEncDec) Encode(w io.Writer, cfg Config) error {
+	src, _ := cfg.src.(*hclSource)
+	if src != nil && src.v2 {
+		src = nil
+	}
+	b, err := hclRender(src, cfg.Tree.ToMap(), func(orig, cur map[string]interface{}) ([]byte, error) {
+		f := &ast.File{Node: &ast.ObjectList{}}
+		if src != nil {
+			var err error
+			if f, err = parser.Parse(src.text); err != nil {
+				return nil, err
+			}
+		}
+		removed := &hcl1Removed{comments: make(map[*ast.CommentGroup]bool)}
+		if err := hclUpdate(hcl1Body{list: f.Node.(*ast.ObjectList), removed: removed}, nil, orig, cur); err != nil {
+			return nil, err
+		}
+		f.Comments = removed.filter(f.Comments)
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, f); err != nil {
+			return nil, err
+		}
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// hclRender returns the text of the current tree, as render writes the source updated from orig to cur.
+//
+// As the printers reformat the whole file, with a source only the lines changed
+// from the unchanged rendering to the current one are taken from render,
+// the rest are kept as they are in the source.
+func hclRender(src *hclSource, cur map[string]interface{}, render func(orig, cur map[string]interface{}) ([]byte, error)) ([]byte, error) {
+	if src == nil {
+		return render(nil, cur)
+	}
+	if reflect.DeepEqual(src.orig, cur) {
+		return src.text, nil
+	}
+	base, err := render(src.orig, src.orig)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := render(src.orig, cur)
+	if err != nil {
+		return nil, err
+	}
+	return hclKeepSource(src.text, base, changed), nil
+}
+
+// hclKeepSource applies the changes from base to cur (the renderings of the
+// original and the current tree) to the source: the lines of base are paired
+// with the source lines by their non-space content, and the unchanged ones are
+// written as they are in the source.
+func hclKeepSource(src, base, cur []byte) []byte {
+	s, n, m := splitLines(string(src)), splitLines(string(base)), splitLines(string(cur))
+	if len(n) == 0 {
+		return cur
+	}
+	bare := func(line string) string { return strings.Join(strings.Fields(line), "") }
+	_, sPair := alignLists(len(n), len(s), func(i, j int) bool { return bare(n[i]) == bare(s[j]) })
+	emit, mPair := alignLists(len(n), len(m), func(i, j int) bool { return n[i] == m[j] })
+
+	var buf bytes.Buffer
+	write := func(lines ...string) {
+		for _, line := range lines {
+			ensureNewline(&buf)
+			buf.WriteString(line)
+		}
+	}
+	var sPos int
+	for i := range n {
+		j := sPair[i]
+		if j >= sPos {
+			// the source lines not in base (blank lines the printer removed)
+			write(s[sPos:j]...)
+			sPos = j
+		}
+		for _, k := range emit[i] {
+			if k != mPair[i] {
+				write(m[k])
+			} else if n[i] != m[k] {
+				// changed: with the indentation of the source line
+				line := m[k]
+				if j >= sPos {
+					nIndent := n[i][:len(n[i])-len(strings.TrimLeft(n[i], " \t"))]
+					sIndent := s[j][:len(s[j])-len(strings.TrimLeft(s[j], " \t"))]
+					if strings.HasPrefix(line, nIndent) {
+						line = sIndent + line[len(nIndent):]
+					}
 				}
-			} else {
-				lis := &ast.ObjectList{}
-				o := &ast.ObjectType{List: lis}
-				keys[subPath] = lis
-				parent.Add(&ast.ObjectItem{
-					Keys: []*ast.ObjectKey{{Token: token.Token{Type: token.STRING, Text: k}}},
-					Val:  o,
-				})
+				write(line)
+			} else if j >= sPos {
+				write(s[j])
 			}
+			// a line of base which is not in the source (a blank line
+			// the printer inserted, or a part of a re-wrapped one) is dropped
+		}
+		if j >= sPos {
+			sPos = j + 1
 		}
 	}
-	return lis
+	write(s[sPos:]...)
+	return buf.Bytes()
 }
 
-var _ = nodeToMap
+// hclBody is a body of an HCL syntax tree: attributes and blocks.
+type hclBody interface {
+	items() []hclItem
+	// value returns the value of the attribute.
+	value(it hclItem) (interface{}, error)
+	setAttribute(name string, v interface{}) error
+	remove(it hclItem)
+	appendBlock(path []string) hclBody
+}
 
-func nodeToMap(node ast.Node, keyDelim string) map[string]interface{} {
-	_ = keyDelim
+// hclItem is an attribute or a block of an hclBody.
+type hclItem struct {
+	// path is the name of the attribute, or the type and the labels of the block.
+	path []string
+	// body of the block, nil for the attributes.
+	body hclBody
+	node interface{}
+}
+
+func hclDecode(body hclBody) (map[string]interface{}, error) {
 	m := make(map[string]interface{})
-	switch x := node.(type) {
-	case *ast.ObjectItem:
-		m[x.Keys[0].Token.Text] = x.Val
-	case *ast.ObjectList:
+	for _, it := range body.items() {
+		var v interface{}
+		var err error
+		if it.body != nil {
+			v, err = hclDecode(it.body)
+		} else {
+			v, err = body.value(it)
+		}
+		if err != nil {
+			return m, errors.Wrap(err, strings.Join(it.path, keyDelim))
+		}
+		hclPut(m, it.path, v, it.body != nil)
 	}
-	return m
+	return m, nil
 }
-func astObjectItem(k string, v interface{}) *ast.ObjectItem {
-	return &ast.ObjectItem{
-		Keys: []*ast.ObjectKey{{Token: token.Token{Type: token.STRING, Text: k}}},
-		Val:  astV(v),
+
+// hclPut puts the value at the path into m. The repeated blocks make a list.
+func hclPut(m map[string]interface{}, path []string, v interface{}, block bool) {
+	for _, k := range path[:len(path)-1] {
+		sub, ok := m[k].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			m[k] = sub
+		}
+		m = sub
+	}
+	k := path[len(path)-1]
+	if block {
+		switch x := m[k].(type) {
+		case map[string]interface{}:
+			v = []interface{}{x, v}
+		case []interface{}:
+			if isTableArray(x) {
+				v = append(x, v)
+			}
+		}
 	}
+	m[k] = v
 }
 
-func astV(v interface{}) ast.Node {
-	switch x := v.(type) {
-	case string:
-		return &ast.LiteralType{Token: astToken(x)}
-	case bool:
-		return &ast.LiteralType{Token: astToken(x)}
-	case int, uint, int8, uint8, int16, uint16, int32, uint32, int64, uint64:
-		return &ast.LiteralType{Token: astToken(v)}
-	case float32, float64:
-		return &ast.LiteralType{Token: astToken(v)}
-	case []string:
-		lis := make([]ast.Node, len(x))
-		for i, s := range x {
-			lis[i] = astV(s)
-		}
-		return &ast.ListType{List: lis}
-	case []bool:
-		lis := make([]ast.Node, len(x))
-		for i, s := range x {
-			lis[i] = astV(s)
-		}
-		return &ast.ListType{List: lis}
-	case []int:
-		lis := make([]ast.Node, len(x))
-		for i, s := range x {
-			lis[i] = astV(s)
-		}
-		return &ast.ListType{List: lis}
-	case []float64:
-		lis := make([]ast.Node, len(x))
-		for i, s := range x {
-			lis[i] = astV(s)
-		}
-		return &ast.ListType{List: lis}
-	default:
-		panic(fmt.Sprintf("unsupported type %[1]T %[1]v", v))
-	}
-}
-
-func astToken(v interface{}) token.Token {
+// hclUpdate changes the items of the body under the path prefix (the block labels) from orig to cur.
+func hclUpdate(body hclBody, prefix []string, orig, cur map[string]interface{}) error {
+	keys := make([]string, 0, len(orig)+len(cur))
+	for k := range orig {
+		keys = append(keys, k)
+	}
+	for k := range cur {
+		if _, ok := orig[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o, inOrig := orig[k]
+		c, inCur := cur[k]
+		if inOrig && inCur && reflect.DeepEqual(o, c) {
+			continue
+		}
+		path := append(append(make([]string, 0, len(prefix)+1), prefix...), k)
+		var attrs, blocks, deeper []hclItem
+		for _, it := range body.items() {
+			switch {
+			case stringsEqual(it.path, path) && it.body == nil:
+				attrs = append(attrs, it)
+			case stringsEqual(it.path, path):
+				blocks = append(blocks, it)
+			case hasPathPrefix(it.path, path):
+				deeper = append(deeper, it)
+			}
+		}
+		oMap, _ := o.(map[string]interface{})
+		cMap, cIsMap := c.(map[string]interface{})
+		switch {
+		case !inCur:
+			for _, its := range [][]hclItem{attrs, blocks, deeper} {
+				for _, it := range its {
+					body.remove(it)
+				}
+			}
+		case len(deeper) != 0 && len(attrs)+len(blocks) == 0 && cIsMap:
+			if err := hclUpdate(body, path, oMap, cMap); err != nil {
+				return err
+			}
+		case len(attrs) != 0 && len(blocks)+len(deeper) == 0:
+			if err := body.setAttribute(k, c); err != nil {
+				return errors.Wrap(err, strings.Join(path, keyDelim))
+			}
+		case len(blocks) != 0 && len(attrs)+len(deeper) == 0 && (cIsMap || isTableArray(c)):
+			cs, os := hclTables(c), hclTables(o)
+			for i, it := range blocks {
+				if i >= len(cs) {
+					body.remove(it)
+					continue
+				}
+				var om map[string]interface{}
+				if i < len(os) {
+					om = os[i]
+				}
+				if err := hclUpdate(it.body, nil, om, cs[i]); err != nil {
+					return err
+				}
+			}
+			for _, cm := range cs[len(blocks):] {
+				if err := hclAdd(body, path, cm); err != nil {
+					return err
+				}
+			}
+		default:
+			for _, its := range [][]hclItem{attrs, blocks, deeper} {
+				for _, it := range its {
+					body.remove(it)
+				}
+			}
+			if err := hclAdd(body, path, c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hclAdd adds the value as new blocks (tables and lists of tables) or as an attribute.
+func hclAdd(body hclBody, path []string, v interface{}) error {
+	if isTable(v) || isTableArray(v) {
+		for _, m := range hclTables(v) {
+			if err := hclUpdate(body.appendBlock(path), nil, nil, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(path) != 1 {
+		return errors.Errorf("%s: only blocks can have labels", strings.Join(path, keyDelim))
+	}
+	return errors.Wrap(body.setAttribute(path[0], v), path[0])
+}
+
+// hclTables returns the table, or the tables of the list.
+func hclTables(v interface{}) []map[string]interface{} {
 	switch x := v.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{x}
+	case []interface{}:
+		ms := make([]map[string]interface{}, 0, len(x))
+		for _, v := range x {
+			if m, ok := v.(map[string]interface{}); ok {
+				ms = append(ms, m)
+			}
+		}
+		return ms
+	}
+	return nil
+}
+
+// hcl1Body is an object list of the HCL (version 1) syntax tree.
+type hcl1Body struct {
+	list *ast.ObjectList
+	// removed collects the comments of the removed items, as the printer
+	// would print them anyway - the file holds all the comments.
+	removed *hcl1Removed
+}
+
+// hcl1Removed is the comments of the removed items: the attached ones,
+// and the lines of the items, with the comments in them.
+type hcl1Removed struct {
+	comments map[*ast.CommentGroup]bool
+	lines    [][2]int
+}
+
+// add the comments of the item.
+func (r *hcl1Removed) add(oi *ast.ObjectItem) {
+	first, last := oi.Pos().Line, 0
+	ast.Walk(oi, func(n ast.Node) (ast.Node, bool) {
+		if n == nil {
+			return n, false
+		}
+		switch x := n.(type) {
+		case *ast.ObjectItem:
+			r.comments[x.LeadComment], r.comments[x.LineComment] = true, true
+		case *ast.LiteralType:
+			r.comments[x.LeadComment], r.comments[x.LineComment] = true, true
+		case *ast.ObjectType:
+			if x.Rbrace.Line > last {
+				last = x.Rbrace.Line
+			}
+		case *ast.ListType:
+			if x.Rbrack.Line > last {
+				last = x.Rbrack.Line
+			}
+		}
+		if n.Pos().Line > last {
+			last = n.Pos().Line
+		}
+		return n, true
+	})
+	r.lines = append(r.lines, [2]int{first, last})
+}
+
+// filter returns the comments which are not removed.
+func (r *hcl1Removed) filter(comments []*ast.CommentGroup) []*ast.CommentGroup {
+	kept := comments[:0]
+Loop:
+	for _, c := range comments {
+		if r.comments[c] {
+			continue
+		}
+		for _, l := range r.lines {
+			if line := c.Pos().Line; l[0] <= line && line <= l[1] {
+				continue Loop
+			}
+		}
+		kept = append(kept, c)
+	}
+	return kept
+}
+
+func (b hcl1Body) items() []hclItem {
+	items := make([]hclItem, 0, len(b.list.Items))
+	for _, oi := range b.list.Items {
+		it := hclItem{path: make([]string, len(oi.Keys)), node: oi}
+		for i, k := range oi.Keys {
+			it.path[i] = fmt.Sprint(k.Token.Value())
+		}
+		if o, ok := oi.Val.(*ast.ObjectType); ok {
+			it.body = hcl1Body{list: o.List, removed: b.removed}
+		}
+		items = append(items, it)
+	}
+	return items
+}
+
+func (b hcl1Body) value(it hclItem) (interface{}, error) {
+	return hcl1Value(it.node.(*ast.ObjectItem).Val)
+}
+
+func hcl1Value(n ast.Node) (interface{}, error) {
+	switch x := n.(type) {
+	case *ast.LiteralType:
+		return x.Token.Value(), nil
+	case *ast.ListType:
+		is := make([]interface{}, len(x.List))
+		for i, n := range x.List {
+			var err error
+			if is[i], err = hcl1Value(n); err != nil {
+				return is, err
+			}
+		}
+		return is, nil
+	case *ast.ObjectType:
+		return hclDecode(hcl1Body{list: x.List})
+	}
+	return nil, errors.Errorf("unknown node %T", n)
+}
+
+func (b hcl1Body) setAttribute(name string, v interface{}) error {
+	if v == nil { // HCL has no null
+		for _, it := range b.items() {
+			if it.body == nil && stringsEqual(it.path, []string{name}) {
+				b.remove(it)
+			}
+		}
+		return nil
+	}
+	n, err := hcl1Node(v)
+	if err != nil {
+		return err
+	}
+	for _, it := range b.items() {
+		if it.body == nil && stringsEqual(it.path, []string{name}) {
+			oi := it.node.(*ast.ObjectItem)
+			// in the same line, to keep the line comment after it
+			if lt, ok := n.(*ast.LiteralType); ok {
+				lt.Token.Pos = oi.Val.Pos()
+			}
+			oi.Val = n
+			return nil
+		}
+	}
+	b.list.Add(&ast.ObjectItem{Keys: hcl1Keys([]string{name}), Assign: hcl1Pos, Val: n})
+	return nil
+}
+
+func (b hcl1Body) remove(it hclItem) {
+	items := b.list.Items[:0]
+	for _, oi := range b.list.Items {
+		if oi != it.node {
+			items = append(items, oi)
+		} else if b.removed != nil {
+			b.removed.add(oi)
+		}
+	}
+	b.list.Items = items
+}
+
+func (b hcl1Body) appendBlock(path []string) hclBody {
+	list := &ast.ObjectList{}
+	b.list.Add(&ast.ObjectItem{Keys: hcl1Keys(path), Val: &ast.ObjectType{List: list}})
+	return hcl1Body{list: list, removed: b.removed}
+}
+
+// hcl1Pos is a valid position for the new nodes, as the printer omits the invalid ones.
+var hcl1Pos = token.Pos{Line: 1, Column: 1}
+
+var rHCLIdent = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// hcl1Keys returns the name (an identifier, if possible) and the quoted labels.
+func hcl1Keys(path []string) []*ast.ObjectKey {
+	keys := make([]*ast.ObjectKey, len(path))
+	for i, k := range path {
+		keys[i] = &ast.ObjectKey{Token: token.Token{Type: token.STRING, Text: strconv.Quote(k)}}
+		if i == 0 && rHCLIdent.MatchString(k) {
+			keys[i].Token = token.Token{Type: token.IDENT, Text: k}
+		}
+	}
+	return keys
+}
+
+// hcl1Node returns the value as an HCL (version 1) syntax tree node.
+func hcl1Node(v interface{}) (ast.Node, error) {
+	switch x := normalizeValue(plainValue(v)).(type) {
 	case string:
-		return token.Token{Type: token.STRING, Text: x}
+		return &ast.LiteralType{Token: token.Token{Type: token.STRING, Text: strconv.Quote(x)}}, nil
 	case bool:
-		return token.Token{Type: token.BOOL, Text: fmt.Sprintf("%t", x)}
-	case int, uint, int8, uint8, int16, uint16, int32, uint32, int64, uint64:
-		return token.Token{Type: token.NUMBER, Text: fmt.Sprintf("%d", v)}
-	case float32, float64:
-		return token.Token{Type: token.FLOAT, Text: fmt.Sprintf("%f", v)}
+		return &ast.LiteralType{Token: token.Token{Type: token.BOOL, Text: strconv.FormatBool(x)}}, nil
+	case int64:
+		return &ast.LiteralType{Token: token.Token{Type: token.NUMBER, Text: strconv.FormatInt(x, 10)}}, nil
+	case uint64:
+		return &ast.LiteralType{Token: token.Token{Type: token.NUMBER, Text: strconv.FormatUint(x, 10)}}, nil
+	case float64:
+		if math.IsInf(x, 0) || math.IsNaN(x) {
+			return nil, errors.Errorf("HCL has no %v", x)
+		}
+		s := strconv.FormatFloat(x, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eE") {
+			s += ".0"
+		}
+		return &ast.LiteralType{Token: token.Token{Type: token.FLOAT, Text: s}}, nil
+	case time.Time:
+		return hcl1Node(x.Format(time.RFC3339Nano))
+	case []interface{}:
+		lt := &ast.ListType{List: make([]ast.Node, 0, len(x))}
+		for _, v := range x {
+			if v == nil {
+				continue
+			}
+			n, err := hcl1Node(v)
+			if err != nil {
+				return lt, err
+			}
+			lt.List = append(lt.List, n)
+		}
+		return lt, nil
+	case map[string]interface{}:
+		body := hcl1Body{list: &ast.ObjectList{}}
+		if err := hclUpdate(body, nil, nil, x); err != nil {
+			return nil, err
+		}
+		return &ast.ObjectType{List: body.list}, nil
 	}
-	panic(fmt.Sprintf("unsupported type %[1]T %[1]v", v))
+	return nil, errors.Errorf("unsupported type %T", v)
 }
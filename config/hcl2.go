@@ -0,0 +1,222 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"io"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/pkg/errors"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// hcl2EncDec is for HCL version 2 (Terraform 0.12+).
+//
+// The attributes with non-constant expressions (references, function calls, templates)
+// are decoded as their source text, and kept as is if unchanged.
+type hcl2EncDec struct{}
+
+func (hcl2EncDec) Decode(r io.Reader) (Config, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Config{}, err
+	}
+	f, diags := hclwrite.ParseConfig(b, "", hcl.InitialPos)
+	if diags.HasErrors() {
+		return Config{}, diags
+	}
+	m, err := hclDecode(hcl2Body{body: f.Body()})
+	if err != nil {
+		return Config{}, err
+	}
+	tt, err := treeFromMap(m)
+	if err != nil {
+		return Config{}, err
+	}
+	return Config{Tree: tt, src: &hclSource{text: b, v2: true, orig: tt.ToMap()}}, nil
+}
+
+func (hcl2EncDec) Encode(w io.Writer, cfg Config) error {
+	src, _ := cfg.src.(*hclSource)
+	if src != nil && !src.v2 {
+		src = nil
+	}
+	b, err := hclRender(src, cfg.Tree.ToMap(), func(orig, cur map[string]interface{}) ([]byte, error) {
+		f := hclwrite.NewFile()
+		if src != nil {
+			var diags hcl.Diagnostics
+			if f, diags = hclwrite.ParseConfig(src.text, "", hcl.InitialPos); diags.HasErrors() {
+				return nil, diags
+			}
+		}
+		if err := hclUpdate(hcl2Body{body: f.Body()}, nil, orig, cur); err != nil {
+			return nil, err
+		}
+		return f.Bytes(), nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// hcl2Body is a body of the HCL (version 2) concrete syntax tree.
+type hcl2Body struct {
+	body *hclwrite.Body
+}
+
+func (b hcl2Body) items() []hclItem {
+	attrs := b.body.Attributes()
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	items := make([]hclItem, 0, len(attrs))
+	for _, name := range names {
+		items = append(items, hclItem{path: []string{name}, node: attrs[name]})
+	}
+	for _, blk := range b.body.Blocks() {
+		items = append(items, hclItem{
+			path: append([]string{blk.Type()}, blk.Labels()...),
+			body: hcl2Body{body: blk.Body()},
+			node: blk,
+		})
+	}
+	return items
+}
+
+func (b hcl2Body) value(it hclItem) (interface{}, error) {
+	src := bytes.TrimSpace(it.node.(*hclwrite.Attribute).Expr().BuildTokens(nil).Bytes())
+	// the closing marker of a heredoc needs the newline
+	if expr, diags := hclsyntax.ParseExpression(append(src, '\n'), "", hcl.InitialPos); !diags.HasErrors() {
+		if v, diags := expr.Value(nil); !diags.HasErrors() && v.IsWhollyKnown() {
+			return ctyToValue(v), nil
+		}
+	}
+	return string(src), nil
+}
+
+func (b hcl2Body) setAttribute(name string, v interface{}) error {
+	val, err := ctyFromValue(v)
+	if err != nil {
+		return err
+	}
+	b.body.SetAttributeValue(name, val)
+	return nil
+}
+
+func (b hcl2Body) remove(it hclItem) {
+	if blk, ok := it.node.(*hclwrite.Block); ok {
+		b.body.RemoveBlock(blk)
+	} else {
+		b.body.RemoveAttribute(it.path[0])
+	}
+}
+
+func (b hcl2Body) appendBlock(path []string) hclBody {
+	if len(b.body.Attributes())+len(b.body.Blocks()) != 0 {
+		b.body.AppendNewline()
+	}
+	return hcl2Body{body: b.body.AppendNewBlock(path[0], path[1:]).Body()}
+}
+
+// ctyToValue converts the cty value to int64, float64, string, bool, nil, []interface{} or map.
+func ctyToValue(v cty.Value) interface{} {
+	if v.IsNull() {
+		return nil
+	}
+	t := v.Type()
+	switch {
+	case t == cty.String:
+		return v.AsString()
+	case t == cty.Bool:
+		return v.True()
+	case t == cty.Number:
+		bf := v.AsBigFloat()
+		if i, acc := bf.Int64(); acc == big.Exact {
+			return i
+		}
+		f, _ := bf.Float64()
+		return f
+	case t.IsListType(), t.IsTupleType(), t.IsSetType():
+		is := make([]interface{}, 0, v.LengthInt())
+		for it := v.ElementIterator(); it.Next(); {
+			_, e := it.Element()
+			is = append(is, ctyToValue(e))
+		}
+		return is
+	case t.IsMapType(), t.IsObjectType():
+		m := make(map[string]interface{}, v.LengthInt())
+		for it := v.ElementIterator(); it.Next(); {
+			k, e := it.Element()
+			m[k.AsString()] = ctyToValue(e)
+		}
+		return m
+	}
+	return v.GoString()
+}
+
+func ctyFromValue(v interface{}) (cty.Value, error) {
+	switch x := normalizeValue(plainValue(v)).(type) {
+	case nil:
+		return cty.NullVal(cty.DynamicPseudoType), nil
+	case string:
+		return cty.StringVal(x), nil
+	case bool:
+		return cty.BoolVal(x), nil
+	case int64:
+		return cty.NumberIntVal(x), nil
+	case uint64:
+		return cty.NumberUIntVal(x), nil
+	case float64:
+		return cty.NumberFloatVal(x), nil
+	case time.Time:
+		return cty.StringVal(x.Format(time.RFC3339Nano)), nil
+	case []interface{}:
+		if len(x) == 0 {
+			return cty.EmptyTupleVal, nil
+		}
+		vals := make([]cty.Value, len(x))
+		for i, v := range x {
+			var err error
+			if vals[i], err = ctyFromValue(v); err != nil {
+				return cty.NilVal, err
+			}
+		}
+		return cty.TupleVal(vals), nil
+	case map[string]interface{}:
+		if len(x) == 0 {
+			return cty.EmptyObjectVal, nil
+		}
+		vals := make(map[string]cty.Value, len(x))
+		for k, v := range x {
+			var err error
+			if vals[k], err = ctyFromValue(v); err != nil {
+				return cty.NilVal, err
+			}
+		}
+		return cty.ObjectVal(vals), nil
+	}
+	return cty.NilVal, errors.Errorf("unsupported type %T", v)
+}
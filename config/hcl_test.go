@@ -0,0 +1,207 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+)
+
+const hcl2Test1 = `# provider
+provider "aws" {
+  region = "us-east-1" # the region
+}
+
+resource "aws_instance" "web" {
+  ami           = var.ami
+  instance_type = "t2.micro"
+  tags = {
+    Name = "web"
+  }
+
+  ebs_block_device {
+    device_name = "/dev/sdb"
+  }
+  ebs_block_device {
+    device_name = "/dev/sdc"
+  }
+  user_data = <<EOT
+#!/bin/sh
+EOT
+}
+`
+
+const hclTest1 = `# job
+job "example" {
+  datacenters = ["dc1"]
+
+  group "cache" {
+    count = 1 // one
+
+    task "redis" {
+      driver = "docker"
+
+      config {
+        image = "redis:3.2"
+      }
+    }
+  }
+
+  constraint {
+    attribute = "a"
+  }
+
+  constraint {
+    attribute = "b"
+  }
+}
+`
+
+func TestHCLEdit(t *testing.T) {
+	for i, tc := range []struct {
+		Type Type
+		Src  string
+		Get  map[string]interface{}
+		Set  map[string]interface{}
+		Del  []string
+		Want string
+	}{
+		{Type: hcl2Enc, Src: hcl2Test1,
+			Get: map[string]interface{}{
+				"resource/aws_instance/web/ami":                            "var.ami",
+				"resource/aws_instance/web/user_data":                      "#!/bin/sh\n",
+				"resource/aws_instance/web/ebs_block_device/1/device_name": "/dev/sdc",
+			},
+			Set: map[string]interface{}{
+				"resource/aws_instance/web/instance_type":                  "t3.large",
+				"resource/aws_instance/web/tags/Env":                       "prod",
+				"resource/aws_instance/web/ebs_block_device/2/device_name": "/dev/sdd",
+				"resource/aws_instance/db/count":                           int64(2),
+			},
+			Del: []string{"provider"},
+			Want: `
+resource "aws_instance" "web" {
+  ami           = var.ami
+  instance_type = "t3.large"
+  tags = {
+    Env  = "prod"
+    Name = "web"
+  }
+
+  ebs_block_device {
+    device_name = "/dev/sdb"
+  }
+  ebs_block_device {
+    device_name = "/dev/sdc"
+  }
+  user_data = <<EOT
+#!/bin/sh
+EOT
+
+  ebs_block_device {
+    device_name = "/dev/sdd"
+  }
+}
+
+resource "aws_instance" "db" {
+  count = 2
+}
+`},
+
+		{Type: hclEnc, Src: hclTest1,
+			Get: map[string]interface{}{
+				"job/example/group/cache/count":                   int64(1),
+				"job/example/group/cache/task/redis/config/image": "redis:3.2",
+				"job/example/constraint/1/attribute":              "b",
+			},
+			Set: map[string]interface{}{
+				"job/example/group/cache/count":      int64(3),
+				"job/example/constraint/1/attribute": "c",
+				"job/example/datacenters/1":          "dc2",
+				"job/example/group/cache/task/web":   map[string]interface{}{"driver": "exec"},
+			},
+			Del: []string{"job", "example", "group", "cache", "task", "redis", "config"},
+			Want: `# job
+job "example" {
+  datacenters = ["dc1", "dc2"]
+
+  group "cache" {
+    count = 3 // one
+
+    task "redis" {
+      driver = "docker"
+    }
+
+    task "web" {
+      driver = "exec"
+    }
+  }
+
+  constraint {
+    attribute = "a"
+  }
+
+  constraint {
+    attribute = "c"
+  }
+}
+`},
+
+		// not canonically formatted: the unchanged lines are kept as is
+		{Type: hcl2Enc, Src: "a   = \"x\"   # c\nb =    1\n\n\nblk \"l\" {\n    c  = 2   // two\n    d = 3\n}\n",
+			Set:  map[string]interface{}{"b": int64(5), "blk/l/d": int64(4), "e": "y"},
+			Del:  []string{"a"},
+			Want: "b = 5\n\n\nblk \"l\" {\n    c  = 2   // two\n    d = 4\n}\ne = \"y\"\n"},
+		{Type: hclEnc, Src: "a   = \"x\"   # c\nb =    1\nblk \"l\" {\n    c  = 2   // two\n    d = 3\n}\nlist = [1,\n  2]\n",
+			Set:  map[string]interface{}{"b": int64(5), "blk/l/d": int64(4), "e": "y"},
+			Del:  []string{"a"},
+			Want: "b = 5\nblk \"l\" {\n    c  = 2   // two\n    d = 4\n}\nlist = [1,\n  2]\n\ne = \"y\"\n"},
+	} {
+		cfg, err := Parser(tc.Type).Decode(strings.NewReader(tc.Src))
+		if err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		var buf strings.Builder
+		if err = Dumper(tc.Type).Encode(&buf, cfg); err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		if d := diff.Diff(buf.String(), tc.Src); d != "" {
+			t.Errorf("%d. round trip: %s", i, d)
+		}
+		for k, want := range tc.Get {
+			if got := cfg.Get(strings.Split(k, "/")); got != want {
+				t.Errorf("%d. %s: got %#v, wanted %#v", i, k, got, want)
+			}
+		}
+		for k, v := range tc.Set {
+			if err = cfg.Set(strings.Split(k, "/"), v); err != nil {
+				t.Fatalf("%d. %s: %+v", i, k, err)
+			}
+		}
+		if err = cfg.Del(tc.Del); err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		buf.Reset()
+		if err = Dumper(tc.Type).Encode(&buf, cfg); err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		if d := diff.Diff(buf.String(), tc.Want); d != "" {
+			t.Errorf("%d. %s", i, d)
+		}
+	}
+}
@@ -16,48 +16,473 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 
 	toml "github.com/pelletier/go-toml"
 	"github.com/pkg/errors"
-	ini "gopkg.in/ini.v1"
 )
 
-type iniEncDec struct{}
+// INIOptions are the options of the ini format.
+type INIOptions struct {
+	// CaseSensitive keeps the case of the section and key names, instead of lowercasing them.
+	CaseSensitive bool
+	// Shadows keeps all the values of a repeated key as a list (like git-config or php.ini's "key[]"),
+	// instead of the last one winning.
+	Shadows bool
+}
+
+// NewINI returns an EncoderDecoder for ini files with the given options.
+//
+// The keys before the first section header are at the top level,
+// so a [DEFAULT] section is just an ordinary "DEFAULT" (or "default") table.
+func NewINI(opts INIOptions) EncoderDecoder { return iniEncDec{opts} }
+
+type iniEncDec struct{ INIOptions }
+
+// name returns the section or key name as it is in the tree.
+func (ed iniEncDec) name(s string) string {
+	if ed.CaseSensitive {
+		return s
+	}
+	return strings.ToLower(s)
+}
 
 func (ed iniEncDec) Decode(r io.Reader) (Config, error) {
 	b, err := io.ReadAll(r)
 	if err != nil {
 		return Config{}, err
 	}
-	f, err := ini.InsensitiveLoad(b)
-	if err != nil {
-		return Config{}, errors.Wrap(err, string(b))
-	}
-	tt, err := toml.TreeFromMap(make(map[string]interface{}))
+	f, err := parseINI(b)
 	if err != nil {
-		return Config{Tree: tt}, err
+		return Config{}, err
 	}
-	for _, section := range f.Sections() {
-		path := []string{section.Name(), ""}[:1]
-		for _, key := range section.Keys() {
-			tt.SetPath(append(path, key.Name()), key.String())
+	m := make(map[string]interface{})
+	for _, section := range f.Sections {
+		values := m
+		if section.Name != "" {
+			name := ed.name(section.Name)
+			var ok bool
+			if values, ok = m[name].(map[string]interface{}); !ok {
+				if _, isValue := m[name]; isValue {
+					return Config{}, errors.Errorf("%q is both a key and a section", name)
+				}
+				values = make(map[string]interface{})
+				m[name] = values
+			}
+		}
+		for _, line := range section.Lines {
+			if line.Key == "" {
+				continue
+			}
+			k := ed.name(line.Key)
+			switch x := values[k].(type) {
+			case string:
+				if ed.Shadows {
+					values[k] = []interface{}{x, line.Value}
+				} else {
+					values[k] = line.Value
+				}
+			case []interface{}:
+				values[k] = append(x, line.Value)
+			default:
+				values[k] = line.Value
+			}
 		}
 	}
-	return Config{Tree: tt}, nil
+	tt, err := treeFromMap(m)
+	return Config{Tree: tt, src: f}, err
 }
+
+// Encode the Config as an ini file.
+//
+// If the Config has been decoded from an ini file, then the unchanged lines
+// (comments, blank lines, keys) are written back as is, only the changed
+// key lines are rewritten, and the new keys are appended to their sections.
 func (ed iniEncDec) Encode(w io.Writer, cfg Config) error {
-	f := ini.Empty()
-	for _, key := range cfg.Keys() {
-		var section string
-		k := key
-		if i := strings.LastIndexByte(key, keyDelim[0]); i >= 0 {
-			section, k = key[:i], key[i+1:]
+	f, _ := cfg.src.(*iniFile)
+	if f == nil {
+		f = &iniFile{Sections: []*iniSection{{}}}
+	}
+	ew := newErrWriter(w)
+	ed.writeTo(ew, f, ed.sections(cfg.Tree))
+	return errors.Wrap(ew.Err(), "write ini")
+}
+
+// iniFile is the concrete syntax tree of an ini file.
+//
+// The first section is always the one of the keys before the first section header.
+type iniFile struct {
+	Sections []*iniSection
+}
+
+// iniSection is a section of an ini file: the header line (if Name is not empty),
+// and all the following lines up to the next section header.
+type iniSection struct {
+	Name  string
+	Lines []iniLine
+}
+
+// iniLine is one logical line of an ini file, with all its physical lines in Raw.
+type iniLine struct {
+	// Raw is the original text, including the line ending.
+	Raw string
+	// Key is empty for comments, blank lines and section headers.
+	Key string
+	// Value is the decoded (unquoted) value.
+	Value string
+	// prefix is Raw up to the value ("key = "),
+	// suffix is Raw after the value (closing quote, inline comment, line ending).
+	prefix, suffix string
+}
+
+func parseINI(b []byte) (*iniFile, error) {
+	f := &iniFile{Sections: []*iniSection{{}}}
+	section := f.Sections[0]
+	lines := splitLines(string(b))
+	for i := 0; i < len(lines); i++ {
+		raw := lines[i]
+		content, nl := chompLine(raw)
+		trimmed := strings.TrimSpace(content)
+		if trimmed == "" || trimmed[0] == '#' || trimmed[0] == ';' {
+			section.Lines = append(section.Lines, iniLine{Raw: raw})
+			continue
+		}
+		if trimmed[0] == '[' {
+			j := strings.IndexByte(trimmed, ']')
+			if j < 0 {
+				return f, errors.Errorf("%d: unclosed section header %q", i+1, trimmed)
+			}
+			section = &iniSection{Name: strings.TrimSpace(trimmed[1:j])}
+			section.Lines = append(section.Lines, iniLine{Raw: raw})
+			f.Sections = append(f.Sections, section)
+			continue
+		}
+		line, n, err := parseINIKeyLine(lines[i:], content, nl)
+		if err != nil {
+			return f, errors.Wrapf(err, "%d", i+1)
+		}
+		i += n - 1
+		section.Lines = append(section.Lines, line)
+	}
+	return f, nil
+}
+
+// parseINIKeyLine parses the key line, which may continue in the following lines.
+// Returns the number of physical lines consumed.
+func parseINIKeyLine(lines []string, content, nl string) (iniLine, int, error) {
+	line := iniLine{Raw: lines[0]}
+	start := len(content) - len(strings.TrimLeft(content, " \t"))
+	rest := content[start:]
+	var keyEnd int
+	if q := rest[0]; q == '"' || q == '`' {
+		j := strings.IndexByte(rest[1:], q)
+		if j < 0 {
+			return line, 1, errors.Errorf("unclosed quoted key in %q", content)
+		}
+		line.Key, keyEnd = rest[1:j+1], j+2
+	}
+	d := strings.IndexAny(rest[keyEnd:], "=:")
+	if d < 0 {
+		return line, 1, errors.Errorf("delimiter(=:) not found in %q", content)
+	}
+	d += keyEnd
+	if keyEnd == 0 {
+		line.Key = strings.TrimSpace(rest[:d])
+	}
+	off := start + d + 1
+	v := content[off:]
+	off += len(v) - len(strings.TrimLeft(v, " \t"))
+	v = content[off:]
+	line.prefix = content[:off]
+
+	switch {
+	case strings.HasPrefix(v, `"""`):
+		// multi-line value
+		var buf strings.Builder
+		v = v[3:]
+		n := 1
+		for {
+			if j := strings.Index(v, `"""`); j >= 0 {
+				buf.WriteString(v[:j])
+				line.Value, line.suffix = buf.String(), v[j:]+nl
+				line.Raw = strings.Join(lines[:n], "")
+				return line, n, nil
+			}
+			if n == len(lines) {
+				return line, n, errors.Errorf("unclosed multi-line value of %q", line.Key)
+			}
+			buf.WriteString(v)
+			buf.WriteString("\n")
+			v, nl = chompLine(lines[n])
+			n++
+		}
+
+	case strings.HasPrefix(v, `"`), strings.HasPrefix(v, "`"):
+		if j := strings.IndexByte(v[1:], v[0]); j >= 0 {
+			line.Value, line.suffix = v[1:j+1], v[j+1:]+nl
+			return line, 1, nil
+		}
+	}
+
+	if j := strings.IndexAny(v, "#;"); j >= 0 {
+		v = v[:j]
+	}
+	line.Value = strings.TrimRight(v, " \t")
+	line.suffix = content[off+len(line.Value):] + nl
+	n := 1
+	// continuation lines
+	for strings.HasSuffix(line.Value, `\`) && n < len(lines) && line.suffix == nl {
+		var next string
+		next, nl = chompLine(lines[n])
+		n++
+		line.Value = line.Value[:len(line.Value)-1] + strings.TrimSpace(next)
+		line.Raw += lines[n-1]
+		line.suffix = nl
+	}
+	return line, n, nil
+}
+
+// sections returns the sections of the tree, with the string values of each key.
+//
+// Top-level simple values are put into the section without a header (""),
+// nested tables are flattened into "parent.child" named sections.
+// A list is one value, unless Shadows is set.
+func (ed iniEncDec) sections(tt *toml.Tree) map[string]map[string][]string {
+	sections := map[string]map[string][]string{"": {}}
+	put := func(name, k string, values []string) {
+		m := sections[name]
+		if m == nil {
+			m = make(map[string][]string)
+			sections[name] = m
+		}
+		m[k] = values
+	}
+	var add func(name string, tt *toml.Tree)
+	add = func(name string, tt *toml.Tree) {
+		for _, k := range tt.Keys() {
+			sub := k
+			if name != "" {
+				sub = name + "." + k
+			}
+			switch x := tt.GetPath([]string{k}).(type) {
+			case *toml.Tree:
+				if len(x.Keys()) == 0 {
+					sections[sub] = make(map[string][]string)
+				}
+				add(sub, x)
+			case []*toml.Tree:
+				for i, t := range x {
+					add(fmt.Sprintf("%s.%d", sub, i), t)
+				}
+			case []interface{}:
+				if !ed.Shadows {
+					put(name, k, []string{FormatValue(x)})
+					break
+				}
+				values := make([]string, len(x))
+				for i, v := range x {
+					values[i] = FormatValue(v)
+				}
+				put(name, k, values)
+			default:
+				put(name, k, []string{FormatValue(x)})
+			}
 		}
-		f.Section(section).Key(k).SetValue(fmt.Sprintf("%v", cfg.Get([]string{key})))
 	}
-	_, err := f.WriteToIndent(w, "  ")
-	return errors.Wrap(err, "WriteToIndent")
+	add("", tt)
+	return sections
+}
+
+// iniRef is the place of a key line: the indexes of its section and line.
+type iniRef struct{ section, line int }
+
+func (ed iniEncDec) writeTo(w io.Writer, f *iniFile, sections map[string]map[string][]string) {
+	keys := make(map[[2]string][]iniRef)
+	lastSection := make(map[string]int)
+	for i, section := range f.Sections {
+		name := ed.name(section.Name)
+		lastSection[name] = i
+		for j, line := range section.Lines {
+			if line.Key != "" {
+				k := [2]string{name, ed.name(line.Key)}
+				keys[k] = append(keys[k], iniRef{i, j})
+			}
+		}
+	}
+	// the plan for each key line: the current values to be written in its place.
+	// Without Shadows, only the last line of a key holds its value.
+	type plan struct {
+		refs  []iniRef
+		first int
+		emit  [][]int
+		pair  []int
+		vals  []string
+	}
+	plans := make(map[iniRef]*plan)
+	for k, refs := range keys {
+		vals, ok := sections[k[0]][k[1]]
+		if !ok {
+			continue
+		}
+		p := &plan{refs: refs, vals: vals}
+		if !ed.Shadows {
+			p.first = len(refs) - 1
+		}
+		origs := make([]string, 0, len(refs)-p.first)
+		for _, ref := range refs[p.first:] {
+			origs = append(origs, f.Sections[ref.section].Lines[ref.line].Value)
+		}
+		p.emit, p.pair = alignLists(len(origs), len(vals), func(i, j int) bool { return origs[i] == vals[j] })
+		for _, ref := range refs {
+			plans[ref] = p
+		}
+	}
+	writeNew := func(buf *bytes.Buffer, indent, name string) {
+		values := sections[name]
+		names := make([]string, 0, len(values))
+		for k := range values {
+			if _, ok := keys[[2]string{name, ed.name(k)}]; !ok {
+				names = append(names, k)
+			}
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			for _, v := range values[k] {
+				fmt.Fprintf(buf, "%s%s = %s\n", indent, k, iniQuote(v))
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	for i, section := range f.Sections {
+		name := ed.name(section.Name)
+		if _, ok := sections[name]; !ok && section.Name != "" {
+			// deleted section
+			continue
+		}
+		insertAt, indent := len(section.Lines), ""
+		if section.Name != "" {
+			insertAt = 1
+		}
+		for j, line := range section.Lines {
+			if line.Key != "" {
+				insertAt = j + 1
+				indent = line.prefix[:len(line.prefix)-len(strings.TrimLeft(line.prefix, " \t"))]
+			}
+		}
+		for j, line := range section.Lines {
+			if line.Key == "" {
+				buf.WriteString(line.Raw)
+			} else if p := plans[iniRef{i, j}]; p != nil {
+				n := 0
+				for n < len(p.refs) && p.refs[n] != (iniRef{i, j}) {
+					n++
+				}
+				if n < p.first {
+					buf.WriteString(line.Raw)
+				} else {
+					for _, k := range p.emit[n-p.first] {
+						if k != p.pair[n-p.first] {
+							ensureNewline(&buf)
+							fmt.Fprintf(&buf, "%s%s = %s\n", indent, line.Key, iniQuote(p.vals[k]))
+						} else if p.vals[k] == line.Value {
+							buf.WriteString(line.Raw)
+						} else {
+							buf.WriteString(line.prefix)
+							buf.WriteString(iniQuote(p.vals[k]))
+							buf.WriteString(line.suffix)
+						}
+					}
+				}
+			}
+			if j == insertAt-1 && lastSection[name] == i {
+				ensureNewline(&buf)
+				writeNew(&buf, indent, name)
+			}
+		}
+		if insertAt == 0 && lastSection[name] == i {
+			writeNew(&buf, "", name)
+		}
+	}
+
+	// new sections
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		if _, ok := lastSection[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ensureNewline(&buf)
+		if b := buf.Bytes(); len(b) != 0 && !bytes.HasSuffix(b, []byte("\n\n")) && !bytes.HasSuffix(b, []byte("\n\r\n")) {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "[%s]\n", name)
+		writeNew(&buf, "", name)
+	}
+	w.Write(buf.Bytes())
+}
+
+// iniQuote quotes the value if it would not survive a round trip unquoted.
+func iniQuote(s string) string {
+	if strings.Contains(s, "\n") {
+		return `"""` + s + `"""`
+	}
+	if s == "" || (!strings.ContainsAny(s, "#;\\") &&
+		strings.TrimSpace(s) == s && s[0] != '"' && s[0] != '`') {
+		return s
+	}
+	if !strings.Contains(s, `"`) {
+		return `"` + s + `"`
+	}
+	if !strings.Contains(s, "`") {
+		return "`" + s + "`"
+	}
+	return `"""` + s + `"""`
+}
+
+// splitLines splits s into lines, keeping the line endings.
+func splitLines(s string) []string {
+	lines := make([]string, 0, strings.Count(s, "\n")+1)
+	for len(s) != 0 {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			lines = append(lines, s)
+			break
+		}
+		lines = append(lines, s[:i+1])
+		s = s[i+1:]
+	}
+	return lines
+}
+
+// chompLine returns the line without, and the line ending.
+func chompLine(line string) (string, string) {
+	if strings.HasSuffix(line, "\r\n") {
+		return line[:len(line)-2], "\r\n"
+	}
+	if strings.HasSuffix(line, "\n") {
+		return line[:len(line)-1], "\n"
+	}
+	return line, ""
+}
+
+func ensureNewline(buf *bytes.Buffer) {
+	if b := buf.Bytes(); len(b) != 0 && b[len(b)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
@@ -0,0 +1,200 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+	"github.com/pkg/errors"
+)
+
+const iniTest1 = `; global settings
+app_mode = development
+
+[paths]
+# Path to where grafana can store temp files
+data = /var/lib/grafana   ; inline comment
+logs = "/var/log/grafana;x"
+
+[Server]
+protocol = http
+
+http_port = 3000
+multi = """first
+second"""
+continued = a\
+  b
+[empty]
+`
+
+func TestINIRoundTrip(t *testing.T) {
+	var ed iniEncDec
+	cfg, err := ed.Decode(strings.NewReader(iniTest1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"app_mode":         "development",
+		"paths/data":       "/var/lib/grafana",
+		"paths/logs":       "/var/log/grafana;x",
+		"server/multi":     "first\nsecond",
+		"server/continued": "ab",
+		"server/http_port": "3000",
+	} {
+		if got := cfg.Get(strings.Split(path, "/")); got != want {
+			t.Errorf("%s: got %q, wanted %q", path, got, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := ed.Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d := diff.Diff(iniTest1, buf.String()); d != "" {
+		t.Errorf("unchanged round trip:\n%s", d)
+	}
+
+	cfg.Set([]string{"paths", "data"}, "/srv/grafana")
+	cfg.Set([]string{"server", "domain"}, "example.com")
+	cfg.Set([]string{"new", "key"}, "value")
+	buf.Reset()
+	if err := ed.Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(
+		strings.Replace(iniTest1,
+			"data = /var/lib/grafana   ;", "data = /srv/grafana   ;", 1),
+		"continued = a\\\n  b\n", "continued = a\\\n  b\ndomain = example.com\n", 1,
+	) + "\n[new]\nkey = value\n"
+	if d := diff.Diff(want, buf.String()); d != "" {
+		t.Errorf("changed:\n%s", d)
+	}
+}
+
+func TestINIDelete(t *testing.T) {
+	var ed iniEncDec
+	cfg, err := ed.Decode(strings.NewReader(iniTest1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"paths/logs", "server", "app_mode"} {
+		if err = cfg.Del(strings.Split(k, "/")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = cfg.Del([]string{"nope"}); errors.Cause(err) != ErrNotFound {
+		t.Errorf("got %v, wanted ErrNotFound", err)
+	}
+	var buf bytes.Buffer
+	if err := ed.Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := `; global settings
+
+[paths]
+# Path to where grafana can store temp files
+data = /var/lib/grafana   ; inline comment
+
+[empty]
+`
+	if d := diff.Diff(want, buf.String()); d != "" {
+		t.Error(d)
+	}
+}
+
+const iniTest2 = `[DEFAULT]
+ServerAliveInterval = 45
+
+[core]
+	editor = vim
+	Editor = nano
+[remote "origin"]
+	fetch = +refs/heads/*:refs/remotes/origin/*
+	fetch = +refs/tags/*:refs/tags/*
+`
+
+func TestINICaseSensitiveShadows(t *testing.T) {
+	ed := NewINI(INIOptions{CaseSensitive: true, Shadows: true})
+	cfg, err := ed.Decode(strings.NewReader(iniTest2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]interface{}{
+		"DEFAULT/ServerAliveInterval": "45",
+		"core/editor":                 "vim",
+		"core/Editor":                 "nano",
+		`remote "origin"/fetch`:       []interface{}{"+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"},
+	} {
+		if got := cfg.Get(strings.Split(path, "/")); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, wanted %#v", path, got, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = ed.Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d := diff.Diff(iniTest2, buf.String()); d != "" {
+		t.Errorf("unchanged round trip:\n%s", d)
+	}
+
+	for k, v := range map[string]interface{}{
+		"DEFAULT/Compression":   "yes",
+		"core/Editor":           "emacs",
+		`remote "origin"/fetch`: []interface{}{"+refs/heads/*:refs/remotes/origin/*", "+refs/notes/*:refs/notes/*", "+refs/tags/*:refs/tags/*"},
+	} {
+		if err = cfg.Set(strings.Split(k, "/"), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.Reset()
+	if err = ed.Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := `[DEFAULT]
+ServerAliveInterval = 45
+Compression = yes
+
+[core]
+	editor = vim
+	Editor = emacs
+[remote "origin"]
+	fetch = +refs/heads/*:refs/remotes/origin/*
+	fetch = +refs/notes/*:refs/notes/*
+	fetch = +refs/tags/*:refs/tags/*
+`
+	if d := diff.Diff(want, buf.String()); d != "" {
+		t.Errorf("changed:\n%s", d)
+	}
+
+	// without the options, the names are lowercased and the last value wins
+	if cfg, err = Parser(iniEnc).Decode(strings.NewReader(iniTest2)); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]interface{}{
+		"default/serveraliveinterval": "45",
+		"core/editor":                 "nano",
+		`remote "origin"/fetch`:       "+refs/tags/*:refs/tags/*",
+	} {
+		if got := cfg.Get(strings.Split(path, "/")); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, wanted %#v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,684 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	toml "github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+)
+
+// Query is a compiled JSONPath expression.
+//
+// Supported are the child (.name, ['name'], [0], [-1]), wildcard (.*, [*]),
+// recursive descent (..name, ..*, ..[0]), union ([0,2], ['a','b']),
+// slice ([start:end:step]) and filter ([?(@.port > 1024 && @.host =~ /^a/)]) selectors.
+type Query struct {
+	src   string
+	steps []jpStep
+}
+
+// Match is a node selected by a Query.
+type Match struct {
+	// Path is the key of the node, usable with Get, Set and Del.
+	Path  []string
+	Value interface{}
+}
+
+type jpStep struct {
+	recursive bool
+	selectors []jpSelector
+}
+
+type jpSelector struct {
+	kind   jpKind
+	name   string
+	index  int
+	slice  [3]*int
+	filter jpExpr
+}
+
+type jpKind uint8
+
+const (
+	jpName = jpKind(iota)
+	jpWildcard
+	jpIndex
+	jpSlice
+	jpFilter
+)
+
+// CompileQuery compiles the JSONPath expression, which must start with "$".
+func CompileQuery(expr string) (*Query, error) {
+	p := jpParser{s: expr}
+	p.skipSpace()
+	if !p.consume("$") {
+		return nil, errors.Errorf("%q: JSONPath must start with $", expr)
+	}
+	steps, err := p.steps()
+	if err != nil {
+		return nil, errors.Wrap(err, expr)
+	}
+	if p.skipSpace(); p.i != len(p.s) {
+		return nil, errors.Errorf("%q: unexpected %q at %d", expr, p.s[p.i:], p.i)
+	}
+	return &Query{src: expr, steps: steps}, nil
+}
+
+func (q *Query) String() string { return q.src }
+
+// Match returns the nodes under root selected by the query.
+func (q *Query) Match(root interface{}) []Match {
+	return matchSteps(q.steps, root, []Match{{Value: root}})
+}
+
+// parent returns the query without its last step, and the name of that last step,
+// if it is a simple child name selector - nil otherwise.
+func (q *Query) parent() (*Query, string) {
+	if len(q.steps) == 0 {
+		return nil, ""
+	}
+	last := q.steps[len(q.steps)-1]
+	if last.recursive || len(last.selectors) != 1 || last.selectors[0].kind != jpName {
+		return nil, ""
+	}
+	return &Query{src: q.src, steps: q.steps[:len(q.steps)-1]}, last.selectors[0].name
+}
+
+func matchSteps(steps []jpStep, root interface{}, matches []Match) []Match {
+	for _, step := range steps {
+		var next []Match
+		for _, m := range matches {
+			if step.recursive {
+				walk(m.Value, m.Path, func(path []string, v interface{}) bool {
+					next = step.apply(next, root, Match{Path: path, Value: v})
+					return true
+				})
+			} else {
+				next = step.apply(next, root, m)
+			}
+		}
+		matches = next
+	}
+	return matches
+}
+
+func (step jpStep) apply(dst []Match, root interface{}, m Match) []Match {
+	child := func(k string, v interface{}) Match {
+		return Match{Path: append(append(make([]string, 0, len(m.Path)+1), m.Path...), k), Value: v}
+	}
+	for _, sel := range step.selectors {
+		switch sel.kind {
+		case jpName:
+			var v interface{}
+			switch x := m.Value.(type) {
+			case *toml.Tree:
+				v = x.GetPath([]string{sel.name})
+			case map[string]interface{}:
+				v = x[sel.name]
+			}
+			if v != nil {
+				dst = append(dst, child(sel.name, v))
+			}
+		case jpWildcard, jpFilter:
+			jpChildren(m.Value, func(k string, v interface{}) {
+				if sel.kind == jpWildcard || jpTruthy(sel.filter.eval(root, v)) {
+					dst = append(dst, child(k, v))
+				}
+			})
+		case jpIndex:
+			n := jpLen(m.Value)
+			i := sel.index
+			if i < 0 {
+				i += n
+			}
+			if i >= 0 && i < n {
+				dst = append(dst, child(strconv.Itoa(i), getPath(m.Value, []string{strconv.Itoa(i)})))
+			}
+		case jpSlice:
+			n := jpLen(m.Value)
+			if n < 0 {
+				continue
+			}
+			start, end, step := 0, n, 1
+			if sel.slice[2] != nil {
+				step = *sel.slice[2]
+			}
+			if step == 0 {
+				continue
+			}
+			if step < 0 {
+				start, end = n-1, -n-1
+			}
+			norm := func(i int) int {
+				if i < 0 {
+					return i + n
+				}
+				return i
+			}
+			if sel.slice[0] != nil {
+				start = norm(*sel.slice[0])
+			}
+			if sel.slice[1] != nil {
+				end = norm(*sel.slice[1])
+			}
+			for i := start; (step > 0 && i < end && i < n) || (step < 0 && i > end && i >= 0); i += step {
+				if i >= 0 && i < n {
+					dst = append(dst, child(strconv.Itoa(i), getPath(m.Value, []string{strconv.Itoa(i)})))
+				}
+			}
+		}
+	}
+	return dst
+}
+
+// jpChildren calls f for each child of the node, in order.
+func jpChildren(node interface{}, f func(k string, v interface{})) {
+	switch x := node.(type) {
+	case *toml.Tree:
+		keys := x.Keys()
+		sort.Strings(keys)
+		for _, k := range keys {
+			f(k, x.GetPath([]string{k}))
+		}
+	case []*toml.Tree:
+		for i, t := range x {
+			f(strconv.Itoa(i), t)
+		}
+	case []interface{}:
+		for i, v := range x {
+			f(strconv.Itoa(i), v)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			f(k, x[k])
+		}
+	}
+}
+
+func jpLen(node interface{}) int {
+	switch x := node.(type) {
+	case []*toml.Tree:
+		return len(x)
+	case []interface{}:
+		return len(x)
+	}
+	return -1
+}
+
+// comparePaths orders the paths element-wise, the numeric elements by value.
+func comparePaths(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		x, errX := strconv.Atoi(a[i])
+		y, errY := strconv.Atoi(b[i])
+		if errX == nil && errY == nil {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+		if a[i] < b[i] {
+			return -1
+		}
+		return 1
+	}
+	return len(a) - len(b)
+}
+
+//
+// filter expressions
+//
+
+type jpExpr interface {
+	eval(root, current interface{}) interface{}
+}
+
+type jpLiteral struct{ v interface{} }
+
+func (e jpLiteral) eval(_, _ interface{}) interface{} { return e.v }
+
+// jpPath is a relative (@) or absolute ($) path in a filter.
+type jpPath struct {
+	absolute bool
+	steps    []jpStep
+}
+
+// jpNothing is the value of a path selecting nothing.
+type jpNothing struct{}
+
+func (e jpPath) eval(root, current interface{}) interface{} {
+	if e.absolute {
+		current = root
+	}
+	ms := matchSteps(e.steps, root, []Match{{Value: current}})
+	if len(ms) == 0 {
+		return jpNothing{}
+	}
+	return plainValue(ms[0].Value)
+}
+
+type jpNot struct{ e jpExpr }
+
+func (e jpNot) eval(root, current interface{}) interface{} { return !jpTruthy(e.e.eval(root, current)) }
+
+type jpBinary struct {
+	op   string
+	a, b jpExpr
+	re   *regexp.Regexp
+}
+
+func (e jpBinary) eval(root, current interface{}) interface{} {
+	a := e.a.eval(root, current)
+	switch e.op {
+	case "&&":
+		return jpTruthy(a) && jpTruthy(e.b.eval(root, current))
+	case "||":
+		return jpTruthy(a) || jpTruthy(e.b.eval(root, current))
+	case "=~":
+		s, ok := a.(string)
+		return ok && e.re.MatchString(s)
+	}
+	b := e.b.eval(root, current)
+	if _, ok := a.(jpNothing); ok {
+		return false
+	}
+	if _, ok := b.(jpNothing); ok {
+		return false
+	}
+	switch e.op {
+	case "==":
+		return jpEqual(a, b)
+	case "!=":
+		return !jpEqual(a, b)
+	}
+	c, ok := jpCompare(a, b)
+	if !ok {
+		return false
+	}
+	switch e.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func jpEqual(a, b interface{}) bool {
+	if c, ok := jpCompare(a, b); ok {
+		return c == 0
+	}
+	return jsonEqual(a, b)
+}
+
+func jpCompare(a, b interface{}) (int, bool) {
+	if f, ok := asFloat(a); ok {
+		if g, ok := asFloat(b); ok {
+			switch {
+			case f < g:
+				return -1, true
+			case f > g:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	s, ok := a.(string)
+	if !ok {
+		return 0, false
+	}
+	t, ok := b.(string)
+	if !ok {
+		return 0, false
+	}
+	return strings.Compare(s, t), true
+}
+
+func jpTruthy(v interface{}) bool {
+	switch x := v.(type) {
+	case jpNothing:
+		return false
+	case bool:
+		return x
+	}
+	return true
+}
+
+//
+// parser
+//
+
+type jpParser struct {
+	s string
+	i int
+}
+
+func (p *jpParser) skipSpace() {
+	for p.i < len(p.s) && unicode.IsSpace(rune(p.s[p.i])) {
+		p.i++
+	}
+}
+
+func (p *jpParser) consume(tok string) bool {
+	if strings.HasPrefix(p.s[p.i:], tok) {
+		p.i += len(tok)
+		return true
+	}
+	return false
+}
+
+func (p *jpParser) peek() byte {
+	if p.i < len(p.s) {
+		return p.s[p.i]
+	}
+	return 0
+}
+
+// steps parses the steps after $ or @.
+func (p *jpParser) steps() ([]jpStep, error) {
+	var steps []jpStep
+	for p.i < len(p.s) {
+		var step jpStep
+		switch {
+		case p.consume(".."):
+			step.recursive = true
+			if p.peek() == '[' {
+				p.i++
+				sels, err := p.bracket()
+				if err != nil {
+					return steps, err
+				}
+				step.selectors = sels
+			} else {
+				sel, err := p.dotSelector()
+				if err != nil {
+					return steps, err
+				}
+				step.selectors = []jpSelector{sel}
+			}
+		case p.consume("."):
+			sel, err := p.dotSelector()
+			if err != nil {
+				return steps, err
+			}
+			step.selectors = []jpSelector{sel}
+		case p.consume("["):
+			sels, err := p.bracket()
+			if err != nil {
+				return steps, err
+			}
+			step.selectors = sels
+		default:
+			return steps, nil
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func (p *jpParser) dotSelector() (jpSelector, error) {
+	if p.consume("*") {
+		return jpSelector{kind: jpWildcard}, nil
+	}
+	start := p.i
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		if c == '.' || c == '[' || c == ' ' || c == ')' || c == '=' || c == '!' || c == '<' || c == '>' || c == '&' || c == '|' || c == ',' || c == ']' {
+			break
+		}
+		p.i++
+	}
+	if p.i == start {
+		return jpSelector{}, errors.Errorf("empty name at %d", start)
+	}
+	return jpSelector{kind: jpName, name: p.s[start:p.i]}, nil
+}
+
+// bracket parses the selectors after a "[", up to and including the "]".
+func (p *jpParser) bracket() ([]jpSelector, error) {
+	var sels []jpSelector
+	for {
+		p.skipSpace()
+		var sel jpSelector
+		switch c := p.peek(); {
+		case c == '*':
+			p.i++
+			sel.kind = jpWildcard
+		case c == '\'' || c == '"':
+			s, err := p.quoted()
+			if err != nil {
+				return sels, err
+			}
+			sel.kind, sel.name = jpName, s
+		case c == '?':
+			p.i++
+			p.skipSpace()
+			paren := p.consume("(")
+			e, err := p.orExpr()
+			if err != nil {
+				return sels, err
+			}
+			p.skipSpace()
+			if paren && !p.consume(")") {
+				return sels, errors.Errorf("missing ) at %d", p.i)
+			}
+			sel.kind, sel.filter = jpFilter, e
+		default:
+			var nums [3]*int
+			var colons int
+			for k := 0; k < 3; k++ {
+				p.skipSpace()
+				if n, ok := p.integer(); ok {
+					nums[k] = &n
+				}
+				p.skipSpace()
+				if k == 2 || !p.consume(":") {
+					break
+				}
+				colons++
+			}
+			if colons == 0 {
+				if nums[0] == nil {
+					return sels, errors.Errorf("bad selector at %d", p.i)
+				}
+				sel.kind, sel.index = jpIndex, *nums[0]
+			} else {
+				sel.kind, sel.slice = jpSlice, nums
+			}
+		}
+		sels = append(sels, sel)
+		p.skipSpace()
+		if p.consume("]") {
+			return sels, nil
+		}
+		if !p.consume(",") {
+			return sels, errors.Errorf("expected , or ] at %d", p.i)
+		}
+	}
+}
+
+func (p *jpParser) integer() (int, bool) {
+	start := p.i
+	if p.peek() == '-' {
+		p.i++
+	}
+	for p.i < len(p.s) && p.s[p.i] >= '0' && p.s[p.i] <= '9' {
+		p.i++
+	}
+	n, err := strconv.Atoi(p.s[start:p.i])
+	if err != nil {
+		p.i = start
+		return 0, false
+	}
+	return n, true
+}
+
+func (p *jpParser) quoted() (string, error) {
+	q := p.s[p.i]
+	var buf strings.Builder
+	for p.i++; p.i < len(p.s); p.i++ {
+		c := p.s[p.i]
+		if c == '\\' && p.i+1 < len(p.s) {
+			p.i++
+			buf.WriteByte(p.s[p.i])
+			continue
+		}
+		if c == q {
+			p.i++
+			return buf.String(), nil
+		}
+		buf.WriteByte(c)
+	}
+	return "", errors.Errorf("unclosed string")
+}
+
+func (p *jpParser) orExpr() (jpExpr, error) {
+	a, err := p.andExpr()
+	if err != nil {
+		return a, err
+	}
+	for p.skipSpace(); p.consume("||"); p.skipSpace() {
+		b, err := p.andExpr()
+		if err != nil {
+			return b, err
+		}
+		a = jpBinary{op: "||", a: a, b: b}
+	}
+	return a, nil
+}
+
+func (p *jpParser) andExpr() (jpExpr, error) {
+	a, err := p.cmpExpr()
+	if err != nil {
+		return a, err
+	}
+	for p.skipSpace(); p.consume("&&"); p.skipSpace() {
+		b, err := p.cmpExpr()
+		if err != nil {
+			return b, err
+		}
+		a = jpBinary{op: "&&", a: a, b: b}
+	}
+	return a, nil
+}
+
+func (p *jpParser) cmpExpr() (jpExpr, error) {
+	a, err := p.operand()
+	if err != nil {
+		return a, err
+	}
+	p.skipSpace()
+	for _, op := range []string{"==", "!=", "<=", ">=", "=~", "<", ">"} {
+		if !p.consume(op) {
+			continue
+		}
+		p.skipSpace()
+		if op == "=~" {
+			var pattern string
+			if p.peek() == '/' {
+				end := p.i + 1
+				for ; end < len(p.s); end++ {
+					if p.s[end] == '\\' {
+						end++
+						continue
+					}
+					if p.s[end] == '/' {
+						break
+					}
+				}
+				if end >= len(p.s) {
+					return nil, errors.Errorf("unclosed regexp at %d", p.i)
+				}
+				pattern, p.i = p.s[p.i+1:end], end+1
+			} else if pattern, err = p.quoted(); err != nil {
+				return nil, err
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+			return jpBinary{op: op, a: a, re: re}, nil
+		}
+		b, err := p.operand()
+		if err != nil {
+			return b, err
+		}
+		return jpBinary{op: op, a: a, b: b}, nil
+	}
+	return a, nil
+}
+
+func (p *jpParser) operand() (jpExpr, error) {
+	p.skipSpace()
+	switch c := p.peek(); {
+	case c == '!':
+		p.i++
+		e, err := p.operand()
+		return jpNot{e: e}, err
+	case c == '(':
+		p.i++
+		e, err := p.orExpr()
+		if err != nil {
+			return e, err
+		}
+		p.skipSpace()
+		if !p.consume(")") {
+			return e, errors.Errorf("missing ) at %d", p.i)
+		}
+		return e, nil
+	case c == '@' || c == '$':
+		p.i++
+		steps, err := p.steps()
+		if err != nil {
+			return nil, err
+		}
+		return jpPath{absolute: c == '$', steps: steps}, nil
+	case c == '\'' || c == '"':
+		s, err := p.quoted()
+		return jpLiteral{v: s}, err
+	}
+	start := p.i
+	for p.i < len(p.s) && strings.IndexByte(" )&|=!<>", p.s[p.i]) < 0 {
+		p.i++
+	}
+	word := p.s[start:p.i]
+	if word == "" {
+		return nil, errors.Errorf("missing operand at %d", start)
+	}
+	v := ParseValue(word)
+	if s, ok := v.(string); ok && s == word {
+		return nil, errors.Errorf("bad literal %q at %d", word, start)
+	}
+	return jpLiteral{v: v}, nil
+}
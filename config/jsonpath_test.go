@@ -0,0 +1,102 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+const jsonPathDoc = `{
+"store": {
+	"book": [
+		{"category": "reference", "author": "Nigel Rees", "title": "Sayings of the Century", "price": 8.95},
+		{"category": "fiction", "author": "Evelyn Waugh", "title": "Sword of Honour", "price": 12.99},
+		{"category": "fiction", "author": "Herman Melville", "title": "Moby Dick", "isbn": "0-553-21311-3", "price": 8.99},
+		{"category": "fiction", "author": "J. R. R. Tolkien", "title": "The Lord of the Rings", "isbn": "0-395-19395-8", "price": 22.99}
+	],
+	"bicycle": {"color": "red", "price": 19.95}
+},
+"limit": 10
+}`
+
+func TestQuery(t *testing.T) {
+	cfg, err := Parser(jsonEnc).Decode(strings.NewReader(jsonPathDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		Query, Want string
+	}{
+		{"$.store.book[*].author", `["Nigel Rees","Evelyn Waugh","Herman Melville","J. R. R. Tolkien"]`},
+		{"$..author", `["Nigel Rees","Evelyn Waugh","Herman Melville","J. R. R. Tolkien"]`},
+		{"$.store.*.color", `["red"]`},
+		{"$.store..price", `[19.95,8.95,12.99,8.99,22.99]`},
+		{"$..book[2].title", `["Moby Dick"]`},
+		{"$..book[-1].title", `["The Lord of the Rings"]`},
+		{"$..book[0,1].title", `["Sayings of the Century","Sword of Honour"]`},
+		{"$..book[:2].title", `["Sayings of the Century","Sword of Honour"]`},
+		{"$..book[1:4:2].title", `["Sword of Honour","The Lord of the Rings"]`},
+		{"$..book[::-1].price", `[22.99,8.99,12.99,8.95]`},
+		{"$..book[?(@.isbn)].title", `["Moby Dick","The Lord of the Rings"]`},
+		{"$..book[?(!@.isbn)].title", `["Sayings of the Century","Sword of Honour"]`},
+		{"$..book[?(@.price < 10)].title", `["Sayings of the Century","Moby Dick"]`},
+		{"$..book[?(@.price > $.limit && @.category == 'fiction')].title", `["Sword of Honour","The Lord of the Rings"]`},
+		{"$..book[?(@.author =~ /^J\\./ || @.price == 8.95)].title", `["Sayings of the Century","The Lord of the Rings"]`},
+		{"$['store']['bicycle']", `[{"color":"red","price":19.95}]`},
+		{"$.nothing", `[]`},
+	} {
+		got := cfg.Get([]string{tc.Query})
+		if err, ok := got.(error); ok {
+			t.Errorf("%s: %v", tc.Query, err)
+			continue
+		}
+		if s := FormatValue(got); s != tc.Want {
+			t.Errorf("%s: got %s, wanted %s", tc.Query, s, tc.Want)
+		}
+	}
+
+	for _, q := range []string{"store", "$.", "$[", "$[?(@.a ==)]", "$[?(@.a =~ /(/)]", "$['a"} {
+		if _, err := CompileQuery(q); err == nil {
+			t.Errorf("%q: wanted error", q)
+		}
+	}
+}
+
+func TestQuerySet(t *testing.T) {
+	for i, tc := range []struct {
+		Doc, Key, Value, Want string
+	}{
+		{Doc: `{"a":{"proxy":{"to":"x"}},"b":{"proxy":{"to":"y","timeout":"1s"}},"c":{}}`,
+			Key: "$..proxy.timeout", Value: "30s",
+			Want: `{"a":{"proxy":{"timeout":"30s","to":"x"}},"b":{"proxy":{"timeout":"30s","to":"y"}},"c":{}}`},
+		{Doc: `{"s":[{"p":1},{"p":2},{"p":3}]}`, Key: "$.s[?(@.p >= 2)].p", Value: "0",
+			Want: `{"s":[{"p":1},{"p":0},{"p":0}]}`},
+		{Doc: `{"a":[1,2,3]}`, Key: "$.a[*]", Value: "true", Want: `{"a":[true,true,true]}`},
+		{Doc: `{"a":{"x":1},"b":{"x":2}}`, Key: "$.*", Value: `{"y":3}`, Want: `{"a":{"y":3},"b":{"y":3}}`},
+	} {
+		cfg, err := Parser(jsonEnc).Decode(strings.NewReader(tc.Doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = cfg.Set([]string{tc.Key}, ParseValue(tc.Value)); err != nil {
+			t.Errorf("%d. %v", i, err)
+		}
+		if got := compactJSON(t, cfg); got != tc.Want {
+			t.Errorf("%d. got %s, wanted %s", i, got, tc.Want)
+		}
+	}
+}
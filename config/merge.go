@@ -0,0 +1,228 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Conflict is a path changed differently by both sides of a three-way merge.
+type Conflict struct {
+	Path []string
+	// Base, Local and Upstream are the values at Path - nil if missing.
+	Base, Local, Upstream interface{}
+}
+
+// MarshalJSON writes the Path as a JSON Pointer.
+func (c Conflict) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Path     string      `json:"path"`
+		Base     interface{} `json:"base,omitempty"`
+		Local    interface{} `json:"local,omitempty"`
+		Upstream interface{} `json:"upstream,omitempty"`
+	}{Path: JoinPointer(c.Path), Base: c.Base, Local: c.Local, Upstream: c.Upstream})
+}
+
+// Merge3 merges the changes from base to local and from base to upstream.
+//
+// The result is local with the non-conflicting upstream changes applied,
+// so it keeps the formatting of local. The conflicting paths keep the local value,
+// and are returned as Conflicts.
+//
+// Tables are merged key by key, arrays of the same length element by element.
+func Merge3(base, local, upstream Config) (Config, []Conflict, error) {
+	merged, conflicts, _, err := merge3(base, local, upstream, false)
+	return merged, conflicts, err
+}
+
+// WriteMerge3 writes the three-way merge of base, local and upstream with enc.
+// The conflicting parts are marked with git-like conflict markers:
+//
+//	<<<<<<< local
+//	...
+//	=======
+//	...
+//	>>>>>>> upstream
+//
+// The conflicts are returned, too.
+func WriteMerge3(w io.Writer, enc Encoder, base, local, upstream Config) ([]Conflict, error) {
+	merged, conflicts, theirs, err := merge3(base, local, upstream, true)
+	if err != nil {
+		return conflicts, err
+	}
+	var ours bytes.Buffer
+	if err = enc.Encode(&ours, merged); err != nil || len(conflicts) == 0 {
+		if err == nil {
+			_, err = w.Write(ours.Bytes())
+		}
+		return conflicts, err
+	}
+	var buf bytes.Buffer
+	if err = enc.Encode(&buf, theirs); err != nil {
+		return conflicts, err
+	}
+	a, b := splitLines(ours.String()), splitLines(buf.String())
+	_, pair := alignLists(len(a), len(b), func(i, j int) bool { return a[i] == b[j] })
+	same := func(i int) bool { return pair[i] >= 0 && a[i] == b[pair[i]] }
+	var out bytes.Buffer
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		if i < len(a) && same(i) && pair[i] == j {
+			out.WriteString(a[i])
+			i, j = i+1, j+1
+			continue
+		}
+		out.WriteString("<<<<<<< local\n")
+		for ; i < len(a) && !same(i); i++ {
+			out.WriteString(a[i])
+		}
+		ensureNewline(&out)
+		end := len(b)
+		if i < len(a) {
+			end = pair[i]
+		}
+		out.WriteString("=======\n")
+		for ; j < end; j++ {
+			out.WriteString(b[j])
+		}
+		ensureNewline(&out)
+		out.WriteString(">>>>>>> upstream\n")
+	}
+	_, err = w.Write(out.Bytes())
+	return conflicts, err
+}
+
+// merge3 returns local with the merged changes, the conflicts - and if withTheirs,
+// also local with the upstream values at the conflicts.
+func merge3(base, local, upstream Config, withTheirs bool) (merged Config, conflicts []Conflict, theirs Config, err error) {
+	var b, l, u interface{}
+	if b, err = plainDoc(base); err != nil {
+		return merged, nil, theirs, err
+	}
+	if l, err = plainDoc(local); err != nil {
+		return merged, nil, theirs, err
+	}
+	if u, err = plainDoc(upstream); err != nil {
+		return merged, nil, theirs, err
+	}
+	m := merger{}
+	if merged, err = m.apply(local, l, m.merge(nil, b, l, u)); err != nil || !withTheirs || len(m.conflicts) == 0 {
+		return merged, m.conflicts, theirs, err
+	}
+	m = merger{preferUpstream: true}
+	theirs, err = m.apply(local, l, m.merge(nil, b, l, u))
+	return merged, m.conflicts, theirs, err
+}
+
+// mergeMissing marks a missing value.
+type mergeMissing struct{}
+
+type merger struct {
+	preferUpstream bool
+	conflicts      []Conflict
+}
+
+// apply returns a copy of cfg (with plain value doc), changed to hold the value.
+func (m *merger) apply(cfg Config, doc, value interface{}) (Config, error) {
+	result, err := cfg.Clone()
+	if err != nil {
+		return cfg, err
+	}
+	return result, errors.Wrap(result.ApplyPatch(diffValues(nil, nil, doc, value).Patch()), "merge")
+}
+
+func (m *merger) merge(path []string, b, l, u interface{}) interface{} {
+	equal := func(x, y interface{}) bool {
+		_, xMissing := x.(mergeMissing)
+		_, yMissing := y.(mergeMissing)
+		if xMissing || yMissing {
+			return xMissing == yMissing
+		}
+		return len(diffValues(nil, nil, x, y)) == 0
+	}
+	switch {
+	case equal(l, u), equal(b, u):
+		return l
+	case equal(b, l):
+		return u
+	}
+	child := func(k string) []string {
+		return append(append(make([]string, 0, len(path)+1), path...), k)
+	}
+	if lm, ok := l.(map[string]interface{}); ok {
+		if um, ok := u.(map[string]interface{}); ok {
+			bm, ok := b.(map[string]interface{})
+			if !ok {
+				// added on both sides: merge the keys
+				bm = make(map[string]interface{})
+			}
+			keys := make([]string, 0, len(lm)+len(um))
+			for _, m := range []map[string]interface{}{bm, lm, um} {
+				for k := range m {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			result := make(map[string]interface{}, len(lm))
+			get := func(m map[string]interface{}, k string) interface{} {
+				if v, ok := m[k]; ok {
+					return v
+				}
+				return mergeMissing{}
+			}
+			for i, k := range keys {
+				if i != 0 && keys[i-1] == k {
+					continue
+				}
+				v := m.merge(child(k), get(bm, k), get(lm, k), get(um, k))
+				if _, missing := v.(mergeMissing); !missing {
+					result[k] = v
+				}
+			}
+			return result
+		}
+	}
+	if la, ok := l.([]interface{}); ok {
+		ua, uOK := u.([]interface{})
+		ba, bOK := b.([]interface{})
+		if uOK && bOK && len(ba) == len(la) && len(la) == len(ua) {
+			result := make([]interface{}, len(la))
+			for i := range la {
+				result[i] = m.merge(child(strconv.Itoa(i)), ba[i], la[i], ua[i])
+			}
+			return result
+		}
+	}
+	c := Conflict{Path: path}
+	for _, x := range []struct {
+		dst *interface{}
+		v   interface{}
+	}{{&c.Base, b}, {&c.Local, l}, {&c.Upstream, u}} {
+		if _, ok := x.v.(mergeMissing); !ok {
+			*x.dst = x.v
+		}
+	}
+	m.conflicts = append(m.conflicts, c)
+	if m.preferUpstream {
+		return u
+	}
+	return l
+}
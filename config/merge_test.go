@@ -0,0 +1,109 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+)
+
+func TestMerge3(t *testing.T) {
+	const base = `; the server
+[server]
+port = 8080
+host = localhost
+workers = 4
+
+[log]
+level = info
+`
+	const local = `; the server
+[server]
+; moved
+port = 9090
+host = localhost
+workers = 8
+
+[log]
+level = info
+`
+	const upstream = `[server]
+port = 8080
+host = 0.0.0.0
+workers = 16
+timeout = 30s
+
+[cache]
+size = 100
+`
+	decode := func(s string) Config {
+		cfg, err := Parser(iniEnc).Decode(strings.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+
+	merged, conflicts, err := Merge3(decode(base), decode(local), decode(upstream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || strings.Join(conflicts[0].Path, "/") != "server/workers" ||
+		conflicts[0].Base != "4" || conflicts[0].Local != "8" || conflicts[0].Upstream != "16" {
+		t.Errorf("conflicts: got %+v", conflicts)
+	}
+	var buf strings.Builder
+	if err = Dumper(iniEnc).Encode(&buf, merged); err != nil {
+		t.Fatal(err)
+	}
+	if d := diff.Diff(buf.String(), `; the server
+[server]
+; moved
+port = 9090
+host = 0.0.0.0
+workers = 8
+timeout = 30s
+
+[cache]
+size = 100
+`); d != "" {
+		t.Error(d)
+	}
+
+	buf.Reset()
+	if _, err = WriteMerge3(&buf, Dumper(iniEnc), decode(base), decode(local), decode(upstream)); err != nil {
+		t.Fatal(err)
+	}
+	if d := diff.Diff(buf.String(), `; the server
+[server]
+; moved
+port = 9090
+host = 0.0.0.0
+<<<<<<< local
+workers = 8
+=======
+workers = 16
+>>>>>>> upstream
+timeout = 30s
+
+[cache]
+size = 100
+`); d != "" {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,497 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+
+	toml "github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+)
+
+// nginxEncDec is for the nginx configuration files.
+//
+// The directives are mapped as the Caddyfile directives are: a directive without
+// arguments is "", otherwise a table with the arguments as "args", and the
+// directives of its block; the repeated directives are a list.
+// The include directives are not followed, they are kept as any other directive.
+type nginxEncDec struct{}
+
+func (ed nginxEncDec) Decode(r io.Reader) (Config, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Config{}, err
+	}
+	f := &nginxFile{text: string(b)}
+	if f.dirs, err = parseNginx(f.text); err != nil {
+		return Config{}, err
+	}
+	tt, err := treeFromMap(nginxNodes(f.dirs))
+	if err != nil {
+		return Config{Tree: tt}, err
+	}
+	f.orig = tt.ToMap()
+	return Config{Tree: tt, src: f}, nil
+}
+
+// Encode the Config as an nginx configuration file.
+//
+// If the Config has been decoded from an nginx configuration file, then the original text
+// is written back, with only the changed directives rewritten, keeping their comments
+// and the alignment of their arguments. The new directives go after the last one of their block.
+func (ed nginxEncDec) Encode(w io.Writer, cfg Config) error {
+	f, _ := cfg.src.(*nginxFile)
+	if f == nil {
+		f = &nginxFile{}
+	}
+	var buf bytes.Buffer
+	f.writeBody(&buf, f.dirs, 0, len(f.text), "", f.orig, cfg.Tree.ToMap())
+	_, err := w.Write(buf.Bytes())
+	return errors.Wrap(err, "write nginx")
+}
+
+// nginxNodes returns the tree of the directives.
+func nginxNodes(dirs []*nginxDirective) map[string]interface{} {
+	m := make(map[string]interface{}, len(dirs))
+	var names []string
+	nodes := make(map[string][]interface{}, len(dirs))
+	for _, d := range dirs {
+		if _, ok := nodes[d.Name]; !ok {
+			names = append(names, d.Name)
+		}
+		nodes[d.Name] = append(nodes[d.Name], d.node())
+	}
+	for _, name := range names {
+		vs := nodes[name]
+		if len(vs) == 1 {
+			m[name] = vs[0]
+			continue
+		}
+		// repeated directives are kept as a list, in order
+		for i, v := range vs {
+			if v == "" {
+				vs[i] = map[string]interface{}{}
+			}
+		}
+		m[name] = vs
+	}
+	return m
+}
+
+// node returns the tree node of the directive: "" for a bare directive,
+// a table of the args (as "args") and the directives of its block otherwise.
+func (d *nginxDirective) node() interface{} {
+	if len(d.Args) == 0 && !d.block {
+		return ""
+	}
+	m := nginxNodes(d.Children)
+	if len(d.Args) != 0 {
+		args := make([]interface{}, len(d.Args))
+		for i, a := range d.Args {
+			args[i] = a.text
+		}
+		m["args"] = args
+	}
+	return m
+}
+
+// nginxFile is the concrete syntax tree of an nginx configuration file.
+type nginxFile struct {
+	text string
+	dirs []*nginxDirective
+	// orig is the tree as decoded, to find the changed nodes.
+	orig map[string]interface{}
+}
+
+func (f *nginxFile) resolveKey(tt *toml.Tree, key []string, set bool) ([]string, error) {
+	return directiveKey(tt, key, set)
+}
+
+// nginxDirective is a directive in the source, with the offsets of its parts in the text.
+type nginxDirective struct {
+	Name     string
+	Args     []nginxToken
+	Children []*nginxDirective
+	block    bool
+	// start and end are the offsets of the name, and after the closing ";" or "}";
+	// open and close are the offsets of the braces of the block.
+	start, nameEnd, end, open, close int
+	// lstart and lend are the offsets of the whole lines of the directive
+	// (with its indentation, and its trailing comment and line ending),
+	// if it doesn't share them with other directives.
+	lstart, lend int
+}
+
+type nginxToken struct {
+	// text is the unquoted text.
+	text       string
+	start, end int
+	quoted     bool
+}
+
+// argsEnd returns the offset after the last argument.
+func (d *nginxDirective) argsEnd() int {
+	if len(d.Args) == 0 {
+		return d.nameEnd
+	}
+	return d.Args[len(d.Args)-1].end
+}
+
+// scanNginx returns the tokens of the text, without the comments.
+func scanNginx(text string) ([]nginxToken, error) {
+	var tokens []nginxToken
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == ';' || c == '{' || c == '}':
+			tokens = append(tokens, nginxToken{text: text[i : i+1], start: i, end: i + 1})
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for ; j < len(text) && text[j] != c; j++ {
+				if text[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(text) {
+				return tokens, errors.Errorf("%d: unclosed quote", lineNo(text, i))
+			}
+			tokens = append(tokens, nginxToken{text: nginxUnescape(text[i+1 : j]), start: i, end: j + 1, quoted: true})
+			i = j + 1
+		default:
+			j := i
+		Word:
+			for ; j < len(text); j++ {
+				switch text[j] {
+				case ' ', '\t', '\r', '\n', ';', '}':
+					break Word
+				case '{':
+					// ${var} is a variable, not a block
+					if j == i || text[j-1] != '$' {
+						break Word
+					}
+					for j < len(text) && text[j] != '}' {
+						j++
+					}
+				case '\\':
+					j++
+				}
+			}
+			if j > len(text) {
+				j = len(text)
+			}
+			tokens = append(tokens, nginxToken{text: nginxUnescape(text[i:j]), start: i, end: j})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// nginxUnescape replaces the escape sequences nginx knows; the other backslashes
+// (as in the regular expressions) are kept.
+func nginxUnescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			buf.WriteByte(s[i])
+			continue
+		}
+		switch c := s[i+1]; c {
+		case '"', '\'', '\\':
+			buf.WriteByte(c)
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		default:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		}
+		i++
+	}
+	return buf.String()
+}
+
+// lineNo returns the 1-based number of the line of the offset.
+func lineNo(text string, offset int) int { return strings.Count(text[:offset], "\n") + 1 }
+
+func parseNginx(text string) ([]*nginxDirective, error) {
+	tokens, err := scanNginx(text)
+	if err != nil {
+		return nil, err
+	}
+	dirs, i, err := parseNginxBody(text, tokens, 0)
+	if err == nil && i < len(tokens) {
+		err = errors.Errorf("%d: unexpected %q", lineNo(text, tokens[i].start), tokens[i].text)
+	}
+	return dirs, err
+}
+
+// parseNginxBody parses the directives up to the closing brace of the block,
+// or the end. Returns the index of the next token (the closing brace).
+func parseNginxBody(text string, tokens []nginxToken, i int) ([]*nginxDirective, int, error) {
+	var dirs []*nginxDirective
+	for i < len(tokens) {
+		t := tokens[i]
+		if !t.quoted {
+			switch t.text {
+			case "}":
+				return dirs, i, nil
+			case ";", "{":
+				return dirs, i, errors.Errorf("%d: unexpected %q", lineNo(text, t.start), t.text)
+			}
+		}
+		d := &nginxDirective{Name: t.text, start: t.start, nameEnd: t.end}
+		for i++; ; i++ {
+			if i == len(tokens) {
+				return dirs, i, errors.Errorf("%d: %s: missing ';'", lineNo(text, t.start), d.Name)
+			}
+			if a := tokens[i]; a.quoted || a.text != ";" && a.text != "{" && a.text != "}" {
+				d.Args = append(d.Args, a)
+				continue
+			}
+			break
+		}
+		switch tokens[i].text {
+		case ";":
+			d.end = tokens[i].end
+			i++
+		case "{":
+			d.block, d.open = true, tokens[i].start
+			var err error
+			if d.Children, i, err = parseNginxBody(text, tokens, i+1); err != nil {
+				return dirs, i, err
+			}
+			if i == len(tokens) {
+				return dirs, i, errors.Errorf("%d: %s: missing '}'", lineNo(text, t.start), d.Name)
+			}
+			d.close, d.end = tokens[i].start, tokens[i].end
+			i++
+		default:
+			return dirs, i, errors.Errorf("%d: %s: missing ';'", lineNo(text, t.start), d.Name)
+		}
+		d.lstart, d.lend = lineSpan(text, d.start, d.end, "#")
+		dirs = append(dirs, d)
+	}
+	return dirs, i, nil
+}
+
+// lineSpan returns the start of the line of start, and the end of the line of end (after the line ending),
+// if there's only space before, and only space or a comment (starting with comment) after.
+func lineSpan(text string, start, end int, comment string) (int, int) {
+	lstart := strings.LastIndexByte(text[:start], '\n') + 1
+	if strings.TrimLeft(text[lstart:start], " \t") != "" {
+		lstart = start
+	}
+	lend := len(text)
+	if i := strings.IndexByte(text[end:], '\n'); i >= 0 {
+		lend = end + i + 1
+	}
+	if rest := strings.TrimLeft(text[end:lend], " \t\r\n"); rest != "" && !strings.HasPrefix(rest, comment) {
+		lend = end
+	}
+	return lstart, lend
+}
+
+// writeBody writes the text from..to, which holds the directives dirs, with the
+// directives of cur in place of those of orig.
+func (f *nginxFile) writeBody(buf *bytes.Buffer, dirs []*nginxDirective, from, to int, indent string, orig, cur map[string]interface{}) {
+	count := make(map[string]int, len(dirs))
+	for _, d := range dirs {
+		count[d.Name]++
+	}
+	if len(dirs) != 0 {
+		indent = leadingSpace(f.text[strings.LastIndexByte(f.text[:dirs[0].start], '\n')+1:])
+	}
+	pos, dropped := from, false
+	seen := make(map[string]int, len(count))
+	emits, pairs := make(map[string][][]int, len(count)), make(map[string][]int, len(count))
+	for _, d := range dirs {
+		writeGap(buf, f.text[pos:d.lstart], dropped)
+		pos = d.lend
+		dropped = true
+		// the n-th instance in the source is the n-th in the tree
+		n := seen[d.Name]
+		seen[d.Name]++
+		curs, origs := caddyInstances(cur[d.Name]), caddyInstances(orig[d.Name])
+		if _, ok := emits[d.Name]; !ok {
+			emits[d.Name], pairs[d.Name] = alignLists(len(origs), len(curs), func(i, j int) bool {
+				return reflect.DeepEqual(origs[i], curs[j])
+			})
+		}
+		if n >= len(origs) {
+			continue
+		}
+		for _, j := range emits[d.Name][n] {
+			dropped = false
+			if j == pairs[d.Name][n] {
+				f.writeDirective(buf, d, curs[j], origs[n])
+			} else {
+				appendItem(buf, indent, nginxFormat(d.Name, curs[j], indent, f.indentUnit()))
+			}
+		}
+	}
+	if len(dirs) == 0 {
+		buf.WriteString(f.text[pos:to])
+		pos = to
+	}
+	for _, k := range sortedMapKeys(cur) {
+		if _, ok := count[k]; ok || k == "args" {
+			continue
+		}
+		if from == 0 && to == len(f.text) {
+			ensureNewline(buf)
+		}
+		for _, v := range caddyInstances(cur[k]) {
+			appendItem(buf, indent, nginxFormat(k, v, indent, f.indentUnit()))
+			dropped = false
+		}
+	}
+	writeGap(buf, f.text[pos:to], dropped)
+}
+
+// writeGap writes the text between two directives (or elements) - without its leading blank lines,
+// if the one before it has been dropped, after a blank line.
+func writeGap(buf *bytes.Buffer, gap string, dropped bool) {
+	if dropped && bytes.HasSuffix(buf.Bytes(), []byte("\n\n")) {
+		for {
+			i := strings.IndexByte(gap, '\n')
+			if i < 0 || strings.TrimSpace(gap[:i]) != "" {
+				break
+			}
+			gap = gap[i+1:]
+		}
+	}
+	buf.WriteString(gap)
+}
+
+// writeDirective writes the directive - as is, if it hasn't changed,
+// or rewriting only the changed arguments and directives of its block.
+func (f *nginxFile) writeDirective(buf *bytes.Buffer, d *nginxDirective, cur, orig interface{}) {
+	if reflect.DeepEqual(cur, orig) {
+		buf.WriteString(f.text[d.lstart:d.lend])
+		return
+	}
+	args, children := caddySplitNode(cur)
+	_, isMap := cur.(map[string]interface{})
+	if d.block && !isMap || !d.block && len(children) != 0 {
+		indent := leadingSpace(f.text[d.lstart:d.start])
+		buf.WriteString(f.text[d.lstart:d.start])
+		buf.WriteString(nginxFormat(d.Name, cur, indent, f.indentUnit()))
+		buf.WriteString(f.text[d.end:d.lend])
+		return
+	}
+	buf.WriteString(f.text[d.lstart:d.nameEnd])
+	// replace the arguments in place, to keep their alignment
+	pos := d.nameEnd
+	for i, a := range args {
+		if i >= len(d.Args) {
+			buf.WriteString(" " + nginxQuoteArg(a))
+			continue
+		}
+		t := d.Args[i]
+		buf.WriteString(f.text[pos:t.start])
+		if a == t.text {
+			buf.WriteString(f.text[t.start:t.end])
+		} else {
+			buf.WriteString(nginxQuoteArg(a))
+		}
+		pos = t.end
+	}
+	if !d.block {
+		buf.WriteString(f.text[d.argsEnd():d.lend])
+		return
+	}
+	_, origChildren := caddySplitNode(orig)
+	buf.WriteString(f.text[d.argsEnd() : d.open+1])
+	closeLine := strings.LastIndexByte(f.text[:d.close], '\n') + 1
+	if strings.TrimLeft(f.text[closeLine:d.close], " \t") != "" || closeLine <= d.open {
+		closeLine = d.close
+	}
+	f.writeBody(buf, d.Children, d.open+1, closeLine, leadingSpace(f.text[d.lstart:d.start])+f.indentUnit(), origChildren, children)
+	buf.WriteString(f.text[closeLine:d.lend])
+}
+
+// indentUnit returns the indentation of the first nested directive, or four spaces.
+func (f *nginxFile) indentUnit() string {
+	for _, d := range f.dirs {
+		if len(d.Children) != 0 {
+			c := d.Children[0]
+			if s := leadingSpace(f.text[strings.LastIndexByte(f.text[:c.start], '\n')+1:]); s != "" {
+				return s
+			}
+		}
+	}
+	return "    "
+}
+
+// appendItem appends the directive (or element) text to buf: on a new line, if buf ends with one,
+// else after a space, on the same line.
+func appendItem(buf *bytes.Buffer, indent, text string) {
+	b := buf.Bytes()
+	switch {
+	case len(b) == 0 || b[len(b)-1] == '\n':
+		buf.WriteString(indent + text + "\n")
+	case b[len(b)-1] == ' ' || b[len(b)-1] == '\t':
+		buf.WriteString(text + " ")
+	default:
+		buf.WriteString(" " + text)
+	}
+}
+
+// nginxFormat returns the text of the directive instance, as a new text.
+func nginxFormat(name string, v interface{}, indent, unit string) string {
+	args, children := caddySplitNode(v)
+	var buf strings.Builder
+	buf.WriteString(name)
+	for _, a := range args {
+		buf.WriteString(" " + nginxQuoteArg(a))
+	}
+	if len(children) == 0 {
+		buf.WriteString(";")
+		return buf.String()
+	}
+	buf.WriteString(" {\n")
+	for _, k := range sortedMapKeys(children) {
+		for _, v := range caddyInstances(children[k]) {
+			buf.WriteString(indent + unit + nginxFormat(k, v, indent+unit, unit) + "\n")
+		}
+	}
+	buf.WriteString(indent + "}")
+	return buf.String()
+}
+
+// nginxQuoteArg quotes the argument, if the nginx lexer would split it.
+func nginxQuoteArg(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\r\n\"';{}#") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,223 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+	"github.com/pkg/errors"
+)
+
+const nginxTest1 = `# main context
+user  nginx;
+worker_processes  auto;
+
+events { worker_connections 1024; }
+
+http {
+    include       /etc/nginx/mime.types;
+    sendfile        on;   # zero copy
+    log_format main '$remote_addr - "$request"';
+
+    server {
+        listen       80;
+        server_name  example.com www.example.com;
+
+        location / {
+            root   /usr/share/nginx/html;
+        }
+        location ~ \.php$ {
+            fastcgi_pass unix:/run/php-fpm.sock;
+        }
+    }
+
+    server {
+        listen 443 ssl;
+    }
+}
+`
+
+func TestNginxRoundTrip(t *testing.T) {
+	cfg, err := Parser(nginxEnc).Decode(strings.NewReader(nginxTest1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]interface{}{
+		"worker_processes/args/0":                      "auto",
+		"http/include/args/0":                          "/etc/nginx/mime.types",
+		"http/log_format/args":                         []interface{}{"main", `$remote_addr - "$request"`},
+		"http/server/0/server_name/args/1":             "www.example.com",
+		"http/server/0/location/1/args":                []interface{}{"~", `\.php$`},
+		"http/server/0/location/1/fastcgi_pass/args/0": "unix:/run/php-fpm.sock",
+		"http/server/1/listen/args/1":                  "ssl",
+		"events/worker_connections/args/0":             "1024",
+	} {
+		if got := cfg.Get(strings.Split(path, "/")); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, wanted %#v", path, got, want)
+		}
+	}
+
+	var buf strings.Builder
+	if err = Dumper(nginxEnc).Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d := diff.Diff(buf.String(), nginxTest1); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestNginxEdit(t *testing.T) {
+	for i, tc := range []struct {
+		Src  string
+		Edit func(cfg Config) error
+		Want string
+	}{
+		{Src: nginxTest1,
+			Edit: func(cfg Config) error {
+				for k, v := range map[string]interface{}{
+					"worker_processes/args/0":                      "4",
+					"http/sendfile/args/0":                         "off",
+					"http/server/0/listen/args/0":                  "8080",
+					"http/server/0/location/0/index":               map[string]interface{}{"args": []interface{}{"index.html"}},
+					"http/server/1/ssl_certificate":                map[string]interface{}{"args": []interface{}{"/etc/ssl/a b.pem"}},
+					"events/use":                                   map[string]interface{}{"args": []interface{}{"epoll"}},
+					"http/server/0/location/1/fastcgi_pass/args/0": "127.0.0.1:9000",
+				} {
+					if err := cfg.Set(strings.Split(k, "/"), v); err != nil {
+						return err
+					}
+				}
+				return cfg.Del([]string{"http", "log_format"})
+			},
+			Want: `# main context
+user  nginx;
+worker_processes  4;
+
+events { worker_connections 1024; use epoll; }
+
+http {
+    include       /etc/nginx/mime.types;
+    sendfile        off;   # zero copy
+
+    server {
+        listen       8080;
+        server_name  example.com www.example.com;
+
+        location / {
+            root   /usr/share/nginx/html;
+            index index.html;
+        }
+        location ~ \.php$ {
+            fastcgi_pass 127.0.0.1:9000;
+        }
+    }
+
+    server {
+        listen 443 ssl;
+        ssl_certificate "/etc/ssl/a b.pem";
+    }
+}
+`},
+
+		{Src: nginxTest1,
+			Edit: func(cfg Config) error {
+				if err := cfg.Del([]string{"http", "server", "0"}); err != nil {
+					return err
+				}
+				return cfg.Set([]string{"http", "server", "1"}, map[string]interface{}{
+					"listen":   map[string]interface{}{"args": []interface{}{"8443"}},
+					"location": map[string]interface{}{"args": []interface{}{"/"}, "return": map[string]interface{}{"args": []interface{}{"204"}}},
+				})
+			},
+			Want: `# main context
+user  nginx;
+worker_processes  auto;
+
+events { worker_connections 1024; }
+
+http {
+    include       /etc/nginx/mime.types;
+    sendfile        on;   # zero copy
+    log_format main '$remote_addr - "$request"';
+
+    server {
+        listen 443 ssl;
+    }
+    server {
+        listen 8443;
+        location / {
+            return 204;
+        }
+    }
+}
+`},
+
+		// a single directive is a list of one
+		{Src: "http {\n    server {\n        listen 80;\n    }\n}\n",
+			Edit: func(cfg Config) error {
+				if got := cfg.Get(strings.Split("http/server/0/listen/0/args/0", "/")); got != "80" {
+					return errors.Errorf("got %#v, wanted 80", got)
+				}
+				if got := cfg.Get(strings.Split("http/server/1", "/")); got != nil {
+					return errors.Errorf("server/1: got %#v", got)
+				}
+				if err := cfg.Set(strings.Split("http/server/0/listen/args/0", "/"), "8080"); err != nil {
+					return err
+				}
+				return cfg.Set(strings.Split("http/server/listen/1/args", "/"), []interface{}{"443"})
+			},
+			Want: "http {\n    server {\n        listen 8080;\n        listen 443;\n    }\n}\n"},
+
+		{Src: "",
+			Edit: func(cfg Config) error {
+				return cfg.Set([]string{"stream"}, map[string]interface{}{
+					"server": map[string]interface{}{"listen": map[string]interface{}{"args": []interface{}{"53", "udp"}}},
+				})
+			},
+			Want: "stream {\n    server {\n        listen 53 udp;\n    }\n}\n"},
+	} {
+		cfg, err := Parser(nginxEnc).Decode(strings.NewReader(tc.Src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tc.Edit(cfg); err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		var buf strings.Builder
+		if err = Dumper(nginxEnc).Encode(&buf, cfg); err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		if d := diff.Diff(buf.String(), tc.Want); d != "" {
+			t.Errorf("%d. %s", i, d)
+		}
+	}
+}
+
+func TestNginxErrors(t *testing.T) {
+	for _, src := range []string{
+		"user nginx",
+		"http {\n",
+		"}\n",
+		"log_format 'x;\n",
+	} {
+		if _, err := Parser(nginxEnc).Decode(strings.NewReader(src)); err == nil {
+			t.Errorf("%q: no error", src)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	toml "github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+)
+
+// ErrTestFailed is returned by ApplyPatch when a "test" operation fails.
+var ErrTestFailed = errors.New("test failed")
+
+// Patch is an RFC 6902 JSON Patch document.
+type Patch []PatchOperation
+
+// PatchOperation is one operation of a JSON Patch.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// MarshalJSON writes the value for the operations which need it - even if it is null.
+func (op PatchOperation) MarshalJSON() ([]byte, error) {
+	type plain PatchOperation
+	switch op.Op {
+	case "add", "replace", "test":
+		return json.Marshal(struct {
+			plain
+			Value interface{} `json:"value"`
+		}{plain: plain(op), Value: op.Value})
+	}
+	op.Value = nil
+	return json.Marshal(plain(op))
+}
+
+// ParsePatch parses the RFC 6902 JSON Patch, with integer numbers as int64.
+func ParsePatch(b []byte) (Patch, error) {
+	var patch Patch
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&patch); err != nil {
+		return nil, err
+	}
+	for i, op := range patch {
+		patch[i].Value = fromJSONNumbers(op.Value)
+	}
+	return patch, nil
+}
+
+// ParseMergePatch parses the RFC 7386 JSON Merge Patch, with integer numbers as int64.
+func ParseMergePatch(b []byte) (map[string]interface{}, error) {
+	v, err := parseJSON(string(b))
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("merge patch must be an object, got %T", v)
+	}
+	return m, nil
+}
+
+// SplitPointer splits the RFC 6901 JSON Pointer into a key (path elements).
+func SplitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, errors.Errorf("JSON pointer %q must start with /", pointer)
+	}
+	key := strings.Split(pointer[1:], "/")
+	for i, k := range key {
+		key[i] = strings.Replace(strings.Replace(k, "~1", "/", -1), "~0", "~", -1)
+	}
+	return key, nil
+}
+
+// JoinPointer returns the RFC 6901 JSON Pointer for the key.
+func JoinPointer(key []string) string {
+	var buf strings.Builder
+	for _, k := range key {
+		buf.WriteByte('/')
+		buf.WriteString(strings.Replace(strings.Replace(k, "~", "~0", -1), "/", "~1", -1))
+	}
+	return buf.String()
+}
+
+// ApplyPatch applies the RFC 6902 JSON Patch.
+//
+// The patch is applied atomically: if any operation fails,
+// the Config is left untouched.
+func (cfg Config) ApplyPatch(patch Patch) error {
+	tt, err := treeFromMap(cfg.Tree.ToMap())
+	if err != nil {
+		return err
+	}
+	for i, op := range patch {
+		if tt, err = applyOp(tt, op); err != nil {
+			return errors.Wrapf(err, "%d. %s %q", i, op.Op, op.Path)
+		}
+	}
+	*cfg.Tree = *tt
+	return nil
+}
+
+func applyOp(tt *toml.Tree, op PatchOperation) (*toml.Tree, error) {
+	key, err := SplitPointer(op.Path)
+	if err != nil {
+		return tt, err
+	}
+	switch op.Op {
+	case "add":
+		return patchAdd(tt, key, op.Value)
+
+	case "remove":
+		if len(key) == 0 {
+			return toml.TreeFromMap(make(map[string]interface{}))
+		}
+		_, err = deletePath(tt, key)
+		return tt, err
+
+	case "replace":
+		if getPath(tt, key) == nil {
+			return tt, errors.Wrap(ErrNotFound, op.Path)
+		}
+		if len(key) == 0 {
+			return patchAdd(tt, key, op.Value)
+		}
+		v, err := tomlNode(op.Value)
+		if err != nil {
+			return tt, err
+		}
+		_, err = setPath(tt, key, v)
+		return tt, err
+
+	case "move", "copy":
+		from, err := SplitPointer(op.From)
+		if err != nil {
+			return tt, err
+		}
+		v := getPath(tt, from)
+		if v == nil {
+			return tt, errors.Wrap(ErrNotFound, op.From)
+		}
+		v = plainValue(v)
+		if op.Op == "move" {
+			if op.From == op.Path {
+				return tt, nil
+			}
+			if strings.HasPrefix(op.Path, op.From+"/") {
+				return tt, errors.Errorf("cannot move %q into its child %q", op.From, op.Path)
+			}
+			if len(from) == 0 {
+				return tt, errors.New("cannot move the root")
+			}
+			if _, err = deletePath(tt, from); err != nil {
+				return tt, err
+			}
+		}
+		return patchAdd(tt, key, v)
+
+	case "test":
+		// the target must exist, even to test for null (RFC 6902 4.6)
+		v := getPath(tt, key)
+		if v == nil {
+			return tt, errors.Wrapf(ErrTestFailed, "%s: missing, wanted %v", op.Path, FormatValue(op.Value))
+		}
+		if !jsonEqual(plainValue(v), op.Value) {
+			return tt, errors.Wrapf(ErrTestFailed, "%s: got %v, wanted %v", op.Path, FormatValue(plainValue(v)), FormatValue(op.Value))
+		}
+		return tt, nil
+	}
+	return tt, errors.Errorf("unknown op %q", op.Op)
+}
+
+// patchAdd is the JSON Patch "add": inserts into arrays ("-" appends), sets in objects.
+func patchAdd(tt *toml.Tree, key []string, value interface{}) (*toml.Tree, error) {
+	v, err := tomlNode(value)
+	if err != nil {
+		return tt, err
+	}
+	if len(key) == 0 {
+		nt, ok := v.(*toml.Tree)
+		if !ok {
+			return tt, errors.Errorf("the root must be an object, got %T", value)
+		}
+		return nt, nil
+	}
+	parentKey, k := key[:len(key)-1], key[len(key)-1]
+	parent := getPath(tt, parentKey)
+	if parent == nil {
+		return tt, errors.Wrap(ErrNotFound, JoinPointer(parentKey))
+	}
+	switch x := parent.(type) {
+	case []*toml.Tree:
+		i := len(x)
+		if k != "-" {
+			if i, err = arrayIndex(k, len(x)); err != nil {
+				return tt, err
+			}
+		}
+		t, ok := v.(*toml.Tree)
+		if !ok {
+			return tt, errors.Errorf("cannot put %T into an array of tables", value)
+		}
+		y := append(append(append(make([]*toml.Tree, 0, len(x)+1), x[:i]...), t), x[i:]...)
+		_, err = setPath(tt, parentKey, y)
+		return tt, err
+
+	case []interface{}:
+		i := len(x)
+		if k != "-" {
+			if i, err = arrayIndex(k, len(x)); err != nil {
+				return tt, err
+			}
+		}
+		y := append(append(append(make([]interface{}, 0, len(x)+1), x[:i]...), v), x[i:]...)
+		if len(parentKey) == 0 {
+			return tt, errors.New("the root is not an array")
+		}
+		_, err = setPath(tt, parentKey, y)
+		return tt, err
+
+	case *toml.Tree:
+		x.SetPath([]string{k}, v)
+		return tt, nil
+	}
+	return tt, errors.Errorf("cannot add %q to %T", k, parent)
+}
+
+// MergePatch applies the RFC 7386 JSON Merge Patch:
+// null values delete, objects are merged recursively, everything else replaces.
+func (cfg Config) MergePatch(patch map[string]interface{}) error {
+	return mergePatch(cfg.Tree, patch)
+}
+
+func mergePatch(tt *toml.Tree, patch map[string]interface{}) error {
+	for k, v := range patch {
+		switch x := v.(type) {
+		case nil:
+			if tt.GetPath([]string{k}) != nil {
+				treeDelete(tt, k)
+			}
+		case map[string]interface{}:
+			child, ok := tt.GetPath([]string{k}).(*toml.Tree)
+			if !ok {
+				var err error
+				if child, err = toml.TreeFromMap(make(map[string]interface{})); err != nil {
+					return err
+				}
+				tt.SetPath([]string{k}, child)
+			}
+			if err := mergePatch(child, x); err != nil {
+				return errors.Wrap(err, k)
+			}
+		default:
+			v, err := tomlNode(v)
+			if err != nil {
+				return errors.Wrap(err, k)
+			}
+			tt.SetPath([]string{k}, v)
+		}
+	}
+	return nil
+}
+
+// plainValue converts the *toml.Tree values to maps.
+func plainValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case *toml.Tree:
+		return x.ToMap()
+	case []*toml.Tree:
+		is := make([]interface{}, len(x))
+		for i, t := range x {
+			is[i] = t.ToMap()
+		}
+		return is
+	}
+	return v
+}
+
+// jsonEqual reports whether a and b are equal as JSON values
+// (numbers are compared by value, not by type).
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			if w, ok := y[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if f, ok := asFloat(a); ok {
+		g, ok := asFloat(b)
+		return ok && f == g
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func asFloat(v interface{}) (float64, bool) {
+	switch x := normalizeValue(v).(type) {
+	case int64:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestApplyPatch(t *testing.T) {
+	for i, tc := range []struct {
+		Doc, Patch, Want string
+		Err              error
+	}{
+		{Doc: `{"foo":"bar"}`, Patch: `[{"op":"add","path":"/baz","value":"qux"}]`, Want: `{"baz":"qux","foo":"bar"}`},
+		{Doc: `{"foo":["bar","baz"]}`, Patch: `[{"op":"add","path":"/foo/1","value":"qux"}]`, Want: `{"foo":["bar","qux","baz"]}`},
+		{Doc: `{"foo":["bar"]}`, Patch: `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, Want: `{"foo":["bar",["abc","def"]]}`},
+		{Doc: `{"baz":"qux","foo":"bar"}`, Patch: `[{"op":"remove","path":"/baz"}]`, Want: `{"foo":"bar"}`},
+		{Doc: `{"foo":["bar","qux","baz"]}`, Patch: `[{"op":"remove","path":"/foo/1"}]`, Want: `{"foo":["bar","baz"]}`},
+		{Doc: `{"baz":"qux","foo":"bar"}`, Patch: `[{"op":"replace","path":"/baz","value":"boo"}]`, Want: `{"baz":"boo","foo":"bar"}`},
+		{Doc: `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			Patch: `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			Want:  `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{Doc: `{"a":{"b":[{"c":1}]}}`, Patch: `[{"op":"copy","from":"/a/b/0","path":"/a/b/-"}]`, Want: `{"a":{"b":[{"c":1},{"c":1}]}}`},
+		{Doc: `{"a/b":{"m~n":8}}`, Patch: `[{"op":"test","path":"/a~1b/m~0n","value":8.0}]`, Want: `{"a/b":{"m~n":8}}`},
+		{Doc: `{"baz":"qux"}`, Patch: `[{"op":"add","path":"/x","value":1},{"op":"test","path":"/baz","value":"bar"}]`, Want: `{"baz":"qux"}`, Err: ErrTestFailed},
+		{Doc: `{"baz":"qux"}`, Patch: `[{"op":"test","path":"/nope","value":null}]`, Want: `{"baz":"qux"}`, Err: ErrTestFailed},
+		{Doc: `{"baz":"qux"}`, Patch: `[{"op":"test","path":"/baz/0","value":null}]`, Want: `{"baz":"qux"}`, Err: ErrTestFailed},
+		{Doc: `{"baz":"qux"}`, Patch: `[{"op":"remove","path":"/nope"}]`, Want: `{"baz":"qux"}`, Err: ErrNotFound},
+	} {
+		cfg, err := Parser(jsonEnc).Decode(strings.NewReader(tc.Doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch, err := ParsePatch([]byte(tc.Patch))
+		if err != nil {
+			t.Fatalf("%d. %v", i, err)
+		}
+		if err = cfg.ApplyPatch(patch); errors.Cause(err) != tc.Err {
+			t.Errorf("%d. got error %v, wanted %v", i, err, tc.Err)
+		}
+		if got := compactJSON(t, cfg); got != tc.Want {
+			t.Errorf("%d. got %s, wanted %s", i, got, tc.Want)
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	cfg, err := Parser(jsonEnc).Decode(strings.NewReader(`{"a":"b","c":{"d":"e","f":"g"},"x":[1]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := ParseMergePatch([]byte(`{"a":"z","c":{"f":null,"h":{"i":1}},"x":null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.MergePatch(patch); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := compactJSON(t, cfg), `{"a":"z","c":{"d":"e","h":{"i":1}}}`; got != want {
+		t.Errorf("got %s, wanted %s", got, want)
+	}
+}
+
+func compactJSON(t *testing.T, cfg Config) string {
+	t.Helper()
+	var buf strings.Builder
+	if err := Dumper(jsonEnc).Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	v, err := parseJSON(buf.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return FormatValue(v)
+}
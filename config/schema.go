@@ -0,0 +1,522 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Schema is a JSON Schema (draft 7 or 2020-12).
+//
+// Only local references ("#", "#/definitions/a", "#/$defs/a") are supported.
+type Schema struct {
+	root    interface{}
+	regexps map[string]*regexp.Regexp
+}
+
+// SchemaError is one violation of a Schema.
+type SchemaError struct {
+	// Path is the JSON Pointer of the offending value.
+	Path    string
+	Message string
+}
+
+func (e SchemaError) Error() string {
+	if e.Path == "" {
+		return "/: " + e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// SchemaErrors is the list of violations returned by Validate.
+type SchemaErrors []SchemaError
+
+func (es SchemaErrors) Error() string {
+	ss := make([]string, len(es))
+	for i, e := range es {
+		ss[i] = e.Error()
+	}
+	return strings.Join(ss, "\n")
+}
+
+// ParseSchema parses the JSON Schema document.
+func ParseSchema(b []byte) (*Schema, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var root interface{}
+	if err := dec.Decode(&root); err != nil {
+		return nil, err
+	}
+	s := Schema{root: fromJSONNumbers(root), regexps: make(map[string]*regexp.Regexp)}
+	if err := s.compile(s.root); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// compile checks the references and compiles the regular expressions of the schema.
+func (s *Schema) compile(sch interface{}) error {
+	switch x := sch.(type) {
+	case bool:
+		return nil
+	case []interface{}:
+		for _, v := range x {
+			if err := s.compile(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		for k, v := range x {
+			switch k {
+			case "enum", "const", "required", "examples", "default", "dependentRequired":
+				continue
+			case "$ref":
+				ref, _ := v.(string)
+				if _, err := s.resolve(ref); err != nil {
+					return err
+				}
+			case "pattern":
+				p, _ := v.(string)
+				if _, err := s.regexp(p); err != nil {
+					return err
+				}
+			case "patternProperties":
+				if m, ok := v.(map[string]interface{}); ok {
+					for p := range m {
+						if _, err := s.regexp(p); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			if err := s.compile(v); err != nil {
+				return errors.Wrap(err, k)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) regexp(p string) (*regexp.Regexp, error) {
+	if re := s.regexps[p]; re != nil {
+		return re, nil
+	}
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil, err
+	}
+	s.regexps[p] = re
+	return re, nil
+}
+
+// resolve returns the schema the local reference points to.
+func (s *Schema) resolve(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, errors.Wrapf(ErrNotImplemented, "$ref %q: only local references are supported", ref)
+	}
+	p, err := url.PathUnescape(ref[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, ref)
+	}
+	key, err := SplitPointer(p)
+	if err != nil {
+		return nil, errors.Wrap(err, ref)
+	}
+	node := s.root
+	for _, k := range key {
+		switch x := node.(type) {
+		case map[string]interface{}:
+			node = x[k]
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil, errors.Wrap(ErrNotFound, ref)
+			}
+			node = x[i]
+		default:
+			node = nil
+		}
+		if node == nil {
+			return nil, errors.Wrap(ErrNotFound, ref)
+		}
+	}
+	return node, nil
+}
+
+// Validate the Config against the Schema, returning all the violations as SchemaErrors.
+func Validate(cfg Config, schema *Schema) error {
+	doc, err := plainDoc(cfg)
+	if err != nil {
+		return err
+	}
+	if errs := schema.check(schema.root, doc, nil); len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+func (s *Schema) check(sch, v interface{}, path []string) SchemaErrors {
+	var errs SchemaErrors
+	errorf := func(format string, args ...interface{}) {
+		errs = append(errs, SchemaError{Path: JoinPointer(path), Message: fmt.Sprintf(format, args...)})
+	}
+	child := func(k string) []string {
+		return append(append(make([]string, 0, len(path)+1), path...), k)
+	}
+	var m map[string]interface{}
+	switch x := sch.(type) {
+	case bool:
+		if !x {
+			errorf("not allowed")
+		}
+		return errs
+	case map[string]interface{}:
+		m = x
+	default:
+		return errs
+	}
+
+	if ref, ok := m["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+		if err != nil {
+			errorf("%v", err)
+		} else {
+			errs = append(errs, s.check(target, v, path)...)
+		}
+	}
+
+	if t, ok := m["type"]; ok {
+		var types []string
+		switch x := t.(type) {
+		case string:
+			types = []string{x}
+		case []interface{}:
+			for _, y := range x {
+				if s, ok := y.(string); ok {
+					types = append(types, s)
+				}
+			}
+		}
+		var found bool
+		for _, typ := range types {
+			if found = schemaTypeOf(v) == typ || typ == "number" && schemaTypeOf(v) == "integer"; found {
+				break
+			}
+		}
+		if !found {
+			errorf("got %s, wanted %s", schemaTypeOf(v), strings.Join(types, " or "))
+		}
+	}
+	if enum, ok := m["enum"].([]interface{}); ok {
+		var found bool
+		for _, e := range enum {
+			if found = jsonEqual(v, e); found {
+				break
+			}
+		}
+		if !found {
+			errorf("%s is not one of %s", FormatValue(v), FormatValue(enum))
+		}
+	}
+	if c, ok := m["const"]; ok && !jsonEqual(v, c) {
+		errorf("got %s, wanted %s", FormatValue(v), FormatValue(c))
+	}
+
+	switch x := v.(type) {
+	case int64, float64:
+		f, _ := asFloat(x)
+		if lim, ok := asFloat(m["minimum"]); ok && f < lim {
+			errorf("%v is less than the minimum %v", x, m["minimum"])
+		}
+		if lim, ok := asFloat(m["maximum"]); ok && f > lim {
+			errorf("%v is greater than the maximum %v", x, m["maximum"])
+		}
+		if lim, ok := asFloat(m["exclusiveMinimum"]); ok && f <= lim {
+			errorf("%v is not greater than %v", x, m["exclusiveMinimum"])
+		}
+		if lim, ok := asFloat(m["exclusiveMaximum"]); ok && f >= lim {
+			errorf("%v is not less than %v", x, m["exclusiveMaximum"])
+		}
+		if d, ok := asFloat(m["multipleOf"]); ok && d > 0 {
+			if q := f / d; q != float64(int64(q)) {
+				errorf("%v is not a multiple of %v", x, m["multipleOf"])
+			}
+		}
+
+	case string:
+		n := int64(utf8.RuneCountInString(x))
+		if lim, ok := m["minLength"].(int64); ok && n < lim {
+			errorf("shorter than %d characters", lim)
+		}
+		if lim, ok := m["maxLength"].(int64); ok && n > lim {
+			errorf("longer than %d characters", lim)
+		}
+		if p, ok := m["pattern"].(string); ok {
+			if re, err := s.regexp(p); err == nil && !re.MatchString(x) {
+				errorf("%q does not match %q", x, p)
+			}
+		}
+		if f, ok := m["format"].(string); ok && !schemaFormat(f, x) {
+			errorf("%q is not a valid %s", x, f)
+		}
+
+	case []interface{}:
+		n := int64(len(x))
+		if lim, ok := m["minItems"].(int64); ok && n < lim {
+			errorf("less than %d items", lim)
+		}
+		if lim, ok := m["maxItems"].(int64); ok && n > lim {
+			errorf("more than %d items", lim)
+		}
+		if unique, _ := m["uniqueItems"].(bool); unique {
+		Unique:
+			for i := range x {
+				for j := 0; j < i; j++ {
+					if jsonEqual(x[i], x[j]) {
+						errorf("items %d and %d are equal", j, i)
+						break Unique
+					}
+				}
+			}
+		}
+		// draft 7: items can be an array, with additionalItems for the rest;
+		// 2020-12: prefixItems, with items for the rest.
+		var prefix []interface{}
+		rest, hasRest := m["items"]
+		if p, ok := m["prefixItems"].([]interface{}); ok {
+			prefix = p
+		} else if p, ok := rest.([]interface{}); ok {
+			prefix = p
+			rest, hasRest = m["additionalItems"]
+		}
+		for i, item := range x {
+			if i < len(prefix) {
+				errs = append(errs, s.check(prefix[i], item, child(strconv.Itoa(i)))...)
+			} else if hasRest {
+				errs = append(errs, s.check(rest, item, child(strconv.Itoa(i)))...)
+			}
+		}
+		if contains, ok := m["contains"]; ok {
+			var count int64
+			for _, item := range x {
+				if len(s.check(contains, item, nil)) == 0 {
+					count++
+				}
+			}
+			lo, hi := int64(1), int64(len(x))
+			if lim, ok := m["minContains"].(int64); ok {
+				lo = lim
+			}
+			if lim, ok := m["maxContains"].(int64); ok {
+				hi = lim
+			}
+			if count < lo || count > hi {
+				errorf("%d items match contains, wanted %d..%d", count, lo, hi)
+			}
+		}
+
+	case map[string]interface{}:
+		n := int64(len(x))
+		if lim, ok := m["minProperties"].(int64); ok && n < lim {
+			errorf("less than %d properties", lim)
+		}
+		if lim, ok := m["maxProperties"].(int64); ok && n > lim {
+			errorf("more than %d properties", lim)
+		}
+		if req, ok := m["required"].([]interface{}); ok {
+			for _, r := range req {
+				if k, ok := r.(string); ok {
+					if _, ok := x[k]; !ok {
+						errorf("missing required property %q", k)
+					}
+				}
+			}
+		}
+		dependent, _ := m["dependentRequired"].(map[string]interface{})
+		dependentSchemas, _ := m["dependentSchemas"].(map[string]interface{})
+		if deps, ok := m["dependencies"].(map[string]interface{}); ok { // draft 7
+			for k, d := range deps {
+				if _, ok := d.([]interface{}); ok {
+					if dependent == nil {
+						dependent = make(map[string]interface{})
+					}
+					dependent[k] = d
+				} else {
+					if dependentSchemas == nil {
+						dependentSchemas = make(map[string]interface{})
+					}
+					dependentSchemas[k] = d
+				}
+			}
+		}
+		props, _ := m["properties"].(map[string]interface{})
+		patterns, _ := m["patternProperties"].(map[string]interface{})
+		additional, hasAdditional := m["additionalProperties"]
+		names, hasNames := m["propertyNames"]
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if hasNames {
+				for _, e := range s.check(names, k, nil) {
+					errorf("property name %q: %s", k, e.Message)
+				}
+			}
+			if req, ok := dependent[k].([]interface{}); ok {
+				for _, r := range req {
+					if d, ok := r.(string); ok {
+						if _, ok := x[d]; !ok {
+							errorf("property %q requires %q", k, d)
+						}
+					}
+				}
+			}
+			if d, ok := dependentSchemas[k]; ok {
+				errs = append(errs, s.check(d, v, path)...)
+			}
+			matched := false
+			if p, ok := props[k]; ok {
+				matched = true
+				errs = append(errs, s.check(p, x[k], child(k))...)
+			}
+			for pattern, p := range patterns {
+				if re, err := s.regexp(pattern); err == nil && re.MatchString(k) {
+					matched = true
+					errs = append(errs, s.check(p, x[k], child(k))...)
+				}
+			}
+			if !matched && hasAdditional {
+				if b, ok := additional.(bool); ok && !b {
+					errorf("property %q is not allowed", k)
+				} else {
+					errs = append(errs, s.check(additional, x[k], child(k))...)
+				}
+			}
+		}
+	}
+
+	if all, ok := m["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			errs = append(errs, s.check(sub, v, path)...)
+		}
+	}
+	if anyOf, ok := m["anyOf"].([]interface{}); ok {
+		var found bool
+		for _, sub := range anyOf {
+			if found = len(s.check(sub, v, path)) == 0; found {
+				break
+			}
+		}
+		if !found {
+			errorf("matches none of anyOf")
+		}
+	}
+	if one, ok := m["oneOf"].([]interface{}); ok {
+		var count int
+		for _, sub := range one {
+			if len(s.check(sub, v, path)) == 0 {
+				count++
+			}
+		}
+		if count != 1 {
+			errorf("matches %d of oneOf, wanted exactly one", count)
+		}
+	}
+	if not, ok := m["not"]; ok && len(s.check(not, v, path)) == 0 {
+		errorf("matches not")
+	}
+	if cond, ok := m["if"]; ok {
+		if len(s.check(cond, v, path)) == 0 {
+			if then, ok := m["then"]; ok {
+				errs = append(errs, s.check(then, v, path)...)
+			}
+		} else if els, ok := m["else"]; ok {
+			errs = append(errs, s.check(els, v, path)...)
+		}
+	}
+	return errs
+}
+
+// schemaTypeOf returns the JSON Schema type of the value.
+func schemaTypeOf(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case int64:
+		return "integer"
+	case float64:
+		if x == float64(int64(x)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+var hostnameRe = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*\.?$`)
+
+// schemaFormat reports whether s is valid for the format - unknown formats are accepted.
+func schemaFormat(format, s string) bool {
+	var err error
+	switch format {
+	case "date-time":
+		_, err = time.Parse(time.RFC3339Nano, s)
+	case "date":
+		_, err = time.Parse("2006-01-02", s)
+	case "time":
+		_, err = time.Parse("15:04:05Z07:00", s)
+	case "email":
+		_, err = mail.ParseAddress(s)
+	case "ipv4":
+		return net.ParseIP(s) != nil && strings.IndexByte(s, ':') < 0
+	case "ipv6":
+		return net.ParseIP(s) != nil && strings.IndexByte(s, ':') >= 0
+	case "hostname":
+		return len(s) <= 253 && hostnameRe.MatchString(s)
+	case "uri":
+		var u *url.URL
+		if u, err = url.Parse(s); err == nil && !u.IsAbs() {
+			return false
+		}
+	case "regex":
+		_, err = regexp.Compile(s)
+	}
+	return err == nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+)
+
+const testSchema = `{
+"$schema": "https://json-schema.org/draft/2020-12/schema",
+"type": "object",
+"required": ["server", "name"],
+"properties": {
+	"name": {"type": "string", "minLength": 3, "pattern": "^[a-z]+$"},
+	"server": {
+		"type": "object",
+		"properties": {
+			"port": {"type": "integer", "minimum": 1, "maximum": 65535},
+			"host": {"type": "string", "format": "hostname"},
+			"mode": {"enum": ["dev", "prod"]}
+		},
+		"additionalProperties": false
+	},
+	"upstreams": {"type": "array", "items": {"$ref": "#/$defs/upstream"}, "uniqueItems": true},
+	"tags": {"type": "array", "contains": {"const": "web"}}
+},
+"$defs": {
+	"upstream": {
+		"type": "object",
+		"required": ["url"],
+		"properties": {"url": {"type": "string", "format": "uri"}, "weight": {"type": "number", "exclusiveMinimum": 0}},
+		"oneOf": [{"required": ["weight"]}, {"properties": {"backup": {"const": true}}, "required": ["backup"]}]
+	}
+}
+}`
+
+func TestValidate(t *testing.T) {
+	schema, err := ParseSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		Type Type
+		Doc  string
+		Want string
+	}{
+		{Type: jsonEnc, Doc: `{"name":"web","server":{"port":8080,"host":"example.com","mode":"prod"},
+			"upstreams":[{"url":"http://a","weight":1.5},{"url":"http://b","backup":true}],"tags":["web"]}`},
+		{Type: tomlEnc, Doc: "name = \"web\"\n[server]\nport = 80\n[[upstreams]]\nurl = \"http://a\"\nweight = 2\n"},
+		{Type: jsonEnc, Doc: `{"name":"Web!","server":{"port":0,"host":"-bad-","mode":"test","debug":true},
+			"upstreams":[{"url":"a","weight":0},{"weight":1,"backup":true}],"tags":["db"]}`,
+			Want: `/name: "Web!" does not match "^[a-z]+$"
+/server: property "debug" is not allowed
+/server/host: "-bad-" is not a valid hostname
+/server/mode: test is not one of ["dev","prod"]
+/server/port: 0 is less than the minimum 1
+/tags: 0 items match contains, wanted 1..1
+/upstreams/0/url: "a" is not a valid uri
+/upstreams/0/weight: 0 is not greater than 0
+/upstreams/1: missing required property "url"
+/upstreams/1: matches 2 of oneOf, wanted exactly one`},
+		{Type: iniEnc, Doc: "[server]\nport = 8080\n",
+			Want: `/: missing required property "name"
+/server/port: got string, wanted integer`},
+	} {
+		cfg, err := Parser(tc.Type).Decode(strings.NewReader(tc.Doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if err := Validate(cfg, schema); err != nil {
+			got = err.Error()
+		}
+		if d := diff.Diff(got, tc.Want); d != "" {
+			t.Errorf("%s: %s", tc.Doc, d)
+		}
+	}
+
+	if _, err := ParseSchema([]byte(`{"$ref": "other.json#/a"}`)); err == nil {
+		t.Error("wanted error for a remote $ref")
+	}
+	if _, err := ParseSchema([]byte(`{"properties": {"a": {"$ref": "#/$defs/missing"}}}`)); err == nil {
+		t.Error("wanted error for a missing $ref")
+	}
+}
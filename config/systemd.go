@@ -0,0 +1,430 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// systemdEncDec is for the systemd unit files.
+//
+// The sections and keys are case sensitive. A key is a string, or a list if it is repeated.
+// An empty assignment resets the list: the key is the list of the values after the last one,
+// or "" if it is the last one.
+type systemdEncDec struct{}
+
+func (ed systemdEncDec) Decode(r io.Reader) (Config, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Config{}, err
+	}
+	f, err := parseSystemd(b)
+	if err != nil {
+		return Config{}, err
+	}
+	m := make(map[string]interface{})
+	for _, section := range f.Sections[1:] {
+		if _, ok := m[section.Name]; !ok {
+			m[section.Name] = make(map[string]interface{})
+		}
+	}
+	for k, refs := range f.keys() {
+		vs := f.values(refs)[systemdEffective(f, refs):]
+		if len(vs) == 1 {
+			m[k[0]].(map[string]interface{})[k[1]] = vs[0]
+		} else {
+			m[k[0]].(map[string]interface{})[k[1]] = toIntfSlice(vs)
+		}
+	}
+	tt, err := treeFromMap(m)
+	if err != nil {
+		return Config{Tree: tt}, err
+	}
+	f.orig = tt.ToMap()
+	return Config{Tree: tt, src: f}, nil
+}
+
+// Encode the Config as a systemd unit file.
+//
+// If the Config has been decoded from a systemd unit file, then the unchanged lines
+// are written back as is, the values of a list are changed in place, and the new keys
+// are appended to their sections.
+func (ed systemdEncDec) Encode(w io.Writer, cfg Config) error {
+	f, _ := cfg.src.(*systemdFile)
+	if f == nil {
+		f = &systemdFile{Sections: []*systemdSection{{}}}
+	}
+	cur, err := systemdSections(cfg.Tree.ToMap())
+	if err != nil {
+		return err
+	}
+	ew := newErrWriter(w)
+	f.writeTo(ew, cur)
+	return errors.Wrap(ew.Err(), "write systemd")
+}
+
+// DropIn writes only the changed keys of the Config decoded from a systemd unit file,
+// as a drop-in (such as foo.service.d/override.conf) to be read after the unit.
+//
+// Each changed key is reset by an empty assignment first, so the new values
+// replace the old ones, even for lists; a deleted key is only reset.
+func DropIn(w io.Writer, cfg Config) error {
+	f, ok := cfg.src.(*systemdFile)
+	if !ok {
+		return errors.New("not decoded from a systemd unit file")
+	}
+	cur, err := systemdSections(cfg.Tree.ToMap())
+	if err != nil {
+		return err
+	}
+	orig, _ := systemdSections(f.orig)
+
+	// the sections and keys in the order of the unit, then the new ones
+	var names []string
+	keys := make(map[string][]string)
+	for _, section := range f.Sections[1:] {
+		if _, ok := keys[section.Name]; !ok {
+			names = append(names, section.Name)
+			keys[section.Name] = nil
+		}
+		for _, line := range section.Lines {
+			if line.Key != "" && !containsString(keys[section.Name], line.Key) {
+				keys[section.Name] = append(keys[section.Name], line.Key)
+			}
+		}
+	}
+	curNames := make([]string, 0, len(cur))
+	for name := range cur {
+		curNames = append(curNames, name)
+	}
+	sort.Strings(curNames)
+	for _, name := range curNames {
+		if _, ok := keys[name]; !ok {
+			names = append(names, name)
+		}
+		for _, k := range sortedMapKeys(cur[name]) {
+			if _, ok := orig[name][k]; !ok {
+				keys[name] = append(keys[name], k)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		var section bytes.Buffer
+		for _, k := range keys[name] {
+			o, inOrig := orig[name][k]
+			c, inCur := cur[name][k]
+			if inOrig && inCur && stringsEqual(systemdValues(o), systemdValues(c)) {
+				continue
+			}
+			if inOrig {
+				fmt.Fprintf(&section, "%s=\n", k)
+			}
+			for _, v := range systemdValues(c) {
+				if v != "" || !inOrig {
+					fmt.Fprintf(&section, "%s=%s\n", k, v)
+				}
+			}
+		}
+		if section.Len() == 0 {
+			continue
+		}
+		if buf.Len() != 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "[%s]\n", name)
+		buf.Write(section.Bytes())
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// systemdSections returns the sections of the tree.
+func systemdSections(m map[string]interface{}) (map[string]map[string]interface{}, error) {
+	sections := make(map[string]map[string]interface{}, len(m))
+	for name, v := range m {
+		section, ok := v.(map[string]interface{})
+		if !ok {
+			return sections, errors.Errorf("%s: not a section, but %T", name, v)
+		}
+		sections[name] = section
+	}
+	return sections, nil
+}
+
+// systemdValues returns the values of the key: one for a string, all of a list.
+func systemdValues(v interface{}) []string {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		ss := make([]string, len(x))
+		for i, v := range x {
+			ss[i] = FormatValue(v)
+		}
+		return ss
+	}
+	return []string{FormatValue(v)}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// systemdFile is the concrete syntax tree of a systemd unit file.
+//
+// The first section is the lines before the first section header.
+type systemdFile struct {
+	Sections []*systemdSection
+	// orig is the tree as decoded, to find the changed keys.
+	orig map[string]interface{}
+}
+
+// systemdSection is a section of a systemd unit file: the header line (except for the first),
+// and all the following lines up to the next section header.
+type systemdSection struct {
+	Name  string
+	Lines []systemdLine
+}
+
+// systemdLine is one logical line of a systemd unit file, with all its physical lines in Raw.
+type systemdLine struct {
+	// Raw is the original text, including the line ending.
+	Raw string
+	// Key is empty for comments, blank lines and section headers.
+	Key string
+	// Value is the value, with the continued lines joined by a space.
+	Value string
+	// prefix is Raw up to the value ("Key="),
+	// suffix is Raw after the value (trailing space, line ending).
+	prefix, suffix string
+}
+
+// systemdRef is the place of a key line: the indexes of its section and line.
+type systemdRef struct{ section, line int }
+
+func parseSystemd(b []byte) (*systemdFile, error) {
+	f := &systemdFile{Sections: []*systemdSection{{}}}
+	section := f.Sections[0]
+	lines := splitLines(string(b))
+	for i := 0; i < len(lines); i++ {
+		raw := lines[i]
+		content, nl := chompLine(raw)
+		trimmed := strings.TrimSpace(content)
+		if trimmed == "" || trimmed[0] == '#' || trimmed[0] == ';' {
+			section.Lines = append(section.Lines, systemdLine{Raw: raw})
+			continue
+		}
+		if trimmed[0] == '[' {
+			if !strings.HasSuffix(trimmed, "]") {
+				return f, errors.Errorf("%d: invalid section header %q", i+1, trimmed)
+			}
+			section = &systemdSection{Name: trimmed[1 : len(trimmed)-1]}
+			section.Lines = append(section.Lines, systemdLine{Raw: raw})
+			f.Sections = append(f.Sections, section)
+			continue
+		}
+		j := strings.IndexByte(content, '=')
+		if j < 0 {
+			return f, errors.Errorf("%d: missing '=' in %q", i+1, trimmed)
+		}
+		if section.Name == "" {
+			return f, errors.Errorf("%d: assignment outside of a section", i+1)
+		}
+		line := systemdLine{Raw: raw, Key: strings.TrimSpace(content[:j])}
+		off := j + 1
+		off += len(content[off:]) - len(strings.TrimLeft(content[off:], " \t"))
+		line.prefix = content[:off]
+		v := strings.TrimRight(content[off:], " \t")
+		line.suffix = content[off+len(v):] + nl
+		// the lines ending with a backslash continue in the next line,
+		// skipping the comment lines
+		for strings.HasSuffix(v, `\`) && i+1 < len(lines) {
+			i++
+			line.Raw += lines[i]
+			next, nl := chompLine(lines[i])
+			if t := strings.TrimSpace(next); t != "" && (t[0] == '#' || t[0] == ';') {
+				continue
+			}
+			v = v[:len(v)-1] + " " + strings.TrimSpace(next)
+			line.suffix = next[len(strings.TrimRight(next, " \t")):] + nl
+		}
+		line.Value = v
+		section.Lines = append(section.Lines, line)
+	}
+	return f, nil
+}
+
+// keys returns the lines of each section and key.
+func (f *systemdFile) keys() map[[2]string][]systemdRef {
+	keys := make(map[[2]string][]systemdRef)
+	for i, section := range f.Sections {
+		for j, line := range section.Lines {
+			if line.Key != "" {
+				k := [2]string{section.Name, line.Key}
+				keys[k] = append(keys[k], systemdRef{i, j})
+			}
+		}
+	}
+	return keys
+}
+
+func (f *systemdFile) values(refs []systemdRef) []string {
+	vs := make([]string, len(refs))
+	for i, ref := range refs {
+		vs[i] = f.Sections[ref.section].Lines[ref.line].Value
+	}
+	return vs
+}
+
+// systemdEffective returns the index of the first effective line of the key:
+// the one after the last empty assignment, or that, if it is the last.
+func systemdEffective(f *systemdFile, refs []systemdRef) int {
+	vs := f.values(refs)
+	for i := len(vs) - 1; i >= 0; i-- {
+		if vs[i] == "" {
+			if i == len(vs)-1 {
+				return i
+			}
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (f *systemdFile) writeTo(w io.Writer, cur map[string]map[string]interface{}) {
+	// the plan for each key line: the current values to be written in its place
+	type plan struct {
+		refs  []systemdRef
+		first int
+		emit  [][]int
+		pair  []int
+		vals  []string
+	}
+	keys := f.keys()
+	plans := make(map[systemdRef]*plan)
+	for k, refs := range keys {
+		values, ok := cur[k[0]][k[1]]
+		if !ok {
+			continue
+		}
+		p := &plan{refs: refs, first: systemdEffective(f, refs), vals: systemdValues(values)}
+		origs := f.values(refs)[p.first:]
+		if len(origs) == 1 && origs[0] == "" && !(len(p.vals) == 1 && p.vals[0] == "") {
+			// keep the reset, and append the values after it
+			p.first, origs = len(refs), nil
+		}
+		p.emit, p.pair = alignLists(len(origs), len(p.vals), func(i, j int) bool { return origs[i] == p.vals[j] })
+		for _, ref := range refs {
+			plans[ref] = p
+		}
+	}
+	lastSection := make(map[string]int)
+	for i, section := range f.Sections {
+		lastSection[section.Name] = i
+	}
+
+	var buf bytes.Buffer
+	for i, section := range f.Sections {
+		values, ok := cur[section.Name]
+		if !ok && i != 0 {
+			// deleted section
+			continue
+		}
+		insertAt := len(section.Lines)
+		for j, line := range section.Lines {
+			if line.Key != "" {
+				insertAt = j + 1
+			}
+		}
+		for j, line := range section.Lines {
+			if line.Key == "" {
+				buf.WriteString(line.Raw)
+			} else if p := plans[systemdRef{i, j}]; p != nil {
+				n := 0
+				for n < len(p.refs) && p.refs[n] != (systemdRef{i, j}) {
+					n++
+				}
+				if n < p.first {
+					buf.WriteString(line.Raw)
+				} else {
+					for _, k := range p.emit[n-p.first] {
+						if k != p.pair[n-p.first] {
+							ensureNewline(&buf)
+							fmt.Fprintf(&buf, "%s=%s\n", line.Key, p.vals[k])
+						} else if p.vals[k] == line.Value {
+							buf.WriteString(line.Raw)
+						} else {
+							buf.WriteString(line.prefix + p.vals[k] + line.suffix)
+						}
+					}
+				}
+				if n == len(p.refs)-1 && p.first == len(p.refs) {
+					for _, v := range p.vals {
+						ensureNewline(&buf)
+						fmt.Fprintf(&buf, "%s=%s\n", line.Key, v)
+					}
+				}
+			}
+			if j == insertAt-1 && i != 0 && lastSection[section.Name] == i {
+				systemdWriteNew(&buf, values, keys, section.Name)
+			}
+		}
+	}
+
+	// new sections
+	var names []string
+	for name := range cur {
+		if _, ok := lastSection[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ensureNewline(&buf)
+		if buf.Len() != 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n\n")) {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "[%s]\n", name)
+		systemdWriteNew(&buf, cur[name], nil, name)
+	}
+	w.Write(buf.Bytes())
+}
+
+// systemdWriteNew writes the keys of the section which are not in keys.
+func systemdWriteNew(buf *bytes.Buffer, values map[string]interface{}, keys map[[2]string][]systemdRef, section string) {
+	for _, k := range sortedMapKeys(values) {
+		if _, ok := keys[[2]string{section, k}]; ok {
+			continue
+		}
+		ensureNewline(buf)
+		for _, v := range systemdValues(values[k]) {
+			fmt.Fprintf(buf, "%s=%s\n", k, v)
+		}
+	}
+}
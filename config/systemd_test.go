@@ -0,0 +1,157 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+)
+
+const systemdTest1 = `# /etc/systemd/system/app.service
+[Unit]
+Description=The app
+After=network.target
+
+[Service]
+Environment=A=1
+Environment=B=2
+ExecStartPre=/bin/true
+ExecStartPre=
+ExecStartPre=/usr/bin/mkdir -p /run/app
+ExecStart=/usr/bin/app \
+    --port 8080 \
+    --verbose
+ExecReload=
+User=app
+
+[Install]
+WantedBy=multi-user.target
+`
+
+func TestSystemdRoundTrip(t *testing.T) {
+	cfg, err := Parser(systemdEnc).Decode(strings.NewReader(systemdTest1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]interface{}{
+		"Unit/Description":     "The app",
+		"Service/Environment":  []interface{}{"A=1", "B=2"},
+		"Service/ExecStartPre": "/usr/bin/mkdir -p /run/app",
+		"Service/ExecStart":    "/usr/bin/app  --port 8080  --verbose",
+		"Service/ExecReload":   "",
+	} {
+		if got := cfg.Get(strings.Split(path, "/")); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, wanted %#v", path, got, want)
+		}
+	}
+	var buf strings.Builder
+	if err = Dumper(systemdEnc).Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d := diff.Diff(buf.String(), systemdTest1); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestSystemdEdit(t *testing.T) {
+	edit := func(cfg Config) error {
+		for k, v := range map[string]interface{}{
+			"Service/Environment":  []interface{}{"A=1", "C=3", "B=2"},
+			"Service/ExecStartPre": []interface{}{"/usr/bin/mkdir -p /run/app", "/bin/sleep 1"},
+			"Service/ExecReload":   "/bin/kill -HUP $MAINPID",
+			"Service/Restart":      "always",
+			"Unit/Description":     "The new app",
+			"Timer/OnCalendar":     "daily",
+		} {
+			if err := cfg.Set(strings.Split(k, "/"), v); err != nil {
+				return err
+			}
+		}
+		return cfg.Del([]string{"Service", "User"})
+	}
+
+	cfg, err := Parser(systemdEnc).Decode(strings.NewReader(systemdTest1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = edit(cfg); err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err = Dumper(systemdEnc).Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := `# /etc/systemd/system/app.service
+[Unit]
+Description=The new app
+After=network.target
+
+[Service]
+Environment=A=1
+Environment=C=3
+Environment=B=2
+ExecStartPre=/bin/true
+ExecStartPre=
+ExecStartPre=/usr/bin/mkdir -p /run/app
+ExecStartPre=/bin/sleep 1
+ExecStart=/usr/bin/app \
+    --port 8080 \
+    --verbose
+ExecReload=
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=always
+
+[Install]
+WantedBy=multi-user.target
+
+[Timer]
+OnCalendar=daily
+`
+	if d := diff.Diff(buf.String(), want); d != "" {
+		t.Error(d)
+	}
+
+	buf.Reset()
+	if err = DropIn(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want = `[Unit]
+Description=
+Description=The new app
+
+[Service]
+Environment=
+Environment=A=1
+Environment=C=3
+Environment=B=2
+ExecStartPre=
+ExecStartPre=/usr/bin/mkdir -p /run/app
+ExecStartPre=/bin/sleep 1
+ExecReload=
+ExecReload=/bin/kill -HUP $MAINPID
+User=
+Restart=always
+
+[Timer]
+OnCalendar=daily
+`
+	if d := diff.Diff(buf.String(), want); d != "" {
+		t.Error(d)
+	}
+}
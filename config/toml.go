@@ -0,0 +1,1140 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	toml "github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+)
+
+type tomlEncDec struct{}
+
+// tomlSource is the source of a decoded TOML document.
+type tomlSource struct {
+	text string
+	// orig is the tree as decoded, to find the changes.
+	orig map[string]interface{}
+}
+
+func (tomlEncDec) Decode(r io.Reader) (Config, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Config{}, err
+	}
+	tt, err := toml.LoadBytes(b)
+	if err != nil {
+		return Config{}, err
+	}
+	return Config{Tree: tt, src: &tomlSource{text: string(b), orig: tt.ToMap()}}, nil
+}
+
+// Encode the Config as TOML.
+//
+// If the Config has been decoded from TOML, then only the changed keys are rewritten,
+// the comments, the layout of the tables and the order of the keys are kept.
+// If some change cannot be made that way, the whole document is rendered anew.
+func (tomlEncDec) Encode(w io.Writer, cfg Config) error {
+	if src, ok := cfg.src.(*tomlSource); ok {
+		if text, err := src.patch(cfg.Tree.ToMap()); err == nil {
+			_, err = io.WriteString(w, text)
+			return err
+		}
+	}
+	// TOML has no null
+	tt, err := treeFromMap(withoutNulls(cfg.AllSettings()))
+	if _, wErr := io.WriteString(w, tt.String()); wErr != nil && err == nil {
+		return wErr
+	}
+	return err
+}
+
+// patch returns the source text changed to hold cur.
+//
+// The changes are applied one by one, each on the freshly scanned text.
+func (src *tomlSource) patch(cur map[string]interface{}) (string, error) {
+	text := src.text
+	changes := diffValues(nil, nil, src.orig, cur)
+	for len(changes) != 0 {
+		c := changes[0]
+		changes = changes[1:]
+		d, err := scanTOML(text)
+		if err != nil {
+			return text, err
+		}
+		switch c.Op {
+		case "remove":
+			err = d.remove(c.Path)
+		case "add":
+			err = d.add(c.Path, c.New)
+		default:
+			if kv, _ := d.keyValue(c.Path); kv == nil && c.New != nil {
+				// a table replaced with something else
+				changes = append([]Change{{Op: "remove", Path: c.Path}, {Op: "add", Path: c.Path, New: c.New}}, changes...)
+				continue
+			}
+			err = d.replace(c.Path, c.New)
+		}
+		if err != nil {
+			return text, errors.Wrap(err, JoinPointer(c.Path))
+		}
+		text = d.apply()
+	}
+	return text, nil
+}
+
+// tomlDoc is the scanned TOML text: the positions of the tables and the keys.
+type tomlDoc struct {
+	text string
+	// sections[0] is the root table, without header.
+	sections []*tomlSection
+	// arrays holds the number of elements of the arrays of tables, by their joined path.
+	arrays map[string]int
+	// crlf is true if the text has CRLF line endings.
+	crlf  bool
+	edits []tomlEdit
+}
+
+// tomlSection is a table header with the following key-value lines.
+type tomlSection struct {
+	// path of the table, with the indexes of the arrays of tables.
+	path  []string
+	array bool
+	// lead is the start of the comment lines right above the header,
+	// start is the start of the header line, body is the end of it.
+	lead, start, body int
+	// end is the lead of the next section, or the end of the text.
+	end  int
+	keys []*tomlKeyValue
+}
+
+// tomlKeyValue is a key-value line (with all the lines of the value), or an entry of an inline table.
+type tomlKeyValue struct {
+	key        []string
+	start, end int
+	value      *tomlValue
+}
+
+// tomlValue is the position of a value. Arrays have items, inline tables have keys.
+type tomlValue struct {
+	start, end int
+	kind       byte // '[', '{' or 0 for the scalars
+	items      []*tomlValue
+	keys       []*tomlKeyValue
+}
+
+type tomlEdit struct {
+	start, end int
+	text       string
+}
+
+func scanTOML(text string) (*tomlDoc, error) {
+	d := &tomlDoc{text: text, arrays: make(map[string]int), crlf: strings.Contains(text, "\r\n")}
+	s := &tomlSection{}
+	d.sections = append(d.sections, s)
+	sc := tomlScanner{text: text}
+	lead := -1
+	for sc.pos < len(text) {
+		lineStart := sc.pos
+		sc.skipSpace()
+		switch sc.peek() {
+		case '#':
+			if lead < 0 {
+				lead = lineStart
+			}
+			sc.skipLine()
+			continue
+		case '\n', '\r', 0:
+			lead = -1
+			sc.skipLine()
+			continue
+		}
+		if sc.peek() == '[' {
+			if lead < 0 {
+				lead = lineStart
+			}
+			s.end = lead
+			s = &tomlSection{lead: lead, start: lineStart}
+			sc.pos++
+			if s.array = sc.peek() == '['; s.array {
+				sc.pos++
+			}
+			sc.skipSpace()
+			key, err := sc.key()
+			if err != nil {
+				return d, err
+			}
+			closing := "]"
+			if s.array {
+				closing = "]]"
+			}
+			if !strings.HasPrefix(text[sc.pos:], closing) {
+				return d, sc.errorf("%s expected", closing)
+			}
+			sc.pos += len(closing)
+			if err = sc.endLine(); err != nil {
+				return d, err
+			}
+			s.path, s.body = d.resolve(key, s.array), sc.pos
+			d.sections = append(d.sections, s)
+			lead = -1
+			continue
+		}
+		lead = -1
+		kv, err := sc.keyValue()
+		if err != nil {
+			return d, err
+		}
+		if err = sc.endLine(); err != nil {
+			return d, err
+		}
+		kv.start, kv.end = lineStart, sc.pos
+		s.keys = append(s.keys, kv)
+	}
+	s.end = len(text)
+	return d, nil
+}
+
+// resolve returns the path of the table header,
+// with the index of the last element of the arrays of tables.
+func (d *tomlDoc) resolve(key []string, array bool) []string {
+	path := make([]string, 0, 2*len(key))
+	for i, k := range key {
+		path = append(path, k)
+		j := strings.Join(path, "\x00")
+		n, ok := d.arrays[j]
+		if i == len(key)-1 {
+			if array {
+				d.arrays[j] = n + 1
+				path = append(path, strconv.Itoa(n))
+			}
+		} else if ok {
+			path = append(path, strconv.Itoa(n-1))
+		}
+	}
+	return path
+}
+
+// isArray reports whether the path is an array of tables.
+func (d *tomlDoc) isArray(path []string) bool {
+	_, ok := d.arrays[strings.Join(path, "\x00")]
+	return ok
+}
+
+// headerKey returns the path without the indexes of the arrays of tables, as a header key.
+func (d *tomlDoc) headerKey(path []string) []string {
+	key := make([]string, 0, len(path))
+	for i, k := range path {
+		if i == 0 || !d.isArray(path[:i]) {
+			key = append(key, k)
+		}
+	}
+	return key
+}
+
+// section returns the section of the table with exactly this path.
+func (d *tomlDoc) section(path []string) *tomlSection {
+	for _, s := range d.sections {
+		if stringsEqual(s.path, path) {
+			return s
+		}
+	}
+	return nil
+}
+
+// keyValue returns the key-value whose full key is a prefix of the path,
+// and the rest of the path, which is inside the value.
+func (d *tomlDoc) keyValue(path []string) (*tomlKeyValue, []string) {
+	for _, s := range d.sections {
+		if !hasPathPrefix(path, s.path) {
+			continue
+		}
+		for _, kv := range s.keys {
+			if hasPathPrefix(path[len(s.path):], kv.key) {
+				return kv, path[len(s.path)+len(kv.key):]
+			}
+		}
+	}
+	return nil, nil
+}
+
+// dotted returns the key-values which define the table at the path by dotted keys
+// (a.b = 1 defines the table a), and their section.
+func (d *tomlDoc) dotted(path []string) (*tomlSection, []*tomlKeyValue) {
+	for _, s := range d.sections {
+		if len(path) <= len(s.path) || !hasPathPrefix(path, s.path) {
+			continue
+		}
+		rest := path[len(s.path):]
+		var kvs []*tomlKeyValue
+		for _, kv := range s.keys {
+			if len(kv.key) > len(rest) && hasPathPrefix(kv.key, rest) {
+				kvs = append(kvs, kv)
+			}
+		}
+		if len(kvs) != 0 {
+			return s, kvs
+		}
+	}
+	return nil, nil
+}
+
+// value returns the value at the path, which must be a key-value or inside one.
+func (d *tomlDoc) value(path []string) (*tomlValue, error) {
+	kv, rest := d.keyValue(path)
+	if kv == nil {
+		return nil, errors.New("not found")
+	}
+	v := kv.value
+	for _, k := range rest {
+		if i := v.index(k); i < 0 {
+			return nil, errors.Errorf("%q not found", k)
+		} else if v.kind == '[' {
+			v = v.items[i]
+		} else {
+			v = v.keys[i].value
+		}
+	}
+	return v, nil
+}
+
+// index returns the index of the item or key k, or -1.
+func (v *tomlValue) index(k string) int {
+	switch v.kind {
+	case '[':
+		if i, err := strconv.Atoi(k); err == nil && 0 <= i && i < len(v.items) {
+			return i
+		}
+	case '{':
+		for i, kv := range v.keys {
+			if len(kv.key) == 1 && kv.key[0] == k {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func (d *tomlDoc) remove(path []string) error {
+	if kv, rest := d.keyValue(path); kv != nil {
+		if len(rest) == 0 {
+			d.edit(kv.start, kv.end, "")
+			return nil
+		}
+		parent, err := d.value(path[:len(path)-1])
+		if err != nil {
+			return err
+		}
+		i := parent.index(path[len(path)-1])
+		if i < 0 {
+			return errors.New("not found")
+		}
+		d.removeItem(parent, i)
+		return nil
+	}
+	// a table defined by dotted keys
+	_, kvs := d.dotted(path)
+	for _, kv := range kvs {
+		d.edit(kv.start, kv.end, "")
+	}
+	// a table or an array of tables, with all its sub-tables
+	found := len(kvs) != 0
+	for _, s := range d.sections[1:] {
+		if !hasPathPrefix(s.path, path) {
+			continue
+		}
+		found = true
+		start := s.lead
+		for s.end == len(d.text) && d.blankLineBefore(start) != "" {
+			start -= len(d.blankLineBefore(start))
+		}
+		d.edit(start, s.end, "")
+	}
+	if !found {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+// removeItem removes the i-th item of the array or key of the inline table.
+func (d *tomlDoc) removeItem(v *tomlValue, i int) {
+	starts, ends := v.itemSpans()
+	n := len(starts)
+	switch {
+	case n == 1:
+		d.edit(v.start+1, v.end-1, "")
+	case d.ownLine(starts[i]) && d.restOfLine(ends[i]) >= 0:
+		d.edit(d.lineStart(starts[i]), d.restOfLine(ends[i]), "")
+	case i < n-1:
+		d.edit(starts[i], starts[i+1], "")
+	default:
+		d.edit(ends[i-1], ends[i], "")
+	}
+}
+
+func (v *tomlValue) itemSpans() (starts, ends []int) {
+	if v.kind == '{' {
+		for _, kv := range v.keys {
+			starts, ends = append(starts, kv.start), append(ends, kv.end)
+		}
+		return starts, ends
+	}
+	for _, it := range v.items {
+		starts, ends = append(starts, it.start), append(ends, it.end)
+	}
+	return starts, ends
+}
+
+func (d *tomlDoc) add(path []string, value interface{}) error {
+	if value == nil { // TOML has no null
+		return nil
+	}
+	parentPath, k := path[:len(path)-1], path[len(path)-1]
+	if kv, _ := d.keyValue(parentPath); kv != nil {
+		parent, err := d.value(parentPath)
+		if err != nil {
+			return err
+		}
+		return d.insertItem(parent, k, value)
+	}
+	if m, ok := value.(map[string]interface{}); ok && len(parentPath) != 0 {
+		// an emptied array of tables is missing from the text
+		if i, err := strconv.Atoi(k); err == nil && (d.isArray(parentPath) || d.missing(parentPath)) {
+			return d.insertElement(parentPath, i, m)
+		}
+	}
+	if s, _ := d.dotted(parentPath); s == nil && (isTable(value) || isTableArray(value)) {
+		var buf strings.Builder
+		if err := tomlWriteTable(&buf, append(d.headerKey(parentPath), k), value); err != nil {
+			return err
+		}
+		d.insertSection(d.blockEnd(parentPath), buf.String())
+		return nil
+	}
+	return d.insertKey(parentPath, k, value)
+}
+
+// missing reports whether no section and no key is at the path.
+func (d *tomlDoc) missing(path []string) bool {
+	for _, s := range d.sections[1:] {
+		if hasPathPrefix(s.path, path) {
+			return false
+		}
+	}
+	kv, _ := d.keyValue(path)
+	return kv == nil
+}
+
+// insertElement inserts a new [[element]] into the array of tables, at index i.
+func (d *tomlDoc) insertElement(path []string, i int, m map[string]interface{}) error {
+	var buf strings.Builder
+	if err := tomlWriteSection(&buf, d.headerKey(path), m, true); err != nil {
+		return err
+	}
+	elem := d.section(append(append(make([]string, 0, len(path)+1), path...), strconv.Itoa(i)))
+	if elem == nil || !elem.array {
+		if i != d.arrays[strings.Join(path, "\x00")] {
+			return errors.Errorf("index %d out of range", i)
+		}
+		d.insertSection(d.blockEnd(path), buf.String())
+		return nil
+	}
+	buf.WriteString("\n")
+	d.insert(elem.lead, buf.String())
+	return nil
+}
+
+// insertKey inserts a key-value line into the table.
+func (d *tomlDoc) insertKey(path []string, k string, value interface{}) error {
+	if s, kvs := d.dotted(path); s != nil {
+		// after the last dotted key of the table, as a dotted key
+		key := append(append(make([]string, 0, len(path)-len(s.path)+1), path[len(s.path):]...), k)
+		line, err := tomlKeyValueText(key, value)
+		if err != nil {
+			return err
+		}
+		last := kvs[len(kvs)-1]
+		indent := leadingSpace(d.text[last.start:last.end])
+		d.insert(last.end, d.newline(last.end)+indent+line+"\n")
+		return nil
+	}
+	line, err := tomlKeyValueText([]string{k}, value)
+	if err != nil {
+		return err
+	}
+	s := d.section(path)
+	if s == nil {
+		// a super-table of some headers: make it explicit, before its first sub-table
+		for _, s := range d.sections[1:] {
+			if hasPathPrefix(s.path, path) {
+				d.insert(s.lead, "["+tomlJoinKey(d.headerKey(path))+"]\n"+line+"\n\n")
+				return nil
+			}
+		}
+		return errors.New("table not found")
+	}
+	if len(s.keys) != 0 {
+		last := s.keys[len(s.keys)-1]
+		indent := leadingSpace(d.text[last.start:last.end])
+		d.insert(last.end, d.newline(last.end)+indent+line+"\n")
+		return nil
+	}
+	if s.start != 0 || len(s.path) != 0 {
+		d.insert(s.body, d.newline(s.body)+line+"\n")
+		return nil
+	}
+	// the root table without keys: after the leading comments
+	at := s.end
+	for at > 0 && d.blankLineBefore(at) != "" {
+		at -= len(d.blankLineBefore(at))
+	}
+	text := d.newline(at) + line + "\n"
+	if at == s.end && at != len(d.text) {
+		text += "\n"
+	}
+	d.insert(at, text)
+	return nil
+}
+
+// insertItem inserts the value as the k-th item of the array, or as the k key of the inline table.
+func (d *tomlDoc) insertItem(v *tomlValue, k string, value interface{}) error {
+	var text string
+	var err error
+	if v.kind == '{' {
+		text, err = tomlKeyValueText([]string{k}, value)
+	} else {
+		text, err = tomlValueText(value)
+	}
+	if err != nil {
+		return err
+	}
+	starts, ends := v.itemSpans()
+	n := len(starts)
+	i := n
+	if v.kind == '[' {
+		if i, err = strconv.Atoi(k); err != nil || i < 0 || i > n {
+			return errors.Errorf("bad index %q", k)
+		}
+	}
+	switch {
+	case n == 0 && v.kind == '{':
+		d.edit(v.start+1, v.end-1, " "+text+" ")
+	case n == 0:
+		d.edit(v.start+1, v.end-1, text)
+	case i < n && d.ownLine(starts[i]):
+		at := d.lineStart(starts[i])
+		d.insert(at, d.text[at:starts[i]]+text+",\n")
+	case i < n:
+		d.insert(starts[i], text+", ")
+	case d.ownLine(starts[n-1]) && d.restOfLine(ends[n-1]) >= 0:
+		comma, end := d.commaAfter(ends[n-1]), d.restOfLine(ends[n-1])
+		indent := d.text[d.lineStart(starts[n-1]):starts[n-1]]
+		if comma < 0 {
+			d.insert(ends[n-1], ",")
+			d.insert(end, d.newline(end)+indent+text+"\n")
+		} else {
+			d.insert(end, d.newline(end)+indent+text+",\n")
+		}
+	default:
+		d.insert(ends[n-1], ", "+text)
+	}
+	return nil
+}
+
+func (d *tomlDoc) replace(path []string, value interface{}) error {
+	if value == nil {
+		return d.remove(path)
+	}
+	v, err := d.value(path)
+	if err != nil {
+		return err
+	}
+	text, err := tomlValueText(value)
+	if err != nil {
+		return err
+	}
+	if v.kind == 0 {
+		text = d.styled(d.text[v.start:v.end], value, text)
+	}
+	d.edit(v.start, v.end, text)
+	return nil
+}
+
+// styled returns the text of the new value in the style of the old one:
+// the kind of the string quotes, the base of the integers.
+func (d *tomlDoc) styled(old string, value interface{}, text string) string {
+	switch x := value.(type) {
+	case string:
+		switch {
+		case strings.HasPrefix(old, "'''") && !strings.Contains(x, "'''") && !strings.HasSuffix(x, "'"):
+			return "'''" + tomlMultiLineStart(old, x) + x + "'''"
+		case strings.HasPrefix(old, `"""`):
+			return `"""` + tomlMultiLineStart(old, x) + tomlEscape(x, true) + `"""`
+		case strings.HasPrefix(old, "'") && !strings.ContainsAny(x, "'\n\r") && !rTOMLControl.MatchString(x):
+			return "'" + x + "'"
+		}
+	case int64:
+		if x >= 0 && len(old) > 2 && old[0] == '0' {
+			switch old[1] {
+			case 'x':
+				return "0x" + strconv.FormatInt(x, 16)
+			case 'o':
+				return "0o" + strconv.FormatInt(x, 8)
+			case 'b':
+				return "0b" + strconv.FormatInt(x, 2)
+			}
+		}
+	}
+	return text
+}
+
+// tomlMultiLineStart returns the newline to write after the opening quotes of a multi-line string:
+// the first newline is trimmed, so it is needed if the string starts with one, and kept if the old one had it.
+func tomlMultiLineStart(old, s string) string {
+	if strings.HasPrefix(s, "\n") || strings.HasPrefix(old[3:], "\n") {
+		return "\n"
+	}
+	if strings.HasPrefix(old[3:], "\r\n") {
+		return "\r\n"
+	}
+	return ""
+}
+
+// blockEnd returns the end of the last section of the table and its sub-tables,
+// or of its nearest parent which has sections.
+func (d *tomlDoc) blockEnd(path []string) int {
+	for p := path; len(p) != 0; p = p[:len(p)-1] {
+		end := -1
+		for _, s := range d.sections[1:] {
+			if hasPathPrefix(s.path, p) {
+				end = s.end
+			}
+		}
+		if end >= 0 {
+			return end
+		}
+	}
+	return len(d.text)
+}
+
+// insertSection inserts the text of new sections at the end of a block, separated by a blank line.
+func (d *tomlDoc) insertSection(at int, text string) {
+	if at < len(d.text) {
+		d.insert(at, text+"\n")
+		return
+	}
+	if at != 0 {
+		text = d.newline(at) + text
+		if d.blankLineBefore(at) == "" {
+			text = "\n" + text
+		}
+	}
+	d.insert(at, text)
+}
+
+func (d *tomlDoc) edit(start, end int, text string) {
+	if d.crlf {
+		text = strings.Replace(strings.Replace(text, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	}
+	d.edits = append(d.edits, tomlEdit{start: start, end: end, text: text})
+}
+func (d *tomlDoc) insert(at int, text string) { d.edit(at, at, text) }
+
+// apply returns the text with the edits applied.
+func (d *tomlDoc) apply() string {
+	edits := d.edits
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].start < edits[j].start || edits[i].start == edits[j].start && edits[i].end < edits[j].end
+	})
+	var buf strings.Builder
+	var pos int
+	for _, e := range edits {
+		if e.start < pos {
+			continue // overlapping edits
+		}
+		buf.WriteString(d.text[pos:e.start])
+		buf.WriteString(e.text)
+		pos = e.end
+	}
+	buf.WriteString(d.text[pos:])
+	return buf.String()
+}
+
+func (d *tomlDoc) lineStart(off int) int { return strings.LastIndexByte(d.text[:off], '\n') + 1 }
+
+// ownLine reports whether only spaces are before off in its line.
+func (d *tomlDoc) ownLine(off int) bool {
+	return strings.TrimLeft(d.text[d.lineStart(off):off], " \t") == ""
+}
+
+// restOfLine returns the end of the line (after the line ending) if only spaces,
+// a comma and a comment are after off in its line, or -1.
+func (d *tomlDoc) restOfLine(off int) int {
+	sc := tomlScanner{text: d.text, pos: off}
+	sc.skipSpace()
+	if sc.peek() == ',' {
+		sc.pos++
+	}
+	if sc.endLine() != nil {
+		return -1
+	}
+	return sc.pos
+}
+
+// commaAfter returns the position of the comma after the item ending at off, or -1.
+func (d *tomlDoc) commaAfter(off int) int {
+	sc := tomlScanner{text: d.text, pos: off}
+	sc.skipBlank()
+	if sc.peek() == ',' {
+		return sc.pos
+	}
+	return -1
+}
+
+// blankLineBefore returns the line before off (a line start) if it is blank.
+func (d *tomlDoc) blankLineBefore(off int) string {
+	if off == 0 || d.text[off-1] != '\n' {
+		return ""
+	}
+	if line := d.text[d.lineStart(off-1):off]; strings.TrimSpace(line) == "" {
+		return line
+	}
+	return ""
+}
+
+// newline returns the line ending to write before the text inserted at off.
+func (d *tomlDoc) newline(off int) string {
+	if off == 0 || d.text[off-1] == '\n' {
+		return ""
+	}
+	return "\n"
+}
+
+func hasPathPrefix(path, prefix []string) bool {
+	return len(path) >= len(prefix) && stringsEqual(path[:len(prefix)], prefix)
+}
+
+func isTableArray(v interface{}) bool {
+	x, ok := v.([]interface{})
+	if !ok || len(x) == 0 {
+		return false
+	}
+	for _, v := range x {
+		if !isTable(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// tomlWriteTable writes the table (or array of tables) as new sections.
+func tomlWriteTable(w *strings.Builder, key []string, v interface{}) error {
+	if m, ok := v.(map[string]interface{}); ok {
+		return tomlWriteSection(w, key, m, false)
+	}
+	for i, v := range v.([]interface{}) {
+		if i != 0 {
+			w.WriteString("\n")
+		}
+		if err := tomlWriteSection(w, key, v.(map[string]interface{}), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tomlWriteSection writes the header, the values of the table, then its sub-tables.
+// The header of a table with sub-tables only is omitted.
+func tomlWriteSection(w *strings.Builder, key []string, m map[string]interface{}, array bool) error {
+	var lines, tables []string
+	for _, k := range sortedMapKeys(m) {
+		v := m[k]
+		if v == nil {
+			continue
+		}
+		if isTable(v) || isTableArray(v) {
+			tables = append(tables, k)
+			continue
+		}
+		line, err := tomlKeyValueText([]string{k}, v)
+		if err != nil {
+			return errors.Wrap(err, k)
+		}
+		lines = append(lines, line+"\n")
+	}
+	header := array || len(lines) != 0 || len(tables) == 0
+	if array {
+		fmt.Fprintf(w, "[[%s]]\n", tomlJoinKey(key))
+	} else if header {
+		fmt.Fprintf(w, "[%s]\n", tomlJoinKey(key))
+	}
+	w.WriteString(strings.Join(lines, ""))
+	for i, k := range tables {
+		if header || i != 0 {
+			w.WriteString("\n")
+		}
+		if err := tomlWriteTable(w, append(append(make([]string, 0, len(key)+1), key...), k), m[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tomlKeyValueText(key []string, value interface{}) (string, error) {
+	text, err := tomlValueText(value)
+	return tomlJoinKey(key) + " = " + text, err
+}
+
+// tomlValueText returns the value as a TOML literal; the tables as inline tables.
+func tomlValueText(v interface{}) (string, error) {
+	switch x := normalizeValue(plainValue(v)).(type) {
+	case string:
+		return tomlEscape(x, false), nil
+	case bool:
+		return strconv.FormatBool(x), nil
+	case int64:
+		return strconv.FormatInt(x, 10), nil
+	case uint64:
+		return strconv.FormatUint(x, 10), nil
+	case float64:
+		switch {
+		case math.IsNaN(x):
+			return "nan", nil
+		case math.IsInf(x, 1):
+			return "inf", nil
+		case math.IsInf(x, -1):
+			return "-inf", nil
+		}
+		s := strconv.FormatFloat(x, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eE") {
+			s += ".0"
+		}
+		return s, nil
+	case time.Time:
+		return x.Format(time.RFC3339Nano), nil
+	case []interface{}:
+		parts := make([]string, 0, len(x))
+		for _, v := range x {
+			if v == nil {
+				continue
+			}
+			s, err := tomlValueText(v)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return "[" + strings.Join(parts, ", ") + "]", nil
+	case map[string]interface{}:
+		if len(x) == 0 {
+			return "{}", nil
+		}
+		parts := make([]string, 0, len(x))
+		for _, k := range sortedMapKeys(x) {
+			if x[k] == nil {
+				continue
+			}
+			s, err := tomlKeyValueText([]string{k}, x[k])
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return "{ " + strings.Join(parts, ", ") + " }", nil
+	case nil:
+		return "", errors.New("TOML has no null")
+	default:
+		return "", errors.Errorf("unknown type %T", v)
+	}
+}
+
+var rTOMLBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+var rTOMLControl = regexp.MustCompile("[\x00-\x08\x0b-\x1f\x7f]")
+
+func tomlJoinKey(key []string) string {
+	parts := make([]string, len(key))
+	for i, k := range key {
+		if rTOMLBareKey.MatchString(k) {
+			parts[i] = k
+		} else {
+			parts[i] = tomlEscape(k, false)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// tomlEscape returns the string as a basic string - without the quotes if multiLine.
+func tomlEscape(s string, multiLine bool) string {
+	var buf strings.Builder
+	if !multiLine {
+		buf.WriteByte('"')
+	}
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			buf.WriteString(`\\`)
+		case r == '"' && (!multiLine || strings.HasPrefix(s[i:], `"""`) || i == len(s)-1):
+			buf.WriteString(`\"`)
+		case r == '\n' && multiLine:
+			buf.WriteByte('\n')
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r == '\r' && !(multiLine && strings.HasPrefix(s[i:], "\r\n")):
+			buf.WriteString(`\r`)
+		case r < 0x20 && r != '\r' || r == 0x7f:
+			fmt.Fprintf(&buf, `\u%04X`, r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	if !multiLine {
+		buf.WriteByte('"')
+	}
+	return buf.String()
+}
+
+// tomlScanner finds the positions of the keys and values in the TOML text.
+type tomlScanner struct {
+	text string
+	pos  int
+}
+
+func (sc *tomlScanner) peek() byte {
+	if sc.pos < len(sc.text) {
+		return sc.text[sc.pos]
+	}
+	return 0
+}
+
+func (sc *tomlScanner) errorf(format string, args ...interface{}) error {
+	line := strings.Count(sc.text[:sc.pos], "\n") + 1
+	return errors.Errorf("%d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (sc *tomlScanner) skipSpace() {
+	for c := sc.peek(); c == ' ' || c == '\t'; c = sc.peek() {
+		sc.pos++
+	}
+}
+
+// skipBlank skips the spaces, line endings and comments.
+func (sc *tomlScanner) skipBlank() {
+	for {
+		sc.skipSpace()
+		switch sc.peek() {
+		case '#':
+			sc.skipLine()
+		case '\n', '\r':
+			sc.pos++
+		default:
+			return
+		}
+	}
+}
+
+// skipLine skips to the start of the next line.
+func (sc *tomlScanner) skipLine() {
+	if i := strings.IndexByte(sc.text[sc.pos:], '\n'); i >= 0 {
+		sc.pos += i + 1
+	} else {
+		sc.pos = len(sc.text)
+	}
+}
+
+// endLine skips the spaces and the comment, to the start of the next line.
+func (sc *tomlScanner) endLine() error {
+	sc.skipSpace()
+	switch sc.peek() {
+	case '#', '\n', 0:
+		sc.skipLine()
+		return nil
+	case '\r':
+		if strings.HasPrefix(sc.text[sc.pos:], "\r\n") {
+			sc.skipLine()
+			return nil
+		}
+	}
+	return sc.errorf("unexpected %q", sc.peek())
+}
+
+// key scans a dotted key.
+func (sc *tomlScanner) key() ([]string, error) {
+	var key []string
+	for {
+		sc.skipSpace()
+		start := sc.pos
+		switch sc.peek() {
+		case '"':
+			end, err := sc.basicString(start)
+			if err != nil {
+				return key, err
+			}
+			k, err := strconv.Unquote(sc.text[start:end])
+			if err != nil {
+				return key, sc.errorf("bad key %s: %v", sc.text[start:end], err)
+			}
+			key = append(key, k)
+			sc.pos = end
+		case '\'':
+			i := strings.IndexAny(sc.text[start+1:], "'\n")
+			if i < 0 || sc.text[start+1+i] != '\'' {
+				return key, sc.errorf("unclosed key")
+			}
+			key = append(key, sc.text[start+1:start+1+i])
+			sc.pos = start + i + 2
+		default:
+			for c := sc.peek(); c == '_' || c == '-' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'; c = sc.peek() {
+				sc.pos++
+			}
+			if sc.pos == start {
+				return key, sc.errorf("key expected")
+			}
+			key = append(key, sc.text[start:sc.pos])
+		}
+		sc.skipSpace()
+		if sc.peek() != '.' {
+			return key, nil
+		}
+		sc.pos++
+	}
+}
+
+// keyValue scans "key = value".
+func (sc *tomlScanner) keyValue() (*tomlKeyValue, error) {
+	kv := &tomlKeyValue{start: sc.pos}
+	var err error
+	if kv.key, err = sc.key(); err != nil {
+		return kv, err
+	}
+	if sc.peek() != '=' {
+		return kv, sc.errorf("= expected")
+	}
+	sc.pos++
+	sc.skipSpace()
+	kv.value, err = sc.value()
+	kv.end = sc.pos
+	return kv, err
+}
+
+func (sc *tomlScanner) value() (*tomlValue, error) {
+	v := &tomlValue{start: sc.pos}
+	var err error
+	switch c := sc.peek(); c {
+	case '"':
+		sc.pos, err = sc.basicString(sc.pos)
+	case '\'':
+		if strings.HasPrefix(sc.text[sc.pos:], "'''") {
+			i := strings.Index(sc.text[sc.pos+3:], "'''")
+			if i < 0 {
+				return v, sc.errorf("unclosed multi-line string")
+			}
+			sc.pos += 3 + i + 3
+			for j := 0; j < 2 && sc.peek() == '\''; j++ {
+				sc.pos++
+			}
+		} else if i := strings.IndexAny(sc.text[sc.pos+1:], "'\n"); i < 0 || sc.text[sc.pos+1+i] != '\'' {
+			return v, sc.errorf("unclosed string")
+		} else {
+			sc.pos += i + 2
+		}
+	case '[':
+		v.kind = c
+		sc.pos++
+		for {
+			sc.skipBlank()
+			if sc.peek() == ']' {
+				break
+			}
+			item, err := sc.value()
+			if err != nil {
+				return v, err
+			}
+			v.items = append(v.items, item)
+			sc.skipBlank()
+			if sc.peek() == ',' {
+				sc.pos++
+			} else if sc.peek() != ']' {
+				return v, sc.errorf("] expected")
+			}
+		}
+		sc.pos++
+	case '{':
+		v.kind = c
+		sc.pos++
+		for {
+			sc.skipSpace()
+			if sc.peek() == '}' {
+				break
+			}
+			kv, err := sc.keyValue()
+			if err != nil {
+				return v, err
+			}
+			v.keys = append(v.keys, kv)
+			sc.skipSpace()
+			if sc.peek() == ',' {
+				sc.pos++
+			} else if sc.peek() != '}' {
+				return v, sc.errorf("} expected")
+			}
+		}
+		sc.pos++
+	default:
+		i := strings.IndexAny(sc.text[sc.pos:], ",]}#\r\n")
+		if i < 0 {
+			i = len(sc.text) - sc.pos
+		}
+		sc.pos += len(strings.TrimRight(sc.text[sc.pos:sc.pos+i], " \t"))
+		if sc.pos == v.start {
+			return v, sc.errorf("value expected")
+		}
+	}
+	v.end = sc.pos
+	return v, err
+}
+
+// basicString returns the end of the (multi-line) basic string starting at start.
+func (sc *tomlScanner) basicString(start int) (int, error) {
+	quote := `"`
+	if strings.HasPrefix(sc.text[start:], `"""`) {
+		quote = `"""`
+	}
+	for i := start + len(quote); i < len(sc.text); i++ {
+		switch c := sc.text[i]; {
+		case c == '\\':
+			i++
+		case c == '\n' && quote == `"`:
+			return i, sc.errorf("unclosed string")
+		case strings.HasPrefix(sc.text[i:], quote):
+			end := i + len(quote)
+			for j := 0; j < 2 && quote == `"""` && end < len(sc.text) && sc.text[end] == '"'; j++ {
+				end++
+			}
+			return end, nil
+		}
+	}
+	return len(sc.text), sc.errorf("unclosed string")
+}
@@ -0,0 +1,235 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+)
+
+const tomlTest1 = `# Cargo manifest
+[package]
+name = "confed"   # the name
+version = '0.1.0'
+authors = [
+    "a <a@example.com>",
+    "b <b@example.com>", # second
+]
+
+[dependencies]
+serde = { version = "1.0", features = ["derive"] }
+toml = "0.5"
+
+# the binaries
+[[bin]]
+name = "one"
+path = "src/one.rs"
+
+[bin.meta]
+x = 1
+
+[[bin]]
+name = "two"
+
+[profile.release]
+lto = true
+`
+
+func TestTOMLRoundTrip(t *testing.T) {
+	for _, src := range []string{tomlTest1, "a = 1\n", "", "a.b = 1\n[c]\nd.'e.f' = [1, 2]\n"} {
+		cfg, err := Parser(tomlEnc).Decode(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf strings.Builder
+		if err = Dumper(tomlEnc).Encode(&buf, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if d := diff.Diff(buf.String(), src); d != "" {
+			t.Error(d)
+		}
+	}
+}
+
+func TestTOMLEdit(t *testing.T) {
+	for i, tc := range []struct {
+		Src  string
+		Edit func(cfg Config) error
+		Want string
+	}{
+		{Src: tomlTest1,
+			Edit: func(cfg Config) error {
+				for k, v := range map[string]interface{}{
+					"package/version":                    "0.2.0",
+					"package/edition":                    "2018",
+					"package/authors/2":                  "c <c@example.com>",
+					"dependencies/serde/features/1":      "std",
+					"dependencies/serde/optional":        true,
+					"bin/1/path":                         "src/two.rs",
+					"profile/release/opt-level":          int64(3),
+					"profile/dev":                        map[string]interface{}{"debug": false},
+					"workspace/members":                  []interface{}{"a", "b"},
+					"dependencies/clap/version":          "2",
+					"bin/0/meta/y":                       2.5,
+					"package/metadata/docs.rs/all-feats": true,
+				} {
+					if err := cfg.Set(strings.Split(k, "/"), v); err != nil {
+						return err
+					}
+				}
+				return cfg.Del([]string{"dependencies", "toml"})
+			},
+			Want: `# Cargo manifest
+[package]
+name = "confed"   # the name
+version = '0.2.0'
+authors = [
+    "a <a@example.com>",
+    "b <b@example.com>", # second
+    "c <c@example.com>",
+]
+edition = "2018"
+
+[package.metadata."docs.rs"]
+all-feats = true
+
+[dependencies]
+serde = { version = "1.0", features = ["derive", "std"], optional = true }
+
+[dependencies.clap]
+version = "2"
+
+# the binaries
+[[bin]]
+name = "one"
+path = "src/one.rs"
+
+[bin.meta]
+x = 1
+y = 2.5
+
+[[bin]]
+name = "two"
+path = "src/two.rs"
+
+[profile.release]
+lto = true
+opt-level = 3
+
+[profile.dev]
+debug = false
+
+[workspace]
+members = ["a", "b"]
+`},
+
+		{Src: tomlTest1,
+			Edit: func(cfg Config) error {
+				if err := cfg.Del([]string{"bin", "0"}); err != nil {
+					return err
+				}
+				if err := cfg.Del([]string{"package", "authors", "0"}); err != nil {
+					return err
+				}
+				if err := cfg.Set([]string{"bin", "1"}, map[string]interface{}{"name": "three"}); err != nil {
+					return err
+				}
+				return cfg.Del([]string{"profile"})
+			},
+			Want: `# Cargo manifest
+[package]
+name = "confed"   # the name
+version = '0.1.0'
+authors = [
+    "b <b@example.com>", # second
+]
+
+[dependencies]
+serde = { version = "1.0", features = ["derive"] }
+toml = "0.5"
+
+[[bin]]
+name = "two"
+
+[[bin]]
+name = "three"
+`},
+
+		{Src: "# header\n\n[a.b]\nc = 1\n",
+			Edit: func(cfg Config) error {
+				if err := cfg.Set([]string{"top"}, "x"); err != nil {
+					return err
+				}
+				return cfg.Set([]string{"a", "d"}, int64(0))
+			},
+			Want: "# header\ntop = \"x\"\n\n[a]\nd = 0\n\n[a.b]\nc = 1\n"},
+
+		{Src: "[[u]]\nn = 1\n",
+			Edit: func(cfg Config) error { return cfg.Set([]string{"u", "1", "n"}, int64(2)) },
+			Want: "[[u]]\nn = 1\n\n[[u]]\nn = 2\n"},
+
+		{Src: "s = \"\"\"\none\"\"\"\nn = 0xff\nt = 1979-05-27T07:32:00Z\n",
+			Edit: func(cfg Config) error {
+				if err := cfg.Set([]string{"s"}, "one\ntwo"); err != nil {
+					return err
+				}
+				return cfg.Set([]string{"n"}, int64(16))
+			},
+			Want: "s = \"\"\"\none\ntwo\"\"\"\nn = 0x10\nt = 1979-05-27T07:32:00Z\n"},
+
+		{Src: "# dotted\na.b = 1 # c\na.c.d = \"x\"\n\n[t]\nx.y = true\nz = 0\n",
+			Edit: func(cfg Config) error {
+				for k, v := range map[string]interface{}{
+					"a/b":   int64(2),
+					"a/e":   "y",
+					"t/x/w": false,
+				} {
+					if err := cfg.Set(strings.Split(k, "/"), v); err != nil {
+						return err
+					}
+				}
+				return cfg.Del([]string{"a", "c"})
+			},
+			Want: "# dotted\na.b = 2 # c\na.e = \"y\"\n\n[t]\nx.y = true\nx.w = false\nz = 0\n"},
+	} {
+		cfg, err := Parser(tomlEnc).Decode(strings.NewReader(tc.Src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tc.Edit(cfg); err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		var buf strings.Builder
+		if err = Dumper(tomlEnc).Encode(&buf, cfg); err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		if d := diff.Diff(buf.String(), tc.Want); d != "" {
+			t.Errorf("%d. %s", i, d)
+		}
+		// the text must hold the same tree
+		cfg2, err := Parser(tomlEnc).Decode(strings.NewReader(buf.String()))
+		if err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		if cs, err := Diff(cfg, cfg2); err != nil {
+			t.Fatal(err)
+		} else if len(cs) != 0 {
+			t.Errorf("%d. changed: %s", i, cs)
+		}
+	}
+}
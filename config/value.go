@@ -0,0 +1,199 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ValueTypes are the type names accepted by ParseTypedValue.
+var ValueTypes = []string{"string", "int", "float", "bool", "null", "datetime", "json"}
+
+var rFloat = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// ParseValue infers the type of the literal:
+// null, true/false, integer, float, RFC 3339 datetime, JSON string, array or object.
+// Anything else (including numbers with leading zeros) is returned as is, as a string.
+func ParseValue(s string) interface{} {
+	switch s {
+	case "null":
+		return nil
+	case "true":
+		return true
+	case "false":
+		return false
+	case "":
+		return s
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil && !hasLeadingZero(s) {
+		return i
+	}
+	if rFloat.MatchString(s) && !hasLeadingZero(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t
+	}
+	switch s[0] {
+	case '"', '[', '{':
+		if v, err := parseJSON(s); err == nil {
+			return v
+		}
+	}
+	return s
+}
+
+// ParseTypedValue parses s as the given type (one of ValueTypes).
+func ParseTypedValue(typ, s string) (interface{}, error) {
+	switch typ {
+	case "string", "str":
+		return s, nil
+	case "int", "integer":
+		return parseInt(s)
+	case "float", "number":
+		f, err := strconv.ParseFloat(s, 64)
+		return f, errors.Wrap(err, s)
+	case "bool", "boolean":
+		b, err := strconv.ParseBool(s)
+		return b, errors.Wrap(err, s)
+	case "null", "nil":
+		if s != "" && s != "null" {
+			return nil, errors.Errorf("%q is not null", s)
+		}
+		return nil, nil
+	case "datetime", "time":
+		t, err := time.Parse(time.RFC3339Nano, s)
+		return t, errors.Wrap(err, s)
+	case "json":
+		return parseJSON(s)
+	}
+	return nil, errors.Wrapf(ErrUnknownType, "%q (known: %s)", typ, strings.Join(ValueTypes, ", "))
+}
+
+// parseInt parses a decimal integer (a leading zero is not octal),
+// or a hexadecimal one with 0x prefix.
+func parseInt(s string) (int64, error) {
+	digits, base := s, 10
+	if t := strings.TrimLeft(s, "+-"); len(s)-len(t) <= 1 && (strings.HasPrefix(t, "0x") || strings.HasPrefix(t, "0X")) {
+		digits, base = s[:len(s)-len(t)]+t[2:], 16
+	}
+	i, err := strconv.ParseInt(digits, base, 64)
+	return i, errors.Wrap(err, s)
+}
+
+func hasLeadingZero(s string) bool {
+	s = strings.TrimLeft(s, "+-")
+	return len(s) > 1 && s[0] == '0' && s[1] != '.'
+}
+
+// parseJSON parses the JSON text, with integer numbers as int64.
+func parseJSON(s string) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, errors.Wrap(err, s)
+	}
+	if dec.More() {
+		return nil, errors.Errorf("garbage after JSON value in %q", s)
+	}
+	return fromJSONNumbers(v), nil
+}
+
+// fromJSONNumbers replaces the json.Numbers with int64 or float64.
+func fromJSONNumbers(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case []interface{}:
+		for i, v := range x {
+			x[i] = fromJSONNumbers(v)
+		}
+	case map[string]interface{}:
+		for k, v := range x {
+			x[k] = fromJSONNumbers(v)
+		}
+	}
+	return v
+}
+
+// FormatValue returns the text form of the value, as the formats without types write it:
+// RFC 3339 for times, JSON for lists and tables, empty string for null.
+func FormatValue(v interface{}) string {
+	switch x := plainValue(v).(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case []interface{}, map[string]interface{}:
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(x); err != nil {
+			return fmt.Sprintf("%v", x)
+		}
+		return strings.TrimSuffix(buf.String(), "\n")
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// normalizeValue converts the integers to int64 and the floats to float64,
+// as the TOML tree expects them.
+func normalizeValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int:
+		return int64(x)
+	case int8:
+		return int64(x)
+	case int16:
+		return int64(x)
+	case int32:
+		return int64(x)
+	case uint:
+		return uint64(x)
+	case uint8:
+		return uint64(x)
+	case uint16:
+		return uint64(x)
+	case uint32:
+		return uint64(x)
+	case float32:
+		return float64(x)
+	case []string:
+		is := make([]interface{}, len(x))
+		for i, s := range x {
+			is[i] = s
+		}
+		return is
+	}
+	return v
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseValue(t *testing.T) {
+	for s, want := range map[string]interface{}{
+		"8080":                 int64(8080),
+		"-1":                   int64(-1),
+		"0755":                 "0755",
+		"1.5":                  1.5,
+		"1e3":                  1e3,
+		"true":                 true,
+		"null":                 nil,
+		"30s":                  "30s",
+		`"8080"`:               "8080",
+		"2019-02-03T04:05:06Z": time.Date(2019, 2, 3, 4, 5, 6, 0, time.UTC),
+		`[1,"a"]`:              []interface{}{int64(1), "a"},
+		`{"a":{"b":1.5}}`:      map[string]interface{}{"a": map[string]interface{}{"b": 1.5}},
+		"[not json":            "[not json",
+	} {
+		if got := ParseValue(s); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %#v, wanted %#v", s, got, want)
+		}
+	}
+
+	if v, err := ParseTypedValue("string", "8080"); err != nil || v != "8080" {
+		t.Errorf("string: got %#v, %v", v, err)
+	}
+	for s, want := range map[string]int64{"010": 10, "08": 8, "-0755": -755, "+1": 1, "0x1F": 31, "-0xff": -255} {
+		if v, err := ParseTypedValue("int", s); err != nil || v != want {
+			t.Errorf("int %s: got %#v, %v, wanted %d", s, v, err, want)
+		}
+	}
+	for _, s := range []string{"x", "0b11", "0o7", "1_000", "0x", "--0x1"} {
+		if _, err := ParseTypedValue("int", s); err == nil {
+			t.Errorf("int %s: wanted error", s)
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	cfg, err := New(map[string]interface{}{"a": map[string]interface{}{"b": 1, "c": []interface{}{"x<y", 2.5}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		V    interface{}
+		Want string
+	}{
+		{V: nil, Want: ""},
+		{V: "a b", Want: "a b"},
+		{V: int64(8080), Want: "8080"},
+		{V: true, Want: "true"},
+		{V: time.Date(2019, 2, 3, 4, 5, 6, 0, time.UTC), Want: "2019-02-03T04:05:06Z"},
+		{V: cfg.Get([]string{"a", "c"}), Want: `["x<y",2.5]`},
+		{V: cfg.Get([]string{"a"}), Want: `{"b":1,"c":["x<y",2.5]}`},
+	} {
+		if got := FormatValue(tc.V); got != tc.Want {
+			t.Errorf("%d. got %q, wanted %q", i, got, tc.Want)
+		}
+	}
+}
+
+func TestTypedSet(t *testing.T) {
+	cfg, err := New(map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"server/port":    "8080",
+		"server/debug":   "true",
+		"server/ratio":   "0.5",
+		"server/nothing": "null",
+		"server/hosts":   `["a","b"]`,
+		"upstream":       `[{"host":"a"},{"host":"b"}]`,
+	} {
+		if err = cfg.Set(strings.Split(k, "/"), ParseValue(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for typ, want := range map[Type]string{
+		jsonEnc: `"port": 8080`,
+		yamlEnc: `port: 8080`,
+		tomlEnc: `port = 8080`,
+	} {
+		var buf bytes.Buffer
+		if err = Dumper(typ).Encode(&buf, cfg); err != nil {
+			t.Fatalf("%s: %+v", typ, err)
+		}
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%s: %q not found in\n%s", typ, want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,512 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// xmlAttrPrefix and xmlTextKey are the keys of the attributes and the text of an element.
+const xmlAttrPrefix, xmlTextKey = "@", "#text"
+
+// xmlEncDec is for XML documents.
+//
+// The root element is the only top-level key. An element with text only is the (trimmed) text,
+// otherwise a table of its attributes (as "@name"), its text (as "#text") and its child elements;
+// the repeated siblings are a list. The names are as written, with their namespace prefixes.
+type xmlEncDec struct{}
+
+func (ed xmlEncDec) Decode(r io.Reader) (Config, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Config{}, err
+	}
+	f := &xmlFile{text: string(b)}
+	if f.root, err = parseXML(f.text); err != nil {
+		return Config{}, err
+	}
+	m := make(map[string]interface{}, 1)
+	if f.root != nil {
+		m[f.root.Name] = f.root.node()
+	}
+	tt, err := treeFromMap(m)
+	if err != nil {
+		return Config{Tree: tt}, err
+	}
+	f.orig = tt.ToMap()
+	return Config{Tree: tt, src: f}, nil
+}
+
+// Encode the Config as an XML document.
+//
+// If the Config has been decoded from an XML document, then the original text is written back
+// (with its declaration, comments and namespaces), with only the changed attributes, texts
+// and elements rewritten. The new attributes go after the existing ones, the new elements
+// after the last child of their parent.
+func (ed xmlEncDec) Encode(w io.Writer, cfg Config) error {
+	cur := cfg.Tree.ToMap()
+	if len(cur) > 1 {
+		return errors.Errorf("an XML document has one root element, not %d", len(cur))
+	}
+	var buf bytes.Buffer
+	if f, ok := cfg.src.(*xmlFile); ok && f.root != nil {
+		f.writeBody(&buf, []*xmlElement{f.root}, nil, 0, len(f.text), "", f.orig, cur)
+	} else {
+		buf.WriteString(xml.Header)
+		for k, v := range cur {
+			buf.WriteString(xmlFormat(k, v, "", "  ") + "\n")
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return errors.Wrap(err, "write xml")
+}
+
+// xmlFile is the source of an XML document, with its root element.
+type xmlFile struct {
+	text string
+	root *xmlElement
+	// orig is the tree as decoded, to find the changed nodes.
+	orig map[string]interface{}
+}
+
+// xmlElement is an element in the source, with the offsets of its parts in the text.
+type xmlElement struct {
+	Name     string
+	Attrs    []xmlAttr
+	Texts    []xmlText
+	Children []*xmlElement
+	// start is the offset of the start tag, tagEnd is after it;
+	// closeStart is the offset of the end tag, end is after it - both are tagEnd for an empty element tag.
+	start, tagEnd, closeStart, end int
+	// lstart and lend are the offsets of the whole lines of the element, if it doesn't share them.
+	lstart, lend int
+}
+
+// xmlAttr is an attribute in the source: start is the offset of the space before it.
+type xmlAttr struct {
+	Name, Value                      string
+	start, valueStart, valueEnd, end int
+}
+
+// xmlText is a character data (or CDATA section) in the source.
+type xmlText struct {
+	Text       string
+	start, end int
+}
+
+func (e *xmlElement) selfClosing() bool { return e.closeStart == e.tagEnd }
+
+// text returns the text of the element, trimmed.
+func (e *xmlElement) text() string {
+	var buf strings.Builder
+	for _, t := range e.Texts {
+		buf.WriteString(t.Text)
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// node returns the tree node of the element.
+func (e *xmlElement) node() interface{} {
+	if len(e.Attrs) == 0 && len(e.Children) == 0 {
+		return e.text()
+	}
+	m := xmlNodes(e.Children)
+	for _, a := range e.Attrs {
+		m[xmlAttrPrefix+a.Name] = a.Value
+	}
+	if s := e.text(); s != "" {
+		m[xmlTextKey] = s
+	}
+	return m
+}
+
+// xmlNodes returns the tree of the elements, the repeated ones as lists.
+func xmlNodes(elements []*xmlElement) map[string]interface{} {
+	m := make(map[string]interface{}, len(elements))
+	for _, e := range elements {
+		switch x := m[e.Name].(type) {
+		case nil:
+			m[e.Name] = e.node()
+		case []interface{}:
+			m[e.Name] = append(x, e.node())
+		default:
+			m[e.Name] = []interface{}{x, e.node()}
+		}
+	}
+	return m
+}
+
+// xmlInstances returns the elements of a node: all for a list, else the node itself.
+func xmlInstances(v interface{}) []interface{} {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return x
+	}
+	return []interface{}{v}
+}
+
+func parseXML(text string) (*xmlElement, error) {
+	d := xml.NewDecoder(strings.NewReader(text))
+	var root *xmlElement
+	var stack []*xmlElement
+	for {
+		start := int(d.InputOffset())
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return root, err
+		}
+		end := int(d.InputOffset())
+		switch t := tok.(type) {
+		case xml.StartElement:
+			e := &xmlElement{Name: xmlName(t.Name), start: start, tagEnd: end, closeStart: -1}
+			if err = e.scanAttrs(text, t.Attr); err != nil {
+				return root, err
+			}
+			if len(stack) != 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, e)
+			} else if root == nil {
+				root = e
+			} else {
+				return root, errors.Errorf("%d: second root element %q", lineNo(text, start), e.Name)
+			}
+			stack = append(stack, e)
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return root, errors.Errorf("%d: unexpected end element %q", lineNo(text, start), xmlName(t.Name))
+			}
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if xmlName(t.Name) != e.Name {
+				return root, errors.Errorf("%d: element %q closed by %q", lineNo(text, start), e.Name, xmlName(t.Name))
+			}
+			e.closeStart, e.end = start, end
+			if start == e.tagEnd && strings.HasSuffix(text[:start], "/>") {
+				// <empty/>
+				e.closeStart = e.tagEnd
+			}
+			e.lstart, e.lend = lineSpan(text, e.start, e.end, "<!--")
+		case xml.CharData:
+			if len(stack) != 0 {
+				e := stack[len(stack)-1]
+				e.Texts = append(e.Texts, xmlText{Text: string(t), start: start, end: end})
+			}
+		}
+	}
+	if len(stack) != 0 {
+		return root, errors.Errorf("unclosed element %q", stack[len(stack)-1].Name)
+	}
+	return root, nil
+}
+
+func xmlName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// scanAttrs finds the offsets of the attributes in the start tag.
+func (e *xmlElement) scanAttrs(text string, attrs []xml.Attr) error {
+	i := e.start + 1 + len(e.Name)
+	skipSpace := func() {
+		for i < e.tagEnd && strings.IndexByte(" \t\r\n", text[i]) >= 0 {
+			i++
+		}
+	}
+	for _, attr := range attrs {
+		a := xmlAttr{Name: xmlName(attr.Name), Value: attr.Value, start: i}
+		skipSpace()
+		i += len(a.Name)
+		skipSpace()
+		if i >= e.tagEnd || text[i] != '=' {
+			return errors.Errorf("%d: attribute %q without value", lineNo(text, i), a.Name)
+		}
+		i++
+		skipSpace()
+		q := text[i]
+		j := strings.IndexByte(text[i+1:e.tagEnd], q)
+		if j < 0 {
+			return errors.Errorf("%d: unclosed attribute %q", lineNo(text, i), a.Name)
+		}
+		a.valueStart, a.valueEnd = i+1, i+1+j
+		i = a.valueEnd + 1
+		a.end = i
+		e.Attrs = append(e.Attrs, a)
+	}
+	return nil
+}
+
+// xmlMap returns the node as a table: the text of an element with text only is its "#text".
+func xmlMap(v interface{}) map[string]interface{} {
+	if m, ok := v.(map[string]interface{}); ok {
+		return m
+	}
+	if s := FormatValue(v); s != "" {
+		return map[string]interface{}{xmlTextKey: s}
+	}
+	return nil
+}
+
+// writeBody writes the text from..to, which holds the elements children and the texts,
+// with the elements of cur in place of those of orig, and the "#text" of cur in place of the texts.
+func (f *xmlFile) writeBody(buf *bytes.Buffer, children []*xmlElement, texts []xmlText, from, to int, indent string, orig, cur map[string]interface{}) {
+	// the changed text replaces the non-space parts of the texts, at the first of them
+	type replacement struct {
+		start, end int
+		text       string
+	}
+	var reps []replacement
+	if s, o := FormatValue(cur[xmlTextKey]), FormatValue(orig[xmlTextKey]); s != o {
+		for _, t := range texts {
+			trimmed := strings.TrimSpace(f.text[t.start:t.end])
+			if trimmed == "" {
+				continue
+			}
+			start := t.start + strings.Index(f.text[t.start:t.end], trimmed)
+			r := replacement{start: start, end: start + len(trimmed)}
+			if len(reps) == 0 {
+				r.text = xmlEscapeText(s, trimmed)
+			}
+			reps = append(reps, r)
+		}
+		if len(reps) == 0 && s != "" {
+			reps = append(reps, replacement{start: from, end: from, text: xmlEscapeText(s, "")})
+		}
+	}
+	writeRange := func(buf *bytes.Buffer, from, to int) {
+		for _, r := range reps {
+			if from <= r.start && r.end <= to {
+				buf.WriteString(f.text[from:r.start])
+				buf.WriteString(r.text)
+				from = r.end
+			}
+		}
+		buf.WriteString(f.text[from:to])
+	}
+	var gap bytes.Buffer
+	gapTo := func(from, to int, dropped bool) {
+		gap.Reset()
+		writeRange(&gap, from, to)
+		writeGap(buf, gap.String(), dropped)
+	}
+
+	count := make(map[string]int, len(children))
+	for _, e := range children {
+		count[e.Name]++
+	}
+	if len(children) != 0 {
+		indent = leadingSpace(f.text[strings.LastIndexByte(f.text[:children[0].start], '\n')+1:])
+	}
+	pos, dropped := from, false
+	seen := make(map[string]int, len(count))
+	emits, pairs := make(map[string][][]int, len(count)), make(map[string][]int, len(count))
+	for _, e := range children {
+		gapTo(pos, e.lstart, dropped)
+		pos, dropped = e.lend, true
+		// the n-th instance in the source is the n-th in the tree
+		n := seen[e.Name]
+		seen[e.Name]++
+		curs, origs := xmlInstances(cur[e.Name]), xmlInstances(orig[e.Name])
+		if _, ok := emits[e.Name]; !ok {
+			emits[e.Name], pairs[e.Name] = alignLists(len(origs), len(curs), func(i, j int) bool {
+				return reflect.DeepEqual(origs[i], curs[j])
+			})
+		}
+		if n >= len(origs) {
+			continue
+		}
+		for _, j := range emits[e.Name][n] {
+			dropped = false
+			if j == pairs[e.Name][n] {
+				buf.WriteString(f.text[e.lstart:e.start])
+				f.writeElement(buf, e, curs[j], origs[n])
+				buf.WriteString(f.text[e.end:e.lend])
+			} else {
+				appendItem(buf, indent, xmlFormat(e.Name, curs[j], indent, f.indentUnit()))
+			}
+		}
+	}
+	if len(children) == 0 {
+		writeRange(buf, pos, to)
+		pos = to
+	}
+	for _, k := range xmlChildKeys(cur) {
+		if _, ok := count[k]; ok {
+			continue
+		}
+		if from == 0 && to == len(f.text) {
+			ensureNewline(buf)
+		}
+		for _, v := range xmlInstances(cur[k]) {
+			appendItem(buf, indent, xmlFormat(k, v, indent, f.indentUnit()))
+			dropped = false
+		}
+	}
+	gapTo(pos, to, dropped)
+}
+
+// writeElement writes the element - as is, if it hasn't changed,
+// or rewriting only the changed attributes, text and children.
+func (f *xmlFile) writeElement(buf *bytes.Buffer, e *xmlElement, cur, orig interface{}) {
+	if reflect.DeepEqual(cur, orig) {
+		buf.WriteString(f.text[e.start:e.end])
+		return
+	}
+	curM, origM := xmlMap(cur), xmlMap(orig)
+	nameEnd := e.start + 1 + len(e.Name)
+	buf.WriteString(f.text[e.start:nameEnd])
+	pos := nameEnd
+	known := make(map[string]bool, len(e.Attrs))
+	for _, a := range e.Attrs {
+		known[a.Name] = true
+		buf.WriteString(f.text[pos:a.start])
+		pos = a.end
+		v, ok := curM[xmlAttrPrefix+a.Name]
+		if !ok {
+			continue
+		}
+		if s := FormatValue(v); s == a.Value {
+			buf.WriteString(f.text[a.start:a.end])
+		} else {
+			buf.WriteString(f.text[a.start:a.valueStart])
+			buf.WriteString(xmlEscapeAttr(s, f.text[a.valueStart-1]))
+			buf.WriteString(f.text[a.valueEnd:a.end])
+		}
+	}
+	for _, k := range sortedMapKeys(curM) {
+		if strings.HasPrefix(k, xmlAttrPrefix) && !known[k[len(xmlAttrPrefix):]] {
+			buf.WriteString(" " + k[len(xmlAttrPrefix):] + `="` + xmlEscapeAttr(FormatValue(curM[k]), '"') + `"`)
+		}
+	}
+
+	indent := leadingSpace(f.text[e.lstart:e.start])
+	if e.selfClosing() {
+		// <empty/> gets content
+		content := xmlFormat(e.Name, xmlContent(curM), indent, f.indentUnit())
+		if strings.HasSuffix(content, "/>") {
+			buf.WriteString(f.text[pos:e.tagEnd])
+			return
+		}
+		buf.WriteString(strings.TrimRight(strings.TrimSuffix(f.text[pos:e.tagEnd], "/>"), " \t\r\n"))
+		buf.WriteString(content[1+len(e.Name):])
+		return
+	}
+	buf.WriteString(f.text[pos:e.tagEnd])
+	closeLine := strings.LastIndexByte(f.text[:e.closeStart], '\n') + 1
+	if strings.TrimLeft(f.text[closeLine:e.closeStart], " \t") != "" || closeLine <= e.tagEnd {
+		closeLine = e.closeStart
+	}
+	f.writeBody(buf, e.Children, e.Texts, e.tagEnd, closeLine, indent+f.indentUnit(), origM, curM)
+	buf.WriteString(f.text[closeLine:e.end])
+}
+
+// indentUnit returns the indentation of the first child of the root, or two spaces.
+func (f *xmlFile) indentUnit() string {
+	if f.root != nil && len(f.root.Children) != 0 {
+		c := f.root.Children[0]
+		if s := leadingSpace(f.text[strings.LastIndexByte(f.text[:c.start], '\n')+1:]); s != "" {
+			return strings.TrimPrefix(s, leadingSpace(f.text[f.root.lstart:f.root.start]))
+		}
+	}
+	return "  "
+}
+
+// xmlContent returns the table without the attributes.
+func xmlContent(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if !strings.HasPrefix(k, xmlAttrPrefix) {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+// xmlChildKeys returns the names of the child elements in the table, sorted.
+func xmlChildKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if !strings.HasPrefix(k, xmlAttrPrefix) && k != xmlTextKey {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// xmlFormat returns the text of the element, as a new text.
+func xmlFormat(name string, v interface{}, indent, unit string) string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		if s := FormatValue(v); s != "" {
+			return "<" + name + ">" + xmlEscapeText(s, "") + "</" + name + ">"
+		}
+		return "<" + name + "/>"
+	}
+	var buf strings.Builder
+	buf.WriteString("<" + name)
+	for _, k := range sortedMapKeys(m) {
+		if strings.HasPrefix(k, xmlAttrPrefix) {
+			buf.WriteString(" " + k[len(xmlAttrPrefix):] + `="` + xmlEscapeAttr(FormatValue(m[k]), '"') + `"`)
+		}
+	}
+	text, children := FormatValue(m[xmlTextKey]), xmlChildKeys(m)
+	if text == "" && len(children) == 0 {
+		buf.WriteString("/>")
+		return buf.String()
+	}
+	buf.WriteString(">" + xmlEscapeText(text, ""))
+	for _, k := range children {
+		for _, v := range xmlInstances(m[k]) {
+			buf.WriteString("\n" + indent + unit + xmlFormat(k, v, indent+unit, unit))
+		}
+	}
+	if len(children) != 0 {
+		buf.WriteString("\n" + indent)
+	}
+	buf.WriteString("</" + name + ">")
+	return buf.String()
+}
+
+// xmlEscapeText escapes the text - as a CDATA section, if the old text was one.
+func xmlEscapeText(s, old string) string {
+	if strings.HasPrefix(old, "<![CDATA[") && !strings.Contains(s, "]]>") {
+		return "<![CDATA[" + s + "]]>"
+	}
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// xmlEscapeAttr escapes the attribute value for the quote q.
+func xmlEscapeAttr(s string, q byte) string {
+	r := strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\n", "&#xA;", "\r", "&#xD;", "\t", "&#x9;")
+	if q == '\'' {
+		r = strings.NewReplacer("&", "&amp;", "<", "&lt;", "'", "&apos;", "\n", "&#xA;", "\r", "&#xD;", "\t", "&#x9;")
+	}
+	return r.Replace(s)
+}
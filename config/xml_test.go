@@ -0,0 +1,156 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+)
+
+const xmlTest1 = `<?xml version="1.0" encoding="UTF-8"?>
+<!-- log4j2 configuration -->
+<Configuration status="WARN" xmlns:xi="http://www.w3.org/2001/XInclude">
+  <Appenders>
+    <Console name="Console"   target="SYSTEM_OUT">
+      <PatternLayout pattern="%d [%t] %-5level %logger{36} - %msg%n"/>
+    </Console>
+    <File name='File' fileName="app.log"/>
+  </Appenders>
+  <Loggers>
+    <Logger name="com.example" level="debug"/>
+    <Logger name="org.hibernate" level="warn"/>
+    <Root level="error">
+      <AppenderRef ref="Console"/>
+    </Root>
+  </Loggers>
+  <Script><![CDATA[a < b]]></Script>
+  <Description>Tom &amp; Jerry</Description>
+</Configuration>
+`
+
+func TestXMLRoundTrip(t *testing.T) {
+	cfg, err := Parser(xmlEnc).Decode(strings.NewReader(xmlTest1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]interface{}{
+		"Configuration/@status":                                  "WARN",
+		"Configuration/@xmlns:xi":                                "http://www.w3.org/2001/XInclude",
+		"Configuration/Appenders/Console/@target":                "SYSTEM_OUT",
+		"Configuration/Appenders/Console/PatternLayout/@pattern": "%d [%t] %-5level %logger{36} - %msg%n",
+		"Configuration/Appenders/File/@name":                     "File",
+		"Configuration/Loggers/Logger/1/@name":                   "org.hibernate",
+		"Configuration/Loggers/Root/AppenderRef/@ref":            "Console",
+		"Configuration/Script":                                   "a < b",
+		"Configuration/Description":                              "Tom & Jerry",
+	} {
+		if got := cfg.Get(strings.Split(path, "/")); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, wanted %#v", path, got, want)
+		}
+	}
+	var buf strings.Builder
+	if err = Dumper(xmlEnc).Encode(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d := diff.Diff(buf.String(), xmlTest1); d != "" {
+		t.Error(d)
+	}
+}
+
+func TestXMLEdit(t *testing.T) {
+	for i, tc := range []struct {
+		Src  string
+		Edit func(cfg Config) error
+		Want string
+	}{
+		{Src: xmlTest1,
+			Edit: func(cfg Config) error {
+				for k, v := range map[string]interface{}{
+					"Configuration/@status":                   "INFO",
+					"Configuration/Appenders/Console/@target": "SYSTEM_ERR",
+					"Configuration/Appenders/File/@name":      "It's",
+					"Configuration/Appenders/File/@append":    "false",
+					"Configuration/Loggers/Logger/2":          map[string]interface{}{"@name": "net", "@level": "info"},
+					"Configuration/Loggers/Root/@level":       "warn",
+					"Configuration/Script":                    "b > a",
+					"Configuration/Description":               "Tom & Jerry & Spike",
+					"Configuration/Properties/Property":       map[string]interface{}{"@name": "dir", "#text": "/var/log"},
+				} {
+					if err := cfg.Set(strings.Split(k, "/"), v); err != nil {
+						return err
+					}
+				}
+				return cfg.Del([]string{"Configuration", "Loggers", "Logger", "0"})
+			},
+			Want: `<?xml version="1.0" encoding="UTF-8"?>
+<!-- log4j2 configuration -->
+<Configuration status="INFO" xmlns:xi="http://www.w3.org/2001/XInclude">
+  <Appenders>
+    <Console name="Console"   target="SYSTEM_ERR">
+      <PatternLayout pattern="%d [%t] %-5level %logger{36} - %msg%n"/>
+    </Console>
+    <File name='It&apos;s' fileName="app.log" append="false"/>
+  </Appenders>
+  <Loggers>
+    <Logger name="org.hibernate" level="warn"/>
+    <Logger level="info" name="net"/>
+    <Root level="warn">
+      <AppenderRef ref="Console"/>
+    </Root>
+  </Loggers>
+  <Script><![CDATA[b > a]]></Script>
+  <Description>Tom &amp; Jerry &amp; Spike</Description>
+  <Properties>
+    <Property name="dir">/var/log</Property>
+  </Properties>
+</Configuration>
+`},
+
+		{Src: "<a>\n  <b/>\n  <c>x</c>\n</a>",
+			Edit: func(cfg Config) error {
+				// <b/> is "", so it is replaced by a table
+				if err := cfg.Set([]string{"a", "b"}, map[string]interface{}{"d": "1"}); err != nil {
+					return err
+				}
+				return cfg.Del([]string{"a", "c"})
+			},
+			Want: "<a>\n  <b>\n    <d>1</d>\n  </b>\n</a>"},
+
+		{Src: "",
+			Edit: func(cfg Config) error {
+				return cfg.Set([]string{"project", "version"}, "1.0")
+			},
+			Want: "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<project>\n  <version>1.0</version>\n</project>\n"},
+	} {
+		cfg, err := Parser(xmlEnc).Decode(strings.NewReader(tc.Src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tc.Edit(cfg); err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		var buf strings.Builder
+		if err = Dumper(xmlEnc).Encode(&buf, cfg); err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		if d := diff.Diff(buf.String(), tc.Want); d != "" {
+			t.Errorf("%d. %s", i, d)
+		}
+	}
+}
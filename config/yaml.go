@@ -0,0 +1,1012 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// yamlEncDec is a lossless YAML encoder/decoder: it keeps the source text,
+// and rewrites only the nodes changed in the tree - comments, anchors, aliases,
+// styles and key order are kept.
+//
+// A stream of more than one document (or one which is not a mapping) is a tree
+// with the documents keyed by their index ("0", "1", ...).
+type yamlEncDec struct{}
+
+// yamlStream is the concrete syntax tree of a YAML stream.
+type yamlStream struct {
+	src  []byte
+	docs []*yaml.Node
+	// multi is true if the documents are keyed by their index in the tree.
+	multi bool
+	// orig is the tree as decoded, to find the changes.
+	orig map[string]interface{}
+}
+
+func (yamlEncDec) Decode(r io.Reader) (Config, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return Config{}, err
+	}
+	f := &yamlStream{src: src}
+	var values []interface{}
+	dec := yaml.NewDecoder(bytes.NewReader(src))
+	for {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return Config{}, err
+		}
+		var v interface{}
+		if err := doc.Decode(&v); err != nil {
+			return Config{}, err
+		}
+		f.docs = append(f.docs, &doc)
+		values = append(values, yamlPlain(v))
+	}
+	m := make(map[string]interface{})
+	if len(values) == 1 {
+		if x, ok := values[0].(map[string]interface{}); ok {
+			m = x
+		} else {
+			f.multi = true
+		}
+	} else if len(values) > 1 {
+		f.multi = true
+	}
+	if f.multi {
+		for i, v := range values {
+			m[strconv.Itoa(i)] = v
+		}
+	}
+	tt, err := treeFromMap(m)
+	if err != nil {
+		return Config{}, err
+	}
+	f.orig = tt.ToMap()
+	return Config{Tree: tt, src: f}, nil
+}
+
+// yamlPlain converts the maps with non-string keys to map[string]interface{}.
+func yamlPlain(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, v := range x {
+			m[fmt.Sprint(k)] = yamlPlain(v)
+		}
+		return m
+	case map[string]interface{}:
+		for k, v := range x {
+			x[k] = yamlPlain(v)
+		}
+	case []interface{}:
+		for i, v := range x {
+			x[i] = yamlPlain(v)
+		}
+	}
+	return v
+}
+
+func (yamlEncDec) Encode(w io.Writer, cfg Config) error {
+	m := cfg.Tree.ToMap()
+	f, ok := cfg.src.(*yamlStream)
+	if ok && len(f.docs) == 0 && len(m) == 0 {
+		_, err := w.Write(f.src)
+		return err
+	}
+	if !ok || len(f.docs) == 0 {
+		b, err := yamlMarshal(m, 2)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	p := newYAMLPatcher(f.src, f.docs)
+	if !f.multi {
+		if err := p.update(yamlCtx{after: -1, indent: -1}, f.docs[0].Content[0], f.orig, m); err != nil {
+			return err
+		}
+	} else {
+		for k := range m {
+			if i, err := strconv.Atoi(k); err != nil || i < 0 {
+				return errors.Errorf("%q: the documents of a YAML stream are keyed by their index", k)
+			}
+		}
+		for i, doc := range f.docs {
+			k := strconv.Itoa(i)
+			cur, ok := m[k]
+			if !ok {
+				p.deleteDoc(i)
+				continue
+			}
+			if len(doc.Content) == 0 {
+				continue
+			}
+			if err := p.update(yamlCtx{after: -1, indent: -1}, doc.Content[0], f.orig[k], cur); err != nil {
+				return errors.Wrap(err, k)
+			}
+		}
+		for i := len(f.docs); ; i++ {
+			v, ok := m[strconv.Itoa(i)]
+			if !ok {
+				break
+			}
+			if err := p.appendDoc(v); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := w.Write(p.apply())
+	return err
+}
+
+// yamlMarshal encodes v as YAML, with the given indentation.
+func yamlMarshal(v interface{}, indent int) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(indent)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	err := enc.Close()
+	return buf.Bytes(), err
+}
+
+// marshal encodes v as YAML in the style of the source.
+func (p *yamlPatcher) marshal(v interface{}) ([]byte, error) {
+	b, err := yamlMarshal(v, p.step)
+	if err != nil || !p.compactSeq {
+		return b, err
+	}
+	return []byte(yamlCompactSeqs(string(b), p.step)), nil
+}
+
+// yamlCompactSeqs unindents the sequences which are values in a mapping,
+// in the YAML text encoded with step indentation.
+func yamlCompactSeqs(text string, step int) string {
+	lines := splitLines(text)
+	indentOf := func(line string) int { return len(line) - len(strings.TrimLeft(line, " ")) }
+	for i := 0; i+1 < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r\n")
+		// the column of the key, after the "- "s
+		keyCol := indentOf(line)
+		for strings.HasPrefix(line[keyCol:], "- ") {
+			keyCol += 2 + indentOf(line[keyCol+2:])
+		}
+		if strings.HasSuffix(line, "|") || strings.HasSuffix(line, "|-") || strings.HasSuffix(line, ">") || strings.HasSuffix(line, ">-") {
+			// skip the block scalar
+			for i+1 < len(lines) && (strings.TrimSpace(lines[i+1]) == "" || indentOf(lines[i+1]) > keyCol) {
+				i++
+			}
+			continue
+		}
+		next := lines[i+1]
+		if !strings.HasSuffix(line, ":") || indentOf(next) != keyCol+step || !strings.HasPrefix(next[keyCol+step:], "-") {
+			continue
+		}
+		for j := i + 1; j < len(lines) && (strings.TrimSpace(lines[j]) == "" || indentOf(lines[j]) > keyCol); j++ {
+			if len(lines[j]) > step && strings.TrimSpace(lines[j]) != "" {
+				lines[j] = lines[j][step:]
+			}
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// yamlPatcher collects the text edits of the YAML source.
+type yamlPatcher struct {
+	src        []byte
+	docs       []*yaml.Node
+	lineStarts []int
+	edits      []yamlEdit
+	// anchors holds the current value of the anchored nodes.
+	anchors map[string]interface{}
+	// step is the indentation of the nested mappings;
+	// compactSeq is true if the sequences in mappings are not indented.
+	step       int
+	compactSeq bool
+}
+
+// yamlEdit replaces src[start:end] with text.
+type yamlEdit struct {
+	start, end int
+	text       string
+}
+
+// yamlCtx is the place of a node: after is the offset after the ":" of its key
+// or the "-" of its sequence item (-1 for a document root), and indent is
+// the indentation of that key or "-".
+type yamlCtx struct {
+	after, indent int
+	item          bool
+	// flow is true in flow collections, where only inline values may stand.
+	flow bool
+}
+
+func newYAMLPatcher(src []byte, docs []*yaml.Node) *yamlPatcher {
+	p := yamlPatcher{src: src, docs: docs, lineStarts: []int{0}, step: 2, anchors: make(map[string]interface{})}
+	for i, c := range src {
+		if c == '\n' {
+			p.lineStarts = append(p.lineStarts, i+1)
+		}
+	}
+	// find the indentation style
+	stepFound, seqFound := false, false
+	var visit func(n *yaml.Node)
+	visit = func(n *yaml.Node) {
+		if n.Kind == yaml.MappingNode && n.Style&yaml.FlowStyle == 0 {
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				k, v := n.Content[i], n.Content[i+1]
+				if v.Style&yaml.FlowStyle != 0 || len(v.Content) == 0 || v.Line == k.Line {
+					continue
+				}
+				switch v.Kind {
+				case yaml.MappingNode:
+					if !stepFound && v.Anchor == "" && v.Column > k.Column {
+						p.step, stepFound = v.Column-k.Column, true
+					}
+				case yaml.SequenceNode:
+					if !seqFound && v.Anchor == "" {
+						p.compactSeq, seqFound = v.Column == k.Column, true
+					}
+				}
+			}
+		}
+		for _, c := range n.Content {
+			visit(c)
+		}
+	}
+	for _, doc := range docs {
+		visit(doc)
+	}
+	return &p
+}
+
+// apply returns the source with the edits applied.
+func (p *yamlPatcher) apply() []byte {
+	edits := p.edits
+	// stable, to keep the order of the insertions at the same place,
+	// which go before a deletion from there
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].start < edits[j].start || edits[i].start == edits[j].start && edits[i].end < edits[j].end
+	})
+	var buf bytes.Buffer
+	var pos int
+	for _, e := range edits {
+		if e.start < pos {
+			continue // overlapping edits should not happen
+		}
+		buf.Write(p.src[pos:e.start])
+		buf.WriteString(e.text)
+		pos = e.end
+	}
+	buf.Write(p.src[pos:])
+	return buf.Bytes()
+}
+
+func (p *yamlPatcher) replace(start, end int, text string) {
+	p.edits = append(p.edits, yamlEdit{start: start, end: end, text: text})
+}
+
+// update records the edits to change the node from orig to cur.
+func (p *yamlPatcher) update(ctx yamlCtx, n *yaml.Node, orig, cur interface{}) error {
+	if n.Anchor != "" {
+		p.anchors[n.Anchor] = cur
+	}
+	if n.Kind == yaml.AliasNode && !p.aliasChanged(n, orig, cur) {
+		return nil
+	}
+	if reflect.DeepEqual(orig, cur) && n.Kind != yaml.AliasNode {
+		return p.updateAliases(ctx, n, cur)
+	}
+	if n.Style&yaml.FlowStyle != 0 && len(n.Content) != 0 {
+		if ok, err := p.updateFlow(n, orig, cur); ok || err != nil {
+			return err
+		}
+	} else if len(n.Content) != 0 {
+		switch n.Kind {
+		case yaml.MappingNode:
+			om, ok1 := orig.(map[string]interface{})
+			cm, ok2 := cur.(map[string]interface{})
+			if ok1 && ok2 && len(cm) != 0 {
+				return p.updateMapping(n, om, cm)
+			}
+		case yaml.SequenceNode:
+			ol, ok1 := orig.([]interface{})
+			cl, ok2 := cur.([]interface{})
+			if ok1 && ok2 && len(cl) != 0 && len(ol) == len(n.Content) && p.canEditSequence(n) {
+				return p.updateSequence(n, ol, cl)
+			}
+		}
+	}
+	return p.replaceNode(ctx, n, cur)
+}
+
+// updateFlow updates the values in the flow collection in place,
+// if its keys (or length) have not changed.
+func (p *yamlPatcher) updateFlow(n *yaml.Node, orig, cur interface{}) (bool, error) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		om, _ := orig.(map[string]interface{})
+		cm, ok := cur.(map[string]interface{})
+		if !ok || len(cm) != len(n.Content)/2 {
+			return false, nil
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if _, ok := cm[n.Content[i].Value]; !ok || n.Content[i].Tag == "!!merge" {
+				return false, nil
+			}
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i].Value
+			if err := p.update(yamlCtx{flow: true}, n.Content[i+1], om[k], cm[k]); err != nil {
+				return true, errors.Wrap(err, k)
+			}
+		}
+		return true, nil
+	case yaml.SequenceNode:
+		ol, _ := orig.([]interface{})
+		cl, ok := cur.([]interface{})
+		if !ok || len(cl) != len(n.Content) || len(ol) != len(n.Content) {
+			return false, nil
+		}
+		for i, item := range n.Content {
+			if err := p.update(yamlCtx{flow: true}, item, ol[i], cl[i]); err != nil {
+				return true, errors.Wrap(err, strconv.Itoa(i))
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// aliasChanged reports whether n is an alias which does not stand for cur anymore:
+// its anchored node is deleted, or the alias itself is changed to differ from it.
+// An unchanged alias follows the changes of its anchor.
+func (p *yamlPatcher) aliasChanged(n *yaml.Node, orig, cur interface{}) bool {
+	if n.Kind != yaml.AliasNode {
+		return false
+	}
+	v, ok := p.anchors[n.Value]
+	return !ok || !reflect.DeepEqual(orig, cur) && !reflect.DeepEqual(v, cur)
+}
+
+// updateAliases records the anchors, and replaces the changed aliases
+// in the unchanged node.
+func (p *yamlPatcher) updateAliases(ctx yamlCtx, n *yaml.Node, cur interface{}) error {
+	if n.Style&yaml.FlowStyle != 0 {
+		if p.flowAliasChanged(n, cur) {
+			return p.replaceNode(ctx, n, cur)
+		}
+		return nil
+	}
+	switch n.Kind {
+	case yaml.MappingNode:
+		m, _ := cur.(map[string]interface{})
+		inherited := p.inherited(n)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Tag == "!!merge" {
+				continue
+			}
+			if err := p.update(yamlCtx{after: p.colonAfter(k), indent: p.indentOf(p.start(k))}, v, m[k.Value], m[k.Value]); err != nil {
+				return errors.Wrap(err, k.Value)
+			}
+		}
+		if inherited != nil {
+			// the anchors of the merged keys may have changed
+			return p.addKeys(n, m, m)
+		}
+	case yaml.SequenceNode:
+		l, _ := cur.([]interface{})
+		if len(l) != len(n.Content) {
+			return nil
+		}
+		for i, item := range n.Content {
+			if err := p.update(yamlCtx{after: p.dash(item) + 1, indent: p.indentOf(p.dash(item)), item: true}, item, l[i], l[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flowAliasChanged records the anchors in the flow collection,
+// and reports whether any alias in it has changed.
+func (p *yamlPatcher) flowAliasChanged(n *yaml.Node, cur interface{}) bool {
+	if n.Anchor != "" {
+		p.anchors[n.Anchor] = cur
+	}
+	var changed bool
+	switch n.Kind {
+	case yaml.AliasNode:
+		return p.aliasChanged(n, cur, cur)
+	case yaml.MappingNode:
+		m, _ := cur.(map[string]interface{})
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Tag == "!!merge" {
+				changed = true
+			} else if p.flowAliasChanged(n.Content[i+1], m[n.Content[i].Value]) {
+				changed = true
+			}
+		}
+	case yaml.SequenceNode:
+		l, _ := cur.([]interface{})
+		for i, item := range n.Content {
+			if i < len(l) && p.flowAliasChanged(item, l[i]) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// inherited returns the values merged into the mapping (with "<<"), as they are now.
+func (p *yamlPatcher) inherited(n *yaml.Node) map[string]interface{} {
+	var m map[string]interface{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Tag != "!!merge" {
+			continue
+		}
+		aliases := []*yaml.Node{n.Content[i+1]}
+		if n.Content[i+1].Kind == yaml.SequenceNode {
+			aliases = n.Content[i+1].Content
+		}
+		for _, a := range aliases {
+			if a.Kind != yaml.AliasNode {
+				continue
+			}
+			am, _ := p.anchors[a.Value].(map[string]interface{})
+			for k, v := range am {
+				if m == nil {
+					m = make(map[string]interface{})
+				}
+				if _, ok := m[k]; !ok { // the first one wins
+					m[k] = v
+				}
+			}
+		}
+	}
+	return m
+}
+
+func (p *yamlPatcher) updateMapping(n *yaml.Node, orig, cur map[string]interface{}) error {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		if k.Tag == "!!merge" {
+			continue
+		}
+		c, ok := cur[k.Value]
+		if !ok {
+			p.deletePair(n, i)
+			continue
+		}
+		if err := p.update(yamlCtx{after: p.colonAfter(k), indent: p.indentOf(p.start(k))}, v, orig[k.Value], c); err != nil {
+			return errors.Wrap(err, k.Value)
+		}
+	}
+	return p.addKeys(n, orig, cur)
+}
+
+// addKeys adds the keys of cur which are not in the mapping explicitly:
+// the new keys, and the merged (with "<<") ones which are changed (from orig)
+// to differ from their anchor - the unchanged ones follow the changes of the anchor.
+func (p *yamlPatcher) addKeys(n *yaml.Node, orig, cur map[string]interface{}) error {
+	explicit := make(map[string]bool, len(n.Content)/2)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		if k.Tag != "!!merge" {
+			explicit[k.Value] = true
+		} else if _, ok := p.anchors[v.Value]; v.Kind == yaml.AliasNode && !ok {
+			// the anchor is deleted
+			p.deletePair(n, i)
+		}
+	}
+	inherited := p.inherited(n)
+	var keys []string
+	for k, v := range cur {
+		if explicit[k] {
+			continue
+		}
+		if o, ok := inherited[k]; ok && reflect.DeepEqual(o, v) {
+			continue
+		}
+		if o, ok := orig[k]; ok && reflect.DeepEqual(o, v) {
+			if _, ok = inherited[k]; ok {
+				continue
+			}
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	indent := p.indentOf(p.start(n.Content[0]))
+	var buf strings.Builder
+	for _, k := range keys {
+		b, err := p.marshal(map[string]interface{}{k: cur[k]})
+		if err != nil {
+			return errors.Wrap(err, k)
+		}
+		buf.WriteString(indentLines(string(b), indent))
+	}
+	p.insertAfter(p.end(n.Content[len(n.Content)-1]), buf.String())
+	return nil
+}
+
+// deletePair deletes the i-th key and its value (with the comments above the key).
+func (p *yamlPatcher) deletePair(n *yaml.Node, i int) {
+	k, v := n.Content[i], n.Content[i+1]
+	start := p.start(k)
+	if ls := p.lineStart(start); strings.TrimSpace(string(p.src[ls:start])) != "" {
+		// the first key, after a "- ": join the next key to the "- "
+		if i+2 < len(n.Content) {
+			p.replace(start, p.start(n.Content[i+2]), "")
+		} else {
+			p.replace(start, p.end(v), "")
+		}
+		return
+	}
+	p.replace(p.commentStart(k), p.lineEndAfter(p.end(v)), "")
+}
+
+func (p *yamlPatcher) canEditSequence(n *yaml.Node) bool {
+	for _, item := range n.Content {
+		dash := p.dash(item)
+		if dash < 0 || strings.TrimSpace(string(p.src[p.lineStart(dash):dash])) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *yamlPatcher) updateSequence(n *yaml.Node, orig, cur []interface{}) error {
+	_, pair := alignLists(len(orig), len(cur), func(i, j int) bool { return reflect.DeepEqual(orig[i], cur[j]) })
+	indent := p.indentOf(p.dash(n.Content[0]))
+	var j int
+	for i, item := range n.Content {
+		dash := p.dash(item)
+		if pair[i] < 0 {
+			p.replace(p.commentStart(item), p.lineEndAfter(p.end(item)), "")
+			continue
+		}
+		if j < pair[i] {
+			text, err := p.items(cur[j:pair[i]], indent)
+			if err != nil {
+				return err
+			}
+			p.replace(p.lineStart(dash), p.lineStart(dash), text)
+		}
+		if err := p.update(yamlCtx{after: dash + 1, indent: indent, item: true}, item, orig[i], cur[pair[i]]); err != nil {
+			return errors.Wrap(err, strconv.Itoa(pair[i]))
+		}
+		j = pair[i] + 1
+	}
+	if j < len(cur) {
+		text, err := p.items(cur[j:], indent)
+		if err != nil {
+			return err
+		}
+		p.insertAfter(p.end(n.Content[len(n.Content)-1]), text)
+	}
+	return nil
+}
+
+// items returns the values as sequence items, with the "-" indented.
+func (p *yamlPatcher) items(values []interface{}, indent int) (string, error) {
+	var buf strings.Builder
+	for _, v := range values {
+		text, err := p.valueText(nil, v, indent+2, false)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(strings.Repeat(" ", indent) + "- " + strings.TrimLeft(text, "\n ") + "\n")
+	}
+	return buf.String(), nil
+}
+
+// replaceNode replaces the whole node with the value.
+func (p *yamlPatcher) replaceNode(ctx yamlCtx, n *yaml.Node, cur interface{}) error {
+	start, end := p.start(n), p.end(n)
+	oldBlock := (n.Kind == yaml.MappingNode || n.Kind == yaml.SequenceNode) && n.Style&yaml.FlowStyle == 0 && len(n.Content) != 0
+	var anchor string
+	if n.Anchor != "" && n.Kind != yaml.AliasNode {
+		anchor = "&" + n.Anchor
+	}
+
+	if ctx.flow {
+		text, err := p.valueText(n, cur, 0, true)
+		if err != nil {
+			return err
+		}
+		if anchor != "" {
+			text = anchor + " " + text
+		}
+		p.replace(start, end, text)
+		return nil
+	}
+	if ctx.after < 0 { // document root
+		text, err := p.valueText(nil, cur, 0, false)
+		if err != nil {
+			return err
+		}
+		p.replace(start, end, strings.TrimLeft(text, "\n "))
+		return nil
+	}
+	indent := ctx.indent + 2
+	if !ctx.item {
+		indent = ctx.indent + p.step
+		if _, ok := cur.([]interface{}); ok && p.compactSeq {
+			indent = ctx.indent
+		}
+	}
+	text, err := p.valueText(n, cur, indent, n.Style&yaml.FlowStyle != 0)
+	if err != nil {
+		return err
+	}
+	newBlock := strings.HasPrefix(text, "\n")
+	if ctx.item && newBlock {
+		// "- a: 1" - the first line goes after the "-"
+		text = strings.TrimLeft(text, "\n ")
+		newBlock = false
+	}
+	switch {
+	case oldBlock && newBlock && anchor == "" && !ctx.item:
+		p.replace(start, end, strings.TrimLeft(indentLines(strings.TrimLeft(text, "\n"), p.indentOf(start)-indent), " "))
+	case newBlock:
+		if anchor != "" {
+			text = " " + anchor + text
+		}
+		p.replace(ctx.after, p.moveComment(end, &text), text)
+	default:
+		if anchor != "" {
+			text = anchor + " " + text
+		}
+		text = " " + text
+		p.replace(ctx.after, p.moveComment(end, &text), text)
+	}
+	return nil
+}
+
+// moveComment moves the rest of the line after end (a comment) to the end of
+// the first line of the multi-line text, and returns the new end of the replaced part.
+func (p *yamlPatcher) moveComment(end int, text *string) int {
+	i := strings.IndexByte(*text, '\n')
+	if i < 0 {
+		return end
+	}
+	lineEnd := p.trimRight(p.lineEndAfter(end))
+	if lineEnd <= end {
+		return end
+	}
+	*text = (*text)[:i] + string(p.src[end:lineEnd]) + (*text)[i:]
+	return lineEnd
+}
+
+// valueText returns the value as YAML text, with the continuation lines indented by indent.
+// The block mappings and sequences start with a newline.
+// If old is a string scalar, then its quoting style is kept.
+// With flow, the mappings and sequences are in flow style.
+func (p *yamlPatcher) valueText(old *yaml.Node, v interface{}, indent int, flow bool) (string, error) {
+	var node yaml.Node
+	if s, ok := v.(string); ok && old != nil && old.Kind == yaml.ScalarNode && old.Tag == "!!str" {
+		node = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: s, Style: old.Style &^ yaml.TaggedStyle}
+	} else if err := node.Encode(v); err != nil {
+		return "", err
+	} else if flow {
+		yamlFlowStyle(&node)
+	}
+	b, err := p.marshal(&node)
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSuffix(string(b), "\n")
+	if (node.Kind == yaml.MappingNode || node.Kind == yaml.SequenceNode) && len(node.Content) != 0 && node.Style&yaml.FlowStyle == 0 {
+		return "\n" + strings.TrimSuffix(indentLines(text+"\n", indent), "\n"), nil
+	}
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		// block scalar, already indented by step
+		text = text[:i+1] + strings.TrimSuffix(indentLines(text[i+1:]+"\n", indent-p.step), "\n")
+	}
+	return text, nil
+}
+
+func yamlFlowStyle(n *yaml.Node) {
+	if n.Kind == yaml.MappingNode || n.Kind == yaml.SequenceNode {
+		n.Style |= yaml.FlowStyle
+	}
+	for _, c := range n.Content {
+		yamlFlowStyle(c)
+	}
+}
+
+// deleteDoc deletes the i-th document.
+func (p *yamlPatcher) deleteDoc(i int) {
+	start, end := p.docStart(i), len(p.src)
+	if i+1 < len(p.docs) {
+		end = p.docStart(i + 1)
+	}
+	p.replace(start, end, "")
+}
+
+// docStart returns the start of the i-th document: its "---" line, if it has one.
+func (p *yamlPatcher) docStart(i int) int {
+	if i == 0 {
+		return 0
+	}
+	prevEnd := p.lineEndAfter(p.end(p.docs[i-1]))
+	start := p.start(p.docs[i])
+	if len(p.docs[i].Content) != 0 {
+		start = p.start(p.docs[i].Content[0])
+	}
+	for l := p.lineOf(start); l >= 0 && p.lineStarts[l] >= prevEnd; l-- {
+		if bytes.HasPrefix(p.src[p.lineStarts[l]:], []byte("---")) {
+			return p.lineStarts[l]
+		}
+	}
+	return prevEnd
+}
+
+func (p *yamlPatcher) appendDoc(v interface{}) error {
+	b, err := p.marshal(v)
+	if err != nil {
+		return err
+	}
+	text := "---\n" + string(b)
+	if len(p.src) != 0 && p.src[len(p.src)-1] != '\n' {
+		text = "\n" + text
+	}
+	p.replace(len(p.src), len(p.src), text)
+	return nil
+}
+
+// insertAfter inserts the lines after the line of off.
+func (p *yamlPatcher) insertAfter(off int, text string) {
+	at := p.lineEndAfter(off)
+	if at == len(p.src) && at != 0 && p.src[at-1] != '\n' {
+		text = "\n" + text
+	}
+	p.replace(at, at, text)
+}
+
+// indentLines indents the non-empty lines by indent spaces.
+func indentLines(text string, indent int) string {
+	if indent <= 0 {
+		return text
+	}
+	prefix := strings.Repeat(" ", indent)
+	var buf strings.Builder
+	for _, line := range splitLines(text) {
+		if strings.TrimSpace(line) != "" {
+			buf.WriteString(prefix)
+		}
+		buf.WriteString(line)
+	}
+	return buf.String()
+}
+
+//
+// positions
+//
+
+// offset returns the byte offset of the 1-based line and (character) column.
+func (p *yamlPatcher) offset(line, col int) int {
+	if line < 1 {
+		return 0
+	}
+	if line > len(p.lineStarts) {
+		return len(p.src)
+	}
+	off := p.lineStarts[line-1]
+	for ; col > 1 && off < len(p.src) && p.src[off] != '\n'; col-- {
+		_, size := utf8.DecodeRune(p.src[off:])
+		off += size
+	}
+	return off
+}
+
+func (p *yamlPatcher) lineOf(off int) int {
+	return sort.Search(len(p.lineStarts), func(i int) bool { return p.lineStarts[i] > off }) - 1
+}
+
+func (p *yamlPatcher) lineStart(off int) int { return p.lineStarts[p.lineOf(off)] }
+
+// lineEndAfter returns the offset after the end of the line of off.
+func (p *yamlPatcher) lineEndAfter(off int) int {
+	if i := bytes.IndexByte(p.src[off:], '\n'); i >= 0 {
+		return off + i + 1
+	}
+	return len(p.src)
+}
+
+func (p *yamlPatcher) indentOf(off int) int { return off - p.lineStart(off) }
+
+// commentStart returns the start of the line of the node,
+// or of the comment lines above it, which belong to it.
+func (p *yamlPatcher) commentStart(n *yaml.Node) int {
+	l := p.lineOf(p.start(n))
+	if n.HeadComment != "" {
+		for k := strings.Count(n.HeadComment, "\n") + 1; k > 0 && l > 0; k-- {
+			prev := strings.TrimSpace(string(p.src[p.lineStarts[l-1]:p.lineStarts[l]]))
+			if prev != "" && !strings.HasPrefix(prev, "#") {
+				break
+			}
+			l--
+		}
+	}
+	return p.lineStarts[l]
+}
+
+// colonAfter returns the offset after the ":" after the key.
+func (p *yamlPatcher) colonAfter(k *yaml.Node) int {
+	off := p.end(k)
+	for off < len(p.src) && p.src[off] != ':' {
+		off++
+	}
+	return off + 1
+}
+
+// dash returns the offset of the "-" of the sequence item, or -1.
+func (p *yamlPatcher) dash(item *yaml.Node) int {
+	for off := p.start(item) - 1; off >= 0; off-- {
+		switch p.src[off] {
+		case '-':
+			return off
+		case ' ', '\t', '\n', '\r':
+		default:
+			return -1
+		}
+	}
+	return -1
+}
+
+func (p *yamlPatcher) start(n *yaml.Node) int { return p.offset(n.Line, n.Column) }
+
+// end returns the offset after the node's text.
+func (p *yamlPatcher) end(n *yaml.Node) int {
+	start := p.start(n)
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return start
+		}
+		return p.end(n.Content[0])
+	case yaml.AliasNode:
+		return start + 1 + len(n.Value)
+	case yaml.MappingNode, yaml.SequenceNode:
+		if n.Style&yaml.FlowStyle != 0 || len(n.Content) == 0 {
+			return p.flowEnd(p.skipProps(start))
+		}
+		return p.end(n.Content[len(n.Content)-1])
+	}
+	i := p.skipProps(start)
+	switch {
+	case n.Style&yaml.DoubleQuotedStyle != 0:
+		for i++; i < len(p.src) && p.src[i] != '"'; i++ {
+			if p.src[i] == '\\' {
+				i++
+			}
+		}
+		return i + 1
+	case n.Style&yaml.SingleQuotedStyle != 0:
+		for i++; i < len(p.src); i++ {
+			if p.src[i] == '\'' {
+				if i+1 < len(p.src) && p.src[i+1] == '\'' {
+					i++
+					continue
+				}
+				break
+			}
+		}
+		return i + 1
+	case n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) == 0 && bytes.HasPrefix(p.src[i:], []byte(n.Value)):
+		return i + len(n.Value)
+	}
+	// block scalar, or multi-line plain scalar: the lines indented more than its parent
+	bound := p.parentIndent(i)
+	end := p.lineEndAfter(i)
+	for l := p.lineOf(i) + 1; l < len(p.lineStarts); l++ {
+		line := string(p.src[p.lineStarts[l]:p.lineEndAfter(p.lineStarts[l])])
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if len(line)-len(strings.TrimLeft(line, " ")) <= bound {
+			break
+		}
+		end = p.lineStarts[l] + len(line)
+	}
+	return p.trimRight(end)
+}
+
+// parentIndent returns the indentation of the key or "-" on the line of off.
+func (p *yamlPatcher) parentIndent(off int) int {
+	ls := p.lineStart(off)
+	line := string(p.src[ls:off])
+	indent := len(line) - len(strings.TrimLeft(line, " "))
+	rest := line[indent:]
+	lastDash := -1
+	for strings.HasPrefix(rest, "- ") || rest == "-" {
+		lastDash = len(line) - len(rest)
+		rest = strings.TrimLeft(rest[1:], " ")
+	}
+	if lastDash >= 0 && strings.TrimSpace(rest) == "" {
+		return lastDash
+	}
+	return len(line) - len(rest)
+}
+
+func (p *yamlPatcher) trimRight(end int) int {
+	for end > 0 && (p.src[end-1] == '\n' || p.src[end-1] == '\r' || p.src[end-1] == ' ' || p.src[end-1] == '\t') {
+		end--
+	}
+	return end
+}
+
+// skipProps skips the anchor and tag of the node starting at off.
+func (p *yamlPatcher) skipProps(off int) int {
+	for off < len(p.src) && (p.src[off] == '&' || p.src[off] == '!') {
+		for off < len(p.src) && !isYAMLSpace(p.src[off]) {
+			off++
+		}
+		for off < len(p.src) && isYAMLSpace(p.src[off]) {
+			off++
+		}
+	}
+	return off
+}
+
+func isYAMLSpace(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' }
+
+// flowEnd returns the offset after the flow collection starting at off.
+func (p *yamlPatcher) flowEnd(off int) int {
+	var depth int
+	for i := off; i < len(p.src); i++ {
+		switch c := p.src[i]; c {
+		case '[', '{':
+			depth++
+		case ']', '}':
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		case '"', '\'':
+			for i++; i < len(p.src) && p.src[i] != c; i++ {
+				if c == '"' && p.src[i] == '\\' {
+					i++
+				}
+			}
+		case '#':
+			if i > 0 && isYAMLSpace(p.src[i-1]) {
+				i = p.lineEndAfter(i) - 1
+			}
+		}
+	}
+	return len(p.src)
+}
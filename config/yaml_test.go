@@ -0,0 +1,198 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+)
+
+const yamlTest1 = `# Deployment
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web   # the name
+  labels: &labels
+    app: web
+    tier: "frontend"
+spec:
+  replicas: 2
+  selector:
+    matchLabels: *labels
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx:1.19
+        args: [--a, --b]
+      # sidecar
+      - name: side
+        command:
+          - sh
+          - |
+            echo hi
+`
+
+func TestYAMLRoundTrip(t *testing.T) {
+	for _, src := range []string{yamlTest1, "a: 1\n---\n# two\nb: [1, 2]\n...\n", "- a\n- b\n", ""} {
+		cfg, err := Parser(yamlEnc).Decode(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf strings.Builder
+		if err = Dumper(yamlEnc).Encode(&buf, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if d := diff.Diff(buf.String(), src); d != "" {
+			t.Error(d)
+		}
+	}
+}
+
+func TestYAMLEdit(t *testing.T) {
+	for i, tc := range []struct {
+		Src  string
+		Edit func(cfg Config) error
+		Want string
+	}{
+		{Src: yamlTest1,
+			Edit: func(cfg Config) error {
+				for k, v := range map[string]interface{}{
+					"metadata/name":                             "api",
+					"spec/replicas":                             int64(3),
+					"spec/template/spec/containers/0/args/2":    "--c",
+					"spec/template/spec/containers/0/ports":     []interface{}{map[string]interface{}{"containerPort": int64(80)}},
+					"spec/template/spec/containers/1/command/1": "echo\nbye\n",
+				} {
+					if err := cfg.Set(strings.Split(k, "/"), v); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			Want: `# Deployment
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api   # the name
+  labels: &labels
+    app: web
+    tier: "frontend"
+spec:
+  replicas: 3
+  selector:
+    matchLabels: *labels
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx:1.19
+        args: [--a, --b, --c]
+        ports:
+        - containerPort: 80
+      # sidecar
+      - name: side
+        command:
+          - sh
+          - |
+            echo
+            bye
+`},
+
+		{Src: yamlTest1,
+			Edit: func(cfg Config) error {
+				if err := cfg.Set([]string{"metadata", "labels", "tier"}, "backend"); err != nil {
+					return err
+				}
+				if err := cfg.Del([]string{"spec", "template", "spec", "containers", "1"}); err != nil {
+					return err
+				}
+				return cfg.Del([]string{"kind"})
+			},
+			Want: `# Deployment
+apiVersion: apps/v1
+metadata:
+  name: web   # the name
+  labels: &labels
+    app: web
+    tier: "backend"
+spec:
+  replicas: 2
+  selector:
+    matchLabels: *labels
+  template:
+    spec:
+      containers:
+      - name: web
+        image: nginx:1.19
+        args: [--a, --b]
+`},
+
+		{Src: "base: &b\n  p: 1\nc:\n  <<: *b\n  r: 3\n",
+			Edit: func(cfg Config) error { return cfg.Set([]string{"c", "p"}, int64(5)) },
+			Want: "base: &b\n  p: 1\nc:\n  <<: *b\n  r: 3\n  p: 5\n"},
+
+		// the unchanged aliases and merges follow the changes of the anchor
+		{Src: "b: &x {c: 2}\nd: *x\n",
+			Edit: func(cfg Config) error { return cfg.Set([]string{"b", "c"}, int64(3)) },
+			Want: "b: &x {c: 3}\nd: *x\n"},
+		{Src: "defaults: &defs\n  port: 8080\n  host: a\nsrv:\n  <<: *defs\n  name: s\n",
+			Edit: func(cfg Config) error { return cfg.Set([]string{"defaults", "port"}, int64(9090)) },
+			Want: "defaults: &defs\n  port: 9090\n  host: a\nsrv:\n  <<: *defs\n  name: s\n"},
+		// the changed alias is written as the value
+		{Src: "b: &x {c: 2}\nd: *x\n",
+			Edit: func(cfg Config) error {
+				if err := cfg.Set([]string{"b", "c"}, int64(3)); err != nil {
+					return err
+				}
+				return cfg.Set([]string{"d", "c"}, int64(4))
+			},
+			Want: "b: &x {c: 3}\nd:\n  c: 4\n"},
+
+		{Src: "a: x # comment\n",
+			Edit: func(cfg Config) error { return cfg.Set([]string{"a"}, map[string]interface{}{"b": int64(1)}) },
+			Want: "a: # comment\n  b: 1\n"},
+
+		{Src: "a: 1\n---\n# second\nb: 2\n---\nc: [1]\n",
+			Edit: func(cfg Config) error {
+				if err := cfg.Del([]string{"1"}); err != nil {
+					return err
+				}
+				if err := cfg.Set([]string{"2", "c", "1"}, int64(2)); err != nil {
+					return err
+				}
+				return cfg.Set([]string{"3"}, map[string]interface{}{"d": "e"})
+			},
+			Want: "a: 1\n---\nc: [1, 2]\n---\nd: e\n"},
+	} {
+		cfg, err := Parser(yamlEnc).Decode(strings.NewReader(tc.Src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tc.Edit(cfg); err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		var buf strings.Builder
+		if err = Dumper(yamlEnc).Encode(&buf, cfg); err != nil {
+			t.Fatalf("%d. %+v", i, err)
+		}
+		if d := diff.Diff(buf.String(), tc.Want); d != "" {
+			t.Errorf("%d. %s", i, d)
+		}
+	}
+}
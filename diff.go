@@ -0,0 +1,99 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/confed/config"
+)
+
+// diffMain is the "diff" subcommand: prints the changes between two configs.
+func diffMain(defaultType string, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	flagFormat := fs.String("format", "text", "output format: text, json or patch (RFC 6902 JSON Patch)")
+	flagTypeA := fs.String("a", "", "type of the first file (default: by its name, or -f, or by its content)")
+	flagTypeB := fs.String("b", "", "type of the second file (default: by its name, or -f, or by its content)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: confed diff [-format text|json|patch] [-a type] [-b type] old new")
+	}
+	a, _, err := readConfig(fs.Arg(0), *flagTypeA, defaultType)
+	if err != nil {
+		return err
+	}
+	b, _, err := readConfig(fs.Arg(1), *flagTypeB, defaultType)
+	if err != nil {
+		return err
+	}
+	changes, err := config.Diff(a, b)
+	if err != nil {
+		return err
+	}
+	switch *flagFormat {
+	case "text":
+		_, err = fmt.Print(changes.String())
+		return err
+	case "json", "patch":
+		var v interface{} = changes
+		if *flagFormat == "patch" {
+			v = changes.Patch()
+		}
+		if len(changes) == 0 {
+			v = []interface{}{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	return errors.Errorf("unknown format %q", *flagFormat)
+}
+
+// readConfig reads the config file, of the given type - if empty, then detected by its name,
+// or the default, or detected by its content. Returns the type, too.
+func readConfig(fn, typ, defaultType string) (config.Config, string, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return config.Config{}, typ, err
+	}
+	defer fh.Close()
+	br := bufio.NewReader(fh)
+	if typ == "" {
+		if t, err := config.Detect(fn, nil); err == nil {
+			typ = string(t)
+		} else if typ = defaultType; typ == "" {
+			head, _ := br.Peek(4096)
+			t, err := config.Detect(fn, head)
+			if err != nil {
+				return config.Config{}, typ, errors.Wrap(err, "detect the type")
+			}
+			typ = string(t)
+		}
+	}
+	dec := config.Parser(config.Type(typ))
+	if dec == nil {
+		return config.Config{}, typ, errors.Errorf("%s: unknown type %q", fn, typ)
+	}
+	cfg, err := dec.Decode(br)
+	return cfg, typ, errors.Wrap(err, "decode "+fn)
+}
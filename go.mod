@@ -3,13 +3,17 @@ module github.com/tgulacsi/confed
 go 1.12
 
 require (
+	github.com/google/go-cmp v0.5.8 // indirect
 	github.com/google/uuid v1.1.0 // indirect
 	github.com/hashicorp/hcl v1.0.0
+	github.com/hashicorp/hcl/v2 v2.11.1
 	github.com/kylelemons/godebug v0.0.0-20170820004349-d65d576e9348
 	github.com/magiconair/properties v1.8.0
 	github.com/mholt/caddy v0.11.4
-	github.com/pelletier/go-toml v1.2.0
+	github.com/pelletier/go-toml v1.9.5
+	github.com/peterh/liner v1.2.2
 	github.com/pkg/errors v0.8.1
-	gopkg.in/ini.v1 v1.42.0
-	gopkg.in/yaml.v2 v2.2.2
+	github.com/zclconf/go-cty v1.8.4
+	golang.org/x/text v0.13.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,128 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// writeInPlace calls write with a temp file in the same directory as fn,
+// syncs it, sets fn's mode and owner on it, and renames it over fn.
+//
+// If backupSuffix is not empty, then the old file is kept as fn+backupSuffix.
+func writeInPlace(fn, backupSuffix string, write func(io.Writer) error) error {
+	// replace the target of the symlink, not the symlink
+	fn, err := filepath.EvalSymlinks(fn)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(fn)
+	fh, err := os.CreateTemp(dir, "."+filepath.Base(fn)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := fh.Name()
+	defer os.Remove(tmp)
+	defer fh.Close()
+
+	if err = write(fh); err != nil {
+		return err
+	}
+	if err = fh.Chmod(fi.Mode().Perm()); err != nil {
+		return errors.Wrap(err, tmp)
+	}
+	if err = chown(fh, fi); err != nil {
+		return errors.Wrap(err, tmp)
+	}
+	if err = fh.Sync(); err != nil {
+		return errors.Wrap(err, tmp)
+	}
+	if err = fh.Close(); err != nil {
+		return errors.Wrap(err, tmp)
+	}
+
+	if backupSuffix != "" {
+		if err = backup(fn, fn+backupSuffix); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tmp, fn); err != nil {
+		return err
+	}
+	// sync the directory, for the rename to be durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// writeNew is writeInPlace for a file which may not exist yet, creating it and its directory.
+func writeNew(fn, backupSuffix string, write func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err == nil {
+		err = fh.Close()
+	} else if os.IsExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	return writeInPlace(fn, backupSuffix, write)
+}
+
+// backup the file to dst, by hard link if possible, by copying if not.
+func backup(src, dst string) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	inp, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer inp.Close()
+	fi, err := inp.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, inp); err != nil {
+		out.Close()
+		return errors.Wrap(err, dst)
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return errors.Wrap(err, dst)
+	}
+	return out.Close()
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestWriteInPlace(t *testing.T) {
+	dir, err := os.MkdirTemp("", "confed-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "app.conf")
+	if err = os.WriteFile(fn, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chmod(fn, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = writeInPlace(fn, ".orig", func(w io.Writer) error {
+		_, err := io.WriteString(w, "new\n")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"app.conf": "new\n", "app.conf.orig": "old\n"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s: got %q, wanted %q", name, b, want)
+		}
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0640 {
+		t.Errorf("got mode %o, wanted %o", got, 0640)
+	}
+
+	// a failed write leaves the file as is
+	if err = writeInPlace(fn, "", func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("failed")
+	}); err == nil {
+		t.Error("failed write: no error")
+	}
+	if b, err := os.ReadFile(fn); err != nil || string(b) != "new\n" {
+		t.Errorf("after a failed write: got %q, %v", b, err)
+	}
+
+	// no temp files are left behind
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, de := range des {
+		names = append(names, de.Name())
+	}
+	if len(names) != 2 {
+		t.Errorf("got %q, wanted only app.conf and app.conf.orig", names)
+	}
+}
@@ -18,12 +18,12 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"flag"
-	"fmt"
+	"io"
 	"log"
 	"os"
-	"sort"
-	"strconv"
+	"path/filepath"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -32,113 +32,212 @@ import (
 
 func main() {
 	if err := Main(); err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		os.Exit(exitCode(err))
 	}
 }
 
 func Main() error {
-	flagTypeIn := flag.String("f", "json", "Type of input")
-	flagTypeOut := flag.String("t", "json", "Type of output")
+	flagTypeIn := flag.String("f", "", "Type of input (default: detected from the file name and content)")
+	flagTypeOut := flag.String("t", "", "Type of output (default: the type of input)")
 	flagNoCommands := flag.Bool("n", false, "don't read commands from stdin")
 	flagSep := flag.String("S", "/", "path separator")
+	flagEnvSep := flag.String("env-sep", config.DotenvSeparator, "separator of the nested keys in the dotenv variable names")
+	flagINICase := flag.Bool("ini-case", false, "keep the case of the ini section and key names")
+	flagINIShadows := flag.Bool("ini-shadows", false, "keep all the values of the repeated ini keys, as a list")
+	flagInPlace := flag.Bool("i", false, "edit the file in place (atomically) instead of writing to stdout")
+	flagBackup := flag.String("backup", "", "with -i, keep the original file with this suffix appended to its name")
+	flagPatch := flag.String("patch", "", "apply this RFC 6902 JSON Patch (array) or RFC 7386 JSON Merge Patch (object) file, instead of reading commands from stdin")
+	flagSchema := flag.String("schema", "", "validate the result against this JSON Schema file before writing it")
+	flagDropIn := flag.String("dropin", "", "for a systemd unit, write only the changed keys as a drop-in of this name (override.conf); with -i, into the unit's .d directory")
+	var script []scriptSource
+	flag.Var(scriptFlag{sources: &script}, "e", "execute this command, instead of reading the commands from stdin (can be repeated)")
+	flag.Var(scriptFlag{sources: &script, file: true}, "s", "execute the commands of this script file (- for stdin), instead of reading them from stdin (can be repeated)")
+	flagInteractive := flag.Bool("I", false, "edit the file interactively: read the commands with line editing, history and path completion, and write the file (in place) by save")
+	flagListFormats := flag.Bool("list-formats", false, "list the supported formats (types), with their aliases, extensions, media types and capabilities, as JSON")
 	flag.Parse()
+	if *flagListFormats {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return withExit(exitOutput, enc.Encode(config.Formats()))
+	}
+	switch flag.Arg(0) {
+	case "diff":
+		return diffMain(*flagTypeIn, flag.Args()[1:])
+	case "merge":
+		return mergeMain(*flagTypeIn, flag.Args()[1:])
+	}
 	fn := flag.Arg(0)
 	inp, err := os.Open(fn)
 	if err != nil {
-		return errors.Wrap(err, fn)
+		return withExit(exitInput, errors.Wrap(err, fn))
 	}
 	defer inp.Close()
 
-	dec := config.Parser(config.Type(*flagTypeIn))
-	enc := config.Dumper(config.Type(*flagTypeOut))
+	br := bufio.NewReader(inp)
+	typeIn := *flagTypeIn
+	if typeIn == "" {
+		head, _ := br.Peek(4096)
+		typ, err := config.Detect(fn, head)
+		if err != nil {
+			return withExit(exitUsage, errors.Wrap(err, "detect the type (use -f)"))
+		}
+		typeIn = string(typ)
+	}
+	typeOut := *flagTypeOut
+	if typeOut == "" {
+		typeOut = typeIn
+	}
+	for _, typ := range []*string{&typeIn, &typeOut} {
+		f, ok := config.Lookup(*typ)
+		if !ok {
+			return withExit(exitUsage, errors.Wrap(config.ErrUnknownType, *typ))
+		}
+		*typ = string(f.Type)
+	}
+	// the file must keep its type when it is written in place
+	var errInPlace error
+	if typeOut != typeIn && *flagDropIn == "" {
+		errInPlace = withExit(exitUsage, errors.Errorf("cannot write %s output in place of the %s input", typeOut, typeIn))
+	}
+	if *flagInPlace && errInPlace != nil {
+		return errInPlace
+	}
+	dec := config.Parser(config.Type(typeIn))
+	enc := config.Dumper(config.Type(typeOut))
+	if typeIn == "dotenv" {
+		dec = config.NewDotenv(*flagEnvSep)
+	}
+	if typeOut == "dotenv" {
+		enc = config.NewDotenv(*flagEnvSep)
+	}
+	iniOpts := config.INIOptions{CaseSensitive: *flagINICase, Shadows: *flagINIShadows}
+	if typeIn == "ini" {
+		dec = config.NewINI(iniOpts)
+	}
+	if typeOut == "ini" {
+		enc = config.NewINI(iniOpts)
+	}
 	log.Printf("Input: %#v, Output: %#v", dec, enc)
 
 	defer os.Stdout.Close()
-	cfg, err := dec.Decode(inp)
+	cfg, err := dec.Decode(br)
 	inp.Close()
 	if err != nil {
-		return errors.Wrap(err, "decode "+inp.Name())
+		return withExit(exitInput, errors.Wrap(err, "decode "+inp.Name()))
 	}
 
-	if *flagNoCommands {
-		return enc.Encode(os.Stdout, cfg)
+	var schema *config.Schema
+	if *flagSchema != "" {
+		b, err := os.ReadFile(*flagSchema)
+		if err != nil {
+			return withExit(exitInput, err)
+		}
+		if schema, err = config.ParseSchema(b); err != nil {
+			return withExit(exitInput, errors.Wrap(err, *flagSchema))
+		}
 	}
 
-	var doPrint bool
-
-	// read commands from stdin, and execute them!
-	scanner := bufio.NewScanner(os.Stdin)
-	var lineNo int
-	for scanner.Scan() {
-		lineNo++
-		line := bytes.TrimSpace(scanner.Bytes())
-		i := bytes.IndexByte(line, ' ')
-		if i < 0 {
-			if bytes.Equal(line, []byte("print")) {
-				doPrint = true
-				continue
-			}
-			if bytes.Equal(line, []byte("dump")) {
-				m := cfg.AllSettings()
-				log.Printf("DUMP %d", len(m))
-				keys := make([]string, 0, len(m))
-				for k := range m {
-					keys = append(keys, k)
-				}
-				sort.Strings(keys)
-				for _, k := range keys {
-					fmt.Printf("%s: %+v\n", k, cfg.Get(strings.Split(k, *flagSep)))
-				}
-				return nil
+	write := func(cfg config.Config, inPlace bool) error {
+		if schema != nil {
+			if err := config.Validate(cfg, schema); err != nil {
+				return withExit(exitFailed, errors.Wrap(err, "validate against "+*flagSchema))
 			}
-			log.Printf("%d. no command in %q", lineNo, line)
-			continue
 		}
-		cmd, path := string(line[:i]), string(line[i+1:])
-		defer os.Stdout.Close()
-		switch cmd {
-		case "print":
-			doPrint = true
-		case "get":
-			v := cfg.Get(strings.Split(path, *flagSep))
-			log.Printf("GET %q: %T", path, v)
-			res := make(map[string]interface{})
-			switch x := v.(type) {
-			case error:
-				log.Fatalf("ERROR: %#v", err)
-			case map[string]interface{}:
-				res = x
-			case []map[string]interface{}:
-				for i, m := range x {
-					res[strconv.Itoa(i)] = m
-				}
-			default:
-				res[path] = v
+		if *flagDropIn != "" {
+			if !inPlace {
+				return withExit(exitOutput, config.DropIn(os.Stdout, cfg))
 			}
-			cfg, err := config.New(res)
-			if err != nil {
-				return err
-			}
-			if err = enc.Encode(os.Stdout, cfg); err != nil {
-				return err
-			}
-		case "set":
-			doPrint = true
-			var value string
-			if i = strings.IndexByte(path, ' '); i > 0 {
-				path, value = path[:i], path[i+1:]
+			return withExit(exitOutput, writeNew(filepath.Join(fn+".d", *flagDropIn), *flagBackup, func(w io.Writer) error {
+				return config.DropIn(w, cfg)
+			}))
+		}
+		if inPlace {
+			if errInPlace != nil {
+				return errInPlace
 			}
-			cfg.Set(strings.Split(path, *flagSep), value)
-		case "rm", "del":
-			doPrint = true
-			cfg.Del(path)
-		default:
-			log.Printf("%d. unknown command %q", lineNo, cmd)
-			continue
+			return withExit(exitOutput, writeInPlace(fn, *flagBackup, func(w io.Writer) error {
+				return enc.Encode(w, cfg)
+			}))
+		}
+		return withExit(exitOutput, enc.Encode(os.Stdout, cfg))
+	}
+	output := func(cfg config.Config) error { return write(cfg, *flagInPlace) }
+	if *flagInteractive {
+		if *flagPatch != "" || len(script) != 0 {
+			return withExit(exitUsage, errors.New("-I cannot be used with -patch, -e or -s"))
 		}
+		return repl(&session{cfg: cfg, enc: enc, sep: *flagSep, out: os.Stdout},
+			func(cfg config.Config) error { return write(cfg, true) })
 	}
-	if !doPrint && lineNo >= 1 {
+	if *flagPatch != "" {
+		if err = applyPatchFile(cfg, *flagPatch); err != nil {
+			return err
+		}
+		return output(cfg)
+	}
+
+	cmds, err := loadScript(script, !*flagNoCommands)
+	if err != nil {
+		return err
+	}
+	sess := &session{cfg: cfg, enc: enc, sep: *flagSep}
+	if err = sess.runBuffered(cmds, os.Stdout); err != nil {
+		return err
+	}
+	if !sess.changed && len(cmds) != 0 {
 		return nil
 	}
-	return enc.Encode(os.Stdout, cfg)
+	return output(cfg)
+}
+
+// applyPatchFile applies the JSON Patch (if the file contains an array)
+// or JSON Merge Patch (if an object) in the file to the Config.
+func applyPatchFile(cfg config.Config, fn string) error {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return withExit(exitInput, err)
+	}
+	if b = bytes.TrimSpace(b); len(b) != 0 && b[0] == '[' {
+		patch, err := config.ParsePatch(b)
+		if err != nil {
+			return withExit(exitInput, errors.Wrap(err, fn))
+		}
+		return errors.Wrap(cfg.ApplyPatch(patch), fn)
+	}
+	patch, err := config.ParseMergePatch(b)
+	if err != nil {
+		return withExit(exitInput, errors.Wrap(err, fn))
+	}
+	return errors.Wrap(cfg.MergePatch(patch), fn)
+}
+
+// splitPath splits the path and the rest of the line at the first space
+// - for JSONPath expressions, the first which is not in brackets or quotes.
+func splitPath(line string) (path, rest string) {
+	if !strings.HasPrefix(line, "$") {
+		if i := strings.IndexByte(line, ' '); i > 0 {
+			return line[:i], line[i+1:]
+		}
+		return line, ""
+	}
+	var depth int
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case c == ' ' && depth <= 0:
+			return line[:i], line[i+1:]
+		}
+	}
+	return line, ""
 }
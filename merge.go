@@ -0,0 +1,85 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/confed/config"
+)
+
+// mergeMain is the "merge" subcommand: three-way merge of base, local and upstream.
+func mergeMain(defaultType string, args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	flagTypeOut := fs.String("t", "", "type of the output (default: the type of local)")
+	flagConflicts := fs.String("conflicts", "", "write the conflicts as JSON to this file, and the local values (instead of conflict markers) to the output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 3 {
+		return errors.New("usage: confed merge [-t type] [-conflicts conflicts.json] base local upstream")
+	}
+	var cfgs [3]config.Config
+	var types [3]string
+	for i, fn := range fs.Args() {
+		var err error
+		if cfgs[i], types[i], err = readConfig(fn, "", defaultType); err != nil {
+			return err
+		}
+	}
+	typ := *flagTypeOut
+	if typ == "" {
+		typ = types[1]
+	}
+	enc := config.Dumper(config.Type(typ))
+	if enc == nil {
+		return errors.Errorf("unknown type %q", typ)
+	}
+
+	var conflicts []config.Conflict
+	if *flagConflicts == "" {
+		var err error
+		if conflicts, err = config.WriteMerge3(os.Stdout, enc, cfgs[0], cfgs[1], cfgs[2]); err != nil {
+			return err
+		}
+	} else {
+		merged, cs, err := config.Merge3(cfgs[0], cfgs[1], cfgs[2])
+		if err != nil {
+			return err
+		}
+		if err = enc.Encode(os.Stdout, merged); err != nil {
+			return err
+		}
+		conflicts = cs
+		if conflicts == nil {
+			conflicts = []config.Conflict{}
+		}
+		b, err := json.MarshalIndent(conflicts, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(*flagConflicts, append(b, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+	if len(conflicts) != 0 {
+		return errors.Errorf("%d conflicts", len(conflicts))
+	}
+	return nil
+}
@@ -0,0 +1,442 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	"github.com/peterh/liner"
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/confed/config"
+)
+
+const replHelp = `The script commands (print, dump, get, set, setjson, rm, del, test, exists,
+setdefault, ifmissing) work on the paths relative to the current table, and
+  ls [path]   list the keys of the table (or list) at path
+  cd [path]   change the current table (.. is the parent, / is the root)
+  pwd         print the current table
+  undo        undo the last change
+  diff        print the changes since the file has been read (or saved)
+  save        write the file, in place
+  help        print this help
+  quit, exit  quit (twice, if there are unsaved changes)
+`
+
+// errQuit is returned by quit to end the REPL.
+var errQuit = errors.New("quit")
+
+// replState is the state of the interactive mode.
+type replState struct {
+	*session
+	// saved is the config as the file holds it, for diff
+	saved config.Config
+	// undo is the stack of the configs before the changes
+	undo []config.Config
+	// save writes the config into the file
+	save func(config.Config) error
+	// quitting is true after a quit refused because of the unsaved changes
+	quitting bool
+}
+
+// replCommands are the commands of the interactive mode, besides the scriptCommands.
+var replCommands = map[string]func(r *replState, args string) error{
+	"ls":    (*replState).ls,
+	"cd":    (*replState).cd,
+	"pwd":   (*replState).pwd,
+	"undo":  (*replState).undoLast,
+	"diff":  (*replState).diff,
+	"save":  (*replState).saveFile,
+	"print": (*replState).print,
+	"help":  func(r *replState, args string) error { _, err := io.WriteString(r.out, replHelp); return err },
+	"quit":  (*replState).quit,
+	"exit":  (*replState).quit,
+}
+
+// repl reads and executes the commands interactively, with line editing, history
+// and path completion, until quit or EOF. The errors are printed, not returned.
+func repl(s *session, save func(config.Config) error) error {
+	saved, err := s.cfg.Clone()
+	if err != nil {
+		return err
+	}
+	r := &replState{session: s, saved: saved, save: save}
+
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+	line.SetTabCompletionStyle(liner.TabPrints)
+	line.SetWordCompleter(r.complete)
+	if fn := historyFile(); fn != "" {
+		if fh, err := os.Open(fn); err == nil {
+			line.ReadHistory(fh)
+			fh.Close()
+		}
+		defer func() {
+			// the history may hold secrets
+			if fh, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err == nil {
+				fh.Chmod(0600) // an older one may have been created readable by others
+				line.WriteHistory(fh)
+				fh.Close()
+			}
+		}()
+	}
+
+	for {
+		text, err := line.Prompt("confed:" + r.cwdPath() + "> ")
+		if err == liner.ErrPromptAborted {
+			continue
+		}
+		if err == io.EOF {
+			fmt.Fprintln(r.out)
+			text = "quit"
+		} else if err != nil {
+			return withExit(exitInput, err)
+		} else if text = strings.TrimSpace(text); text == "" || text[0] == '#' {
+			continue
+		} else {
+			line.AppendHistory(text)
+		}
+		if err = r.exec(text); err == errQuit {
+			return nil
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// historyFile returns the name of the history file, or "" if there is no home directory.
+func historyFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".confed_history")
+}
+
+// exec executes one command line. A failed script command changes nothing,
+// a successful one which changes the config can be undone.
+func (r *replState) exec(text string) error {
+	name, args := splitCommand(text)
+	if name != "quit" && name != "exit" {
+		r.quitting = false
+	}
+	if f, ok := replCommands[name]; ok {
+		return f(r, args)
+	}
+	if err := checkCommand(name, args); err != nil {
+		return err
+	}
+	before, err := r.cfg.Clone()
+	if err != nil {
+		return err
+	}
+	if err = scriptCommands[name](r.session, name, args); err != nil {
+		r.cfg = before
+		return err
+	}
+	if changes, err := config.Diff(before, r.cfg); err != nil || len(changes) != 0 {
+		r.undo = append(r.undo, before)
+	}
+	return nil
+}
+
+// cwdPath returns the current table as an absolute path.
+func (r *replState) cwdPath() string { return r.sep + strings.Join(r.cwd, r.sep) }
+
+func (r *replState) pwd(args string) error {
+	if args != "" {
+		return errors.Errorf("unexpected arguments %q", args)
+	}
+	_, err := fmt.Fprintln(r.out, r.cwdPath())
+	return err
+}
+
+func (r *replState) cd(args string) error {
+	path, rest, err := nextPath(args)
+	if err != nil {
+		return err
+	}
+	if rest != "" || strings.HasPrefix(path, "$") {
+		return errors.New("usage: cd [path]")
+	}
+	key := r.key(path)
+	if path == "" {
+		key = nil
+	}
+	switch r.cfg.Get(key).(type) {
+	case *toml.Tree, map[string]interface{}, []*toml.Tree, []interface{}:
+		r.cwd = key
+		return nil
+	case nil:
+		return errors.Errorf("%s: missing", path)
+	}
+	return errors.Errorf("%s: not a table", path)
+}
+
+func (r *replState) ls(args string) error {
+	path, rest, err := nextPath(args)
+	if err != nil {
+		return err
+	}
+	if rest != "" || strings.HasPrefix(path, "$") {
+		return errors.New("usage: ls [path]")
+	}
+	key := r.key(path)
+	node := r.cfg.Get(key)
+	if node == nil {
+		return errors.Errorf("%s: missing", path)
+	}
+	names := children(node)
+	if names == nil {
+		_, err = fmt.Fprintln(r.out, config.FormatValue(node))
+		return err
+	}
+	for _, name := range names {
+		v, text := getChild(node, name), quotePath(r.pathName(key, names, name), r.sep)
+		if children(v) != nil {
+			_, err = fmt.Fprintln(r.out, text+r.sep)
+		} else {
+			_, err = fmt.Fprintf(r.out, "%s = %s\n", text, config.FormatValue(v))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// print writes the config, as it would be saved.
+func (r *replState) print(args string) error {
+	if args != "" {
+		return errors.Errorf("unexpected arguments %q", args)
+	}
+	return r.enc.Encode(r.out, r.cfg)
+}
+
+func (r *replState) undoLast(args string) error {
+	if args != "" {
+		return errors.Errorf("unexpected arguments %q", args)
+	}
+	if len(r.undo) == 0 {
+		return errors.New("nothing to undo")
+	}
+	r.cfg, r.undo = r.undo[len(r.undo)-1], r.undo[:len(r.undo)-1]
+	return nil
+}
+
+func (r *replState) diff(args string) error {
+	if args != "" {
+		return errors.Errorf("unexpected arguments %q", args)
+	}
+	changes, err := config.Diff(r.saved, r.cfg)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(r.out, changes.String())
+	return err
+}
+
+func (r *replState) saveFile(args string) error {
+	if args != "" {
+		return errors.Errorf("unexpected arguments %q", args)
+	}
+	if err := r.save(r.cfg); err != nil {
+		return err
+	}
+	saved, err := r.cfg.Clone()
+	if err != nil {
+		return err
+	}
+	r.saved = saved
+	return nil
+}
+
+// quit ends the REPL - if there are unsaved changes, only when asked the second time.
+func (r *replState) quit(args string) error {
+	if args != "" {
+		return errors.Errorf("unexpected arguments %q", args)
+	}
+	if !r.quitting {
+		if changes, err := config.Diff(r.saved, r.cfg); err != nil || len(changes) != 0 {
+			r.quitting = true
+			return errors.New("there are unsaved changes: save them, or quit again to discard them")
+		}
+	}
+	return errQuit
+}
+
+// complete completes the command name (the first word), or the path under the cursor.
+func (r *replState) complete(line string, pos int) (head string, completions []string, tail string) {
+	head, tail = line[:pos], line[pos:]
+	i := lastArgStart(head)
+	head, word := head[:i], head[i:]
+	if strings.TrimSpace(head) == "" {
+		names := make(map[string]bool)
+		for name := range scriptCommands {
+			names[name] = true
+		}
+		for name := range replCommands {
+			names[name] = true
+		}
+		for name := range names {
+			if strings.HasPrefix(name, word) {
+				completions = append(completions, name+" ")
+			}
+		}
+		sort.Strings(completions)
+		return head, completions, tail
+	}
+	if strings.HasPrefix(word, "$") {
+		return head, nil, tail
+	}
+
+	parts := splitQuoted(word, r.sep)
+	prefix := parts[len(parts)-1]
+	dir := word[:len(word)-len(prefix)]
+	key := r.cwd
+	if dir != "" {
+		path, _, err := nextPath(dir)
+		if err != nil {
+			return head, nil, tail
+		}
+		if key = r.key(strings.TrimSuffix(path, r.sep)); path == r.sep {
+			key = nil
+		}
+	}
+	node := r.cfg.Get(key)
+	names := children(node)
+	for _, name := range names {
+		text := quotePath(r.pathName(key, names, name), r.sep)
+		if !strings.HasPrefix(text, prefix) {
+			continue
+		}
+		if children(getChild(node, name)) != nil {
+			completions = append(completions, dir+text+r.sep)
+		} else {
+			completions = append(completions, dir+text+" ")
+		}
+	}
+	return head, completions, tail
+}
+
+// lastArgStart returns the start of the last argument of the line (see nextArg).
+func lastArgStart(line string) int {
+	var start int
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\' && quote != '\'':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ' ' || c == '\t':
+			start = i + 1
+		}
+	}
+	return start
+}
+
+// quotePath returns the element of the key as text which the paths read back as is (see session.key).
+func quotePath(name, sep string) string {
+	switch name {
+	case "", ".", "..":
+		return `"` + name + `"`
+	}
+	var buf strings.Builder
+	for i, c := range name {
+		if strings.ContainsRune(" \t\\'\"", c) || c == '$' && i == 0 || strings.HasPrefix(name[i:], sep) {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
+
+// pathName returns the name of the child of the table at key, as the paths address it:
+// without the quotes added by the backend (the site addresses of a Caddyfile),
+// if the name without them resolves to a child, too.
+func (r *replState) pathName(key, names []string, name string) string {
+	u, err := strconv.Unquote(name)
+	if err != nil || u == name || r.cfg.Get(append(key[:len(key):len(key)], u)) == nil {
+		return name
+	}
+	for _, n := range names {
+		if n == u {
+			return name
+		}
+	}
+	return u
+}
+
+// children returns the sorted keys of a table, or the indexes of a list;
+// nil for a scalar.
+func children(node interface{}) []string {
+	var n int
+	switch x := node.(type) {
+	case *toml.Tree:
+		keys := x.Keys()
+		sort.Strings(keys)
+		return keys
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	case []*toml.Tree:
+		n = len(x)
+	case []interface{}:
+		n = len(x)
+	default:
+		return nil
+	}
+	names := make([]string, n)
+	for i := range names {
+		names[i] = strconv.Itoa(i)
+	}
+	return names
+}
+
+// getChild returns the child of the table or list, by its name (or index).
+func getChild(node interface{}, name string) interface{} {
+	switch x := node.(type) {
+	case *toml.Tree:
+		return x.GetPath([]string{name})
+	case map[string]interface{}:
+		return x[name]
+	case []*toml.Tree:
+		if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(x) {
+			return x[i]
+		}
+	case []interface{}:
+		if i, err := strconv.Atoi(name); err == nil && i >= 0 && i < len(x) {
+			return x[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tgulacsi/confed/config"
+)
+
+func TestREPLComplete(t *testing.T) {
+	cfg, err := config.Parser("caddy").Decode(strings.NewReader("example.com {\n\tproxy /a http://a\n\tgzip\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.Set([]string{"my key", "it's"}, "x"); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	r := &replState{session: &session{cfg: cfg, enc: config.Dumper("json"), sep: "/", out: &out}}
+	for _, tc := range []struct {
+		Line string
+		Want []string
+	}{
+		{Line: "s", Want: []string{"save ", "set ", "setdefault ", "setjson "}},
+		{Line: "cd ", Want: []string{"example.com/", `my\ key/`}},
+		{Line: "cd ex", Want: []string{"example.com/"}},
+		{Line: `ls "example.com"/p`, Want: []string{`"example.com"/proxy/`}},
+		{Line: `get my\ key/`, Want: []string{`my\ key/it\'s `}},
+	} {
+		head, got, _ := r.complete(tc.Line, len(tc.Line))
+		if !reflect.DeepEqual(got, tc.Want) {
+			t.Errorf("%q: got %q, wanted %q", tc.Line, got, tc.Want)
+		}
+		// the completion must be read back as the key
+		for _, c := range got {
+			if !strings.HasSuffix(c, "/") || strings.HasPrefix(head, "cd ") {
+				continue
+			}
+			if err = r.exec(head + c); err != nil {
+				t.Errorf("%q: %+v", head+c, err)
+			}
+		}
+	}
+
+	if err = r.exec(`cd "example.com"/proxy`); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.cwd, []string{"example.com", "proxy"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cd: got %q, wanted %q", got, want)
+	}
+	out.Reset()
+	if err = r.exec(`ls /my\ key`); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "it\\'s = x\n"; got != want {
+		t.Errorf("ls: got %q, wanted %q", got, want)
+	}
+	if err = r.exec(`get /my\ key/it\'s`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestREPLExec(t *testing.T) {
+	cfg, err := config.Parser("json").Decode(strings.NewReader(`{"a":1,"b":{"c":"x"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := cfg.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out, file bytes.Buffer
+	save := func(cfg config.Config) error {
+		file.Reset()
+		return config.Dumper("json").Encode(&file, cfg)
+	}
+	r := &replState{session: &session{cfg: cfg, enc: config.Dumper("json"), sep: "/", out: &out}, saved: saved, save: save}
+	for i, tc := range []struct {
+		Line, Out, Err string
+	}{
+		{Line: "set a 2"},
+		{Line: "diff", Out: "~ /a: 1 -> 2\n"},
+		{Line: "undo"},
+		{Line: "get a", Out: "1\n"},
+		{Line: "diff"},
+		{Line: "undo", Err: "nothing to undo"},
+
+		// a failed command changes nothing, and is not undone
+		{Line: "set a 3"},
+		{Line: "set a/x 1", Err: "a/x"},
+		{Line: "rm b/c"},
+		{Line: "undo"},
+		{Line: "get b/c", Out: "x\n"},
+		{Line: "undo"},
+		{Line: "get a", Out: "1\n"},
+
+		// quit refuses once, while there are unsaved changes
+		{Line: "rm b"},
+		{Line: "quit", Err: "unsaved changes"},
+		{Line: "save"},
+		{Line: "diff"},
+		{Line: "undo"},
+		{Line: "diff", Out: "+ /b: {\"c\":\"x\"}\n"},
+		{Line: "quit", Err: "unsaved changes"},
+		{Line: "ls", Out: "a = 1\nb/\n"},
+		{Line: "quit", Err: "unsaved changes"},
+		{Line: "quit", Err: errQuit.Error()},
+	} {
+		out.Reset()
+		err := r.exec(tc.Line)
+		if tc.Err == "" && err != nil || tc.Err != "" && (err == nil || !strings.Contains(err.Error(), tc.Err)) {
+			t.Errorf("%d. %q: got error %v, wanted %q", i, tc.Line, err, tc.Err)
+		}
+		if got := out.String(); got != tc.Out {
+			t.Errorf("%d. %q: got %q, wanted %q", i, tc.Line, got, tc.Out)
+		}
+	}
+	// save wrote the config without b
+	if got, want := strings.Join(strings.Fields(file.String()), ""), `{"a":1}`; got != want {
+		t.Errorf("saved %s, wanted %s", got, want)
+	}
+}
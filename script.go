@@ -0,0 +1,639 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tgulacsi/confed/config"
+)
+
+// The exit codes.
+const (
+	// exitFailed is for a failed command, or a result that does not validate: nothing is written.
+	exitFailed = 1
+	// exitUsage is for bad flags, an unknown type or a syntax error in the script.
+	exitUsage = 2
+	// exitInput is for an input (config, script, patch, schema) that cannot be read or parsed.
+	exitInput = 3
+	// exitOutput is for a result that cannot be written.
+	exitOutput = 4
+	// exitAssertion is for a failed test or exists: nothing is written.
+	exitAssertion = 5
+)
+
+// exitError is an error with the exit code of the program.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Cause() error  { return e.err }
+func (e *exitError) ExitCode() int { return e.code }
+
+// withExit returns err with the exit code, nil if err is nil.
+func withExit(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// exitCode returns the exit code of the (outermost) exitError in err's chain, or exitFailed.
+func exitCode(err error) int {
+	for err != nil {
+		if ec, ok := err.(interface{ ExitCode() int }); ok {
+			return ec.ExitCode()
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return exitFailed
+}
+
+// scriptCommand is one command of a script.
+type scriptCommand struct {
+	// Source is the name of the script file, or -e.
+	Source string
+	Line   int
+	// Name is the command, Args is the rest of the line, as is.
+	Name, Args string
+}
+
+func (c scriptCommand) String() string { return fmt.Sprintf("%s:%d: %s", c.Source, c.Line, c.Name) }
+
+// scriptSource is a -e command or a -s script file.
+type scriptSource struct {
+	file bool
+	text string
+}
+
+// scriptFlag collects the -e commands and -s script files, in the order of the flags.
+type scriptFlag struct {
+	sources *[]scriptSource
+	file    bool
+}
+
+func (f scriptFlag) String() string { return "" }
+func (f scriptFlag) Set(s string) error {
+	*f.sources = append(*f.sources, scriptSource{file: f.file, text: s})
+	return nil
+}
+
+// loadScript parses all the sources - or the stdin, if there are none and readStdin is true.
+// Syntax errors (unknown commands) are reported before anything is executed.
+func loadScript(sources []scriptSource, readStdin bool) ([]scriptCommand, error) {
+	if len(sources) == 0 && readStdin {
+		sources = []scriptSource{{file: true, text: "-"}}
+	}
+	var cmds []scriptCommand
+	var nE int
+	for _, src := range sources {
+		var r io.Reader
+		name := src.text
+		if !src.file {
+			nE++
+			r, name = strings.NewReader(src.text), fmt.Sprintf("-e#%d", nE)
+		} else if src.text == "-" {
+			r, name = os.Stdin, "stdin"
+		} else {
+			fh, err := os.Open(src.text)
+			if err != nil {
+				return cmds, withExit(exitInput, err)
+			}
+			defer fh.Close()
+			r = fh
+		}
+		cs, err := parseScript(r, name)
+		if err != nil {
+			return cmds, err
+		}
+		cmds = append(cmds, cs...)
+	}
+	return cmds, nil
+}
+
+// parseScript parses the commands, one per line.
+// Empty lines, and lines starting with # are skipped.
+func parseScript(r io.Reader, source string) ([]scriptCommand, error) {
+	var cmds []scriptCommand
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	var lineNo int
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		cmd := scriptCommand{Source: source, Line: lineNo}
+		cmd.Name, cmd.Args = splitCommand(line)
+		if err := checkCommand(cmd.Name, cmd.Args); err != nil {
+			return cmds, withExit(exitUsage, errors.Wrapf(err, "%s:%d", source, lineNo))
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, withExit(exitInput, errors.Wrap(scanner.Err(), source))
+}
+
+// session is the state of executing a script.
+type session struct {
+	cfg config.Config
+	// enc encodes the config for print (of the REPL)
+	enc config.Encoder
+	// sep is the path separator
+	sep string
+	// out receives the results of get and dump
+	out io.Writer
+	// changed is true if the config is to be written at the end
+	changed bool
+	// cwd is the table the relative paths start from (see cd)
+	cwd []string
+}
+
+// key returns the key of the path: relative to cwd, unless it starts with sep,
+// where ".." is the parent and "." (or an empty element: a/, a//b) is the current table.
+// The path is split on sep, except in the quoted parts, and then unquoted (see nextPath).
+// A JSONPath expression (starting with "$") is kept as is.
+func (s *session) key(path string) []string {
+	if strings.HasPrefix(path, "$") {
+		return []string{path}
+	}
+	key := append([]string(nil), s.cwd...)
+	if strings.HasPrefix(path, s.sep) {
+		key, path = key[:0], path[len(s.sep):]
+	}
+	if path == "" {
+		return key
+	}
+	for _, k := range splitQuoted(path, s.sep) {
+		switch k {
+		case "", ".":
+		case "..":
+			if len(key) != 0 {
+				key = key[:len(key)-1]
+			}
+		default:
+			// the quotes and escapes are not part of the key
+			if arg, _, err := nextArg(k); err == nil && !strings.HasPrefix(k, "$") {
+				k = arg
+			}
+			key = append(key, k)
+		}
+	}
+	return key
+}
+
+// checkCommand checks that the command (and the command of ifmissing) exists,
+// and that its path, if it is a JSONPath expression, compiles.
+func checkCommand(name, args string) error {
+	if _, ok := scriptCommands[name]; !ok {
+		return errors.Errorf("unknown command %q", name)
+	}
+	if err := checkPath(name, args); err != nil {
+		return errors.Wrap(err, name)
+	}
+	if name != "ifmissing" {
+		return nil
+	}
+	if _, rest, err := nextPath(args); err != nil || rest == "" {
+		return errors.New("usage: ifmissing path command...")
+	} else {
+		name, args = splitCommand(rest)
+	}
+	return checkCommand(name, args)
+}
+
+// checkPath compiles the path argument of the command, if it is a JSONPath expression.
+func checkPath(name, args string) error {
+	switch name {
+	case "print", "dump":
+		return nil
+	case "set", "setdefault":
+		if strings.HasPrefix(args, "-t ") {
+			_, rest, err := nextArg(args[3:])
+			if err != nil {
+				return err
+			}
+			args = rest
+		}
+	}
+	path, _, err := nextPath(args)
+	if err != nil || !strings.HasPrefix(path, "$") {
+		return err
+	}
+	_, err = config.CompileQuery(path)
+	return err
+}
+
+// splitCommand splits the line to the command name and its arguments.
+func splitCommand(line string) (name, args string) {
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		return line[:i], strings.TrimSpace(line[i+1:])
+	}
+	return line, ""
+}
+
+// run executes the commands, stopping at the first error.
+func (s *session) run(cmds []scriptCommand) error {
+	for _, cmd := range cmds {
+		if err := scriptCommands[cmd.Name](s, cmd.Name, cmd.Args); err != nil {
+			return errors.Wrap(err, cmd.String())
+		}
+	}
+	return nil
+}
+
+// runBuffered runs the commands, and writes the results of get and dump into w
+// only if all the commands succeed.
+func (s *session) runBuffered(cmds []scriptCommand, w io.Writer) error {
+	var out bytes.Buffer
+	s.out = &out
+	if err := s.run(cmds); err != nil {
+		return err
+	}
+	_, err := w.Write(out.Bytes())
+	return withExit(exitOutput, err)
+}
+
+// scriptCommands are the commands, by name; each gets the rest of the line.
+var scriptCommands = map[string]func(s *session, name, args string) error{
+	"print":   (*session).print,
+	"dump":    (*session).dump,
+	"get":     (*session).get,
+	"set":     (*session).set,
+	"setjson": (*session).set,
+	"rm":      (*session).rm,
+	"del":     (*session).rm,
+
+	"test":       (*session).test,
+	"exists":     (*session).exists,
+	"setdefault": (*session).setdefault,
+}
+
+func init() {
+	// ifmissing executes the other commands
+	scriptCommands["ifmissing"] = (*session).ifmissing
+}
+
+// test path op value: asserts that the value at path (all the values a JSONPath selects)
+// equals (==), differs from (!=), or matches the regexp (=~) the value.
+func (s *session) test(name, args string) error {
+	path, rest, err := nextPath(args)
+	if err != nil {
+		return err
+	}
+	op, text, err := nextArg(rest)
+	if err != nil {
+		return err
+	}
+	if path == "" || op == "" {
+		return errors.New("usage: test path ==|!=|=~ value")
+	}
+	want, err := parseValueArg("", text)
+	if err != nil {
+		return err
+	}
+	var check func(v interface{}) bool
+	switch op {
+	case "==":
+		check = func(v interface{}) bool { return config.Equal(v, want) }
+	case "!=":
+		check = func(v interface{}) bool { return !config.Equal(v, want) }
+	case "=~":
+		if arg, _ := want.(string); arg != "" {
+			text = arg
+		}
+		rx, err := regexp.Compile(text)
+		if err != nil {
+			return err
+		}
+		check = func(v interface{}) bool { return rx.MatchString(config.FormatValue(v)) }
+	default:
+		return errors.Errorf("unknown operator %q (==, != or =~)", op)
+	}
+
+	key := s.key(path)
+	if !s.cfg.Has(key) {
+		return withExit(exitAssertion, errors.Errorf("%s: missing, wanted %s %s", path, op, text))
+	}
+	got := s.cfg.Get(key)
+	values := []interface{}{got}
+	if strings.HasPrefix(path, "$") {
+		values, _ = got.([]interface{})
+	}
+	for _, v := range values {
+		if !check(v) {
+			return withExit(exitAssertion, errors.Errorf("%s: got %s, wanted %s %s", path, config.FormatValue(v), op, text))
+		}
+	}
+	return nil
+}
+
+// exists path: asserts that there is a value at path.
+func (s *session) exists(name, args string) error {
+	path, rest, err := nextPath(args)
+	if err != nil {
+		return err
+	}
+	if path == "" || rest != "" {
+		return errors.New("usage: exists path")
+	}
+	if !s.cfg.Has(s.key(path)) {
+		return withExit(exitAssertion, errors.Errorf("%s: missing", path))
+	}
+	return nil
+}
+
+// ifmissing path command...: executes the command if there is no value at path.
+func (s *session) ifmissing(name, args string) error {
+	path, rest, err := nextPath(args)
+	if err != nil {
+		return err
+	}
+	if s.cfg.Has(s.key(path)) {
+		return nil
+	}
+	name, args = splitCommand(rest)
+	return errors.Wrap(scriptCommands[name](s, name, args), name)
+}
+
+func (s *session) print(name, args string) error {
+	if args != "" {
+		return errors.Errorf("unexpected arguments %q", args)
+	}
+	s.changed = true
+	return nil
+}
+
+func (s *session) dump(name, args string) error {
+	if args != "" {
+		return errors.Errorf("unexpected arguments %q", args)
+	}
+	m := s.cfg.AllSettings()
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(s.out, "%s: %+v\n", k, s.cfg.Get(strings.Split(k, s.sep))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get path: writes the value at path (which must exist), whatever the type of the file is:
+// a scalar as text, a table or list as JSON (see config.FormatValue), on one line.
+// For a JSONPath expression, the matches keyed by their paths, as JSON.
+func (s *session) get(name, args string) error {
+	path, rest, err := nextPath(args)
+	if err != nil {
+		return err
+	}
+	if path == "" || rest != "" {
+		return errors.New("usage: get path")
+	}
+	var v interface{}
+	if strings.HasPrefix(path, "$") {
+		matches, err := s.cfg.Query(path)
+		if err != nil {
+			return err
+		}
+		res := make(map[string]interface{}, len(matches))
+		for _, m := range matches {
+			res[strings.Join(m.Path, s.sep)] = m.Value
+		}
+		v = res
+	} else {
+		key := s.key(path)
+		if !s.cfg.Has(key) {
+			return errors.Wrap(config.ErrNotFound, path)
+		}
+		v = s.cfg.Get(key)
+	}
+	_, err = fmt.Fprintln(s.out, config.FormatValue(v))
+	return err
+}
+
+// set [-t type] path value
+func (s *session) set(name, args string) error {
+	path, value, err := parseSetArgs(name, args)
+	if err != nil {
+		return err
+	}
+	if err := s.cfg.Set(s.key(path), value); err != nil {
+		return errors.Wrap(err, path)
+	}
+	s.changed = true
+	return nil
+}
+
+// setdefault [-t type] path value: set, if path is missing.
+func (s *session) setdefault(name, args string) error {
+	path, value, err := parseSetArgs(name, args)
+	if err != nil {
+		return err
+	}
+	key := s.key(path)
+	if s.cfg.Has(key) {
+		return nil
+	}
+	if err := s.cfg.Set(key, value); err != nil {
+		return errors.Wrap(err, path)
+	}
+	s.changed = true
+	return nil
+}
+
+// parseSetArgs parses the "[-t type] path value" arguments of set.
+//
+// The value is the rest of the line, as is (see config.ParseValue);
+// if it is one quoted argument, then it is that string (or of the given type).
+func parseSetArgs(name, args string) (path string, value interface{}, err error) {
+	var typ string
+	if name == "setjson" {
+		typ = "json"
+	} else if strings.HasPrefix(args, "-t ") {
+		if typ, args, err = nextArg(args[3:]); err != nil {
+			return "", nil, err
+		}
+	}
+	path, text, err := nextPath(args)
+	if err != nil {
+		return path, nil, err
+	}
+	if path == "" {
+		return path, nil, errors.Errorf("usage: %s [-t type] path value", name)
+	}
+	if typ == "json" {
+		value, err = parseValue(typ, text)
+	} else {
+		value, err = parseValueArg(typ, text)
+	}
+	return path, value, errors.Wrap(err, path)
+}
+
+// parseValueArg parses the value: if it is one quoted argument, then it is that string
+// (or of the given type), else the text as is.
+func parseValueArg(typ, text string) (interface{}, error) {
+	if text == "" || (text[0] != '"' && text[0] != '\'') {
+		return parseValue(typ, text)
+	}
+	arg, rest, err := nextArg(text)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		// not one argument, but the rest of the line, as is
+		return parseValue(typ, text)
+	}
+	if typ == "" {
+		return arg, nil
+	}
+	return config.ParseTypedValue(typ, arg)
+}
+
+// parseValue parses the text as the given type, or infers its type if typ is empty.
+func parseValue(typ, text string) (interface{}, error) {
+	if typ == "" {
+		return config.ParseValue(text), nil
+	}
+	return config.ParseTypedValue(typ, text)
+}
+
+func (s *session) rm(name, args string) error {
+	path, rest, err := nextPath(args)
+	if err != nil {
+		return err
+	}
+	if path == "" || rest != "" {
+		return errors.Errorf("usage: %s path", name)
+	}
+	if err := s.cfg.Del(s.key(path)); err != nil {
+		return err
+	}
+	s.changed = true
+	return nil
+}
+
+// nextArg returns the first argument of the line, and the rest of the line.
+//
+// The argument ends at the first space which is not quoted ('single' or "double",
+// where \" \\ \n \t are escapes) or escaped (with \).
+// A JSONPath expression (starting with $) is split by splitPath, as is.
+func nextArg(line string) (arg, rest string, err error) {
+	line = strings.TrimLeft(line, " \t")
+	if strings.HasPrefix(line, "$") {
+		arg, rest = splitPath(line)
+		return arg, strings.TrimLeft(rest, " \t"), nil
+	}
+	var buf bytes.Buffer
+	var quote byte
+	i := 0
+Loop:
+	for ; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				buf.WriteByte(c)
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' && i+1 < len(line) {
+				i++
+				switch c = line[i]; c {
+				case 'n':
+					buf.WriteByte('\n')
+				case 't':
+					buf.WriteByte('\t')
+				case '"', '\\':
+					buf.WriteByte(c)
+				default:
+					buf.WriteByte('\\')
+					buf.WriteByte(c)
+				}
+			} else {
+				buf.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '\\' && i+1 < len(line):
+			i++
+			buf.WriteByte(line[i])
+		case c == ' ' || c == '\t':
+			break Loop
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	if quote != 0 {
+		return "", "", errors.Errorf("unclosed %c quote in %q", quote, line)
+	}
+	return buf.String(), strings.TrimLeft(line[i:], " \t"), nil
+}
+
+// nextPath is nextArg for a path, which is returned as is, with its quotes and escapes:
+// the path is split on the separators outside of them (see splitQuoted),
+// and then each element is read by nextArg.
+func nextPath(line string) (path, rest string, err error) {
+	line = strings.TrimLeft(line, " \t")
+	if _, rest, err = nextArg(line); err != nil {
+		return "", "", err
+	}
+	return strings.TrimRight(line[:len(line)-len(rest)], " \t"), rest, nil
+}
+
+// splitQuoted splits the path on sep - but not inside the quoted parts, nor at an escaped (\) one.
+func splitQuoted(path, sep string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case quote != '\'' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case strings.HasPrefix(path[i:], sep):
+			parts = append(parts, path[start:i])
+			start = i + len(sep)
+			i += len(sep) - 1
+		}
+	}
+	return append(parts, path[start:])
+}
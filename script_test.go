@@ -0,0 +1,335 @@
+// Copyright 2019 Tamás Gulácsi
+//
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/diff"
+	"github.com/tgulacsi/confed/config"
+)
+
+func TestNextPath(t *testing.T) {
+	for _, tc := range []struct {
+		Line, Path, Rest string
+		Key              []string
+	}{
+		{Line: "a/b c d", Path: "a/b", Rest: "c d", Key: []string{"a", "b"}},
+		{Line: `"example.com"/proxy/1 x`, Path: `"example.com"/proxy/1`, Rest: "x",
+			Key: []string{"example.com", "proxy", "1"}},
+		{Line: `"a/b \"c\""/d`, Path: `"a/b \"c\""/d`, Key: []string{`a/b "c"`, "d"}},
+		{Line: `'a b'/c`, Path: `'a b'/c`, Key: []string{"a b", "c"}},
+		{Line: `a\ b/c 1`, Path: `a\ b/c`, Rest: "1", Key: []string{"a b", "c"}},
+		{Line: `a\/b/".."/c`, Path: `a\/b/".."/c`, Key: []string{"a/b", "..", "c"}},
+		{Line: `$.a[?(@.b == 'x y')] 1`, Path: `$.a[?(@.b == 'x y')]`, Rest: "1",
+			Key: []string{`$.a[?(@.b == 'x y')]`}},
+	} {
+		path, rest, err := nextPath(tc.Line)
+		if err != nil {
+			t.Errorf("%q: %+v", tc.Line, err)
+			continue
+		}
+		if path != tc.Path || rest != tc.Rest {
+			t.Errorf("%q: got %q, %q, wanted %q, %q", tc.Line, path, rest, tc.Path, tc.Rest)
+		}
+		s := session{sep: "/"}
+		if key := s.key(path); !reflect.DeepEqual(key, tc.Key) {
+			t.Errorf("%q: got key %q, wanted %q", tc.Line, key, tc.Key)
+		}
+	}
+	if _, _, err := nextPath(`"example.com/proxy`); err == nil {
+		t.Error("unclosed quote: no error")
+	}
+}
+
+func TestScriptCaddyKey(t *testing.T) {
+	const src = `example.com {
+	proxy /a http://a
+	proxy /b http://b
+}
+`
+	for _, path := range []string{`"example.com"/proxy/1/args`, "example.com/proxy/1/args"} {
+		cfg, err := config.Parser("caddy").Decode(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmds, err := parseScript(strings.NewReader(`set `+path+` ["/c", "http://c"]`), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &session{cfg: cfg, sep: "/", out: new(bytes.Buffer)}
+		if err = s.run(cmds); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err = config.Dumper("caddy").Encode(&buf, s.cfg); err != nil {
+			t.Fatal(err)
+		}
+		want := `example.com {
+	proxy /a http://a
+	proxy /c http://c
+}
+`
+		if d := diff.Diff(buf.String(), want); d != "" {
+			t.Errorf("%s: %s", path, d)
+		}
+	}
+}
+
+func TestScriptQuotedKey(t *testing.T) {
+	cfg, err := config.Parser("json").Decode(strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds, err := parseScript(strings.NewReader(`set "my key" "hello world"
+set 'a b'/c 1
+set x\ y/"z/w" 2`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &session{cfg: cfg, sep: "/", out: new(bytes.Buffer)}
+	if err = s.run(cmds); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = config.Dumper("json").Encode(&buf, s.cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(strings.Fields(buf.String()), ""), `{"ab":{"c":1},"mykey":"helloworld","xy":{"z/w":2}}`; got != want {
+		t.Errorf("got %s, wanted %s", buf.String(), want)
+	}
+}
+
+func TestParseScriptQuery(t *testing.T) {
+	for _, line := range []string{
+		"exists $.DB[",
+		"ifmissing $.DB[ set a 1",
+		"ifmissing a set $..[ 1",
+		"set -t int $.a[?(@.b ==] 1",
+		`get "a/b`,
+	} {
+		_, err := parseScript(strings.NewReader(line), "test")
+		if err == nil {
+			t.Errorf("%q: no error", line)
+		} else if got := exitCode(err); got != exitUsage {
+			t.Errorf("%q: got exit code %d, wanted %d (%v)", line, got, exitUsage, err)
+		}
+	}
+}
+
+func TestNextArg(t *testing.T) {
+	for _, tc := range []struct {
+		Line, Arg, Rest string
+	}{
+		{Line: "  a b  c", Arg: "a", Rest: "b  c"},
+		{Line: `"a b" c`, Arg: "a b", Rest: "c"},
+		{Line: `'a \n b'`, Arg: `a \n b`},
+		{Line: `"a\n\t\"\\b"`, Arg: "a\n\t\"\\b"},
+		{Line: `"a\xb"`, Arg: `a\xb`},
+		{Line: `a\ b c`, Arg: "a b", Rest: "c"},
+		{Line: `x"y z"w v`, Arg: "xy zw", Rest: "v"},
+		{Line: `$.a[?(@.b == 'c d')] e`, Arg: `$.a[?(@.b == 'c d')]`, Rest: "e"},
+		{Line: "", Arg: ""},
+	} {
+		arg, rest, err := nextArg(tc.Line)
+		if err != nil {
+			t.Errorf("%q: %+v", tc.Line, err)
+			continue
+		}
+		if arg != tc.Arg || rest != tc.Rest {
+			t.Errorf("%q: got %q, %q, wanted %q, %q", tc.Line, arg, rest, tc.Arg, tc.Rest)
+		}
+	}
+	for _, line := range []string{`"a b`, `'a`} {
+		if _, _, err := nextArg(line); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+func TestParseScriptError(t *testing.T) {
+	for _, tc := range []struct {
+		Script, Want string
+	}{
+		{Script: "get a\nfrobnicate a\n", Want: "test:2"},
+		{Script: "# comment\n\nset a 1\nexists $.a[\n", Want: "test:4"},
+		{Script: "frob a\nget a\n", Want: "test:1"},
+		{Script: "get a\n  # comment\nrm \"a/b\n", Want: "test:3"},
+	} {
+		_, err := parseScript(strings.NewReader(tc.Script), "test")
+		if err == nil {
+			t.Errorf("%q: no error", tc.Script)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tc.Want+":") {
+			t.Errorf("%q: got %q, wanted %q", tc.Script, err, tc.Want)
+		}
+		if got := exitCode(err); got != exitUsage {
+			t.Errorf("%q: got exit code %d, wanted %d", tc.Script, got, exitUsage)
+		}
+	}
+}
+
+func TestLoadScript(t *testing.T) {
+	dir, err := os.MkdirTemp("", "confed-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "script")
+	if err = os.WriteFile(fn, []byte("set b 2\n\nset c 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmds, err := loadScript([]scriptSource{
+		{text: "set a 1"}, {file: true, text: fn}, {text: "rm a"},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, cmd := range cmds {
+		got = append(got, cmd.String()+" "+cmd.Args)
+	}
+	want := []string{"-e#1:1: set a 1", fn + ":1: set b 2", fn + ":3: set c 3", "-e#2:1: rm a"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+
+	if _, err = loadScript([]scriptSource{{file: true, text: filepath.Join(dir, "nope")}}, false); exitCode(err) != exitInput {
+		t.Errorf("missing file: got %v, wanted exit code %d", err, exitInput)
+	}
+}
+
+func TestRunFailed(t *testing.T) {
+	cfg, err := config.Parser("json").Decode(strings.NewReader(`{"a":1,"b":{"c":"x"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		Script, Want string
+		Code         int
+	}{
+		{Script: "get a\nset a 2\nget b/c\nget b\n", Want: "1\nx\n{\"c\":\"x\"}\n"},
+		{Script: "get a\nexists nope\nget b/c\n", Code: exitAssertion},
+		{Script: "get a\nset a/x 1\n", Code: exitFailed},
+		{Script: "get a\nget nope\nget b\n", Code: exitFailed},
+	} {
+		cmds, err := parseScript(strings.NewReader(tc.Script), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		clone, err := cfg.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		s := &session{cfg: clone, enc: config.Dumper("json"), sep: "/"}
+		err = s.runBuffered(cmds, &buf)
+		if got := exitCode(err); err != nil && got != tc.Code || err == nil && tc.Code != 0 {
+			t.Errorf("%q: got %v (exit code %d), wanted exit code %d", tc.Script, err, got, tc.Code)
+		}
+		if d := diff.Diff(buf.String(), tc.Want); d != "" {
+			t.Errorf("%q: %s", tc.Script, d)
+		}
+	}
+}
+
+func TestScriptAssertions(t *testing.T) {
+	const src = `{"db":{"host":"localhost","port":5432,"tags":["a","b"]},"users":[{"name":"x","admin":true},{"name":"y","admin":false}]}`
+	cfg, err := config.Parser("json").Decode(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		Script, Want string
+		Code         int
+	}{
+		{Script: "test db/port == 5432\ntest db/host == localhost\ntest db/host != remote"},
+		{Script: `test db/tags == ["a","b"]`},
+		{Script: "test db/host =~ ^local\ntest db/port =~ '^54[0-9]+$'"},
+		{Script: `test $.users[*].name =~ "^[xy]$"`},
+		{Script: "test db/port == 5433", Code: exitAssertion},
+		{Script: "test db/nope == 1", Code: exitAssertion},
+		{Script: "test $.users[*].admin == true", Code: exitAssertion},
+		{Script: "test db/port ~ 1", Code: exitFailed},
+
+		{Script: "exists db/host\nexists $.users[?(@.admin == true)]"},
+		{Script: "exists db/nope", Code: exitAssertion},
+		{Script: "exists $.users[?(@.name == 'z')]", Code: exitAssertion},
+
+		{Script: "ifmissing db/host set db/host remote\nget db/host", Want: "localhost"},
+		{Script: "ifmissing db/user set db/user admin\nget db/user", Want: "admin"},
+		{Script: "ifmissing $.users[?(@.name == 'z')] set users/2/name z\nget users/2/name", Want: "z"},
+
+		{Script: "setdefault db/port 1\nget db/port", Want: "5432"},
+		{Script: "setdefault -t string db/user 1\nget db/user", Want: "1"},
+		{Script: "setdefault db/tags/5 c", Code: exitFailed},
+	} {
+		cmds, err := parseScript(strings.NewReader(tc.Script), "test")
+		if err != nil {
+			t.Fatalf("%q: %+v", tc.Script, err)
+		}
+		clone, err := cfg.Clone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		s := &session{cfg: clone, enc: config.Dumper("json"), sep: "/"}
+		err = s.runBuffered(cmds, &buf)
+		if got := exitCode(err); err != nil && got != tc.Code || err == nil && tc.Code != 0 {
+			t.Errorf("%q: got %v (exit code %d), wanted exit code %d", tc.Script, err, got, tc.Code)
+		}
+		if got := strings.Join(strings.Fields(buf.String()), ""); got != tc.Want {
+			t.Errorf("%q: got %s, wanted %s", tc.Script, got, tc.Want)
+		}
+	}
+}
+
+func TestScriptGet(t *testing.T) {
+	for _, tc := range []struct {
+		Type, Src, Script, Want string
+	}{
+		{Type: "gitconfig", Src: "[alias]\n\tx = log\n", Script: "get alias/x", Want: "log\n"},
+		{Type: "systemd", Src: "[Service]\nExecStart=/bin/app\n", Script: "get Service/ExecStart", Want: "/bin/app\n"},
+		{Type: "dotenv", Src: "DB__PORT=5432\n", Script: "get DB/PORT", Want: "5432\n"},
+		{Type: "xml", Src: `<Configuration status="warn"/>`, Script: "get Configuration/@status", Want: "warn\n"},
+		{Type: "caddy", Src: "example.com {\n\tgzip\n\tproxy / http://a\n}\n",
+			Script: "get example.com/proxy/args/1\nget example.com/proxy", Want: "http://a\n{\"args\":[\"/\",\"http://a\"]}\n"},
+		{Type: "yaml", Src: "a:\n  b: [1, 2]\n", Script: "get a/b\nget $..b[1]", Want: "[1,2]\n{\"a/b/1\":2}\n"},
+	} {
+		cfg, err := config.Parser(config.Type(tc.Type)).Decode(strings.NewReader(tc.Src))
+		if err != nil {
+			t.Fatalf("%s: %+v", tc.Type, err)
+		}
+		cmds, err := parseScript(strings.NewReader(tc.Script), "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		s := &session{cfg: cfg, enc: config.Dumper(config.Type(tc.Type)), sep: "/"}
+		if err = s.runBuffered(cmds, &buf); err != nil {
+			t.Errorf("%s: %+v", tc.Type, err)
+		}
+		if got := buf.String(); got != tc.Want {
+			t.Errorf("%s: got %q, wanted %q", tc.Type, got, tc.Want)
+		}
+	}
+}